@@ -0,0 +1,164 @@
+// Package backend abstracts the Kafka client library used to read and write topics, or the store
+// replacing Kafka.
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Message is a Kafka record.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Timestamp time.Time
+}
+
+// Header is a Kafka record header.
+type Header struct {
+	Key   []byte
+	Value []byte
+}
+
+// Backend is a Kafka client.
+type Backend interface {
+	// Partitions returns the partitions of the topic.
+	Partitions(topic string) ([]int32, error)
+
+	// Offsets returns the oldest offset and the high water mark (offset of the next message) of a partition.
+	Offsets(topic string, partition int32) (oldest, highWater int64, err error)
+
+	// Consume streams the messages of a partition, starting at offset, until closed.
+	Consume(topic string, partition int32, offset int64) (Consumer, error)
+
+	// NewProducer returns an asynchronous producer.
+	NewProducer() (Producer, error)
+
+	// Produce synchronously sends messages.
+	Produce(msgs ...*Message) error
+
+	// CommittedOffsets returns the offsets committed by a consumer group on the topic's partitions (-1 if none).
+	CommittedOffsets(group, topic string, partitions []int32) (map[int32]int64, error)
+
+	// TopicConfig returns the configuration entries of the topic, including defaults.
+	TopicConfig(topic string) (map[string]string, error)
+
+	// SetTopicConfig changes configuration entries of the topic, keeping the others.
+	SetTopicConfig(topic string, entries map[string]string) error
+
+	// Health returns the state of the cluster and of the given topics.
+	Health(topics ...string) *ClusterHealth
+
+	// Close releases the client's resources.
+	Close() error
+}
+
+// Consumer streams the messages of a partition.
+type Consumer interface {
+	Messages() <-chan *Message
+	Errors() <-chan error
+	Close() error
+}
+
+// Producer sends messages asynchronously.
+type Producer interface {
+	// Send queues a message for delivery.
+	Send(msg *Message)
+
+	// Close waits for the queued messages to be delivered and returns the success and error counts.
+	Close() (successes, errors int64)
+}
+
+// ErrorNotifier is implemented by the producers able to tell which messages failed to be delivered.
+type ErrorNotifier interface {
+	// NotifyErrors sets the function called with each failed message, before any Send. It can be
+	// called concurrently.
+	NotifyErrors(onError func(msg *Message, err error))
+}
+
+// PartitionProducer is implemented by the backends able to produce to a given partition. Their producers
+// send the messages to the partition of their key's hash, ignoring Message.Partition.
+type PartitionProducer interface {
+	// ProduceToPartitions synchronously sends messages to their Partition.
+	ProduceToPartitions(msgs ...*Message) error
+}
+
+// ErrPartitionsUnsupported is returned by the PartitionProducers wrapping a backend that isn't one.
+var ErrPartitionsUnsupported = errors.New("the backend can't produce to partitions")
+
+// Factory creates a backend connected to the given brokers.
+type Factory func(brokers []string, config Config) (Backend, error)
+
+var (
+	factories      = map[string]Factory{}
+	factoriesMutex sync.Mutex
+)
+
+// Register makes a backend available by name, so sinks can be added without changing this package.
+// It panics if the name is already registered.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("backend %q registered twice", name))
+	}
+
+	factories[name] = factory
+}
+
+func init() {
+	Register("sarama", NewSarama)
+	Register("kafka-go", NewKafkaGo)
+	Register("memory", func([]string, Config) (Backend, error) { return NewMemory(), nil })
+	Register("redis", NewRedis)
+	Register("nats", NewNATS)
+	Register("pulsar", NewPulsar)
+}
+
+// New creates a backend by name.
+func New(name string, brokers []string, config Config) (Backend, error) {
+	factoriesMutex.Lock()
+	factory, ok := factories[name]
+	factoriesMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown Kafka backend %q", name)
+	}
+
+	return factory(brokers, config)
+}
+
+// Names returns the registered backends' names, sorted.
+func Names() (names []string) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	names = make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// Config is the configuration common to all backends.
+type Config struct {
+	// Version is the Kafka protocol version (sarama backend only).
+	Version string
+
+	// SASLUser and SASLPassword enable the SASL/PLAIN authentication if set.
+	SASLUser     string
+	SASLPassword string
+
+	// Ordered keeps the order of messages in a partition when the producer retries (sarama backend only).
+	Ordered bool
+}
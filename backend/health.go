@@ -0,0 +1,35 @@
+package backend
+
+import "time"
+
+// ClusterHealth is the state of the Kafka cluster as seen by the backend.
+type ClusterHealth struct {
+	Brokers []BrokerHealth
+
+	// MetadataTime is the time of the last metadata refresh, and MetadataError its error if it failed.
+	MetadataTime  time.Time
+	MetadataAge   time.Duration
+	MetadataError string `json:",omitempty"`
+
+	// Topics are the partitions of the requested topics.
+	Topics map[string][]PartitionHealth
+}
+
+// BrokerHealth is the state of a broker.
+type BrokerHealth struct {
+	ID        int32
+	Addr      string
+	Connected bool
+}
+
+// PartitionHealth is the state of a topic's partition.
+type PartitionHealth struct {
+	Partition      int32
+	Leader         int32
+	Replicas       []int32
+	InSyncReplicas []int32
+	Error          string `json:",omitempty"`
+}
+
+// metadataMaxAge is the age of the metadata after which Health refreshes it.
+const metadataMaxAge = 30 * time.Second
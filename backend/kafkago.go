@@ -0,0 +1,468 @@
+package backend
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+type kafkaGoBackend struct {
+	brokers []string
+	client  *kafkago.Client
+	writer  *kafkago.Writer
+
+	// transport and dialer are only set to authenticate
+	transport kafkago.RoundTripper
+	dialer    *kafkago.Dialer
+
+	// brokerChecks are the last connectivity checks of the brokers, by address
+	brokerChecks      map[string]brokerCheck
+	brokerChecksMutex sync.Mutex
+}
+
+// brokerCheckTTL is how long the connectivity of a broker checked by Health is cached.
+const brokerCheckTTL = 30 * time.Second
+
+type brokerCheck struct {
+	connected bool
+	time      time.Time
+}
+
+// NewKafkaGo creates a backend using the segmentio/kafka-go library.
+func NewKafkaGo(brokers []string, config Config) (Backend, error) {
+	b := &kafkaGoBackend{brokers: brokers, brokerChecks: map[string]brokerCheck{}}
+
+	if len(config.SASLUser) != 0 {
+		mechanism := plain.Mechanism{Username: config.SASLUser, Password: config.SASLPassword}
+
+		b.transport = &kafkago.Transport{SASL: mechanism}
+		b.dialer = &kafkago.Dialer{Timeout: 10 * time.Second, DualStack: true, SASLMechanism: mechanism}
+	}
+
+	b.client = &kafkago.Client{Addr: kafkago.TCP(brokers...), Transport: b.transport}
+
+	b.writer = b.newWriter()
+
+	// check connectivity like other backends do
+	if _, err := b.client.Metadata(context.Background(), &kafkago.MetadataRequest{}); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+var _ Backend = &kafkaGoBackend{}
+
+func (b *kafkaGoBackend) newWriter() *kafkago.Writer {
+	return &kafkago.Writer{
+		Addr:         kafkago.TCP(b.brokers...),
+		Balancer:     &kafkago.Hash{}, // same partitioning as sarama's default
+		RequiredAcks: kafkago.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+		Transport:    b.transport,
+	}
+}
+
+func (b *kafkaGoBackend) Partitions(topic string) (partitions []int32, err error) {
+	res, err := b.client.Metadata(context.Background(), &kafkago.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return
+	}
+
+	for _, t := range res.Topics {
+		if t.Error != nil {
+			return nil, t.Error
+		}
+
+		for _, p := range t.Partitions {
+			partitions = append(partitions, int32(p.ID))
+		}
+	}
+
+	return
+}
+
+func (b *kafkaGoBackend) Offsets(topic string, partition int32) (oldest, highWater int64, err error) {
+	res, err := b.client.ListOffsets(context.Background(), &kafkago.ListOffsetsRequest{
+		Topics: map[string][]kafkago.OffsetRequest{
+			topic: {kafkago.FirstOffsetOf(int(partition)), kafkago.LastOffsetOf(int(partition))},
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	for _, po := range res.Topics[topic] {
+		if po.Error != nil {
+			return 0, 0, po.Error
+		}
+
+		if po.Partition == int(partition) {
+			return po.FirstOffset, po.LastOffset, nil
+		}
+	}
+
+	return
+}
+
+func (b *kafkaGoBackend) Consume(topic string, partition int32, offset int64) (Consumer, error) {
+	reader := kafkago.NewReader(kafkago.ReaderConfig{
+		Brokers:   b.brokers,
+		Topic:     topic,
+		Partition: int(partition),
+		MaxWait:   100 * time.Millisecond,
+		Dialer:    b.dialer,
+	})
+
+	if err := reader.SetOffset(offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &kafkaGoConsumer{
+		reader:   reader,
+		cancel:   cancel,
+		messages: make(chan *Message),
+		errors:   make(chan error),
+	}
+
+	c.wg.Add(1)
+	go c.run(ctx)
+
+	return c, nil
+}
+
+func (b *kafkaGoBackend) NewProducer() (Producer, error) {
+	p := &kafkaGoProducer{writer: b.newWriter()}
+
+	p.writer.Async = true
+	p.writer.Completion = func(msgs []kafkago.Message, err error) {
+		if err != nil {
+			log.Print("kafka-go producer error: ", err)
+			atomic.AddInt64(&p.errors, int64(len(msgs)))
+
+			if p.onError != nil {
+				for _, m := range msgs {
+					p.onError(fromKafkaGoMessage(m), err)
+				}
+			}
+			return
+		}
+
+		atomic.AddInt64(&p.successes, int64(len(msgs)))
+	}
+
+	return p, nil
+}
+
+func (b *kafkaGoBackend) Produce(msgs ...*Message) error {
+	kmsgs := make([]kafkago.Message, len(msgs))
+	for i, msg := range msgs {
+		kmsgs[i] = toKafkaGoMessage(msg)
+	}
+
+	return b.writer.WriteMessages(context.Background(), kmsgs...)
+}
+
+var _ PartitionProducer = &kafkaGoBackend{}
+
+func (b *kafkaGoBackend) ProduceToPartitions(msgs ...*Message) error {
+	writer := b.newWriter()
+	writer.Balancer = kafkago.BalancerFunc(func(msg kafkago.Message, _ ...int) int { return msg.Partition })
+
+	defer writer.Close()
+
+	kmsgs := make([]kafkago.Message, len(msgs))
+	for i, msg := range msgs {
+		kmsgs[i] = toKafkaGoMessage(msg)
+		kmsgs[i].Partition = int(msg.Partition)
+	}
+
+	return writer.WriteMessages(context.Background(), kmsgs...)
+}
+
+func (b *kafkaGoBackend) CommittedOffsets(group, topic string, partitions []int32) (offsets map[int32]int64, err error) {
+	reqPartitions := make([]int, len(partitions))
+	for i, p := range partitions {
+		reqPartitions[i] = int(p)
+	}
+
+	res, err := b.client.OffsetFetch(context.Background(), &kafkago.OffsetFetchRequest{
+		GroupID: group,
+		Topics:  map[string][]int{topic: reqPartitions},
+	})
+	if err != nil {
+		return
+	}
+
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	offsets = make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		offsets[p] = -1
+	}
+
+	for _, p := range res.Topics[topic] {
+		if p.Error == nil {
+			offsets[int32(p.Partition)] = p.CommittedOffset
+		}
+	}
+
+	return
+}
+
+func (b *kafkaGoBackend) TopicConfig(topic string) (config map[string]string, err error) {
+	res, err := b.client.DescribeConfigs(context.Background(), &kafkago.DescribeConfigsRequest{
+		Resources: []kafkago.DescribeConfigRequestResource{{
+			ResourceType: kafkago.ResourceTypeTopic,
+			ResourceName: topic,
+		}},
+	})
+	if err != nil {
+		return
+	}
+
+	config = map[string]string{}
+	for _, resource := range res.Resources {
+		if resource.Error != nil {
+			return nil, resource.Error
+		}
+
+		for _, entry := range resource.ConfigEntries {
+			config[entry.ConfigName] = entry.ConfigValue
+		}
+	}
+
+	return
+}
+
+func (b *kafkaGoBackend) SetTopicConfig(topic string, entries map[string]string) (err error) {
+	configs := make([]kafkago.IncrementalAlterConfigsRequestConfig, 0, len(entries))
+	for name, value := range entries {
+		configs = append(configs, kafkago.IncrementalAlterConfigsRequestConfig{
+			Name:            name,
+			Value:           value,
+			ConfigOperation: kafkago.ConfigOperationSet,
+		})
+	}
+
+	res, err := b.client.IncrementalAlterConfigs(context.Background(), &kafkago.IncrementalAlterConfigsRequest{
+		Resources: []kafkago.IncrementalAlterConfigsRequestResource{{
+			ResourceType: kafkago.ResourceTypeTopic,
+			ResourceName: topic,
+			Configs:      configs,
+		}},
+	})
+	if err != nil {
+		return
+	}
+
+	for _, resource := range res.Resources {
+		if resource.Error != nil {
+			return resource.Error
+		}
+	}
+
+	return
+}
+
+func (b *kafkaGoBackend) Health(topics ...string) *ClusterHealth {
+	h := &ClusterHealth{
+		MetadataTime: time.Now(),
+		Topics:       map[string][]PartitionHealth{},
+	}
+
+	res, err := b.client.Metadata(context.Background(), &kafkago.MetadataRequest{Topics: topics})
+	if err != nil {
+		h.MetadataError = err.Error()
+		return h
+	}
+
+	h.Brokers = make([]BrokerHealth, len(res.Brokers))
+
+	wg := sync.WaitGroup{}
+	for i, broker := range res.Brokers {
+		h.Brokers[i] = BrokerHealth{
+			ID:   int32(broker.ID),
+			Addr: net.JoinHostPort(broker.Host, strconv.Itoa(broker.Port)),
+		}
+
+		wg.Add(1)
+		go func(bh *BrokerHealth) {
+			defer wg.Done()
+			bh.Connected = b.brokerConnected(bh.Addr)
+		}(&h.Brokers[i])
+	}
+
+	wg.Wait()
+
+	for _, t := range res.Topics {
+		if t.Error != nil {
+			h.Topics[t.Name] = []PartitionHealth{{Partition: -1, Leader: -1, Error: t.Error.Error()}}
+			continue
+		}
+
+		for _, p := range t.Partitions {
+			ph := PartitionHealth{
+				Partition:      int32(p.ID),
+				Leader:         int32(p.Leader.ID),
+				Replicas:       brokerIDs(p.Replicas),
+				InSyncReplicas: brokerIDs(p.Isr),
+			}
+
+			if p.Error != nil {
+				ph.Error = p.Error.Error()
+			}
+
+			h.Topics[t.Name] = append(h.Topics[t.Name], ph)
+		}
+	}
+
+	return h
+}
+
+// brokerConnected dials the broker to check its connectivity, unless it was checked less than
+// brokerCheckTTL ago.
+func (b *kafkaGoBackend) brokerConnected(addr string) bool {
+	b.brokerChecksMutex.Lock()
+	check, ok := b.brokerChecks[addr]
+	b.brokerChecksMutex.Unlock()
+
+	if ok && time.Since(check.time) < brokerCheckTTL {
+		return check.connected
+	}
+
+	check = brokerCheck{time: time.Now()}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		check.connected = true
+	}
+
+	b.brokerChecksMutex.Lock()
+	b.brokerChecks[addr] = check
+	b.brokerChecksMutex.Unlock()
+
+	return check.connected
+}
+
+func brokerIDs(brokers []kafkago.Broker) (ids []int32) {
+	for _, broker := range brokers {
+		ids = append(ids, int32(broker.ID))
+	}
+	return
+}
+
+func (b *kafkaGoBackend) Close() error {
+	return b.writer.Close()
+}
+
+func toKafkaGoMessage(msg *Message) kafkago.Message {
+	km := kafkago.Message{
+		Topic: msg.Topic,
+		Key:   msg.Key,
+		Value: msg.Value,
+		Time:  msg.Timestamp,
+	}
+
+	for _, hdr := range msg.Headers {
+		km.Headers = append(km.Headers, kafkago.Header{Key: string(hdr.Key), Value: hdr.Value})
+	}
+
+	return km
+}
+
+func fromKafkaGoMessage(m kafkago.Message) *Message {
+	msg := &Message{
+		Topic:     m.Topic,
+		Partition: int32(m.Partition),
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Timestamp: m.Time,
+	}
+
+	for _, hdr := range m.Headers {
+		msg.Headers = append(msg.Headers, Header{Key: []byte(hdr.Key), Value: hdr.Value})
+	}
+
+	return msg
+}
+
+type kafkaGoConsumer struct {
+	reader   *kafkago.Reader
+	cancel   func()
+	messages chan *Message
+	errors   chan error
+	wg       sync.WaitGroup
+}
+
+func (c *kafkaGoConsumer) run(ctx context.Context) {
+	defer c.wg.Done()
+
+	defer close(c.messages)
+	defer close(c.errors)
+
+	for {
+		m, err := c.reader.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			select {
+			case c.errors <- err:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		select {
+		case c.messages <- fromKafkaGoMessage(m):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *kafkaGoConsumer) Messages() <-chan *Message { return c.messages }
+func (c *kafkaGoConsumer) Errors() <-chan error      { return c.errors }
+
+func (c *kafkaGoConsumer) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return c.reader.Close()
+}
+
+type kafkaGoProducer struct {
+	writer    *kafkago.Writer
+	successes int64
+	errors    int64
+	onError   func(*Message, error)
+}
+
+var _ ErrorNotifier = &kafkaGoProducer{}
+
+func (p *kafkaGoProducer) NotifyErrors(onError func(*Message, error)) {
+	p.onError = onError
+}
+
+func (p *kafkaGoProducer) Send(msg *Message) {
+	p.writer.WriteMessages(context.Background(), toKafkaGoMessage(msg))
+}
+
+func (p *kafkaGoProducer) Close() (successes, errors int64) {
+	p.writer.Close()
+	return atomic.LoadInt64(&p.successes), atomic.LoadInt64(&p.errors)
+}
@@ -0,0 +1,313 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// kvBatchSize is the number of records read or written at once in key-value stores.
+const kvBatchSize = 1000
+
+// kvSnapshotTTL is how long a snapshot taken by Offsets waits to be consumed before being released.
+const kvSnapshotTTL = time.Minute
+
+// kvStore is a key-value store replacing Kafka, keeping the last value of each key of a topic.
+type kvStore interface {
+	// Addr returns the address of the store, for the health reports.
+	Addr() string
+
+	// Ping checks the connectivity to the store.
+	Ping() error
+
+	// Keys returns the keys of the topic.
+	Keys(topic string) ([][]byte, error)
+
+	// Get returns the values of keys of the topic (nil if not found).
+	Get(topic string, keys [][]byte) ([][]byte, error)
+
+	// Write stores the messages, deleting the keys of the messages with an empty value. It returns
+	// the number of messages that failed.
+	Write(msgs []*Message) (errors int64)
+
+	Close() error
+}
+
+// kvReleaser is implemented by the stores keeping data from their Keys calls for the Get calls.
+type kvReleaser interface {
+	// Release drops the data kept by the last Keys call of the topic.
+	Release(topic string)
+}
+
+// kvBackend exposes a key-value store as a Kafka backend.
+//
+// A topic has one partition, its offsets are renewed by each Offsets call so the indexes are always
+// rebuilt from the keys. The keys of the topics must only be written by sync2kafka.
+type kvBackend struct {
+	store kvStore
+
+	// snapshots are the keys found by the last Offsets call of each topic, consumed by Consume
+	snapshots      map[string]*kvSnapshot
+	snapshotsMutex sync.Mutex
+
+	// users are the snapshots of each topic waiting to be consumed or being consumed, the store's
+	// data being released when there are none left
+	users map[string]int
+}
+
+type kvSnapshot struct {
+	oldest int64
+	keys   [][]byte
+	expiry *time.Timer
+}
+
+func newKVBackend(store kvStore) (Backend, error) {
+	// check connectivity like other backends do
+	if err := store.Ping(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return &kvBackend{store: store, snapshots: map[string]*kvSnapshot{}, users: map[string]int{}}, nil
+}
+
+var _ Backend = &kvBackend{}
+
+func (b *kvBackend) Partitions(topic string) ([]int32, error) {
+	return []int32{0}, nil
+}
+
+// Offsets takes a snapshot of the topic's keys, read by the next Consume call of the topic. The offsets
+// increase with each snapshot so the resume keys of the indexes are always before the oldest offset.
+func (b *kvBackend) Offsets(topic string, partition int32) (oldest, highWater int64, err error) {
+	if partition != 0 {
+		return 0, 0, fmt.Errorf("topic %q has no partition %d", topic, partition)
+	}
+
+	keys, err := b.store.Keys(topic)
+	if err != nil {
+		return
+	}
+
+	highWater = time.Now().UnixNano()
+	oldest = highWater - int64(len(keys))
+
+	snapshot := &kvSnapshot{oldest: oldest, keys: keys}
+
+	// the offsets may be read without consuming the topic. Whoever stops the timer releases the snapshot.
+	snapshot.expiry = time.AfterFunc(kvSnapshotTTL, func() {
+		b.snapshotsMutex.Lock()
+		if b.snapshots[topic] == snapshot {
+			delete(b.snapshots, topic)
+		}
+		b.snapshotsMutex.Unlock()
+
+		b.release(topic)
+	})
+
+	b.snapshotsMutex.Lock()
+	if previous := b.snapshots[topic]; previous != nil && previous.expiry.Stop() {
+		b.users[topic]-- // replaced before being consumed
+	}
+	b.snapshots[topic] = snapshot
+	b.users[topic]++
+	b.snapshotsMutex.Unlock()
+
+	return
+}
+
+// release drops the data kept by the store for the topic when its last snapshot user is gone.
+func (b *kvBackend) release(topic string) {
+	b.snapshotsMutex.Lock()
+	defer b.snapshotsMutex.Unlock()
+
+	if b.users[topic]--; b.users[topic] > 0 {
+		return
+	}
+
+	delete(b.users, topic)
+
+	if r, ok := b.store.(kvReleaser); ok {
+		r.Release(topic)
+	}
+}
+
+// Consume streams the snapshot taken by the last Offsets call (a new one if none), from offset.
+func (b *kvBackend) Consume(topic string, partition int32, offset int64) (Consumer, error) {
+	b.snapshotsMutex.Lock()
+	snapshot := b.snapshots[topic]
+	delete(b.snapshots, topic)
+	b.snapshotsMutex.Unlock()
+
+	if snapshot == nil || !snapshot.expiry.Stop() {
+		if _, _, err := b.Offsets(topic, partition); err != nil {
+			return nil, err
+		}
+		return b.Consume(topic, partition, offset)
+	}
+
+	c := &kvConsumer{
+		messages: make(chan *Message),
+		errors:   make(chan error),
+		closed:   make(chan bool),
+	}
+
+	go func() {
+		defer b.release(topic) // on every path, as the consumer may stop before reading all the keys
+		c.run(b.store, topic, snapshot, offset)
+	}()
+
+	return c, nil
+}
+
+func (b *kvBackend) NewProducer() (Producer, error) {
+	return &kvProducer{store: b.store}, nil
+}
+
+func (b *kvBackend) Produce(msgs ...*Message) error {
+	if errors := b.store.Write(msgs); errors != 0 {
+		return fmt.Errorf("%d of %d messages failed", errors, len(msgs))
+	}
+	return nil
+}
+
+func (b *kvBackend) CommittedOffsets(group, topic string, partitions []int32) (map[int32]int64, error) {
+	return nil, errors.New("consumer groups are not supported by key-value stores")
+}
+
+// TopicConfig returns cleanup.policy=compact since the store keeps only the last value of each key.
+func (b *kvBackend) TopicConfig(topic string) (map[string]string, error) {
+	return map[string]string{"cleanup.policy": "compact"}, nil
+}
+
+func (b *kvBackend) SetTopicConfig(topic string, entries map[string]string) error {
+	return errors.New("topic configurations are not supported by key-value stores")
+}
+
+func (b *kvBackend) Health(topics ...string) *ClusterHealth {
+	h := &ClusterHealth{
+		Brokers:      []BrokerHealth{{ID: 0, Addr: b.store.Addr()}},
+		MetadataTime: time.Now(),
+		Topics:       map[string][]PartitionHealth{},
+	}
+
+	if err := b.store.Ping(); err != nil {
+		h.MetadataError = err.Error()
+		return h
+	}
+
+	h.Brokers[0].Connected = true
+
+	for _, topic := range topics {
+		h.Topics[topic] = []PartitionHealth{{
+			Partition:      0,
+			Leader:         0,
+			Replicas:       []int32{0},
+			InSyncReplicas: []int32{0},
+		}}
+	}
+
+	return h
+}
+
+func (b *kvBackend) Close() error {
+	return b.store.Close()
+}
+
+type kvConsumer struct {
+	messages chan *Message
+	errors   chan error
+	closed   chan bool
+	once     sync.Once
+}
+
+func (c *kvConsumer) run(store kvStore, topic string, snapshot *kvSnapshot, offset int64) {
+	defer close(c.messages)
+
+	start := offset - snapshot.oldest
+	if start < 0 {
+		start = 0
+	}
+
+	for i := int(start); i < len(snapshot.keys); i += kvBatchSize {
+		end := i + kvBatchSize
+		if end > len(snapshot.keys) {
+			end = len(snapshot.keys)
+		}
+
+		keys := snapshot.keys[i:end]
+
+		values, err := store.Get(topic, keys)
+		if err != nil {
+			select {
+			case c.errors <- err:
+			case <-c.closed:
+			}
+			return
+		}
+
+		for n, key := range keys {
+			msg := &Message{
+				Topic:  topic,
+				Offset: snapshot.oldest + int64(i+n),
+				Key:    key,
+				Value:  []byte{}, // deleted since the snapshot
+			}
+
+			if values[n] != nil {
+				msg.Value = values[n]
+			}
+
+			select {
+			case c.messages <- msg:
+			case <-c.closed:
+				return
+			}
+		}
+	}
+
+	<-c.closed
+}
+
+func (c *kvConsumer) Messages() <-chan *Message { return c.messages }
+func (c *kvConsumer) Errors() <-chan error      { return c.errors }
+
+func (c *kvConsumer) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// kvProducer writes the messages by batches.
+type kvProducer struct {
+	store     kvStore
+	batch     []*Message
+	successes int64
+	errors    int64
+}
+
+func (p *kvProducer) Send(msg *Message) {
+	p.batch = append(p.batch, msg)
+
+	if len(p.batch) == kvBatchSize {
+		p.flush()
+	}
+}
+
+func (p *kvProducer) flush() {
+	if len(p.batch) == 0 {
+		return
+	}
+
+	errors := p.store.Write(p.batch)
+
+	p.errors += errors
+	p.successes += int64(len(p.batch)) - errors
+
+	p.batch = p.batch[:0]
+}
+
+func (p *kvProducer) Close() (successes, errors int64) {
+	p.flush()
+	return p.successes, p.errors
+}
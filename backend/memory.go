@@ -0,0 +1,343 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory backend, for tests. Its zero value is ready to use.
+//
+// Topics are created on first use, with one partition unless created by CreateTopic.
+type Memory struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	topics map[string][][]*Message
+	config map[string]map[string]string
+
+	// CommittedGroupOffsets are returned by CommittedOffsets, by group, topic and partition.
+	CommittedGroupOffsets map[string]map[string]map[int32]int64
+
+	// FailProduce is called with each message sent by a producer; the message is not stored if it
+	// returns an error (optional).
+	FailProduce func(msg *Message) error
+}
+
+var _ Backend = &Memory{}
+
+// NewMemory creates an in-memory backend.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (b *Memory) init() {
+	if b.topics == nil {
+		b.topics = map[string][][]*Message{}
+		b.cond = sync.NewCond(&b.mutex)
+	}
+}
+
+// topic returns the partitions of the topic, creating it if needed. The mutex must be held.
+func (b *Memory) topic(topic string) [][]*Message {
+	b.init()
+
+	partitions, ok := b.topics[topic]
+	if !ok {
+		partitions = make([][]*Message, 1)
+		b.topics[topic] = partitions
+	}
+
+	return partitions
+}
+
+// CreateTopic creates a topic with the given number of partitions, if it doesn't exist.
+func (b *Memory) CreateTopic(topic string, partitions int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.init()
+
+	if _, ok := b.topics[topic]; !ok {
+		b.topics[topic] = make([][]*Message, partitions)
+	}
+}
+
+// AddPartitions grows the topic to the given number of partitions, like adding partitions to a Kafka topic.
+func (b *Memory) AddPartitions(topic string, partitions int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	current := b.topic(topic)
+	for len(current) < partitions {
+		current = append(current, nil)
+	}
+
+	b.topics[topic] = current
+}
+
+// Messages returns a copy of the messages of a partition.
+func (b *Memory) Messages(topic string, partition int32) []*Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]*Message(nil), b.topic(topic)[partition]...)
+}
+
+// State returns the compacted state of a partition (tombstones removed).
+func (b *Memory) State(topic string, partition int32) map[string][]byte {
+	state := map[string][]byte{}
+
+	for _, m := range b.Messages(topic, partition) {
+		if len(m.Value) == 0 {
+			delete(state, string(m.Key))
+		} else {
+			state[string(m.Key)] = m.Value
+		}
+	}
+
+	return state
+}
+
+func (b *Memory) Partitions(topic string) ([]int32, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	partitions := make([]int32, len(b.topic(topic)))
+	for i := range partitions {
+		partitions[i] = int32(i)
+	}
+
+	return partitions, nil
+}
+
+func (b *Memory) Offsets(topic string, partition int32) (oldest, highWater int64, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	partitions := b.topic(topic)
+	if int(partition) >= len(partitions) {
+		return 0, 0, fmt.Errorf("topic %q has no partition %d", topic, partition)
+	}
+
+	return 0, int64(len(partitions[partition])), nil
+}
+
+func (b *Memory) Consume(topic string, partition int32, offset int64) (Consumer, error) {
+	if _, _, err := b.Offsets(topic, partition); err != nil {
+		return nil, err
+	}
+
+	c := &memoryConsumer{
+		messages: make(chan *Message),
+		errors:   make(chan error),
+		closed:   make(chan bool),
+	}
+
+	go c.run(b, topic, partition, offset)
+
+	return c, nil
+}
+
+func (b *Memory) NewProducer() (Producer, error) {
+	return &memoryProducer{backend: b}, nil
+}
+
+func (b *Memory) Produce(msgs ...*Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, msg := range msgs {
+		partitions := b.topic(msg.Topic)
+
+		partition := msg.Partition
+		if int(partition) >= len(partitions) {
+			return fmt.Errorf("topic %q has no partition %d", msg.Topic, partition)
+		}
+
+		m := *msg
+		m.Offset = int64(len(partitions[partition]))
+		if m.Timestamp.IsZero() {
+			m.Timestamp = time.Now()
+		}
+
+		partitions[partition] = append(partitions[partition], &m)
+	}
+
+	b.cond.Broadcast()
+	return nil
+}
+
+var _ PartitionProducer = &Memory{}
+
+// ProduceToPartitions is Produce, as the memory backend always honors the messages' Partition.
+func (b *Memory) ProduceToPartitions(msgs ...*Message) error {
+	return b.Produce(msgs...)
+}
+
+func (b *Memory) CommittedOffsets(group, topic string, partitions []int32) (map[int32]int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		offsets[p] = -1
+
+		if offset, ok := b.CommittedGroupOffsets[group][topic][p]; ok {
+			offsets[p] = offset
+		}
+	}
+
+	return offsets, nil
+}
+
+// TopicConfig returns the entries set by SetTopicConfig, and cleanup.policy=compact by default.
+func (b *Memory) TopicConfig(topic string) (map[string]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	config := map[string]string{"cleanup.policy": "compact"}
+	for name, value := range b.config[topic] {
+		config[name] = value
+	}
+
+	return config, nil
+}
+
+func (b *Memory) SetTopicConfig(topic string, entries map[string]string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.config == nil {
+		b.config = map[string]map[string]string{}
+	}
+
+	if b.config[topic] == nil {
+		b.config[topic] = map[string]string{}
+	}
+
+	for name, value := range entries {
+		b.config[topic][name] = value
+	}
+
+	return nil
+}
+
+func (b *Memory) Health(topics ...string) *ClusterHealth {
+	h := &ClusterHealth{
+		Brokers:      []BrokerHealth{{ID: 0, Addr: "memory", Connected: true}},
+		MetadataTime: time.Now(),
+		Topics:       map[string][]PartitionHealth{},
+	}
+
+	for _, topic := range topics {
+		partitions, _ := b.Partitions(topic)
+		for _, p := range partitions {
+			h.Topics[topic] = append(h.Topics[topic], PartitionHealth{
+				Partition:      p,
+				Leader:         0,
+				Replicas:       []int32{0},
+				InSyncReplicas: []int32{0},
+			})
+		}
+	}
+
+	return h
+}
+
+func (b *Memory) Close() error {
+	return nil
+}
+
+type memoryConsumer struct {
+	messages chan *Message
+	errors   chan error
+	closed   chan bool
+	once     sync.Once
+}
+
+func (c *memoryConsumer) run(b *Memory, topic string, partition int32, offset int64) {
+	defer close(c.messages)
+
+	// wake up waiters when closed
+	go func() {
+		<-c.closed
+		b.mutex.Lock()
+		b.cond.Broadcast()
+		b.mutex.Unlock()
+	}()
+
+	for {
+		b.mutex.Lock()
+		for {
+			select {
+			case <-c.closed:
+				b.mutex.Unlock()
+				return
+			default:
+			}
+
+			if offset < int64(len(b.topic(topic)[partition])) {
+				break
+			}
+
+			b.cond.Wait()
+		}
+
+		msg := b.topic(topic)[partition][offset]
+		b.mutex.Unlock()
+
+		select {
+		case c.messages <- msg:
+			offset++
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *memoryConsumer) Messages() <-chan *Message { return c.messages }
+func (c *memoryConsumer) Errors() <-chan error      { return c.errors }
+
+func (c *memoryConsumer) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+type memoryProducer struct {
+	backend   *Memory
+	successes int64
+	errors    int64
+	onError   func(*Message, error)
+}
+
+var _ ErrorNotifier = &memoryProducer{}
+
+func (p *memoryProducer) NotifyErrors(onError func(*Message, error)) {
+	p.onError = onError
+}
+
+func (p *memoryProducer) Send(msg *Message) {
+	var err error
+	if p.backend.FailProduce != nil {
+		err = p.backend.FailProduce(msg)
+	}
+
+	if err == nil {
+		err = p.backend.Produce(msg)
+	}
+
+	if err != nil {
+		p.errors++
+
+		if p.onError != nil {
+			p.onError(msg, err)
+		}
+		return
+	}
+
+	p.successes++
+}
+
+func (p *memoryProducer) Close() (successes, errors int64) {
+	return p.successes, p.errors
+}
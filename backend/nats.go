@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type natsStore struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	buckets      map[string]nats.KeyValue
+	bucketsMutex sync.Mutex
+}
+
+// NewNATS creates a backend writing the topics to NATS JetStream key-value buckets, instead of Kafka.
+// The bucket of a topic is its name with the characters other than letters, digits, - and _ replaced
+// by _, created if needed. The keys are base64 URL encoded (unpadded) since buckets restrict their
+// characters. Deletions (empty values) delete the keys.
+func NewNATS(urls []string, config Config) (Backend, error) {
+	options := []nats.Option{nats.Name("sync2kafka"), nats.Timeout(10 * time.Second)}
+	if len(config.SASLUser) != 0 {
+		options = append(options, nats.UserInfo(config.SASLUser, config.SASLPassword))
+	}
+
+	conn, err := nats.Connect(strings.Join(urls, ","), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newKVBackend(&natsStore{conn: conn, js: js, buckets: map[string]nats.KeyValue{}})
+}
+
+var _ kvStore = &natsStore{}
+
+func (s *natsStore) Addr() string { return s.conn.ConnectedUrlRedacted() }
+
+func (s *natsStore) Ping() error {
+	_, err := s.js.AccountInfo()
+	return err
+}
+
+// natsBucketName returns the bucket name of the topic.
+func natsBucketName(topic string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, topic)
+}
+
+// bucket returns the bucket of the topic, creating it if needed.
+func (s *natsStore) bucket(topic string) (kv nats.KeyValue, err error) {
+	s.bucketsMutex.Lock()
+	defer s.bucketsMutex.Unlock()
+
+	if kv = s.buckets[topic]; kv != nil {
+		return
+	}
+
+	name := natsBucketName(topic)
+
+	kv, err = s.js.KeyValue(name)
+	if err == nats.ErrBucketNotFound {
+		kv, err = s.js.CreateKeyValue(&nats.KeyValueConfig{Bucket: name, History: 1})
+	}
+
+	if err != nil {
+		return
+	}
+
+	s.buckets[topic] = kv
+	return
+}
+
+func (s *natsStore) Keys(topic string) (keys [][]byte, err error) {
+	kv, err := s.bucket(topic)
+	if err != nil {
+		return
+	}
+
+	names, err := kv.Keys()
+	if err == nats.ErrNoKeysFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	keys = make([][]byte, 0, len(names))
+	for _, name := range names {
+		key, decodeErr := base64.RawURLEncoding.DecodeString(name)
+		if decodeErr != nil {
+			continue // not written by sync2kafka
+		}
+		keys = append(keys, key)
+	}
+
+	return
+}
+
+func (s *natsStore) Get(topic string, keys [][]byte) (values [][]byte, err error) {
+	kv, err := s.bucket(topic)
+	if err != nil {
+		return
+	}
+
+	values = make([][]byte, len(keys))
+	for i, key := range keys {
+		entry, getErr := kv.Get(base64.RawURLEncoding.EncodeToString(key))
+		if getErr == nats.ErrKeyNotFound {
+			continue
+		}
+
+		if getErr != nil {
+			return nil, getErr
+		}
+
+		values[i] = entry.Value()
+	}
+
+	return
+}
+
+func (s *natsStore) Write(msgs []*Message) (errors int64) {
+	for _, msg := range msgs {
+		kv, err := s.bucket(msg.Topic)
+		if err != nil {
+			errors++
+			continue
+		}
+
+		key := base64.RawURLEncoding.EncodeToString(msg.Key)
+
+		if len(msg.Value) == 0 {
+			err = kv.Delete(key)
+		} else {
+			_, err = kv.Put(key, msg.Value)
+		}
+
+		if err != nil {
+			errors++
+		}
+	}
+
+	return
+}
+
+func (s *natsStore) Close() error {
+	s.conn.Close()
+	return nil
+}
@@ -0,0 +1,231 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+type pulsarStore struct {
+	url    string
+	client pulsar.Client
+
+	producers      map[string]pulsar.Producer
+	producersMutex sync.Mutex
+
+	// snapshots are the values read by the last Keys call of each topic, consumed by Get
+	snapshots      map[string]map[string][]byte
+	snapshotsMutex sync.Mutex
+}
+
+// NewPulsar creates a backend producing to Apache Pulsar topics, instead of Kafka. The topics must have
+// key-based compaction enabled: deletions are messages with an empty payload. The topics are read
+// compacted, in full, to index them (all the partitions of partitioned topics).
+func NewPulsar(urls []string, config Config) (Backend, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no Pulsar address")
+	}
+
+	options := pulsar.ClientOptions{
+		URL:               "pulsar://" + strings.Join(urls, ","),
+		ConnectionTimeout: 10 * time.Second,
+	}
+
+	if strings.Contains(urls[0], "://") {
+		options.URL = strings.Join(urls, ",")
+	}
+
+	if len(config.SASLUser) != 0 {
+		auth, err := pulsar.NewAuthenticationBasic(config.SASLUser, config.SASLPassword)
+		if err != nil {
+			return nil, err
+		}
+		options.Authentication = auth
+	}
+
+	client, err := pulsar.NewClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKVBackend(&pulsarStore{
+		url:       options.URL,
+		client:    client,
+		producers: map[string]pulsar.Producer{},
+		snapshots: map[string]map[string][]byte{},
+	})
+}
+
+var _ kvStore = &pulsarStore{}
+
+func (s *pulsarStore) Addr() string { return s.url }
+
+// Ping looks up a topic, as the client connects lazily.
+func (s *pulsarStore) Ping() error {
+	_, err := s.client.TopicPartitions("sync2kafka-ping")
+	return err
+}
+
+// Keys reads the compacted topic, keeping the values for Get.
+func (s *pulsarStore) Keys(topic string) (keys [][]byte, err error) {
+	partitions, err := s.client.TopicPartitions(topic)
+	if err != nil {
+		return
+	}
+
+	values := map[string][]byte{}
+	for _, partition := range partitions {
+		if err = s.read(partition, values); err != nil {
+			return
+		}
+	}
+
+	s.snapshotsMutex.Lock()
+	s.snapshots[topic] = values
+	s.snapshotsMutex.Unlock()
+
+	keys = make([][]byte, 0, len(values))
+	for key := range values {
+		keys = append(keys, []byte(key))
+	}
+
+	return
+}
+
+func (s *pulsarStore) read(topic string, values map[string][]byte) (err error) {
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          topic,
+		StartMessageID: pulsar.EarliestMessageID(),
+		ReadCompacted:  true,
+	})
+	if err != nil {
+		return
+	}
+
+	defer reader.Close()
+
+	for reader.HasNext() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		msg, nextErr := reader.Next(ctx)
+		cancel()
+
+		if nextErr != nil {
+			return nextErr
+		}
+
+		if len(msg.Payload()) == 0 {
+			delete(values, msg.Key())
+		} else {
+			values[msg.Key()] = msg.Payload()
+		}
+	}
+
+	return
+}
+
+func (s *pulsarStore) Get(topic string, keys [][]byte) (values [][]byte, err error) {
+	s.snapshotsMutex.Lock()
+	defer s.snapshotsMutex.Unlock()
+
+	snapshot := s.snapshots[topic]
+
+	values = make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = snapshot[string(key)]
+		delete(snapshot, string(key))
+	}
+
+	if len(snapshot) == 0 {
+		delete(s.snapshots, topic)
+	}
+
+	return
+}
+
+// Release drops the values of the topic not read by Get, implementing kvReleaser.
+func (s *pulsarStore) Release(topic string) {
+	s.snapshotsMutex.Lock()
+	delete(s.snapshots, topic)
+	s.snapshotsMutex.Unlock()
+}
+
+func (s *pulsarStore) producer(topic string) (producer pulsar.Producer, err error) {
+	s.producersMutex.Lock()
+	defer s.producersMutex.Unlock()
+
+	if producer = s.producers[topic]; producer != nil {
+		return
+	}
+
+	producer, err = s.client.CreateProducer(pulsar.ProducerOptions{Topic: topic})
+	if err != nil {
+		return
+	}
+
+	s.producers[topic] = producer
+	return
+}
+
+func (s *pulsarStore) Write(msgs []*Message) int64 {
+	failed := int64(0)
+	wg := sync.WaitGroup{}
+	used := map[pulsar.Producer]bool{}
+
+	for _, msg := range msgs {
+		producer, err := s.producer(msg.Topic)
+		if err != nil {
+			atomic.AddInt64(&failed, 1)
+			continue
+		}
+
+		pm := &pulsar.ProducerMessage{
+			Key:     string(msg.Key),
+			Payload: msg.Value,
+		}
+
+		if !msg.Timestamp.IsZero() {
+			pm.EventTime = msg.Timestamp
+		}
+
+		if len(msg.Headers) != 0 {
+			pm.Properties = make(map[string]string, len(msg.Headers))
+			for _, hdr := range msg.Headers {
+				pm.Properties[string(hdr.Key)] = string(hdr.Value)
+			}
+		}
+
+		wg.Add(1)
+		producer.SendAsync(context.Background(), pm, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+			}
+			wg.Done()
+		})
+
+		used[producer] = true
+	}
+
+	for producer := range used {
+		producer.Flush()
+	}
+
+	wg.Wait()
+
+	return atomic.LoadInt64(&failed)
+}
+
+func (s *pulsarStore) Close() error {
+	s.producersMutex.Lock()
+	for _, producer := range s.producers {
+		producer.Close()
+	}
+	s.producersMutex.Unlock()
+
+	s.client.Close()
+	return nil
+}
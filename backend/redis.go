@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type redisStore struct {
+	addr string
+	pool *redis.Pool
+}
+
+// NewRedis creates a backend writing the topics to a Redis server, instead of Kafka, to hydrate caches
+// directly. The record of key K in topic T is the Redis key "T:K". Records are SET, deletions (empty
+// values) are DEL.
+func NewRedis(addrs []string, config Config) (Backend, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no Redis address")
+	}
+
+	options := []redis.DialOption{redis.DialConnectTimeout(10 * time.Second)}
+	if len(config.SASLUser) != 0 {
+		options = append(options, redis.DialUsername(config.SASLUser), redis.DialPassword(config.SASLPassword))
+	}
+
+	return newKVBackend(&redisStore{
+		addr: addrs[0],
+		pool: &redis.Pool{
+			MaxIdle:     10,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addrs[0], options...)
+			},
+		},
+	})
+}
+
+var _ kvStore = &redisStore{}
+
+func (s *redisStore) Addr() string { return s.addr }
+
+func (s *redisStore) Ping() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+// redisKey returns the Redis key of a record.
+func redisKey(topic string, key []byte) string {
+	return topic + ":" + string(key)
+}
+
+// redisPattern returns the SCAN pattern matching the keys of the topic.
+func redisPattern(topic string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(topic)
+	return escaped + ":*"
+}
+
+func (s *redisStore) Keys(topic string) (keys [][]byte, err error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	pattern := redisPattern(topic)
+	prefixLen := len(topic) + 1
+	cursor := 0
+
+	for {
+		var values []interface{}
+		values, err = redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", kvBatchSize))
+		if err != nil {
+			return
+		}
+
+		var batch [][]byte
+		if _, err = redis.Scan(values, &cursor, &batch); err != nil {
+			return
+		}
+
+		for _, key := range batch {
+			keys = append(keys, key[prefixLen:])
+		}
+
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+func (s *redisStore) Get(topic string, keys [][]byte) (values [][]byte, err error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = redisKey(topic, key)
+	}
+
+	return redis.ByteSlices(conn.Do("MGET", args...))
+}
+
+// Write pipelines the SET and DEL commands.
+func (s *redisStore) Write(msgs []*Message) (errors int64) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	pending := 0
+	for _, msg := range msgs {
+		key := redisKey(msg.Topic, msg.Key)
+
+		var err error
+		if len(msg.Value) == 0 {
+			err = conn.Send("DEL", key)
+		} else {
+			err = conn.Send("SET", key, msg.Value)
+		}
+
+		if err != nil {
+			errors++
+			continue
+		}
+
+		pending++
+	}
+
+	if err := conn.Flush(); err != nil {
+		return errors + int64(pending)
+	}
+
+	for ; pending != 0; pending-- {
+		if _, err := conn.Receive(); err != nil {
+			errors++
+		}
+	}
+
+	return
+}
+
+func (s *redisStore) Close() error {
+	return s.pool.Close()
+}
@@ -0,0 +1,427 @@
+package backend
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type saramaBackend struct {
+	client sarama.Client
+
+	mutex        sync.Mutex
+	syncProducer sarama.SyncProducer
+	admin        sarama.ClusterAdmin
+
+	metadataTime  time.Time
+	metadataError error
+}
+
+// NewSarama creates a backend using the Shopify/sarama library.
+func NewSarama(brokers []string, config Config) (Backend, error) {
+	conf := sarama.NewConfig()
+	conf.Producer.Return.Successes = true
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+
+	if len(config.SASLUser) != 0 {
+		conf.Net.SASL.Enable = true
+		conf.Net.SASL.User = config.SASLUser
+		conf.Net.SASL.Password = config.SASLPassword
+	}
+
+	if config.Ordered {
+		// a single in-flight request per broker, so a retried batch can't be overtaken
+		conf.Net.MaxOpenRequests = 1
+	}
+
+	if len(config.Version) != 0 {
+		version, err := sarama.ParseKafkaVersion(config.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.Version = version
+	}
+
+	client, err := sarama.NewClient(brokers, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saramaBackend{client: client}, nil
+}
+
+var _ Backend = &saramaBackend{}
+
+func (b *saramaBackend) Partitions(topic string) ([]int32, error) {
+	return b.client.Partitions(topic)
+}
+
+func (b *saramaBackend) Offsets(topic string, partition int32) (oldest, highWater int64, err error) {
+	if oldest, err = b.client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+		return
+	}
+
+	highWater, err = b.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	return
+}
+
+func (b *saramaBackend) Consume(topic string, partition int32, offset int64) (Consumer, error) {
+	consumer, err := sarama.NewConsumerFromClient(b.client)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		consumer.Close()
+		return nil, err
+	}
+
+	c := &saramaConsumer{
+		consumer: consumer,
+		pc:       pc,
+		messages: make(chan *Message),
+		errors:   make(chan error),
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+func (b *saramaBackend) NewProducer() (Producer, error) {
+	producer, err := sarama.NewAsyncProducerFromClient(b.client)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &saramaProducer{producer: producer}
+
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		for prodErr := range producer.Errors() {
+			log.Print("sarama producer error: ", prodErr)
+			p.errors++
+
+			if p.onError != nil {
+				p.onError(prodErr.Msg.Metadata.(*Message), prodErr.Err)
+			}
+		}
+	}()
+
+	go func() {
+		defer p.wg.Done()
+		for range producer.Successes() {
+			p.successes++
+		}
+	}()
+
+	return p, nil
+}
+
+func (b *saramaBackend) Produce(msgs ...*Message) (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.syncProducer == nil {
+		b.syncProducer, err = sarama.NewSyncProducerFromClient(b.client)
+		if err != nil {
+			return
+		}
+	}
+
+	pms := make([]*sarama.ProducerMessage, len(msgs))
+	for i, msg := range msgs {
+		pms[i] = toSaramaMessage(msg)
+	}
+
+	return b.syncProducer.SendMessages(pms)
+}
+
+var _ PartitionProducer = &saramaBackend{}
+
+func (b *saramaBackend) ProduceToPartitions(msgs ...*Message) (err error) {
+	conf := *b.client.Config()
+	conf.Producer.Partitioner = sarama.NewManualPartitioner
+
+	brokers := b.client.Brokers()
+	addrs := make([]string, len(brokers))
+	for i, broker := range brokers {
+		addrs[i] = broker.Addr()
+	}
+
+	producer, err := sarama.NewSyncProducer(addrs, &conf)
+	if err != nil {
+		return
+	}
+
+	defer producer.Close()
+
+	pms := make([]*sarama.ProducerMessage, len(msgs))
+	for i, msg := range msgs {
+		pms[i] = toSaramaMessage(msg)
+	}
+
+	return producer.SendMessages(pms)
+}
+
+func (b *saramaBackend) clusterAdmin() (admin sarama.ClusterAdmin, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.admin == nil {
+		// NB: not closed as it would close the shared client
+		b.admin, err = sarama.NewClusterAdminFromClient(b.client)
+	}
+
+	return b.admin, err
+}
+
+func (b *saramaBackend) CommittedOffsets(group, topic string, partitions []int32) (offsets map[int32]int64, err error) {
+	admin, err := b.clusterAdmin()
+	if err != nil {
+		return
+	}
+
+	res, err := admin.ListConsumerGroupOffsets(group, map[string][]int32{topic: partitions})
+	if err != nil {
+		return
+	}
+
+	offsets = make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		offsets[partition] = -1
+
+		if block := res.GetBlock(topic, partition); block != nil {
+			offsets[partition] = block.Offset
+		}
+	}
+
+	return
+}
+
+func (b *saramaBackend) describeTopicConfig(topic string) (entries []sarama.ConfigEntry, err error) {
+	admin, err := b.clusterAdmin()
+	if err != nil {
+		return
+	}
+
+	return admin.DescribeConfig(sarama.ConfigResource{Type: sarama.TopicResource, Name: topic})
+}
+
+func (b *saramaBackend) TopicConfig(topic string) (config map[string]string, err error) {
+	entries, err := b.describeTopicConfig(topic)
+	if err != nil {
+		return
+	}
+
+	config = make(map[string]string, len(entries))
+	for _, entry := range entries {
+		config[entry.Name] = entry.Value
+	}
+
+	return
+}
+
+func (b *saramaBackend) SetTopicConfig(topic string, entries map[string]string) (err error) {
+	// the AlterConfigs request replaces the whole topic configuration, so the current overrides are kept
+	current, err := b.describeTopicConfig(topic)
+	if err != nil {
+		return
+	}
+
+	config := make(map[string]*string, len(current)+len(entries))
+	for _, entry := range current {
+		if entry.Default || entry.ReadOnly || (entry.Source != sarama.SourceTopic && entry.Source != sarama.SourceUnknown) {
+			continue
+		}
+
+		value := entry.Value
+		config[entry.Name] = &value
+	}
+
+	for name, value := range entries {
+		value := value
+		config[name] = &value
+	}
+
+	admin, err := b.clusterAdmin()
+	if err != nil {
+		return
+	}
+
+	return admin.AlterConfig(sarama.TopicResource, topic, config, false)
+}
+
+func (b *saramaBackend) Health(topics ...string) *ClusterHealth {
+	b.mutex.Lock()
+	if time.Since(b.metadataTime) > metadataMaxAge {
+		b.metadataError = b.client.RefreshMetadata(topics...)
+		b.metadataTime = time.Now()
+	}
+
+	h := &ClusterHealth{
+		MetadataTime: b.metadataTime,
+		MetadataAge:  time.Since(b.metadataTime),
+		Topics:       map[string][]PartitionHealth{},
+	}
+
+	if b.metadataError != nil {
+		h.MetadataError = b.metadataError.Error()
+	}
+	b.mutex.Unlock()
+
+	for _, broker := range b.client.Brokers() {
+		connected, _ := broker.Connected()
+		h.Brokers = append(h.Brokers, BrokerHealth{
+			ID:        broker.ID(),
+			Addr:      broker.Addr(),
+			Connected: connected,
+		})
+	}
+
+	for _, topic := range topics {
+		partitions, err := b.client.Partitions(topic)
+		if err != nil {
+			h.Topics[topic] = []PartitionHealth{{Partition: -1, Leader: -1, Error: err.Error()}}
+			continue
+		}
+
+		for _, partition := range partitions {
+			ph := PartitionHealth{Partition: partition, Leader: -1}
+
+			if leader, err := b.client.Leader(topic, partition); err != nil {
+				ph.Error = err.Error()
+			} else {
+				ph.Leader = leader.ID()
+			}
+
+			ph.Replicas, _ = b.client.Replicas(topic, partition)
+			ph.InSyncReplicas, _ = b.client.InSyncReplicas(topic, partition)
+
+			h.Topics[topic] = append(h.Topics[topic], ph)
+		}
+	}
+
+	return h
+}
+
+func (b *saramaBackend) Close() error {
+	if b.syncProducer != nil {
+		b.syncProducer.Close()
+	}
+
+	return b.client.Close()
+}
+
+func toSaramaMessage(msg *Message) *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Key:       sarama.ByteEncoder(msg.Key),
+		Value:     sarama.ByteEncoder(msg.Value),
+		Timestamp: msg.Timestamp,
+	}
+
+	for _, hdr := range msg.Headers {
+		pm.Headers = append(pm.Headers, sarama.RecordHeader{Key: hdr.Key, Value: hdr.Value})
+	}
+
+	return pm
+}
+
+type saramaConsumer struct {
+	consumer sarama.Consumer
+	pc       sarama.PartitionConsumer
+	messages chan *Message
+	errors   chan error
+}
+
+func (c *saramaConsumer) run() {
+	defer close(c.messages)
+	defer close(c.errors)
+
+	msgs, errs := c.pc.Messages(), c.pc.Errors()
+
+	for msgs != nil || errs != nil {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				continue
+			}
+
+			msg := &Message{
+				Topic:     m.Topic,
+				Partition: m.Partition,
+				Offset:    m.Offset,
+				Key:       m.Key,
+				Value:     m.Value,
+				Timestamp: m.Timestamp,
+			}
+
+			for _, hdr := range m.Headers {
+				msg.Headers = append(msg.Headers, Header{Key: hdr.Key, Value: hdr.Value})
+			}
+
+			c.messages <- msg
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			c.errors <- err
+		}
+	}
+}
+
+func (c *saramaConsumer) Messages() <-chan *Message { return c.messages }
+func (c *saramaConsumer) Errors() <-chan error      { return c.errors }
+
+func (c *saramaConsumer) Close() error {
+	// drain so run() can finish
+	go func() {
+		for range c.messages {
+		}
+	}()
+	go func() {
+		for range c.errors {
+		}
+	}()
+
+	c.pc.AsyncClose()
+	return c.consumer.Close()
+}
+
+type saramaProducer struct {
+	producer  sarama.AsyncProducer
+	wg        sync.WaitGroup
+	successes int64
+	errors    int64
+	onError   func(*Message, error)
+}
+
+var _ ErrorNotifier = &saramaProducer{}
+
+func (p *saramaProducer) Send(msg *Message) {
+	pm := toSaramaMessage(msg)
+	pm.Metadata = msg
+
+	p.producer.Input() <- pm
+}
+
+func (p *saramaProducer) NotifyErrors(onError func(*Message, error)) {
+	p.onError = onError
+}
+
+func (p *saramaProducer) Close() (successes, errors int64) {
+	p.producer.AsyncClose()
+	p.wg.Wait()
+	return p.successes, p.errors
+}
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"sync"
+)
+
+// Switch is a backend whose client can be replaced, ie to reconnect with renewed credentials. The
+// consumers and producers created before a replacement keep using the previous client.
+type Switch struct {
+	mutex   sync.RWMutex
+	current Backend
+}
+
+var _ Backend = &Switch{}
+var _ PartitionProducer = &Switch{}
+
+// NewSwitch creates a switch using the given backend.
+func NewSwitch(b Backend) *Switch {
+	return &Switch{current: b}
+}
+
+// Set replaces the backend, returning the previous one, to be closed by the caller when it's not used anymore.
+func (s *Switch) Set(b Backend) (previous Backend) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, s.current = s.current, b
+	return
+}
+
+func (s *Switch) get() Backend {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.current
+}
+
+func (s *Switch) Partitions(topic string) ([]int32, error) {
+	return s.get().Partitions(topic)
+}
+
+func (s *Switch) Offsets(topic string, partition int32) (oldest, highWater int64, err error) {
+	return s.get().Offsets(topic, partition)
+}
+
+func (s *Switch) Consume(topic string, partition int32, offset int64) (Consumer, error) {
+	return s.get().Consume(topic, partition, offset)
+}
+
+func (s *Switch) NewProducer() (Producer, error) {
+	return s.get().NewProducer()
+}
+
+func (s *Switch) Produce(msgs ...*Message) error {
+	return s.get().Produce(msgs...)
+}
+
+// ProduceToPartitions fails if the current backend isn't a PartitionProducer.
+func (s *Switch) ProduceToPartitions(msgs ...*Message) error {
+	producer, ok := s.get().(PartitionProducer)
+	if !ok {
+		return ErrPartitionsUnsupported
+	}
+	return producer.ProduceToPartitions(msgs...)
+}
+
+func (s *Switch) CommittedOffsets(group, topic string, partitions []int32) (map[int32]int64, error) {
+	return s.get().CommittedOffsets(group, topic, partitions)
+}
+
+func (s *Switch) TopicConfig(topic string) (map[string]string, error) {
+	return s.get().TopicConfig(topic)
+}
+
+func (s *Switch) SetTopicConfig(topic string, entries map[string]string) error {
+	return s.get().SetTopicConfig(topic, entries)
+}
+
+func (s *Switch) Health(topics ...string) *ClusterHealth {
+	return s.get().Health(topics...)
+}
+
+func (s *Switch) Close() error {
+	return s.get().Close()
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"net"
+	"time"
+)
+
+// SetBandwidthLimit limits the bytes per second sent to the server by the next connections (no limit if
+// 0), so big transfers don't saturate a shared network.
+func (c *sync2KafkaClient) SetBandwidthLimit(bytesPerSecond int) {
+	c.bandwidth = bytesPerSecond
+}
+
+// limitedConn paces the writes to a maximum of bytes per second.
+type limitedConn struct {
+	net.Conn
+	rate int
+
+	start time.Time
+	sent  int64
+}
+
+func (c *limitedConn) Write(b []byte) (n int, err error) {
+	// write by chunks of 100ms, so the bandwidth is smooth even with big messages
+	chunk := c.rate / 10
+	if chunk == 0 {
+		chunk = 1
+	}
+
+	for len(b) != 0 {
+		part := b
+		if len(part) > chunk {
+			part = part[:chunk]
+		}
+
+		c.wait()
+
+		var written int
+		written, err = c.Conn.Write(part)
+		n += written
+		c.sent += int64(written)
+
+		if err != nil {
+			return
+		}
+
+		b = b[written:]
+	}
+
+	return
+}
+
+// wait sleeps until the bytes sent are within the rate.
+func (c *limitedConn) wait() {
+	now := time.Now()
+
+	next := c.start.Add(time.Duration(c.sent) * time.Second / time.Duration(c.rate))
+
+	if now.Sub(next) > time.Second {
+		// idle for a while, don't allow a burst to catch up
+		c.start = now
+		c.sent = 0
+		return
+	}
+
+	if d := next.Sub(now); d > 10*time.Millisecond {
+		time.Sleep(d)
+	}
+}
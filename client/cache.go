@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+
+	"github.com/boltdb/bolt"
+)
+
+// DiffCache is a local file keeping the hashes of the values of the last successful syncs, by topic, so
+// a client sends only the changed records, whatever the server supports.
+type DiffCache struct {
+	db *bolt.DB
+}
+
+// OpenDiffCache opens the cache file, creating it if needed.
+func OpenDiffCache(path string) (cache *DiffCache, err error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return
+	}
+
+	return &DiffCache{db: db}, nil
+}
+
+// Close closes the cache file.
+func (c *DiffCache) Close() error {
+	return c.db.Close()
+}
+
+// Reset forgets the hashes of the topic, so its next sync sends all the records.
+func (c *DiffCache) Reset(topic string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(cacheBucket(topic)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+func (c *DiffCache) unchanged(topic string, key []byte, hash []byte) (unchanged bool, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(cacheBucket(topic)); b != nil {
+			unchanged = string(b.Get(key)) == string(hash)
+		}
+		return nil
+	})
+	return
+}
+
+// save stores the hashes of a successful sync; they replace all the topic's hashes if replace is true.
+func (c *DiffCache) save(topic string, hashes map[string][]byte, replace bool) error {
+	return c.db.Update(func(tx *bolt.Tx) (err error) {
+		if replace {
+			if err = tx.DeleteBucket(cacheBucket(topic)); err != nil && err != bolt.ErrBucketNotFound {
+				return
+			}
+		}
+
+		b, err := tx.CreateBucketIfNotExists(cacheBucket(topic))
+		if err != nil {
+			return
+		}
+
+		for key, hash := range hashes {
+			if err = b.Put([]byte(key), hash); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+}
+
+func cacheHash(value []byte) []byte {
+	h := fnv.New64a()
+	h.Write(value)
+	hash := make([]byte, 8)
+	binary.BigEndian.PutUint64(hash, h.Sum64())
+	return hash
+}
+
+// cacheBucket returns the bucket of the topic's hashes; the topic may be empty (the server's default).
+func cacheBucket(topic string) []byte {
+	return []byte("topic:" + topic)
+}
+
+// cachedSync tracks the records of a sync using a DiffCache.
+type cachedSync struct {
+	cache   *DiffCache
+	hashes  map[string][]byte
+	skipped int64
+}
+
+// UseCache makes the client skip the records unchanged since the last successful sync of the topic
+// recorded in the cache, which is updated after a successful EndTransfer. The records of a sync with
+// DoDelete are all sent, since the server deletes the keys not sent, but they replace the cached ones.
+// ExpectedRecords can't be announced without DoDelete, as the skipped records are not sent.
+func (c *BinarySync2KafkaClient) UseCache(cache *DiffCache) error {
+	if c.syncInit.ExpectedRecords != 0 && !c.syncInit.DoDelete {
+		return errors.New("sync2KafkaClient can't announce the expected records with a cache")
+	}
+
+	c.cached = &cachedSync{cache: cache, hashes: map[string][]byte{}}
+	return nil
+}
+
+// Skipped returns the number of records not sent because they're unchanged in the cache.
+func (c *BinarySync2KafkaClient) Skipped() int64 {
+	if c.cached == nil {
+		return 0
+	}
+	return c.cached.skipped
+}
+
+// skip tells if the record is unchanged in the cache, or records its hash.
+func (c *BinarySync2KafkaClient) skip(kv BinaryKV) (skip bool, err error) {
+	cs := c.cached
+	hash := cacheHash(kv.Value)
+
+	if !c.syncInit.DoDelete {
+		if skip, err = cs.cache.unchanged(c.syncInit.Topic, kv.Key, hash); err != nil || skip {
+			if skip {
+				cs.skipped++
+			}
+			return
+		}
+	}
+
+	cs.hashes[string(kv.Key)] = hash
+	return
+}
+
+func (c *BinarySync2KafkaClient) saveCache() error {
+	cs := c.cached
+	if cs == nil {
+		return nil
+	}
+
+	defer func() { cs.hashes = map[string][]byte{} }()
+
+	return cs.cache.save(c.syncInit.Topic, cs.hashes, c.syncInit.DoDelete)
+}
@@ -1,11 +1,19 @@
 package client
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 type SyncInitInfo struct {
-	// Format of data. Can be `json` or `binary`.
+	// Format of data. Can be `json`, `binary`, `msgpack`, `cbor` or `gob`.
+	// If empty, the format is negotiated from Formats, or detected from the first values (msgpack or cbor only).
 	Format string `json:"format"`
 
+	// Formats accepted by the client, by preference order, when Format is empty.
+	// The server answers with a SyncResult giving the selected format.
+	Formats []string `json:"formats,omitempty"`
+
 	// DoDelete makes the sync delete unseen keys. No deletions if false (the default case).
 	DoDelete bool `json:"doDelete"`
 
@@ -14,20 +22,163 @@ type SyncInitInfo struct {
 
 	// Topic target topic if not default
 	Topic string `json:"topic"`
+
+	// Force bypasses the server's safety checks of syncs with deletions: the expected record count and
+	// the maximum percentage of deleted keys.
+	Force bool `json:"force,omitempty"`
+
+	// ClientName and ClientVersion identify the client in the server's logs, status and events (optional)
+	ClientName    string `json:"clientName,omitempty"`
+	ClientVersion string `json:"clientVersion,omitempty"`
+
+	// SessionID identifies the transfer so it can be resumed if interrupted (letters, digits, - and _,
+	// up to 64 characters; the server must have sessions enabled). A resumable transfer must send its
+	// records in the same order each time, and only the client's token can resume it.
+	SessionID string `json:"sessionId,omitempty"`
+
+	// ResumeSession asks to resume the transfer of SessionID. The server answers with a SyncResult giving
+	// the number of records to skip, 0 if the session can't be resumed.
+	ResumeSession bool `json:"resumeSession,omitempty"`
+
+	// ExpectedRecords is the number of records the client will send (optional), for the progress of the
+	// transfer in the server's status. A transfer ending with much less records is rejected as truncated,
+	// unless forced.
+	ExpectedRecords int64 `json:"expectedRecords,omitempty"`
+
+	// IdempotencyKey identifies the sync so retrying it is safe: if the sync of the topic with this key
+	// completed recently with the same token, the server answers its result instead of running it again.
+	// The server answers with a SyncResult after the init object, with Completed set in this case.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Multiplex turns the connection into a multiplexed one (see Multiplex); the other fields are ignored.
+	Multiplex bool `json:"multiplex,omitempty"`
+
+	// Info asks the server's ServerInfo instead of a transfer; the other fields are ignored.
+	Info bool `json:"info,omitempty"`
 }
 
 type SyncResult struct {
 	OK bool `json:"ok"`
+
+	// Warnings raised by the server during the sync
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Error is set when the sync failed or the connection was rejected
+	Error *Error `json:"error,omitempty"`
+
+	// Format selected by the server when the client gave Formats
+	Format string `json:"format,omitempty"`
+
+	// ResumeFrom is the number of records of the resumed session already received by the server, the
+	// skipped ones included
+	ResumeFrom int64 `json:"resumeFrom,omitempty"`
+
+	// Counts of the records by change, set at the end of a successful sync
+	Counts *SyncCounts `json:"counts,omitempty"`
+
+	// Completed is set when the sync of the idempotency key already completed; this is its result
+	Completed bool `json:"completed,omitempty"`
+
+	// Timings of the phases of the sync, set at its end
+	Timings *SyncTimings `json:"timings,omitempty"`
+
+	// Verification of the produced records, set at the end of a successful sync if the server verifies them
+	Verification *SyncVerification `json:"verification,omitempty"`
+
+	// Repartition is set when the partitions of the topic changed since its last sync
+	Repartition *SyncRepartition `json:"repartition,omitempty"`
+}
+
+// SyncRepartition reports a change of the number of partitions of the topic since its last sync.
+type SyncRepartition struct {
+	PreviousPartitions int `json:"previousPartitions"`
+	Partitions         int `json:"partitions"`
+	// PartitionAffinity is set when the partitions are synced in parallel, each with its own index.
+	// Without partition affinity, the records are also produced to the partition of their key's hash
+	// (the producers' default partitioner), but only the first partition is indexed.
+	PartitionAffinity bool `json:"partitionAffinity"`
+	// Reproduced is set when all the records of the sync were produced, unchanged ones included, to
+	// write them to the partition their key hashes to now (topics without partition affinity).
+	Reproduced bool `json:"reproduced,omitempty"`
+	// MovedDeleted is the number of records deleted from the partitions their key doesn't hash to
+	// anymore, before the sync (partition affinity with delete only).
+	MovedDeleted int `json:"movedDeleted,omitempty"`
+}
+
+// SyncVerification is the check of the records produced by a sync, read back from the topic.
+type SyncVerification struct {
+	// Checked is the number of produced records verified, all of them or a sample.
+	Checked int64 `json:"checked"`
+	// Missing records were not read back from the topic, Mismatched were read with another value.
+	Missing    int64 `json:"missing"`
+	Mismatched int64 `json:"mismatched"`
+	// Keys of some of the missing or mismatched records.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// SyncTimings are the durations of the phases of a sync, in milliseconds. The phases overlap: the
+// records are diffed and produced while the client sends them.
+type SyncTimings struct {
+	// Read is the transfer of the records by the client.
+	Read int64 `json:"readMs"`
+	// Index is the update of the topic's index, before the diff.
+	Index int64 `json:"indexMs"`
+	// Diff is the comparison of the records to the index, up to the last record.
+	Diff int64 `json:"diffMs"`
+	// Produce is the time taken to hand the messages to the producer, and to flush it.
+	Produce int64 `json:"produceMs"`
+	// Delete is the production of the deletions, after the last record.
+	Delete int64 `json:"deleteMs"`
+}
+
+// SyncCounts are the records of a sync by change. Unchanged records are not produced, and the Deleted
+// records are produced as tombstones.
+type SyncCounts struct {
+	Created   uint64 `json:"created"`
+	Modified  uint64 `json:"modified"`
+	Deleted   uint64 `json:"deleted"`
+	Unchanged uint64 `json:"unchanged"`
+
+	// DeletedPercent is the percentage of the topic's keys deleted.
+	DeletedPercent float64 `json:"deletedPercent,omitempty"`
 }
 
 type JsonKV struct {
 	Key           *json.RawMessage `json:"k"`
 	Value         *json.RawMessage `json:"v"`
 	EndOfTransfer bool             `json:"EOT"`
+
+	// Abort cancels the transfer; nothing more will be produced
+	Abort bool `json:"abort,omitempty"`
+
+	// Pause tells the server the client is waiting (ie: on its source); Resume or any value ends it
+	Pause  bool `json:"pause,omitempty"`
+	Resume bool `json:"resume,omitempty"`
+
+	// Timestamp of the record in the source system (optional)
+	Timestamp *time.Time `json:"ts,omitempty"`
+
+	// ExpiresAt is the time the record expires at, on the topics with expiry (optional). A change of the
+	// expiry alone doesn't produce the record again.
+	ExpiresAt *time.Time `json:"exp,omitempty"`
 }
 
 type BinaryKV struct {
 	Key           []byte `json:"k"`
 	Value         []byte `json:"v"`
 	EndOfTransfer bool   `json:"EOT"`
+
+	// Abort cancels the transfer; nothing more will be produced
+	Abort bool `json:"abort,omitempty"`
+
+	// Pause tells the server the client is waiting (ie: on its source); Resume or any value ends it
+	Pause  bool `json:"pause,omitempty"`
+	Resume bool `json:"resume,omitempty"`
+
+	// Timestamp of the record in the source system (optional)
+	Timestamp *time.Time `json:"ts,omitempty"`
+
+	// ExpiresAt is the time the record expires at, on the topics with expiry (optional). A change of the
+	// expiry alone doesn't produce the record again.
+	ExpiresAt *time.Time `json:"exp,omitempty"`
 }
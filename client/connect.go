@@ -7,8 +7,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/websocket"
 )
 
 type sync2KafkaClient struct {
@@ -19,14 +25,30 @@ type sync2KafkaClient struct {
 	target             string
 	conn               net.Conn
 	err                error
-	enc                *json.Encoder
+	enc                frameEncoder
 	dec                *json.Decoder
 	syncInit           *SyncInitInfo
+	resumeFrom         int64
+	counts             *SyncCounts
+	timings            *SyncTimings
+	verification       *SyncVerification
+	repartition        *SyncRepartition
+	completed          bool
+
+	// bandwidth is the maximum of bytes per second sent (no limit if 0)
+	bandwidth int
+
+	// dial opens the connection instead of connecting to target, if set
+	dial func(ctx context.Context) (net.Conn, error)
 }
 
 // BinarySync2KafkaClient communicates with sync2kafka with binary encoded messages
 type BinarySync2KafkaClient struct {
 	sync2KafkaClient
+
+	cached *cachedSync
+
+	noFormatFallback bool
 }
 
 type JsonSync2KafkaClient struct {
@@ -34,10 +56,19 @@ type JsonSync2KafkaClient struct {
 }
 
 // NewBinary creates a new binary client for sync2kafaka server  (uses []byte key value messages for input)
+// If config.Format is not a binary format, the format is negotiated with the server from config.Formats
+// (BinaryFormats by default, the most efficient first). The client falls back to the binary format,
+// supported by all the servers, if the server doesn't support the requested ones or doesn't negotiate
+// (see DisableFormatFallback).
 func NewBinary(config *SyncInitInfo, target string, insecureSkipVerify, useTls bool, caCert string) (client *BinarySync2KafkaClient) {
-	config.Format = "binary"
+	if !isBinaryFormat(config.Format) {
+		config.Format = ""
+	}
+	if len(config.Format) == 0 && len(config.Formats) == 0 {
+		config.Formats = BinaryFormats
+	}
 	return &BinarySync2KafkaClient{
-		*newSync2KafkaClient(useTls, insecureSkipVerify, caCert, target, config),
+		sync2KafkaClient: *newSync2KafkaClient(useTls, insecureSkipVerify, caCert, target, config),
 	}
 }
 
@@ -63,15 +94,32 @@ func newSync2KafkaClient(useTls bool, insecureSkipVerify bool, caCert string, ta
 	}
 }
 
+// Connect connects this sync2kafka client to a sync2kafka server. If the target is a ws:// or wss:// URL,
+// the connection is made over WebSocket.
+func (c *sync2KafkaClient) Connect(ctx context.Context) (err error) {
+	if c.dial != nil {
+		var conn net.Conn
+		if conn, err = c.dial(ctx); err != nil {
+			return
+		}
+
+		c.setConn(conn)
+		return
+	}
 
+	if strings.HasPrefix(c.target, "ws://") || strings.HasPrefix(c.target, "wss://") {
+		return c.connectWebSocket(ctx)
+	}
 
-// Connect connects this sync2kafka client to a sync2kafka server.
-func (c *sync2KafkaClient) Connect(ctx context.Context) (err error) {
 	var d net.Dialer
 
 	// connect to target
 	if !c.useTLS {
-		c.conn, err = d.DialContext(ctx, "tcp", c.target)
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", c.target); err != nil {
+			return
+		}
+		c.setConn(conn)
 	} else {
 		netConn, _ := d.DialContext(ctx, "tcp", c.target)
 		// tls handshake on open connection (with context)
@@ -82,13 +130,43 @@ func (c *sync2KafkaClient) Connect(ctx context.Context) (err error) {
 			log.Println("sync2KafkaClient could not connect using tls", err)
 			return
 		}
-		c.conn = conn
+		c.setConn(conn)
 	}
-	c.enc = json.NewEncoder(c.conn)
-	c.dec = json.NewDecoder(c.conn)
 	return
 }
 
+func (c *sync2KafkaClient) connectWebSocket(ctx context.Context) (err error) {
+	origin := "http" + strings.TrimPrefix(c.target, "ws")
+
+	config, err := websocket.NewConfig(c.target, origin)
+	if err != nil {
+		return
+	}
+
+	config.TlsConfig = genTLSConf(c)
+	config.TlsConfig.ServerName = config.Location.Hostname()
+
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+
+	c.setConn(ws)
+	return
+}
+
+// setConn makes the client use the connection, limiting its bandwidth if set.
+func (c *sync2KafkaClient) setConn(conn net.Conn) {
+	if c.bandwidth != 0 {
+		conn = &limitedConn{Conn: conn, rate: c.bandwidth}
+	}
+
+	c.conn = conn
+	c.enc = json.NewEncoder(c.conn)
+	c.dec = json.NewDecoder(c.conn)
+}
 
 func genTLSConf(c *sync2KafkaClient) (config *tls.Config) {
 	if c.insecureSkipVerify {
@@ -114,32 +192,205 @@ func genTLSConf(c *sync2KafkaClient) (config *tls.Config) {
 	return &tls.Config{
 		InsecureSkipVerify: c.insecureSkipVerify,
 		RootCAs:            rootCAs,
-		ServerName: c.target,
+		ServerName:         c.target,
 	}
 
 }
 
 // StartTransfer starts a data transfert session. Endtransfer() must be called after transferring all data
+// Servers older than the idempotency keys or the sessions don't answer the init object: the client
+// reconnects without them then.
 func (c *sync2KafkaClient) StartTransfer() (err error) {
+	err = c.startTransfer()
+	if err != errNoAnswer || len(c.syncInit.Format) == 0 || !c.dropAnsweredFeatures() {
+		return
+	}
+
+	log.Print("sync2KafkaClient: the server didn't answer the init request, reconnecting without the features it doesn't support")
+	return c.reconnect()
+}
+
+// dropAnsweredFeatures removes the features the server answers the init object for from it, returning
+// true if any was requested.
+func (c *sync2KafkaClient) dropAnsweredFeatures() (dropped bool) {
+	if len(c.syncInit.IdempotencyKey) != 0 {
+		c.syncInit.IdempotencyKey = ""
+		dropped = true
+	}
+	if c.syncInit.ResumeSession {
+		// the transfer starts from scratch
+		c.syncInit.ResumeSession = false
+		c.syncInit.SessionID = ""
+		dropped = true
+	}
+	return
+}
+
+// reconnect starts the transfer again on a new connection.
+func (c *sync2KafkaClient) reconnect() (err error) {
+	c.conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), fallbackConnectTimeout)
+	defer cancel()
+
+	if err = c.Connect(ctx); err != nil {
+		return
+	}
+
+	return c.startTransfer()
+}
+
+func (c *sync2KafkaClient) startTransfer() (err error) {
 	// initialize transfer
 	if err = c.enc.Encode(c.syncInit); err != nil {
 		return errors.New("sync2KafkaClient system init request error" + err.Error())
 	}
+
+	format := c.syncInit.Format
+	if (len(format) == 0 && len(c.syncInit.Formats) != 0) || c.syncInit.ResumeSession || len(c.syncInit.IdempotencyKey) != 0 {
+		// the server answers with the format to use and the records to skip, or the completed sync's result
+		result := SyncResult{}
+		if err = c.readAnswer(&result); err != nil {
+			return
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.Completed {
+			c.completed = true
+			c.counts = result.Counts
+			return
+		}
+
+		if len(format) == 0 {
+			format = result.Format
+		}
+		c.resumeFrom = result.ResumeFrom
+	}
+
+	if len(format) != 0 {
+		if c.enc, err = newFrameEncoder(format, c.conn); err != nil {
+			return
+		}
+	}
 	c.isTransfering = true
 	return
 }
 
+// answerTimeout is the time given to the server to answer the init object, when it has to.
+const answerTimeout = 30 * time.Second
+
+// errNoAnswer is returned when the server didn't answer the init object: servers older than the requested
+// features don't answer, or close the connection.
+var errNoAnswer = errors.New("sync2KafkaClient: no answer to the init request (server too old?)")
+
+// readAnswer reads the server's answer to the init object.
+func (c *sync2KafkaClient) readAnswer(result *SyncResult) (err error) {
+	c.conn.SetReadDeadline(time.Now().Add(answerTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	if err = c.dec.Decode(result); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() ||
+			err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, syscall.ECONNRESET) {
+			return errNoAnswer
+		}
+		return errors.New("sync2KafkaClient init response error " + err.Error())
+	}
+	return
+}
+
+// ResumeFrom returns the number of records the server already has when resuming a session, after
+// StartTransfer. The client must send the records following them.
+func (c *sync2KafkaClient) ResumeFrom() int64 {
+	return c.resumeFrom
+}
+
+// Completed returns true if the sync of the idempotency key already completed, after StartTransfer.
+// The values don't need to be sent: SendValue and EndTransfer do nothing, Counts are the completed sync's.
+func (c *sync2KafkaClient) Completed() bool {
+	return c.completed
+}
+
 // SendValue send one value in a Transfer session (after calling StartTransfer() and before calling EndTransfer()
 func (c *BinarySync2KafkaClient) SendValue(kv BinaryKV) (err error) {
-		if err = c.enc.Encode(kv); err != nil {
-			return errors.New("sync2KafkaClient request encoding error " + err.Error())
+	if c.completed {
+		return
+	}
+
+	if c.cached != nil && kv.Key != nil {
+		skip, err := c.skip(kv)
+		if err != nil || skip {
+			return err
 		}
+	}
+
+	if err = c.enc.Encode(kv); err != nil {
+		return c.serverError(errors.New("sync2KafkaClient request encoding error " + err.Error()))
+	}
 	return
 }
 
-// EndTransfer ends a data transfer session
+// Abort cancels a data transfer session; the server won't apply the remaining changes (especially deletions).
+func (c *BinarySync2KafkaClient) Abort() (err error) {
+	return c.abort(BinaryKV{Abort: true})
+}
+
+// Abort cancels a data transfer session; the server won't apply the remaining changes (especially deletions).
+func (c *JsonSync2KafkaClient) Abort() (err error) {
+	return c.abort(JsonKV{Abort: true})
+}
+
+func (c *sync2KafkaClient) abort(abort interface{}) (err error) {
+	if !c.isTransfering {
+		return
+	}
+
+	c.isTransfering = false
+
+	if err = c.enc.Encode(abort); err != nil {
+		return c.serverError(errors.New("sync2KafkaClient Abort request error " + err.Error()))
+	}
+
+	result := SyncResult{}
+	if err = c.dec.Decode(&result); err != nil {
+		return errors.New("sync2KafkaClient Abort response error " + err.Error())
+	}
+
+	if result.Error != nil && result.Error.Code != ErrAborted {
+		return result.Error
+	}
+
+	return
+}
+
+// Pause tells the server the transfer is paused, so it allows a longer silence.
+func (c *BinarySync2KafkaClient) Pause() error {
+	return c.enc.Encode(BinaryKV{Pause: true})
+}
+
+// Resume tells the server the transfer is resumed. Sending a value also resumes it.
+func (c *BinarySync2KafkaClient) Resume() error {
+	return c.enc.Encode(BinaryKV{Resume: true})
+}
+
+// Pause tells the server the transfer is paused, so it allows a longer silence.
+func (c *JsonSync2KafkaClient) Pause() error {
+	return c.enc.Encode(JsonKV{Pause: true})
+}
+
+// Resume tells the server the transfer is resumed. Sending a value also resumes it.
+func (c *JsonSync2KafkaClient) Resume() error {
+	return c.enc.Encode(JsonKV{Resume: true})
+}
+
+// EndTransfer ends a data transfer session, and updates the cache if any.
 func (c *BinarySync2KafkaClient) EndTransfer() (err error) {
-	return c.endTransfer(BinaryKV{EndOfTransfer: true})
+	if err = c.endTransfer(BinaryKV{EndOfTransfer: true}); err != nil || c.completed {
+		return
+	}
+
+	return c.saveCache()
 }
 
 // EndTransfer ends a data transfer session
@@ -147,25 +398,71 @@ func (c *JsonSync2KafkaClient) EndTransfer() (err error) {
 	return c.endTransfer(JsonKV{EndOfTransfer: true})
 }
 
-func (c *sync2KafkaClient) endTransfer(eof interface {}) (err error) {
+func (c *sync2KafkaClient) endTransfer(eof interface{}) (err error) {
+	if c.completed {
+		return
+	}
+
 	c.isTransfering = false
 
 	// end transfer
 	if err = c.enc.Encode(eof); err != nil {
-		return errors.New("sync2KafkaClient EndOfTransfer request error " + err.Error())
+		return c.serverError(errors.New("sync2KafkaClient EndOfTransfer request error " + err.Error()))
 	}
 	result := SyncResult{}
 	if err = c.dec.Decode(&result); err != nil {
 		return errors.New("sync2KafkaClient EndOfTransfer response error " + err.Error())
 	}
+	if result.Error != nil {
+		return result.Error
+	}
 	if !result.OK {
 		return fmt.Errorf("sync2KafkaClient result from sync2kafka server is not ok : %v", result)
 	}
 
+	c.counts = result.Counts
+	c.timings = result.Timings
+	c.verification = result.Verification
+	c.repartition = result.Repartition
 	return
 }
 
+// Counts returns the records of the sync by change, after a successful EndTransfer (nil if the server
+// doesn't report them).
+func (c *sync2KafkaClient) Counts() *SyncCounts {
+	return c.counts
+}
+
+// Timings returns the durations of the sync's phases, after a successful EndTransfer (nil if the server
+// doesn't report them).
+func (c *sync2KafkaClient) Timings() *SyncTimings {
+	return c.timings
+}
+
+// Verification returns the check of the produced records, after a successful EndTransfer (nil if the
+// server doesn't verify them).
+func (c *sync2KafkaClient) Verification() *SyncVerification {
+	return c.verification
+}
 
+// Repartition returns the change of the topic's partitions since its last sync, after a successful
+// EndTransfer (nil if they didn't change).
+func (c *sync2KafkaClient) Repartition() *SyncRepartition {
+	return c.repartition
+}
+
+// serverError returns the error sent by the server before closing the connection, if any, or err.
+func (c *sync2KafkaClient) serverError(err error) error {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	result := SyncResult{}
+	if c.dec.Decode(&result) == nil && result.Error != nil {
+		return result.Error
+	}
+
+	return err
+}
 
 func (c *JsonSync2KafkaClient) Close() error {
 	if c.isTransfering {
@@ -183,4 +480,4 @@ func (c *BinarySync2KafkaClient) Close() error {
 
 func (c *sync2KafkaClient) Close() error {
 	return c.conn.Close()
-}
\ No newline at end of file
+}
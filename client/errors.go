@@ -0,0 +1,40 @@
+package client
+
+import "fmt"
+
+// Error codes sent by the server.
+const (
+	ErrBadRequest      = "bad-request"
+	ErrUnauthorized    = "unauthorized"
+	ErrUnknownFormat   = "unknown-format"
+	ErrNoTopic         = "no-topic"
+	ErrTopicNotAllowed = "topic-not-allowed"
+	ErrTopicLocked     = "topic-locked"
+	ErrConsumerLag     = "consumer-lag"
+	ErrSyncFailed      = "sync-failed"
+	ErrAborted         = "aborted"
+	ErrRecordTooLarge  = "record-too-large"
+	ErrInvalidRecord   = "invalid-record"
+	ErrDuplicateKey    = "duplicate-key"
+	ErrDatasetSize     = "dataset-size"
+	ErrTruncated       = "truncated"
+	ErrTooManyDeletes  = "too-many-deletes"
+	ErrShuttingDown    = "shutting-down"
+	ErrCanaryRejected  = "canary-rejected"
+)
+
+// Error is an error reported by the server.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("sync2kafka server error (%s): %s", e.Code, e.Message)
+}
+
+// IsErrorCode returns true if err is a server error with the given code.
+func IsErrorCode(err error, code string) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"log"
+	"time"
+)
+
+// fallbackFormat is the format supported by all the servers: the "binary" format is JSON objects with
+// the keys and values base64 encoded.
+const fallbackFormat = "binary"
+
+const fallbackConnectTimeout = 10 * time.Second
+
+// DisableFormatFallback makes the transfer fail if the server doesn't support the requested formats,
+// instead of falling back to the binary format.
+func (c *BinarySync2KafkaClient) DisableFormatFallback() {
+	c.noFormatFallback = true
+}
+
+// StartTransfer starts a data transfert session. Endtransfer() must be called after transferring all data.
+// A requested format other than binary is negotiated with the binary format as fallback; if the server
+// reports none of the negotiated formats supported, or doesn't answer the negotiation (servers before it),
+// the client reconnects with the binary format, not negotiated.
+func (c *BinarySync2KafkaClient) StartTransfer() (err error) {
+	if c.noFormatFallback {
+		return c.sync2KafkaClient.StartTransfer()
+	}
+
+	if format := c.syncInit.Format; len(format) != 0 && format != fallbackFormat {
+		c.syncInit.Format = ""
+		c.syncInit.Formats = []string{format, fallbackFormat}
+	}
+
+	err = c.sync2KafkaClient.StartTransfer()
+	if len(c.syncInit.Formats) == 0 {
+		return
+	}
+
+	switch {
+	case IsErrorCode(err, ErrUnknownFormat):
+		log.Printf("sync2KafkaClient: the server supports none of the formats %q, falling back to %s", c.syncInit.Formats, fallbackFormat)
+	case err == errNoAnswer:
+		log.Printf("sync2KafkaClient: the server didn't negotiate the format, falling back to %s", fallbackFormat)
+	default:
+		return
+	}
+
+	if err == errNoAnswer {
+		// the server is older than the negotiation, so than the other answered features
+		c.dropAnsweredFeatures()
+	}
+
+	c.syncInit.Format = fallbackFormat
+	c.syncInit.Formats = nil
+
+	return c.reconnect()
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//go:generate go run ../cmd/s2kclient fixtures -o ../protocol/fixtures
+
+// Senders of the protocol messages.
+const (
+	SenderClient = "client"
+	SenderServer = "server"
+)
+
+// ProtocolFixture is an example message of the sync protocol, marshaled from the Go types, so clients in
+// other languages can check they read and write the same JSON.
+type ProtocolFixture struct {
+	Name    string      `json:"name"`
+	Sender  string      `json:"sender"`
+	Doc     string      `json:"doc"`
+	Message interface{} `json:"message"`
+}
+
+// ProtocolFixtures returns the examples of the messages of the protocol, in the order of a transfer.
+func ProtocolFixtures() []ProtocolFixture {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	jsonKey := json.RawMessage(`"user-1"`)
+	jsonValue := json.RawMessage(`{"name":"Alice","age":42}`)
+
+	return []ProtocolFixture{
+		{
+			Name: "init-json", Sender: SenderClient,
+			Doc: "first message of a transfer of JSON records, deleting the keys not sent",
+			Message: SyncInitInfo{
+				Format:        "json",
+				DoDelete:      true,
+				Token:         "secret",
+				Topic:         "users",
+				ClientName:    "example",
+				ClientVersion: "1.0.0",
+			},
+		},
+		{
+			Name: "init-negotiate", Sender: SenderClient,
+			Doc: "first message of a transfer negotiating its format; the server answers with result-negotiated",
+			Message: SyncInitInfo{
+				Formats:         []string{"msgpack", "binary"},
+				Token:           "secret",
+				Topic:           "users",
+				ExpectedRecords: 1000,
+			},
+		},
+		{
+			Name: "init-resume", Sender: SenderClient,
+			Doc: "first message of a resumable transfer; the server answers with result-resume",
+			Message: SyncInitInfo{
+				Format:        "binary",
+				Topic:         "users",
+				SessionID:     "daily-users",
+				ResumeSession: true,
+			},
+		},
+		{
+			Name: "init-idempotent", Sender: SenderClient,
+			Doc: "first message of a transfer with an idempotency key; the server answers with result-completed if it already completed, or an empty result",
+			Message: SyncInitInfo{
+				Format:         "binary",
+				Topic:          "users",
+				IdempotencyKey: "users-2020-01-02",
+			},
+		},
+		{
+			Name: "result-negotiated", Sender: SenderServer,
+			Doc:     "answer to init-negotiate: the next messages use the format",
+			Message: SyncResult{OK: true, Format: "binary"},
+		},
+		{
+			Name: "result-resume", Sender: SenderServer,
+			Doc:     "answer to init-resume: the client skips the records the server already has",
+			Message: SyncResult{OK: true, ResumeFrom: 500},
+		},
+		{
+			Name: "result-completed", Sender: SenderServer,
+			Doc:     "answer to init-idempotent when the sync already completed: the transfer ends",
+			Message: SyncResult{OK: true, Completed: true, Counts: &SyncCounts{Created: 1, Unchanged: 999}},
+		},
+		{
+			Name: "record-json", Sender: SenderClient,
+			Doc:     "a record in the json format: the key and value are any JSON",
+			Message: JsonKV{Key: &jsonKey, Value: &jsonValue},
+		},
+		{
+			Name: "record-binary", Sender: SenderClient,
+			Doc:     "a record in the binary format: the key and value are base64 encoded bytes",
+			Message: BinaryKV{Key: []byte("user-1"), Value: []byte(`{"name":"Alice","age":42}`), Timestamp: &ts},
+		},
+		{
+			Name: "pause", Sender: SenderClient,
+			Doc:     "the client waits for its source, the server allows a longer silence",
+			Message: BinaryKV{Pause: true},
+		},
+		{
+			Name: "resume", Sender: SenderClient,
+			Doc:     "the client sends records again (any record also resumes the transfer)",
+			Message: BinaryKV{Resume: true},
+		},
+		{
+			Name: "end-of-transfer", Sender: SenderClient,
+			Doc:     "all the records were sent; the server answers with the result of the sync",
+			Message: BinaryKV{EndOfTransfer: true},
+		},
+		{
+			Name: "abort", Sender: SenderClient,
+			Doc:     "the transfer is cancelled; the server answers with result-aborted",
+			Message: BinaryKV{Abort: true},
+		},
+		{
+			Name: "result-success", Sender: SenderServer,
+			Doc: "result of a successful sync",
+			Message: SyncResult{
+				OK:       true,
+				Warnings: []string{"2 messages retried after produce errors"},
+				Counts:   &SyncCounts{Created: 10, Modified: 5, Deleted: 1, Unchanged: 984, DeletedPercent: 0.1},
+				Timings:  &SyncTimings{Read: 1200, Index: 300, Diff: 1150, Produce: 80, Delete: 5},
+			},
+		},
+		{
+			Name: "result-aborted", Sender: SenderServer,
+			Doc:     "answer to abort",
+			Message: SyncResult{Error: &Error{Code: ErrAborted, Message: "transfer aborted"}},
+		},
+		{
+			Name: "result-error", Sender: SenderServer,
+			Doc:     "a rejected connection or failed sync; the server closes the connection",
+			Message: SyncResult{Error: &Error{Code: ErrUnauthorized, Message: "authentication failed: wrong token"}},
+		},
+		{
+			Name: "init-info", Sender: SenderClient,
+			Doc:     "first message asking the server's build and features instead of a transfer; the server answers with server-info",
+			Message: SyncInitInfo{Info: true},
+		},
+		{
+			Name: "server-info", Sender: SenderServer,
+			Doc: "answer to init-info; the server closes the connection",
+			Message: ServerInfo{
+				Version:          "1.2.3",
+				Commit:           "0123abc",
+				GoVersion:        "go1.13.3",
+				ProtocolVersions: []int{ProtocolVersion},
+				Formats:          []string{"msgpack", "cbor", "gob", "binary", "json"},
+				Features:         []string{FeatureMultiplex, FeatureIdempotency, FeatureTLS},
+			},
+		},
+	}
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ugorji/go/codec"
+)
+
+// BinaryFormats are the formats a binary client negotiates by default, the most efficient first.
+// The "gob" format is also supported but must be explicitly requested, as it's only for Go clients.
+var BinaryFormats = []string{"msgpack", "binary"}
+
+func isBinaryFormat(format string) bool {
+	switch format {
+	case "binary", "msgpack", "cbor", "gob":
+		return true
+	}
+	return false
+}
+
+var (
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+)
+
+type frameEncoder interface {
+	Encode(v interface{}) error
+}
+
+func newFrameEncoder(format string, w io.Writer) (enc frameEncoder, err error) {
+	switch format {
+	case "json", "binary":
+		enc = json.NewEncoder(w)
+
+	case "msgpack":
+		enc = codec.NewEncoder(w, msgpackHandle)
+
+	case "cbor":
+		enc = codec.NewEncoder(w, cborHandle)
+
+	case "gob":
+		enc = gob.NewEncoder(w)
+
+	default:
+		err = fmt.Errorf("unsupported format %q", format)
+	}
+
+	return
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Multiplexer runs several transfers over one connection to the server, each transfer having its own
+// stream and init object (so its own topic and token).
+type Multiplexer struct {
+	conn    *sync2KafkaClient
+	session *yamux.Session
+}
+
+// Multiplex connects to a sync2kafka server and turns the connection into a multiplexed one.
+func Multiplex(ctx context.Context, target string, insecureSkipVerify, useTls bool, caCert string) (m *Multiplexer, err error) {
+	c := newSync2KafkaClient(useTls, insecureSkipVerify, caCert, target, &SyncInitInfo{Multiplex: true})
+
+	if err = c.Connect(ctx); err != nil {
+		return
+	}
+
+	if err = c.enc.Encode(c.syncInit); err != nil {
+		c.Close()
+		return
+	}
+
+	result := SyncResult{}
+	if err = c.dec.Decode(&result); err != nil {
+		c.Close()
+		return nil, errors.New("sync2KafkaClient multiplex response error " + err.Error())
+	}
+
+	if result.Error != nil {
+		c.Close()
+		return nil, result.Error
+	}
+
+	session, err := yamux.Client(c.conn, nil)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	return &Multiplexer{conn: c, session: session}, nil
+}
+
+// NewBinary creates a binary client transferring over a stream of the connection (see NewBinary).
+func (m *Multiplexer) NewBinary(config *SyncInitInfo) (client *BinarySync2KafkaClient) {
+	client = NewBinary(config, "", false, false, "")
+	client.dial = m.openStream
+	return
+}
+
+// NewJson creates a json client transferring over a stream of the connection (see NewJson).
+func (m *Multiplexer) NewJson(config *SyncInitInfo) (client *JsonSync2KafkaClient) {
+	client = NewJson(config, "", false, false, "")
+	client.dial = m.openStream
+	return
+}
+
+func (m *Multiplexer) openStream(ctx context.Context) (net.Conn, error) {
+	return m.session.Open()
+}
+
+// Close closes the connection, and all its streams.
+func (m *Multiplexer) Close() error {
+	m.session.Close()
+	return m.conn.Close()
+}
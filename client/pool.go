@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Pool keeps multiplexed connections to a server, spreading the transfers of its clients over them.
+// Connections are opened when first needed and reopened when lost, so the TLS handshakes are done once
+// for many transfers. Transfers are authenticated by their own init objects, as with a Multiplexer.
+type Pool struct {
+	target             string
+	insecureSkipVerify bool
+	useTLS             bool
+	caCert             string
+
+	conns  []*Multiplexer
+	next   int
+	closed bool
+	mutex  sync.Mutex
+}
+
+// ErrPoolClosed is returned by the clients of a closed pool.
+var ErrPoolClosed = errors.New("sync2kafka client pool is closed")
+
+// NewPool creates a pool of size connections to a sync2kafka server (1 if size < 1).
+func NewPool(target string, insecureSkipVerify, useTls bool, caCert string, size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Pool{
+		target:             target,
+		insecureSkipVerify: insecureSkipVerify,
+		useTLS:             useTls,
+		caCert:             caCert,
+		conns:              make([]*Multiplexer, size),
+	}
+}
+
+// NewBinary creates a binary client transferring over a connection of the pool (see NewBinary).
+func (p *Pool) NewBinary(config *SyncInitInfo) (client *BinarySync2KafkaClient) {
+	client = NewBinary(config, "", false, false, "")
+	client.dial = p.openStream
+	return
+}
+
+// NewJson creates a json client transferring over a connection of the pool (see NewJson).
+func (p *Pool) NewJson(config *SyncInitInfo) (client *JsonSync2KafkaClient) {
+	client = NewJson(config, "", false, false, "")
+	client.dial = p.openStream
+	return
+}
+
+// openStream opens a stream on the next connection, reconnecting it if it was lost.
+func (p *Pool) openStream(ctx context.Context) (conn net.Conn, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	idx := p.next
+	p.next = (p.next + 1) % len(p.conns)
+
+	if m := p.conns[idx]; m != nil {
+		if conn, err = m.session.Open(); err == nil {
+			return
+		}
+
+		// lost, reconnect
+		m.Close()
+		p.conns[idx] = nil
+	}
+
+	m, err := Multiplex(ctx, p.target, p.insecureSkipVerify, p.useTLS, p.caCert)
+	if err != nil {
+		return
+	}
+
+	p.conns[idx] = m
+	return m.session.Open()
+}
+
+// Close closes the connections of the pool, and all their streams.
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+
+	for idx, m := range p.conns {
+		if m != nil {
+			m.Close()
+			p.conns[idx] = nil
+		}
+	}
+
+	return nil
+}
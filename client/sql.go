@@ -0,0 +1,97 @@
+package client
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// SendRows sends the rows of a query: the value of keyColumn is the record's key, and the row marshaled
+// as a JSON object of its columns is the value. []byte columns are sent as strings. The rows are not
+// closed. It returns the number of rows sent.
+func (c *BinarySync2KafkaClient) SendRows(rows *sql.Rows, keyColumn string) (count int64, err error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return
+	}
+
+	keyIdx := -1
+	for idx, column := range columns {
+		if column == keyColumn {
+			keyIdx = idx
+		}
+	}
+
+	if keyIdx == -1 {
+		return 0, fmt.Errorf("key column %q not in the rows", keyColumn)
+	}
+
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for idx := range values {
+		dest[idx] = &values[idx]
+	}
+
+	return c.SendScanned(rows, func(rows *sql.Rows) (key []byte, value interface{}, err error) {
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for idx, column := range columns {
+			v := values[idx]
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			row[column] = v
+		}
+
+		return rowKey(values[keyIdx]), row, nil
+	})
+}
+
+// SendScanned sends the rows of a query, scanned by scan into a key and a value marshaled to JSON (ie: a
+// struct with json tags). The rows are not closed. It returns the number of rows sent.
+func (c *BinarySync2KafkaClient) SendScanned(rows *sql.Rows, scan func(rows *sql.Rows) (key []byte, value interface{}, err error)) (count int64, err error) {
+	for rows.Next() {
+		key, value, err := scan(rows)
+		if err != nil {
+			return count, err
+		}
+
+		if key == nil {
+			return count, fmt.Errorf("row %d has no key", count+1)
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return count, fmt.Errorf("failed to marshal row %d: %v", count+1, err)
+		}
+
+		if err = c.SendValue(BinaryKV{Key: key, Value: data}); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	err = rows.Err()
+	return
+}
+
+// rowKey returns the key of a column value (nil if NULL).
+func rowKey(v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	case int64:
+		return []byte(strconv.FormatInt(v, 10))
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+// Version and Commit identify the build, set with -ldflags "-X github.com/mcluseau/sync2kafka/client.Version=..."
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// BuildVersion returns the Version with the Commit, if set.
+func BuildVersion() string {
+	if len(Commit) == 0 {
+		return Version
+	}
+	return Version + " (" + Commit + ")"
+}
+
+// ProtocolVersion is the version of the sync protocol implemented by this package. It changes when the
+// messages change incompatibly; compatible additions keep it.
+const ProtocolVersion = 1
+
+// Features a server can have enabled, listed in its ServerInfo.
+const (
+	FeatureMultiplex     = "multiplex"
+	FeatureSessions      = "sessions"
+	FeatureIdempotency   = "idempotency"
+	FeatureVerification  = "verification"
+	FeatureTLS           = "tls"
+	FeatureVirtualHosts  = "virtual-hosts"
+	FeatureAuthWebhook   = "auth-webhook"
+	FeaturePriorities    = "priorities"
+	FeatureStore         = "store"
+	FeatureRecordSamples = "record-samples"
+)
+
+// ServerInfo describes the build and features of a server. The server answers with it to a SyncInitInfo
+// with Info set, and its HTTP API at /version.
+type ServerInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"goVersion"`
+
+	// ProtocolVersions are the versions of the sync protocol supported by the server.
+	ProtocolVersions []int `json:"protocolVersions"`
+
+	// Formats supported by the server, the most efficient first.
+	Formats []string `json:"formats"`
+
+	// Features enabled on the server (Feature* constants).
+	Features []string `json:"features"`
+}
+
+// ServerInfo asks the server's build and features instead of a transfer, after Connect. The server
+// closes the connection after answering. The servers without Info support reject the request with an
+// error, returned as is.
+func (c *sync2KafkaClient) ServerInfo() (info *ServerInfo, err error) {
+	if err = c.enc.Encode(SyncInitInfo{Info: true}); err != nil {
+		return nil, c.serverError(err)
+	}
+
+	answer := struct {
+		ServerInfo
+		Error *Error `json:"error,omitempty"`
+	}{}
+
+	if err = c.dec.Decode(&answer); err != nil {
+		return nil, err
+	}
+
+	if answer.Error != nil {
+		return nil, answer.Error
+	}
+
+	return &answer.ServerInfo, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+func benchCommand(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	records := flags.Int("records", 100000, "Number of records (distinct keys) in the dataset")
+	keySize := flags.Int("key-size", 16, "Key size in bytes")
+	valueSize := flags.Int("value-size", 256, "Value size in bytes")
+	changeRatio := flags.Float64("change-ratio", 0.1, "Ratio of values changed between runs")
+	runs := flags.Int("runs", 3, "Number of syncs to run")
+	doDelete := flags.Bool("delete", false, "Sync with deletions")
+	seed := flags.Int64("seed", 1, "Random seed (same seed, same dataset)")
+
+	flags.Parse(args)
+
+	rnd := rand.New(rand.NewSource(*seed))
+
+	dataset := make([]client.BinaryKV, *records)
+	for i := range dataset {
+		key := make([]byte, *keySize)
+		copy(key, fmt.Sprintf("%0*d", *keySize, i))
+
+		dataset[i] = client.BinaryKV{Key: key, Value: randomBytes(rnd, *valueSize)}
+	}
+
+	roundTrips := make([]time.Duration, 0, *runs)
+
+	for run := 1; run <= *runs; run++ {
+		if run > 1 {
+			for i := range dataset {
+				if rnd.Float64() < *changeRatio {
+					dataset[i].Value = randomBytes(rnd, *valueSize)
+				}
+			}
+		}
+
+		result := benchRun(dataset, *doDelete)
+
+		log.Printf("run %d/%d: %d records in %v (%.0f records/s, %.1f MB/s)", run, *runs,
+			len(dataset), result.total, float64(len(dataset))/result.total.Seconds(),
+			float64(len(dataset)*(*keySize+*valueSize))/result.total.Seconds()/1e6)
+		log.Printf("run %d/%d: write latency (not acknowledged) p50=%v p90=%v p99=%v max=%v, end of transfer to result=%v", run, *runs,
+			percentile(result.writeLatencies, 0.5), percentile(result.writeLatencies, 0.9),
+			percentile(result.writeLatencies, 0.99), percentile(result.writeLatencies, 1), result.finalization)
+
+		roundTrips = append(roundTrips, result.total)
+	}
+
+	sortDurations(roundTrips)
+
+	log.Printf("sync round-trip (start to result) over %d runs: p50=%v p90=%v p99=%v max=%v", len(roundTrips),
+		percentile(roundTrips, 0.5), percentile(roundTrips, 0.9), percentile(roundTrips, 0.99), percentile(roundTrips, 1))
+}
+
+func randomBytes(rnd *rand.Rand, size int) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	ba := make([]byte, size)
+	for i := range ba {
+		ba[i] = letters[rnd.Intn(len(letters))]
+	}
+	return ba
+}
+
+type benchResult struct {
+	// writeLatencies are the times to write each record to the connection. The protocol doesn't
+	// acknowledge records, only the sync: its round-trip is the total.
+	writeLatencies []time.Duration
+	finalization   time.Duration
+	total          time.Duration
+}
+
+// percentile returns the p-th percentile (0 to 1) of the sorted durations.
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	idx := int(p * float64(len(durations)-1))
+	return durations[idx]
+}
+
+func sortDurations(durations []time.Duration) {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+}
+
+func benchRun(dataset []client.BinaryKV, doDelete bool) (result benchResult) {
+	c := connect(doDelete)
+	defer c.Close()
+
+	// measure the requested format only
+	c.DisableFormatFallback()
+
+	start := time.Now()
+
+	if err := c.StartTransfer(); err != nil {
+		log.Fatal(err)
+	}
+
+	result.writeLatencies = make([]time.Duration, len(dataset))
+
+	for i, kv := range dataset {
+		writeStart := time.Now()
+
+		if err := c.SendValue(kv); err != nil {
+			log.Fatal(err)
+		}
+
+		result.writeLatencies[i] = time.Since(writeStart)
+	}
+
+	endStart := time.Now()
+
+	if err := c.EndTransfer(); err != nil {
+		log.Fatal(err)
+	}
+
+	result.finalization = time.Since(endStart)
+	result.total = time.Since(start)
+
+	sortDurations(result.writeLatencies)
+
+	return
+}
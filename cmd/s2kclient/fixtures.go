@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+// fixturesCommand writes the protocol fixtures, one JSON file each.
+func fixturesCommand(args []string) {
+	flags := flag.NewFlagSet("fixtures", flag.ExitOnError)
+	output := flags.String("o", "protocol/fixtures", "Output directory")
+
+	flags.Parse(args)
+
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, fixture := range client.ProtocolFixtures() {
+		data, err := json.MarshalIndent(fixture, "", "  ")
+		if err != nil {
+			log.Fatalf("fixture %s: %v", fixture.Name, err)
+		}
+
+		if err = ioutil.WriteFile(filepath.Join(*output, fixture.Name+".json"), append(data, '\n'), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 
 	//"bufio"
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"time"
@@ -20,13 +22,22 @@ import (
 )
 
 var (
-	useTls     = flag.Bool("use-tls", false, "use TLS connection")
-	skipVerify     = flag.Bool("skip-tls-verify", false, "skip tls verification")
-	tlsCertPath     = flag.String("tls-cert", "", "TLS certificate path (required if key is set)")
-	token             = flag.String("token", "", "sync2kafka server token")
-	server  = flag.String("server", ":9084", "sync2kafka server url")
-	topic             = flag.String("topic", "sync2kafka", "destination topic")
-	sep             = flag.String("separator", " ", "key/value separator (default is space)")
+	useTls      = flag.Bool("use-tls", false, "use TLS connection")
+	skipVerify  = flag.Bool("skip-tls-verify", false, "skip tls verification")
+	tlsCertPath = flag.String("tls-cert", "", "TLS certificate path (required if key is set)")
+	token       = flag.String("token", "", "sync2kafka server token")
+	server      = flag.String("server", ":9084", "sync2kafka server address, or ws:// or wss:// URL to connect over WebSocket")
+	topic       = flag.String("topic", "sync2kafka", "destination topic")
+	sep         = flag.String("separator", " ", "key/value separator (default is space)")
+	format      = flag.String("format", "", "transfer format (binary, msgpack, cbor or gob; negotiated with the server if empty, binary if the server doesn't support it)")
+	clientName  = flag.String("client-name", "s2kclient", "client name reported to the server")
+	force       = flag.Bool("force", false, "bypass the server's safety checks of syncs with deletions")
+	sessionID   = flag.String("session-id", "", "session ID to resume the transfer if interrupted (the input must be the same, in the same order)")
+	idemKey     = flag.String("idempotency-key", "", "key identifying the sync, so a retry of a completed sync returns its result without running it again")
+	expected    = flag.Int64("expected-records", 0, "number of records in the input, so the server reports the progress and rejects a truncated transfer (unknown if 0)")
+	cachePath   = flag.String("cache", "", "local cache file of the last synced values, to send only the changed records")
+	bandwidth   = flag.Int("bandwidth-limit", 0, "maximum bytes per second sent to the server (no limit if 0)")
+	showVersion = flag.Bool("version", false, "print the version and exit")
 
 	s2klient *client.BinarySync2KafkaClient
 )
@@ -35,37 +46,55 @@ func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(client.BuildVersion())
+		return
+	}
+
 	SetupCloseHandler()
 
-	// read cert
-	var crt string
-	if tlsCertPath != nil {
-		crtBytes, err := ioutil.ReadFile(*tlsCertPath)
-		if err != nil {
-			log.Fatal(err)
+	if flag.NArg() != 0 {
+		switch flag.Arg(0) {
+		case "bench":
+			benchCommand(flag.Args()[1:])
+		case "info":
+			infoCommand()
+		case "fixtures":
+			fixturesCommand(flag.Args()[1:])
+		default:
+			log.Fatalf("unknown command %q", flag.Arg(0))
 		}
-		crt = string(crtBytes)
+		return
 	}
 
-	s2klient = client.NewBinary(&client.SyncInitInfo{
-		Format:   "",
-		DoDelete: false,
-		Token:    *token,
-		Topic:    *topic,
-	}, *server, *skipVerify, *useTls, crt)
+	s2klient = connect(false)
 
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
-	err := s2klient.Connect(ctx)
+	if len(*cachePath) != 0 {
+		cache, err := client.OpenDiffCache(*cachePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cache.Close()
 
-	if err != nil {
-		log.Fatal(err)
+		if err = s2klient.UseCache(cache); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	if err = s2klient.StartTransfer(); err != nil{
+	if err := s2klient.StartTransfer(); err != nil {
 		log.Fatal(err)
 	}
 
-	for ; ;  {
+	skip := s2klient.ResumeFrom()
+	if skip != 0 {
+		log.Printf("resuming the session after %d records", skip)
+	}
+
+	if s2klient.Completed() {
+		log.Print("sync already completed with this idempotency key")
+	}
+
+	for !s2klient.Completed() {
 		scanner := bufio.NewScanner(os.Stdin)
 		scanner.Scan()
 		keyvalue := scanner.Text()
@@ -75,23 +104,103 @@ func main() {
 			break
 		}
 
+		if skip != 0 {
+			skip--
+			continue
+		}
+
 		kv := client.BinaryKV{
-			Key:           []byte(keyvalueSplit[0]),
-			Value:         []byte(keyvalueSplit[1]),
+			Key:   []byte(keyvalueSplit[0]),
+			Value: []byte(keyvalueSplit[1]),
 		}
 
-		if err = s2klient.SendValue(kv); err != nil{
+		if err := s2klient.SendValue(kv); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := s2klient.EndTransfer(); err != nil {
+		log.Fatal(err)
+	}
+
+	if skipped := s2klient.Skipped(); skipped != 0 {
+		log.Printf("%d unchanged records not sent (cache)", skipped)
+	}
+
+	if counts := s2klient.Counts(); counts != nil {
+		log.Printf("%d created, %d modified, %d deleted, %d unchanged", counts.Created, counts.Modified, counts.Deleted, counts.Unchanged)
+	}
+
+	if t := s2klient.Timings(); t != nil {
+		log.Printf("timings: read %dms, index %dms, diff %dms, produce %dms, delete %dms", t.Read, t.Index, t.Diff, t.Produce, t.Delete)
+	}
+
+	if v := s2klient.Verification(); v != nil {
+		log.Printf("verification: %d checked, %d missing, %d mismatched", v.Checked, v.Missing, v.Mismatched)
+	}
+
+	if r := s2klient.Repartition(); r != nil {
+		log.Printf("repartition: %d partitions, %d at the last sync (partition affinity: %v, moved records deleted: %d)",
+			r.Partitions, r.PreviousPartitions, r.PartitionAffinity, r.MovedDeleted)
+	}
+
+	if err := s2klient.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// connect creates a binary client from the flags and connects it, with a 2 seconds timeout.
+func connect(doDelete bool) *client.BinarySync2KafkaClient {
+	// read cert
+	var crt string
+	if len(*tlsCertPath) != 0 {
+		crtBytes, err := ioutil.ReadFile(*tlsCertPath)
+		if err != nil {
 			log.Fatal(err)
 		}
+		crt = string(crtBytes)
 	}
 
-	if err = s2klient.EndTransfer(); err != nil {
+	c := client.NewBinary(&client.SyncInitInfo{
+		Format:     *format,
+		DoDelete:   doDelete,
+		Token:      *token,
+		Topic:      *topic,
+		ClientName: *clientName,
+		Force:      *force,
+
+		SessionID:     *sessionID,
+		ResumeSession: len(*sessionID) != 0,
+
+		IdempotencyKey:  *idemKey,
+		ExpectedRecords: *expected,
+	}, *server, *skipVerify, *useTls, crt)
+
+	c.SetBandwidthLimit(*bandwidth)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := c.Connect(ctx); err != nil {
 		log.Fatal(err)
 	}
 
-	if err = s2klient.Close(); err != nil {
+	return c
+}
+
+// infoCommand prints the build and features of the server.
+func infoCommand() {
+	c := connect(false)
+	defer c.Close()
+
+	info, err := c.ServerInfo()
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(info)
 }
 
 func SetupCloseHandler() {
@@ -101,10 +210,12 @@ func SetupCloseHandler() {
 	go func() {
 		<-c
 		if s2klient != nil {
-			if err := s2klient.Close(); err != nil {
-				os.Exit(1)
+			// interrupted: don't sync a partial dataset
+			if err := s2klient.Abort(); err != nil {
+				log.Print("abort failed: ", err)
 			}
+			s2klient.Close()
 		}
-		os.Exit(0)
+		os.Exit(1)
 	}()
-}
\ No newline at end of file
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	acmeDomains   = flag.String("acme-domains", "", "Domains to get TLS certificates for with ACME, comma separated (enables ACME for the listener and the HTTP API)")
+	acmeEmail     = flag.String("acme-email", "", "Contact email of the ACME account")
+	acmeCacheDir  = flag.String("acme-cache-dir", "acme-cache", "Directory where ACME certificates are stored")
+	acmeDirectory = flag.String("acme-directory", "", "ACME directory URL (Let's Encrypt if empty)")
+	acmeHTTPBind  = flag.String("acme-http-bind", "", "Listen specification of the ACME HTTP-01 challenge server, ie :80 (only TLS-ALPN-01 challenges if empty)")
+
+	acmeManager *autocert.Manager
+)
+
+func setupACME() {
+	if len(*acmeDomains) == 0 {
+		return
+	}
+
+	// certificates are obtained on the first handshake, and renewed before they expire
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(strings.Split(*acmeDomains, ",")...),
+		Cache:      autocert.DirCache(*acmeCacheDir),
+		Email:      *acmeEmail,
+	}
+
+	if len(*acmeDirectory) != 0 {
+		acmeManager.Client = &acme.Client{DirectoryURL: *acmeDirectory}
+	}
+
+	if len(*acmeHTTPBind) != 0 {
+		go func() {
+			log.Print("ACME challenges listening on ", *acmeHTTPBind)
+			log.Fatal("ACME challenges listen failed: ", http.ListenAndServe(*acmeHTTPBind, acmeManager.HTTPHandler(nil)))
+		}()
+	}
+
+	log.Print("ACME enabled for ", *acmeDomains)
+}
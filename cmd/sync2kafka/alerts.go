@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+var (
+	alertSlackWebhook = flag.String("alert-slack-webhook", "", "Slack incoming webhook URL receiving the alerts")
+	alertTeamsWebhook = flag.String("alert-teams-webhook", "", "Microsoft Teams incoming webhook URL receiving the alerts")
+	alertWebhook      = flag.String("alert-webhook", "", "URL receiving the alerts as JSON")
+	freshnessWindow   = flag.Duration("freshness-window", 0, "Alert when a topic has no successful sync for this duration (0: no alert)")
+	freshnessInterval = flag.String("freshness-intervals", "", "Expected sync intervals of topics, overriding freshness-window (topic=duration, comma separated)")
+)
+
+func alertNotifiers() (notifiers []server.Notifier) {
+	if len(*alertSlackWebhook) != 0 {
+		notifiers = append(notifiers, server.NewSlackNotifier(*alertSlackWebhook))
+	}
+
+	if len(*alertTeamsWebhook) != 0 {
+		notifiers = append(notifiers, server.NewTeamsNotifier(*alertTeamsWebhook))
+	}
+
+	if len(*alertWebhook) != 0 {
+		notifiers = append(notifiers, server.NewWebhookNotifier(*alertWebhook))
+	}
+
+	return
+}
+
+func freshnessIntervals() (intervals map[string]time.Duration) {
+	if len(*freshnessInterval) == 0 {
+		return
+	}
+
+	intervals = make(map[string]time.Duration)
+
+	for _, spec := range strings.Split(*freshnessInterval, ",") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid freshness interval %q: expected topic=duration", spec)
+		}
+
+		interval, err := time.ParseDuration(parts[1])
+		if err != nil {
+			log.Fatalf("invalid freshness interval %q: %v", spec, err)
+		}
+
+		intervals[parts[0]] = interval
+	}
+
+	return
+}
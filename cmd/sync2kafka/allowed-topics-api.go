@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+type allowedTopicsAPI struct{}
+
+func (a *allowedTopicsAPI) Register(ws *restful.WebService) {
+	topicParam := ws.PathParameter("topic", "Name of the topic")
+
+	ws.Route(ws.GET("/allowed-topics").To(a.List).Writes([]string{}))
+	ws.Route(ws.PUT("/allowed-topics/{topic}").To(a.Allow).Param(topicParam).Filter(adminFilter))
+	ws.Route(ws.DELETE("/allowed-topics/{topic}").To(a.Disallow).Param(topicParam).Filter(adminFilter))
+}
+
+func (a *allowedTopicsAPI) fail(req *restful.Request, res *restful.Response, err error) {
+	log.Printf("allowed topics API: %s: failed: %v", req.Request.URL.Path, err)
+	res.WriteErrorString(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
+
+func (a *allowedTopicsAPI) List(req *restful.Request, res *restful.Response) {
+	topics, err := srv.AllowedTopics()
+	if err != nil {
+		a.fail(req, res, err)
+		return
+	}
+
+	if topics == nil {
+		topics = []string{}
+	}
+
+	res.WriteEntity(topics)
+}
+
+func (a *allowedTopicsAPI) Allow(req *restful.Request, res *restful.Response) {
+	topic := req.PathParameter("topic")
+
+	if err := srv.AllowTopic(topic); err == server.ErrInvalidTopicName {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		a.fail(req, res, err)
+		return
+	}
+
+	log.Printf("allowed topics API: allowed topic %q", topic)
+}
+
+func (a *allowedTopicsAPI) Disallow(req *restful.Request, res *restful.Response) {
+	topic := req.PathParameter("topic")
+
+	if err := srv.DisallowTopic(topic); err != nil {
+		a.fail(req, res, err)
+		return
+	}
+
+	log.Printf("allowed topics API: disallowed topic %q", topic)
+}
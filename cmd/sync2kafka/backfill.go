@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+func backfillCommand(args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	keyPrefix := flags.String("key-prefix", "", "Prefix added to the copied keys")
+	doDelete := flags.Bool("delete", false, "Delete keys of the target not present in the source")
+	reason := flags.String("reason", "", "Reason of the backfill, for the audit log")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: sync2kafka [flags] backfill [-key-prefix prefix] [-delete] [-reason reason] <source topic> <target topic>")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	req := server.BackfillRequest{
+		Source:   flags.Arg(0),
+		DoDelete: *doDelete,
+		Reason:   *reason,
+	}
+
+	if len(*keyPrefix) != 0 {
+		req.Transforms = []server.Transform{{Type: server.TransformKeyPrefix, Value: *keyPrefix}}
+	}
+
+	result, err := srv.Backfill(flags.Arg(1), req, "command line")
+
+	if len(result.Warnings) != 0 {
+		log.Print("warnings:\n  ", strings.Join(result.Warnings, "\n  "))
+	}
+
+	if err != nil {
+		log.Fatalf("failed to backfill topic %q: %v", flags.Arg(1), err)
+	}
+
+	log.Printf("%d records copied from topic %q to %q", result.Copied, req.Source, flags.Arg(1))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runCommand runs a one-shot subcommand instead of the server.
+func runCommand(args []string) {
+	switch args[0] {
+	case "dump":
+		setupVault()
+		setupKafka()
+		setupServer()
+		dumpCommand(args[1:])
+
+	case "restore":
+		setupVault()
+		setupKafka()
+		setupServer()
+		restoreCommand(args[1:])
+
+	case "backfill":
+		setupVault()
+		setupKafka()
+		setupServer()
+		backfillCommand(args[1:])
+
+	case "top":
+		topCommand(args[1:])
+
+	case "conformance":
+		conformanceCommand(args[1:])
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/server"
+	"github.com/mcluseau/sync2kafka/server/servertest"
+)
+
+// conformanceCommand runs a server for the tests of the clients: the syncs are accepted as usual, but
+// produced to an in-memory Kafka whose messages are echoed by an HTTP API.
+func conformanceCommand(args []string) {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	bind := flags.String("bind", ":9084", "Listen address of the syncs")
+	httpBind := flags.String("http-bind", ":8080", "Listen address of the echo API")
+	token := flags.String("token", "", "Require a token to operate")
+
+	chaos := &servertest.Chaos{}
+	flags.Float64Var(&chaos.SlowReadProbability, "chaos-slow-reads", 0, "Probability of a read of the server being delayed")
+	flags.Float64Var(&chaos.ResetProbability, "chaos-resets", 0, "Probability of a read of the server resetting the connection instead")
+	flags.Float64Var(&chaos.DelayedResultProbability, "chaos-delayed-results", 0, "Probability of a write of the server (ie: a result) being delayed")
+	chaosDelay := flags.Duration("chaos-delay", time.Second, "Maximum delay of the slow reads and delayed results")
+	flags.Int64Var(&chaos.Seed, "chaos-seed", 0, "Seed of the random failures (random if 0)")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: sync2kafka conformance [-bind addr] [-http-bind addr] [-token token] [-chaos-* ...]")
+		fmt.Fprintln(flags.Output(), "echo API: GET /topics/<topic>/messages (all the messages) or /topics/<topic>/state (compacted)")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	mem := backend.NewMemory()
+
+	opts := server.Options{
+		Kafka:          mem,
+		Token:          *token,
+		AllowAllTopics: true,
+	}
+
+	if chaos.SlowReadProbability != 0 || chaos.ResetProbability != 0 || chaos.DelayedResultProbability != 0 {
+		chaos.SlowReadDelay = *chaosDelay
+		chaos.ResultDelay = *chaosDelay
+
+		if chaos.Seed == 0 {
+			chaos.Seed = time.Now().UnixNano()
+		}
+
+		log.Print("conformance: chaos enabled, seed ", chaos.Seed)
+		opts.Middlewares = []server.Middleware{chaos.Middleware()}
+	}
+
+	conformanceSrv := server.New(opts)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topics/", func(w http.ResponseWriter, req *http.Request) {
+		httpEcho(mem, w, req)
+	})
+
+	go func() {
+		log.Print("conformance: echo API listening on ", *httpBind)
+		log.Fatal("http listen failed: ", http.ListenAndServe(*httpBind, mux))
+	}()
+
+	listener, err := net.Listen("tcp", *bind)
+	if err != nil {
+		log.Fatal("listen failed: ", err)
+	}
+
+	log.Print("conformance: listening on ", *bind)
+
+	if err := conformanceSrv.Serve(context.Background(), listener); err != nil {
+		log.Fatal("listener failed: ", err)
+	}
+}
+
+// echoMessage is a message of the in-memory Kafka, with the key and value base64 encoded like BinaryKV.
+type echoMessage struct {
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Key       []byte `json:"k"`
+	Value     []byte `json:"v"`
+}
+
+func httpEcho(mem *backend.Memory, w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/topics/"), "/")
+	if req.Method != http.MethodGet || len(parts) != 2 || len(parts[0]) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+
+	topic := parts[0]
+
+	partitions, err := mem.Partitions(topic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	messages := make([]echoMessage, 0)
+	for _, partition := range partitions {
+		for _, msg := range mem.Messages(topic, partition) {
+			messages = append(messages, echoMessage{Partition: partition, Offset: msg.Offset, Key: msg.Key, Value: msg.Value})
+		}
+	}
+
+	switch parts[1] {
+	case "messages":
+
+	case "state":
+		last := map[string]echoMessage{}
+		for _, msg := range messages {
+			if len(msg.Value) == 0 {
+				delete(last, string(msg.Key))
+			} else {
+				last[string(msg.Key)] = msg
+			}
+		}
+
+		messages = messages[:0]
+		for _, msg := range last {
+			messages = append(messages, msg)
+		}
+
+		sort.Slice(messages, func(i, j int) bool { return string(messages[i].Key) < string(messages[j].Key) })
+
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
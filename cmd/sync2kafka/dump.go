@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// readTopicState reads the compacted state of a topic, sorted by key, with the values unwrapped from their
+// envelopes so a restore wraps them again.
+func readTopicState(topic string) (kvs []KeyValue, err error) {
+	err = srv.TopicState(topic, func(key, value []byte) error {
+		kvs = append(kvs, KeyValue{Key: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return
+}
+
+// checkDumpFormat returns an error if the format isn't `json` or `binary`.
+func checkDumpFormat(format string) error {
+	if format != "json" && format != "binary" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return nil
+}
+
+// dumpTopic writes the compacted state of a topic, one object per line, in the given format (`json` or `binary`).
+func dumpTopic(topic, format string, w io.Writer) (count int, err error) {
+	if err = checkDumpFormat(format); err != nil {
+		return
+	}
+
+	kvs, err := readTopicState(topic)
+	if err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(w)
+
+	for _, kv := range kvs {
+		var obj interface{}
+
+		switch format {
+		case "json":
+			if !json.Valid(kv.Key) || !json.Valid(kv.Value) {
+				return count, fmt.Errorf("key %q: key or value is not valid JSON, use the binary format", kv.Key)
+			}
+
+			key, value := json.RawMessage(kv.Key), json.RawMessage(kv.Value)
+			obj = JsonKV{Key: &key, Value: &value}
+
+		case "binary":
+			obj = BinaryKV{Key: kv.Key, Value: kv.Value}
+		}
+
+		if err = enc.Encode(obj); err != nil {
+			return
+		}
+
+		count++
+	}
+
+	return
+}
+
+func dumpCommand(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := flags.String("format", "binary", "Output format (json or binary)")
+	output := flags.String("o", "-", "Output file (- for stdout)")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: sync2kafka [flags] dump [-format json|binary] [-o file] <topic>")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	topic := flags.Arg(0)
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatal("failed to create output: ", err)
+		}
+
+		defer file.Close()
+		out = file
+	}
+
+	buf := bufio.NewWriter(out)
+
+	count, err := dumpTopic(topic, *format, buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+
+	if err != nil {
+		log.Fatalf("failed to dump topic %q: %v", topic, err)
+	}
+
+	log.Printf("dumped %d records from topic %q", count, topic)
+}
+
+func httpDumpTopic(req *restful.Request, res *restful.Response) {
+	topic := req.PathParameter("topic")
+
+	format := req.QueryParameter("format")
+	if len(format) == 0 {
+		format = "binary"
+	}
+
+	if err := checkDumpFormat(format); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !srv.IsTopicAllowed(topic) {
+		res.WriteErrorString(http.StatusForbidden, "topic not allowed")
+		return
+	}
+
+	// the state is read before writing the records, so an error on the first one can still be answered
+	w := &countingWriter{w: res}
+
+	res.AddHeader("Content-Type", "application/x-jsonlines")
+
+	count, err := dumpTopic(topic, format, w)
+	if err != nil {
+		log.Printf("dump of topic %q failed after %d records: %v", topic, count, err)
+
+		if w.n == 0 {
+			res.Header().Set("Content-Type", "text/plain")
+			res.WriteErrorString(http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+// countingWriter counts the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	expiryScanInterval = flag.Duration("expiry-scan-interval", 10*time.Minute, "Interval between expired keys scans of the topics with expiry (disabled if 0)")
+)
+
+func setupExpiry() {
+	if *expiryScanInterval == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(*expiryScanInterval) {
+			srv.ExpireTopics()
+		}
+	}()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+const bearerHdr = "Bearer "
+
+// API roles: read can access the status, admin can access everything.
+const (
+	roleRead  = "read"
+	roleAdmin = "admin"
+
+	roleAttribute = "role"
+)
+
+var (
+	httpToken         = flag.String("http-token", "", "Bearer token for API access (admin role)")
+	httpReadToken     = flag.String("http-read-token", "", "Bearer token for read-only API access (status only)")
+	httpClientCA      = flag.String("http-client-ca", "", "CA of the API client certificates (HTTPS only); certificates are given the read role by default")
+	httpAdminSubjects = flag.String("http-admin-subjects", "", "Common names of the API client certificates given the admin role, comma separated")
+)
+
+func httpAuthEnabled() bool {
+	return len(*httpToken) != 0 || len(*httpReadToken) != 0 || len(*httpClientCA) != 0
+}
+
+func loadHTTPClientCAs() *x509.CertPool {
+	caPEM, err := ioutil.ReadFile(*httpClientCA)
+	if err != nil {
+		log.Fatal("failed to read the API client CA: ", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		log.Fatal("no certificate found in the API client CA")
+	}
+
+	return pool
+}
+
+// authFilter authenticates the request, giving it its role.
+func authFilter(req *restful.Request, res *restful.Response, chain *restful.FilterChain) {
+	role := requestRole(req.Request)
+
+	if len(role) == 0 {
+		res.WriteErrorString(http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	req.SetAttribute(roleAttribute, role)
+	chain.ProcessFilter(req, res)
+}
+
+// adminFilter restricts a route to the admin role.
+func adminFilter(req *restful.Request, res *restful.Response, chain *restful.FilterChain) {
+	if httpAuthEnabled() && req.Attribute(roleAttribute) != roleAdmin {
+		res.WriteErrorString(http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	chain.ProcessFilter(req, res)
+}
+
+// requestRole returns the role of the request's token or client certificate, or "" if not authenticated.
+func requestRole(req *http.Request) string {
+	hdr := req.Header.Get("Authorization")
+
+	if strings.HasPrefix(hdr, bearerHdr) {
+		authToken := hdr[len(bearerHdr):]
+
+		switch {
+		case len(*httpToken) != 0 && authToken == *httpToken:
+			return roleAdmin
+		case len(*httpReadToken) != 0 && authToken == *httpReadToken:
+			return roleRead
+		}
+	}
+
+	if req.TLS != nil && len(req.TLS.VerifiedChains) != 0 {
+		subject := req.TLS.VerifiedChains[0][0].Subject.CommonName
+
+		for _, adminSubject := range strings.Split(*httpAdminSubjects, ",") {
+			if len(adminSubject) != 0 && subject == adminSubject {
+				return roleAdmin
+			}
+		}
+
+		return roleRead
+	}
+
+	return ""
+}
+
+// requestSubject identifies the requester for audit logs: the client certificate's common name, or the
+// remote address.
+func requestSubject(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) != 0 {
+		return fmt.Sprintf("%q (%s)", req.TLS.VerifiedChains[0][0].Subject.CommonName, req.RemoteAddr)
+	}
+	return req.RemoteAddr
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
 	swaggerui "github.com/mcluseau/go-swagger-ui"
 	"github.com/mcluseau/sync2kafka/apiutils"
-	)
-
-const bearerHdr = "Bearer "
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/server"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
 
 var (
-	httpBind  = flag.String("http-bind", ":8080", "HTTP API bind port")
-	httpToken = flag.String("http-token", "", "Bearer token for API access")
+	httpBind      = flag.String("http-bind", ":8080", "HTTP API bind port")
+	websocketPath = flag.String("websocket-path", "/sync", "HTTP path accepting syncs over WebSocket (disabled if empty)")
 )
 
 func setupHTTP() {
@@ -23,12 +29,77 @@ func setupHTTP() {
 		ws := &restful.WebService{}
 		ws.Produces(restful.MIME_JSON)
 
-		if len(*httpToken) != 0 {
-			ws.Param(ws.HeaderParameter("Authorization", "Bearer token for authentication").Required(true))
+		if httpAuthEnabled() {
+			ws.Param(ws.HeaderParameter("Authorization", "Bearer token for authentication"))
 			ws.Filter(authFilter)
 		}
 
-		ws.Route(ws.GET("/connections").Writes(connStatuses).To(httpGetConnections))
+		connectionFilters := func(rb *restful.RouteBuilder) {
+			rb.Param(ws.QueryParameter("topic", "Only the connections to this topic")).
+				Param(ws.QueryParameter("status", "Only the connections with this status (ie: reading data, finished)")).
+				Param(ws.QueryParameter("client", "Only the connections of this client name")).
+				Param(ws.QueryParameter("active", "Only the connections not finished").DataType("boolean"))
+		}
+
+		ws.Route(ws.GET("/connections").Writes(map[string]server.ConnStatus{}).To(httpGetConnections).
+			Doc("Current and recent connections by remote address").Do(connectionFilters))
+
+		ws.Route(ws.GET("/connections/list").Writes(server.ConnectionsPage{}).To(httpListConnections).
+			Doc("Page of the current and recent connections, the most recent first").Do(connectionFilters).
+			Param(ws.QueryParameter("offset", "Number of connections to skip").DataType("integer").DefaultValue("0")).
+			Param(ws.QueryParameter("limit", fmt.Sprintf("Maximum number of connections (up to %d)", maxConnectionsLimit)).
+				DataType("integer").DefaultValue(strconv.Itoa(defaultConnectionsLimit))))
+
+		ws.Route(ws.GET("/connections/samples").Writes(map[string][]server.RecordSample{}).To(httpGetRecordSamples).
+			Filter(adminFilter).Doc("Last records received by the connections, truncated, by remote address (requires -record-samples)").
+			Do(connectionFilters))
+
+		ws.Route(ws.GET("/version").Writes(client.ServerInfo{}).To(httpGetVersion).
+			Doc("Build, supported protocol versions and formats, and enabled features of the server"))
+
+		ws.Route(ws.GET("/freshness").Writes([]server.TopicFreshness{}).To(httpGetFreshness))
+
+		ws.Route(ws.GET("/recoveries").Writes([]server.JournalRecovery{}).To(httpGetRecoveries))
+
+		ws.Route(ws.GET("/kafka").To(httpGetKafkaHealth).Writes(backend.ClusterHealth{}).
+			Param(ws.QueryParameter("topic", "Topic to report partitions of (default topic if not set); can be repeated")))
+
+		ws.Route(ws.GET("/topics/{topic}/dump").To(httpDumpTopic).Filter(adminFilter).
+			Param(ws.PathParameter("topic", "Name of the topic")).
+			Param(ws.QueryParameter("format", "Output format (json or binary)").DefaultValue("binary")).
+			Produces("application/x-jsonlines"))
+
+		ws.Route(ws.POST("/topics/{topic}/erase").To(httpErase).Filter(adminFilter).
+			Doc("Tombstone the given keys, or the keys matching a pattern, in the topic (audit logged)").
+			Param(ws.PathParameter("topic", "Name of the topic")).
+			Reads(server.EraseRequest{}).Writes(server.EraseResult{}))
+
+		ws.Route(ws.POST("/topics/{topic}/backfill").To(httpBackfill).Filter(adminFilter).
+			Doc("Sync the topic with the state of another topic, ie: to rename or repartition it (audit logged)").
+			Param(ws.PathParameter("topic", "Name of the target topic")).
+			Reads(server.BackfillRequest{}).Writes(server.BackfillResult{}))
+
+		ws.Route(ws.GET("/topic-locks").To(httpGetTopicLocks).Writes([]server.TopicLockStatus{}).
+			Doc("Locks of the topics being synced"))
+
+		ws.Route(ws.DELETE("/topic-locks/{topic}").To(httpReleaseTopicLock).Filter(adminFilter).
+			Doc(fmt.Sprintf("Force the release of the topic's lock, cancelling its sync and waiting up to %v for it to stop (202 if it didn't)", releaseLockTimeout)).
+			Param(ws.PathParameter("topic", "Name of the topic")))
+
+		ws.Route(ws.GET("/config").To(httpGetConfig).Filter(adminFilter).Writes(server.EffectiveConfig{}).
+			Doc("Effective configuration of the server, without its secrets"))
+
+		// equivalents of the signals, for the platforms without them
+		ws.Route(ws.POST("/reload").To(httpReload).Filter(adminFilter).
+			Doc("Reload the configuration files (like SIGHUP)"))
+		ws.Route(ws.POST("/shutdown").To(httpShutdown).Filter(adminFilter).
+			Doc("Stop accepting connections, wait for the running transfers and exit (like SIGTERM)"))
+		ws.Route(ws.GET("/stacks").To(httpGetStacks).Filter(adminFilter).Produces("text/plain").
+			Doc("Dump the stacks of all the goroutines (like SIGUSR1)"))
+
+		if len(*allowedTopicsFile) != 0 {
+			(&allowedTopicsAPI{}).Register(ws)
+		}
 
 		if hasStore {
 			(&storeAPI{}).Register(ws)
@@ -38,41 +109,256 @@ func setupHTTP() {
 	})
 
 	swaggerui.HandleAt("/swagger-ui/")
+	http.Handle("/metrics", promhttp.Handler())
+
+	if len(*websocketPath) != 0 {
+		http.Handle(*websocketPath, srv.WebSocketHandler())
+	}
+
+	httpServer := &http.Server{
+		Addr:    *httpBind,
+		Handler: restful.DefaultContainer,
+	}
+
+	if acmeManager != nil {
+		httpServer.TLSConfig = acmeManager.TLSConfig()
+	}
+
+	if len(*httpClientCA) != 0 {
+		if httpServer.TLSConfig == nil {
+			httpServer.TLSConfig = &tls.Config{}
+		}
+
+		httpServer.TLSConfig.ClientCAs = loadHTTPClientCAs()
+		httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 
 	go func() {
 		var err error
-		if len(*tlsKeyPath) == 0 {
+		if acmeManager != nil {
+			log.Print("HTTPS (ACME) listening on ", *httpBind)
+			err = httpServer.ListenAndServeTLS("", "")
+
+		} else if len(*tlsKeyPath) == 0 {
+			if len(*httpClientCA) != 0 {
+				log.Print("WARNING: client certificates require HTTPS, they are ignored")
+			}
+
 			log.Print("HTTP listening on ", *httpBind)
-			err = http.ListenAndServe(*httpBind, restful.DefaultContainer)
+			err = httpServer.ListenAndServe()
 		} else {
 			log.Print("HTTPS listening on ", *httpBind)
-			err = http.ListenAndServeTLS(*httpBind, *tlsCertPath, *tlsKeyPath, restful.DefaultContainer)
+			err = httpServer.ListenAndServeTLS(*tlsCertPath, *tlsKeyPath)
 		}
 
 		log.Fatal("http listen failed: ", err)
 	}()
 }
 
-func authFilter(req *restful.Request, res *restful.Response, chain *restful.FilterChain) {
-	if len(*httpToken) != 0 {
-		hdr := req.HeaderParameter("Authorization")
+func httpGetKafkaHealth(req *restful.Request, res *restful.Response) {
+	topics := req.Request.URL.Query()["topic"]
+	if len(topics) == 0 && len(*targetTopic) != 0 {
+		topics = []string{*targetTopic}
+	}
 
-		authToken := ""
-		if strings.HasPrefix(hdr, bearerHdr) {
-			authToken = hdr[len(bearerHdr):]
-		}
+	res.WriteEntity(kafka.Health(topics...))
+}
+
+const (
+	defaultConnectionsLimit = 100
+	maxConnectionsLimit     = 1000
+)
+
+func httpGetConnections(req *restful.Request, res *restful.Response) {
+	filter, err := connectionsFilter(req)
+	if err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res.WriteEntity(srv.FilterConnections(filter))
+}
+
+func httpListConnections(req *restful.Request, res *restful.Response) {
+	filter, err := connectionsFilter(req)
+	if err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	offset, err := intParameter(req, "offset", 0)
+	if err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := intParameter(req, "limit", defaultConnectionsLimit)
+	if err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if limit < 1 || limit > maxConnectionsLimit {
+		res.WriteErrorString(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxConnectionsLimit))
+		return
+	}
+
+	res.WriteEntity(srv.ListConnections(filter, offset, limit))
+}
+
+func httpGetRecordSamples(req *restful.Request, res *restful.Response) {
+	filter, err := connectionsFilter(req)
+	if err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res.WriteEntity(srv.RecordSamples(filter))
+}
+
+func connectionsFilter(req *restful.Request) (filter server.ConnectionsFilter, err error) {
+	filter = server.ConnectionsFilter{
+		Topic:  req.QueryParameter("topic"),
+		Status: req.QueryParameter("status"),
+		Client: req.QueryParameter("client"),
+	}
 
-		if authToken != *httpToken {
-			res.WriteErrorString(http.StatusUnauthorized, "Unauthorized")
-			return
+	if v := req.QueryParameter("active"); len(v) != 0 {
+		if filter.Active, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("invalid active: %v", err)
 		}
 	}
 
-	chain.ProcessFilter(req, res)
+	return
 }
 
-func httpGetConnections(req *restful.Request, res *restful.Response) {
-	connStatusesMutex.Lock()
-	defer connStatusesMutex.Unlock()
-	res.WriteEntity(connStatuses)
+// intParameter returns the positive integer query parameter, or def if not set.
+func intParameter(req *restful.Request, name string, def int) (v int, err error) {
+	s := req.QueryParameter(name)
+	if len(s) == 0 {
+		return def, nil
+	}
+
+	if v, err = strconv.Atoi(s); err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+
+	return
+}
+
+func httpGetVersion(req *restful.Request, res *restful.Response) {
+	res.WriteEntity(srv.Info())
+}
+
+func httpGetRecoveries(req *restful.Request, res *restful.Response) {
+	res.WriteEntity(srv.Recoveries())
+}
+
+func httpGetConfig(req *restful.Request, res *restful.Response) {
+	config, err := srv.EffectiveConfig()
+	if err != nil {
+		log.Print("config API: failed: ", err)
+		res.WriteErrorString(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res.WriteEntity(config)
+}
+
+func httpErase(req *restful.Request, res *restful.Response) {
+	topic := req.PathParameter("topic")
+
+	if !srv.IsTopicAllowed(topic) {
+		res.WriteErrorString(http.StatusForbidden, "topic not allowed")
+		return
+	}
+
+	eraseReq := server.EraseRequest{}
+	if err := req.ReadEntity(&eraseReq); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := srv.Erase(topic, eraseReq, requestSubject(req.Request))
+	if err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res.WriteEntity(result)
+}
+
+func httpBackfill(req *restful.Request, res *restful.Response) {
+	topic := req.PathParameter("topic")
+
+	backfillReq := server.BackfillRequest{}
+	if err := req.ReadEntity(&backfillReq); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !srv.IsTopicAllowed(topic) || !srv.IsTopicAllowed(backfillReq.Source) {
+		res.WriteErrorString(http.StatusForbidden, "topic not allowed")
+		return
+	}
+
+	result, err := srv.Backfill(topic, backfillReq, requestSubject(req.Request))
+	switch {
+	case errors.Is(err, server.ErrTopicLocked):
+		res.WriteErrorString(http.StatusConflict, err.Error())
+		return
+
+	case errors.Is(err, server.ErrDeletionsDenied):
+		res.WriteErrorString(http.StatusForbidden, err.Error())
+		return
+
+	case err != nil:
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res.WriteEntity(result)
+}
+
+func httpGetTopicLocks(req *restful.Request, res *restful.Response) {
+	res.WriteEntity(srv.TopicLocks())
+}
+
+// releaseLockTimeout is the time given to the holder of a force-released lock to stop.
+const releaseLockTimeout = 30 * time.Second
+
+func httpReleaseTopicLock(req *restful.Request, res *restful.Response) {
+	topic := req.PathParameter("topic")
+
+	log.Printf("AUDIT: release of the lock of topic %q by %s", topic, requestSubject(req.Request))
+
+	switch err := srv.ReleaseTopic(topic, releaseLockTimeout); err {
+	case nil:
+		res.WriteHeader(http.StatusNoContent)
+
+	case server.ErrTopicNotLocked:
+		res.WriteErrorString(http.StatusNotFound, err.Error())
+
+	default:
+		// the topic is released once the holder stopped
+		res.WriteErrorString(http.StatusAccepted, err.Error())
+	}
+}
+
+func httpReload(req *restful.Request, res *restful.Response) {
+	reload()
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func httpShutdown(req *restful.Request, res *restful.Response) {
+	go shutdown()
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func httpGetStacks(req *restful.Request, res *restful.Response) {
+	res.Write([]byte(stacks()))
+}
+
+func httpGetFreshness(req *restful.Request, res *restful.Response) {
+	res.WriteEntity(srv.Freshness())
 }
@@ -2,30 +2,134 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"strings"
+	"time"
 
-	"github.com/Shopify/sarama"
+	"github.com/mcluseau/sync2kafka/backend"
 )
 
 var (
-	kafkaBrokers = flag.String("brokers", "kafka:9092", "Kafka brokers, comma separated")
-	targetTopic  = flag.String("topic", "", "Kafka topic to synchronize")
+	kafkaBrokers      = flag.String("brokers", "kafka:9092", "Kafka brokers, comma separated")
+	targetTopic       = flag.String("topic", "", "Kafka topic to synchronize")
+	kafkaVersion      = flag.String("kafka-version", "0.11.0.0", "Kafka protocol version (0.11+ is required for record headers)")
+	kafkaBackend      = flag.String("kafka-backend", "sarama", "Kafka client library to use (sarama, kafka-go, redis, nats or pulsar to write the topics to Redis, NATS JetStream key-value buckets or Pulsar instead, or memory for local tests, or a sink registered by a -plugin)")
+	kafkaSASLUser     = flag.String("kafka-sasl-user", "", "Kafka SASL/PLAIN user (no authentication if empty)")
+	kafkaSASLPassword = flag.String("kafka-sasl-password", "", "Kafka SASL/PLAIN password")
+	readTimeout       = flag.Duration("kafka-read-timeout", 10*time.Second, "Maximum time to wait for a message when reading a topic")
 
-	kafka sarama.Client
+	eventsTopic    = flag.String("events-topic", "", "Topic where an event is published at the end of each sync (no events if empty)")
+	produceWorkers = flag.Int("produce-workers", 1, "Parallel producers of a sync (a key is always sent by the same producer; ignored with -ordered-produce)")
+	orderedProduce = flag.Bool("ordered-produce", false, "Produce a sync's changes sorted by key, keeping the order across retries (buffers the changes in memory)")
+
+	produceErrors       = flag.String("produce-errors", "fail", "What to do with messages that failed to be produced: fail the sync, retry them, abort the sync on the first one, or skip them")
+	produceRetries      = flag.Int("produce-retries", 3, "Maximum retries of failed messages with -produce-errors=retry")
+	produceRetryBackoff = flag.Duration("produce-retry-backoff", time.Second, "Delay before the first retry of failed messages, doubled for each next one")
+
+	compactionCheck  = flag.Bool("compaction-check", false, "Verify after each sync that the topic is compacted, and estimate its records waiting for compaction")
+	compactionConfig = flag.String("compaction-config", "", "Topic configuration entries set after each sync if different (name=value, comma separated; ie: min.cleanable.dirty.ratio=0.1)")
+
+	kafka backend.Backend
+
+	// kafkaSwitches are the clients replaced when the Kafka credentials change, by cluster ("" for the main one)
+	kafkaSwitches map[string]*backend.Switch
 )
 
-func setupKafka() {
-	conf := sarama.NewConfig()
-	conf.Producer.Return.Successes = true
-	conf.Producer.RequiredAcks = sarama.WaitForAll
+// previousKafkaTTL is how long a replaced Kafka client is kept for the syncs started before its replacement.
+const previousKafkaTTL = time.Hour
 
+func setupKafka() {
 	var err error
 
-	kafka, err = sarama.NewClient(strings.Split(*kafkaBrokers, ","), conf)
+	kafka, err = backend.New(*kafkaBackend, strings.Split(*kafkaBrokers, ","), kafkaConfig())
 	if err != nil {
 		log.Fatal("failed to connect to Kafka: ", err)
 	}
 
-	log.Print("connected to Kafka")
+	log.Printf("connected to Kafka (backend: %s)", *kafkaBackend)
+
+	setupClusters()
+
+	if vault != nil { // the credentials may be renewed
+		kafkaSwitches = map[string]*backend.Switch{"": backend.NewSwitch(kafka)}
+		kafka = kafkaSwitches[""]
+
+		for name, cluster := range clusters {
+			kafkaSwitches[name] = backend.NewSwitch(cluster)
+			clusters[name] = kafkaSwitches[name]
+		}
+	}
+}
+
+// reconnectKafka replaces the Kafka clients with new ones, using the current credentials. The previous
+// clients are closed after previousKafkaTTL.
+func reconnectKafka() (err error) {
+	config, err := readTopicsConfigIfAny()
+	if err != nil {
+		return
+	}
+
+	clients := make(map[string]backend.Backend, len(kafkaSwitches))
+
+	for name := range kafkaSwitches {
+		backendName, brokers := *kafkaBackend, strings.Split(*kafkaBrokers, ",")
+
+		if len(name) != 0 {
+			cluster, ok := config.Clusters[name]
+			if !ok {
+				continue // removed from the configuration, keep the current client
+			}
+
+			if len(cluster.Backend) != 0 {
+				backendName = cluster.Backend
+			}
+			brokers = cluster.Brokers
+		}
+
+		if clients[name], err = backend.New(backendName, brokers, kafkaConfig()); err != nil {
+			for _, client := range clients {
+				if client != nil {
+					client.Close()
+				}
+			}
+			return fmt.Errorf("failed to connect to Kafka cluster %q: %v", name, err)
+		}
+	}
+
+	for name, client := range clients {
+		previous := kafkaSwitches[name].Set(client)
+		time.AfterFunc(previousKafkaTTL, func() { previous.Close() })
+	}
+
+	log.Print("reconnected to Kafka with the renewed credentials")
+	return
+}
+
+func compactionConfigEntries() (entries map[string]string) {
+	if len(*compactionConfig) == 0 {
+		return
+	}
+
+	entries = make(map[string]string)
+
+	for _, spec := range strings.Split(*compactionConfig, ",") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid compaction config entry %q: expected name=value", spec)
+		}
+
+		entries[parts[0]] = parts[1]
+	}
+
+	return
+}
+
+func kafkaConfig() backend.Config {
+	return backend.Config{
+		Version:      *kafkaVersion,
+		SASLUser:     *kafkaSASLUser,
+		SASLPassword: *kafkaSASLPassword,
+		Ordered:      *orderedProduce,
+	}
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+var listenSpecs stringsFlag
+
+func init() {
+	flag.Var(&listenSpecs, "listen", "Address to listen on, as host:port?network=...&tls=...&keepalive=... (repeatable, replaces -bind; "+
+		"network is tcp, tcp4 or tcp6 for IPv6 only, tls=false accepts plain connections, keepalive overrides -tcp-keepalive-period)")
+}
+
+// listen opens the listeners of the -listen flags, and uses the sockets passed by systemd. Without
+// both, it listens on -bind.
+func listen() (listeners []server.Listener) {
+	listeners = systemdListeners()
+
+	specs := listenSpecs
+	if len(specs) == 0 && len(listeners) == 0 {
+		specs = []string{*bindSpec}
+	}
+
+	for _, spec := range specs {
+		addr, query := spec, ""
+		if idx := strings.IndexByte(spec, '?'); idx != -1 {
+			addr, query = spec[:idx], spec[idx+1:]
+		}
+
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			log.Fatalf("invalid listen address %q: %v", spec, err)
+		}
+
+		network := "tcp"
+		if v := values.Get("network"); len(v) != 0 {
+			network = v
+		}
+
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			log.Fatalf("invalid listen address %q: unknown network %q", spec, network)
+		}
+
+		l := server.Listener{}
+
+		if v := values.Get("tls"); len(v) != 0 {
+			useTLS, err := strconv.ParseBool(v)
+			if err != nil {
+				log.Fatalf("invalid listen address %q tls: %v", spec, err)
+			}
+			l.NoTLS = !useTLS
+		}
+
+		if v := values.Get("keepalive"); len(v) != 0 {
+			if l.KeepAlivePeriod, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("invalid listen address %q keepalive: %v", spec, err)
+			}
+		}
+
+		if l.Listener, err = net.Listen(network, addr); err != nil {
+			log.Fatalf("failed to listen on %s: %v", spec, err)
+		}
+
+		log.Printf("listening on %s (%s, TLS: %v)", l.Addr(), network, srv.Options().TLSConfig != nil && !l.NoTLS)
+
+		listeners = append(listeners, l)
+	}
+
+	return
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation (LISTEN_PID and LISTEN_FDS),
+// so connections are queued by systemd while the service is (re)started.
+func systemdListeners() (listeners []server.Listener) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		log.Fatal("invalid LISTEN_FDS: ", err)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// not for our children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < count; i++ {
+		const firstFD = 3 // SD_LISTEN_FDS_START
+
+		name := "systemd-socket-" + strconv.Itoa(i)
+		if i < len(names) && len(names[i]) != 0 {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(firstFD+i), name)
+
+		l, err := net.FileListener(file)
+		if err != nil {
+			log.Fatalf("failed to use the systemd socket %s: %v", name, err)
+		}
+
+		file.Close() // l has its own copy
+
+		log.Printf("listening on %s (systemd socket %s, TLS: %v)", l.Addr(), name, srv.Options().TLSConfig != nil)
+
+		listeners = append(listeners, server.Listener{Listener: l})
+	}
+
+	return
+}
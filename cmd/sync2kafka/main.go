@@ -1,43 +1,115 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
-	"net"
-	"os"
-	"os/signal"
-	"runtime"
-	"syscall"
+	"strings"
 	"time"
+
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/server"
+	"github.com/mcluseau/sync2kafka/syncer"
 )
 
+type KeyValue = server.KeyValue
+type JsonKV = server.JsonKV
+type BinaryKV = server.BinaryKV
+
 var (
 	tlsKeyPath      = flag.String("tls-key", "", "TLS key path (listen with TLS encryption if set)")
 	tlsCertPath     = flag.String("tls-cert", "", "TLS certificate path (required if key is set)")
-	bindSpec        = flag.String("bind", ":9084", "Listen specification (host:port)")
+	bindSpec        = flag.String("bind", ":9084", "Listen specification (host:port; see -listen for several addresses)")
 	keepAlivePeriod = flag.Duration("tcp-keepalive-period", 30*time.Second, "TCP keepalive period")
+	showVersion     = flag.Bool("version", false, "Print the version and exit")
+
+	token             = flag.String("token", "", "Require a token to operate")
+	authWebhook       = flag.String("auth-webhook", "", "URL of an HTTP endpoint authorizing the syncs (replaces the token and allowed topics)")
+	authTimeout       = flag.Duration("auth-webhook-timeout", 5*time.Second, "Timeout of the auth webhook calls")
+	allowAllTopics    = flag.Bool("allow-all-topics", false, "Allow any topic to be synchronized")
+	allowedTopicsFile = flag.String("allowed-topics-file", "", "File containing allowed topics (1 per line; # is comment)")
+	maxIndexings      = flag.Int("parallel-indexers", 4, "Maximum parallel indexing operations")
+	warmTopics        = flag.String("warm-topics", "", "Topics whose index is kept up to date between syncs, so their syncs start faster (comma separated; requires -store)")
+	warmInterval      = flag.Duration("warm-interval", 10*time.Second, "Period of the warm topics' index updates")
+	idleTimeout       = flag.Duration("idle-timeout", 5*time.Minute, "Maximum silence of a client during a transfer (0: no limit)")
+	pausedIdleTimeout = flag.Duration("paused-idle-timeout", time.Hour, "Maximum silence of a client that paused its transfer (0: no limit)")
+	topicLockTTL      = flag.Duration("topic-lock-ttl", 0, "Time without progress after which the sync holding a topic lock is cancelled when the topic is locked again (0: no limit)")
+	concurrentSyncs   = flag.Int("max-concurrent-syncs", 0, "Maximum of syncs reading or producing records at the same time, the syncs of highest priority first (0: no limit)")
+	finalizeTimeout   = flag.Duration("finalize-timeout", time.Hour, "Maximum time a sync can take to finish after the end of its transfer, before being cancelled as failed (0: no limit)")
+	maxKeySize        = flag.Int("max-key-size", 0, "Maximum size of a record's key in bytes (0: no limit)")
+	maxValueSize      = flag.Int("max-value-size", 0, "Maximum size of a record's value in bytes (0: no limit)")
+	journalDir        = flag.String("journal-dir", "", "Directory where accepted values are journaled until the end of their sync, to replay them after a crash (no journal if empty)")
+	idempotencyTTL    = flag.Duration("idempotency-ttl", time.Hour, "How long the results of syncs with an idempotency key are kept to answer their retries")
+	sessionTTL        = flag.Duration("session-ttl", 0, "How long an interrupted transfer with a session ID waits to be resumed by its client before being replayed without deletions (requires -journal-dir; disabled if 0)")
+	verifyPercent     = flag.Float64("verify-percent", 0, "Percentage of the keys produced by a sync read back from the topic to check their values, sampled by key (0: no verification)")
+	maxShortfall      = flag.Float64("max-shortfall-percent", 10, "Maximum percentage of the records announced by a client that its transfer can miss before being rejected as truncated, unless forced")
+	maxDeletePercent  = flag.Float64("max-delete-percent", 0, "Maximum percentage of a topic's keys a sync can delete, unless the client forces it (0: no limit)")
+	duplicateKeys     = flag.String("duplicate-keys", "ignore", "What to do with keys sent twice in a transfer: ignore (keep the last value), warn, or reject the transfer")
+	recordSamples     = flag.Int("record-samples", 0, "Number of recent records kept per connection, truncated, to preview them through the admin API (0: no samples)")
+	recordSampleBytes = flag.Int("record-sample-bytes", 64, "Size the sampled keys and values are truncated to")
+	recordErrorPolicy = flag.String("record-error-policy", server.RecordErrorFail, "What to do with invalid records: fail the transfer, or skip them (except in syncs with deletions, that would delete their keys)")
+
+	lagCheckGroups = flag.String("lag-check-groups", "", "Consumer groups to check the lag of before a sync with deletions, comma separated (on the topics they consume)")
+	maxConsumerLag = flag.Int64("max-consumer-lag", 1000, "Maximum lag of checked consumer groups before a sync with deletions")
+	lagCheckRefuse = flag.Bool("lag-check-refuse", false, "Refuse syncs with deletions when a checked consumer group lags (only warn in the result otherwise)")
+
+	srv *server.Server
 )
 
 func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(client.BuildVersion())
+		return
+	}
+
+	if flag.NArg() != 0 {
+		runCommand(flag.Args())
+		return
+	}
+
+	log.Print("sync2kafka ", client.BuildVersion())
+
 	go handleSignals()
 
+	setupPlugins()
+	setupVault()
+	setupACME()
 	setupStore()
 	setupKafka()
+	setupServer()
+	go refreshVault()
 	setupHTTP()
+	setupMongoSource()
+	setupLDAPSource()
+	setupRegisteredSources()
+	setupExpiry()
 
-	go connStatusCleaner()
+	var ctx context.Context
+	ctx, stopServing = context.WithCancel(context.Background())
 
-	if len(*targetTopic) != 0 {
-		go indexTopic(*targetTopic)
+	if err := srv.ServeListeners(ctx, listen()...); err != context.Canceled {
+		log.Fatal("listener failed: ", err)
 	}
 
+	select {} // shutting down
+}
+
+func setupServer() {
 	var tlsConfig *tls.Config
-	tlsMode := len(*tlsKeyPath) != 0
-	if tlsMode { // TLS mode, prepare tlsConfig
+	if acmeManager != nil { // TLS mode with ACME certificates
+		tlsConfig = acmeManager.TLSConfig()
+
+	} else if vaultCert != nil { // TLS mode with the certificate from Vault
+		tlsConfig = &tls.Config{
+			GetCertificate: getVaultCertificate,
+		}
+
+	} else if len(*tlsKeyPath) != 0 { // TLS mode, prepare tlsConfig
 		cert, err := tls.LoadX509KeyPair(*tlsCertPath, *tlsKeyPath)
 		if err != nil {
 			log.Fatal("failed to load TLS key pair: ", err)
@@ -48,50 +120,99 @@ func main() {
 		}
 	}
 
-	listener, err := net.Listen("tcp", *bindSpec)
-	if err != nil {
-		log.Fatalf("failed to listen on %s: %v", *bindSpec, err)
+	switch *recordErrorPolicy {
+	case server.RecordErrorFail, server.RecordErrorSkip:
+	default:
+		log.Fatalf("invalid record error policy: %q", *recordErrorPolicy)
 	}
 
-	log.Printf("listening on %s (TLS: %v)", *bindSpec, tlsMode)
+	switch *produceErrors {
+	case "fail":
+		*produceErrors = syncer.ProduceErrorsFail
+	case syncer.ProduceErrorsRetry, syncer.ProduceErrorsAbort, syncer.ProduceErrorsSkip:
+	default:
+		log.Fatalf("invalid produce errors policy: %q", *produceErrors)
+	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatal("listener failed: ", err)
-		}
+	switch *duplicateKeys {
+	case "ignore":
+		*duplicateKeys = server.DuplicateKeysIgnore
+	case server.DuplicateKeysIgnore, server.DuplicateKeysWarn, server.DuplicateKeysReject:
+	default:
+		log.Fatalf("invalid duplicate keys policy: %q", *duplicateKeys)
+	}
 
-		switch c := conn.(type) {
-		case *net.TCPConn:
-			c.SetKeepAlivePeriod(*keepAlivePeriod)
-			c.SetKeepAlive(true)
+	topicsConfig, err := loadTopics()
+	if err != nil {
+		log.Fatal("failed to load the topics configuration: ", err)
+	}
 
-		default: // should not happen
-			log.Print("connection is not TCP?!")
-		}
+	if len(topicsConfig.VirtualHosts) != 0 && tlsConfig == nil {
+		log.Print("warning: virtual hosts are configured but TLS is not enabled, they won't be used")
+	}
 
-		if tlsMode {
-			conn = tls.Server(conn, tlsConfig)
+	var warm []string
+	if len(*warmTopics) != 0 {
+		if !hasStore {
+			log.Fatal("-warm-topics requires -store")
 		}
-
-		go handleConn(conn)
+		warm = strings.Split(*warmTopics, ",")
 	}
-}
-
-func handleSignals() {
-	c := make(chan os.Signal, 1)
-
-	signal.Notify(c, syscall.SIGUSR1)
 
-	for sig := range c {
-		switch sig {
-		case syscall.SIGUSR1:
-			buf := make([]byte, 64*1024)
-			buf = buf[:runtime.Stack(buf, true)]
-			log.Print("got SIGUSR1, dump all stacks:\n", string(buf))
-
-		default:
-			log.Print("got unexpected signal ", sig, ", ignoring.")
-		}
+	var groups []string
+	if len(*lagCheckGroups) != 0 {
+		groups = strings.Split(*lagCheckGroups, ",")
 	}
+
+	srv = server.New(server.Options{
+		Kafka:               kafka,
+		Clusters:            clusters,
+		Topics:              topicsConfig.Topics,
+		Store:               db,
+		Token:               *token,
+		AuthWebhook:         *authWebhook,
+		AuthWebhookTimeout:  *authTimeout,
+		DefaultTopic:        *targetTopic,
+		AllowAllTopics:      *allowAllTopics,
+		AllowedTopicsFile:   *allowedTopicsFile,
+		TLSConfig:           tlsConfig,
+		VirtualHosts:        topicsConfig.VirtualHosts,
+		TokenPriorities:     topicsConfig.TokenPriorities,
+		KeepAlivePeriod:     *keepAlivePeriod,
+		ReadTimeout:         *readTimeout,
+		SortedProduce:       *orderedProduce,
+		ProduceWorkers:      *produceWorkers,
+		ProduceErrorPolicy:  *produceErrors,
+		ProduceRetries:      *produceRetries,
+		ProduceRetryBackoff: *produceRetryBackoff,
+		IdleTimeout:         *idleTimeout,
+		PausedIdleTimeout:   *pausedIdleTimeout,
+		FinalizeTimeout:     *finalizeTimeout,
+		TopicLockTTL:        *topicLockTTL,
+		MaxConcurrentSyncs:  *concurrentSyncs,
+		MaxKeySize:          *maxKeySize,
+		MaxValueSize:        *maxValueSize,
+		RecordErrorPolicy:   *recordErrorPolicy,
+		DuplicateKeysPolicy: *duplicateKeys,
+		MaxDeletePercent:    *maxDeletePercent,
+		MaxShortfallPercent: *maxShortfall,
+		VerifyPercent:       *verifyPercent,
+		CompactionCheck:     *compactionCheck,
+		CompactionConfig:    compactionConfigEntries(),
+		JournalDir:          *journalDir,
+		SessionTTL:          *sessionTTL,
+		IdempotencyTTL:      *idempotencyTTL,
+		EventsTopic:         *eventsTopic,
+		Notifiers:           alertNotifiers(),
+		FreshnessWindow:     *freshnessWindow,
+		FreshnessIntervals:  freshnessIntervals(),
+		ParallelIndexers:    *maxIndexings,
+		WarmTopics:          warm,
+		WarmInterval:        *warmInterval,
+		LagCheckGroups:      groups,
+		MaxConsumerLag:      *maxConsumerLag,
+		LagCheckRefuse:      *lagCheckRefuse,
+		RecordSamples:       *recordSamples,
+		RecordSampleBytes:   *recordSampleBytes,
+	})
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"plugin"
+)
+
+var pluginPaths stringsFlag
+
+func init() {
+	flag.Var(&pluginPaths, "plugin", "Go plugin (.so) to load, registering its sources and sinks from its init functions (repeatable; "+
+		"requires a cgo build, and plugins built with the same Go and module versions)")
+}
+
+// setupPlugins loads the plugins, so their connectors are registered before the sources and sinks are created.
+func setupPlugins() {
+	for _, path := range pluginPaths {
+		if _, err := plugin.Open(path); err != nil {
+			log.Fatalf("failed to load plugin %q: %v", path, err)
+		}
+
+		log.Print("loaded plugin ", path)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// readDump reads a file written by dumpTopic, in the given format (`json` or `binary`).
+func readDump(r io.Reader, format string, out chan<- KeyValue) (err error) {
+	dec := json.NewDecoder(r)
+
+	for {
+		var kv KeyValue
+
+		switch format {
+		case "json":
+			obj := JsonKV{}
+			if err = dec.Decode(&obj); err != nil {
+				break
+			}
+
+			if obj.EndOfTransfer {
+				continue
+			}
+
+			if obj.Key == nil || obj.Value == nil {
+				return fmt.Errorf("record without key or value")
+			}
+
+			kv = KeyValue{Key: *obj.Key, Value: *obj.Value}
+
+		case "binary":
+			obj := BinaryKV{}
+			if err = dec.Decode(&obj); err != nil {
+				break
+			}
+
+			if obj.EndOfTransfer {
+				continue
+			}
+
+			kv = KeyValue{Key: obj.Key, Value: obj.Value}
+
+		default:
+			return fmt.Errorf("unknown format %q", format)
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+
+		out <- kv
+	}
+}
+
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	format := flags.String("format", "binary", "Input format (json or binary)")
+	input := flags.String("i", "-", "Input file (- for stdin)")
+	doDelete := flags.Bool("delete", false, "Delete keys not present in the input")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: sync2kafka [flags] restore [-format json|binary] [-delete] [-i file] <topic>")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	topic := flags.Arg(0)
+
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			log.Fatal("failed to open input: ", err)
+		}
+
+		defer file.Close()
+		in = file
+	}
+
+	stats, err := srv.SyncFromState(topic, *doDelete, func(out chan<- KeyValue) error {
+		return readDump(bufio.NewReader(in), *format, out)
+	})
+
+	if stats != nil {
+		log.Print("sync stats:\n", stats.LogString())
+	}
+
+	if err != nil {
+		log.Fatalf("failed to restore topic %q: %v", topic, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	shutdownTimeout = flag.Duration("shutdown-timeout", time.Minute, "Maximum time to wait for the running transfers on shutdown")
+
+	// stopServing closes the listeners
+	stopServing  = func() {}
+	shutdownOnce sync.Once
+)
+
+// handleSignals triggers the actions of the signals, which depend on the platform (see signals_*.go).
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+
+	for _, signals := range [][]os.Signal{reloadSignals, dumpStacksSignals, shutdownSignals} {
+		if len(signals) != 0 { // no signal would be all signals
+			signal.Notify(c, signals...)
+		}
+	}
+
+	for sig := range c {
+		switch {
+		case isSignalIn(sig, reloadSignals):
+			reload()
+
+		case isSignalIn(sig, dumpStacksSignals):
+			log.Print("got ", sig, ", dump all stacks:\n", stacks())
+
+		case isSignalIn(sig, shutdownSignals):
+			log.Print("got ", sig, ", shutting down")
+			go shutdown()
+
+		default:
+			log.Print("got unexpected signal ", sig, ", ignoring.")
+		}
+	}
+}
+
+func isSignalIn(sig os.Signal, signals []os.Signal) bool {
+	for _, s := range signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reloads the configuration files.
+func reload() {
+	if srv != nil {
+		reloadTopics()
+	}
+}
+
+// stacks returns the stacks of all the goroutines.
+func stacks() string {
+	buf := make([]byte, 64*1024)
+	buf = buf[:runtime.Stack(buf, true)]
+	return string(buf)
+}
+
+// shutdown stops accepting connections, waits for the running transfers up to -shutdown-timeout, and exits.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		stopServing()
+
+		if srv != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			defer cancel()
+
+			log.Print("shutdown: waiting for the running transfers")
+			if err := srv.Drain(ctx); err != nil {
+				log.Printf("shutdown: transfers still running after %v", *shutdownTimeout)
+			}
+		}
+
+		log.Print("shutdown: done")
+		os.Exit(0)
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	reloadSignals     = []os.Signal{syscall.SIGHUP}
+	dumpStacksSignals = []os.Signal{syscall.SIGUSR1}
+	shutdownSignals   = []os.Signal{os.Interrupt, syscall.SIGTERM}
+)
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows has no reload or dump signals, the admin API does it (POST /reload, GET /stacks). Console
+// close, logoff and shutdown events are received as SIGTERM.
+var (
+	reloadSignals     []os.Signal
+	dumpStacksSignals []os.Signal
+	shutdownSignals   = []os.Signal{os.Interrupt, syscall.SIGTERM}
+)
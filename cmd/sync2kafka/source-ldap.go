@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/mcluseau/sync2kafka/source"
+)
+
+var (
+	ldapURL          = flag.String("ldap-url", "", "LDAP URL to search entries from (disabled if empty)")
+	ldapBindDN       = flag.String("ldap-bind-dn", "", "LDAP bind DN (anonymous if empty)")
+	ldapBindPassword = flag.String("ldap-bind-password", "", "LDAP bind password")
+	ldapBaseDN       = flag.String("ldap-base-dn", "", "LDAP search base DN")
+	ldapFilter       = flag.String("ldap-filter", "(objectClass=*)", "LDAP search filter")
+	ldapAttributes   = flag.String("ldap-attributes", "", "LDAP attributes to fetch, comma separated (all if empty)")
+	ldapPageSize     = flag.Uint("ldap-page-size", 500, "LDAP search page size")
+	ldapTopic        = flag.String("ldap-topic", "", "Topic to sync the LDAP entries to (defaults to -topic)")
+	ldapInterval     = flag.Duration("ldap-interval", time.Hour, "Interval between LDAP searches")
+)
+
+func setupLDAPSource() {
+	if len(*ldapURL) == 0 {
+		return
+	}
+
+	topic := *ldapTopic
+	if len(topic) == 0 {
+		topic = *targetTopic
+	}
+
+	if len(topic) == 0 || len(*ldapBaseDN) == 0 {
+		log.Fatal("LDAP source requires a topic and a base DN")
+	}
+
+	var attributes []string
+	if len(*ldapAttributes) != 0 {
+		attributes = strings.Split(*ldapAttributes, ",")
+	}
+
+	src := &ldapSource{
+		topic:        topic,
+		url:          *ldapURL,
+		bindDN:       *ldapBindDN,
+		bindPassword: *ldapBindPassword,
+		baseDN:       *ldapBaseDN,
+		filter:       *ldapFilter,
+		attributes:   attributes,
+		pageSize:     uint32(*ldapPageSize),
+	}
+
+	go runScheduledSource("ldap "+*ldapBaseDN, *ldapInterval, src.run)
+}
+
+func init() {
+	source.Register("ldap", newLDAPSource)
+}
+
+// newLDAPSource creates the registered ldap source, with the parameters of the -ldap-* flags:
+// url, bind-dn, bind-password, base-dn, filter, attributes and page-size.
+func newLDAPSource(params map[string]string) (src source.Source, err error) {
+	s := &ldapSource{
+		url:          params["url"],
+		bindDN:       params["bind-dn"],
+		bindPassword: params["bind-password"],
+		baseDN:       params["base-dn"],
+		filter:       "(objectClass=*)",
+		pageSize:     500,
+	}
+
+	if len(s.url) == 0 || len(s.baseDN) == 0 {
+		return nil, errors.New("ldap source requires an url and a base-dn")
+	}
+
+	if v, ok := params["filter"]; ok {
+		s.filter = v
+	}
+
+	if v := params["attributes"]; len(v) != 0 {
+		s.attributes = strings.Split(v, ",")
+	}
+
+	if v, ok := params["page-size"]; ok {
+		size, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		s.pageSize = uint32(size)
+	}
+
+	return s, nil
+}
+
+type ldapSource struct {
+	topic        string
+	url          string
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	filter       string
+	attributes   []string
+	pageSize     uint32
+}
+
+// ldapEntry is the JSON value written for each entry.
+type ldapEntry struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+func (s *ldapSource) run(_ time.Time) (err error) {
+	stats, err := srv.SyncFromSource(s.topic, true, s.Fill)
+	if err != nil {
+		return
+	}
+
+	log.Printf("source ldap: sync to %q stats:\n%s", s.topic, stats.LogString())
+	return
+}
+
+// Fill sends the entries found by the search, implementing source.Source.
+func (s *ldapSource) Fill(out chan<- KeyValue) (err error) {
+	conn, err := ldap.DialURL(s.url)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	if len(s.bindDN) != 0 {
+		if err = conn.Bind(s.bindDN, s.bindPassword); err != nil {
+			return
+		}
+	}
+
+	req := ldap.NewSearchRequest(s.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, s.filter, s.attributes, nil)
+
+	res, err := conn.SearchWithPaging(req, s.pageSize)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range res.Entries {
+		value := ldapEntry{
+			DN:         entry.DN,
+			Attributes: make(map[string][]string, len(entry.Attributes)),
+		}
+
+		for _, attr := range entry.Attributes {
+			value.Attributes[attr.Name] = attr.Values
+		}
+
+		ba, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		out <- KeyValue{
+			Key:   []byte(entry.DN),
+			Value: ba,
+		}
+	}
+
+	return
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mcluseau/sync2kafka/source"
+)
+
+var (
+	mongoURI          = flag.String("mongo-uri", "", "MongoDB URI to snapshot a collection from (disabled if empty)")
+	mongoDatabase     = flag.String("mongo-database", "", "MongoDB database of the collection")
+	mongoCollection   = flag.String("mongo-collection", "", "MongoDB collection to snapshot")
+	mongoKeyField     = flag.String("mongo-key-field", "_id", "MongoDB document field to use as the key")
+	mongoTopic        = flag.String("mongo-topic", "", "Topic to sync the MongoDB collection to (defaults to -topic)")
+	mongoInterval     = flag.Duration("mongo-interval", time.Hour, "Interval between MongoDB collection snapshots")
+	mongoChangeStream = flag.Bool("mongo-change-stream", false, "Apply MongoDB change stream events between snapshots")
+)
+
+func setupMongoSource() {
+	if len(*mongoURI) == 0 {
+		return
+	}
+
+	topic := *mongoTopic
+	if len(topic) == 0 {
+		topic = *targetTopic
+	}
+
+	if len(topic) == 0 || len(*mongoDatabase) == 0 || len(*mongoCollection) == 0 {
+		log.Fatal("MongoDB source requires a topic, a database and a collection")
+	}
+
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(*mongoURI))
+	if err != nil {
+		log.Fatal("failed to connect to MongoDB: ", err)
+	}
+
+	src := &mongoSource{
+		coll:     client.Database(*mongoDatabase).Collection(*mongoCollection),
+		keyField: *mongoKeyField,
+		topic:    topic,
+	}
+
+	name := fmt.Sprintf("mongodb %s.%s", *mongoDatabase, *mongoCollection)
+	go runScheduledSource(name, *mongoInterval, src.run)
+}
+
+func init() {
+	source.Register("mongo", newMongoSource)
+}
+
+// newMongoSource creates the registered mongo source, snapshotting a collection with the parameters of the
+// -mongo-* flags: uri, database, collection and key-field. Its change stream is only applied with the flags.
+func newMongoSource(params map[string]string) (src source.Source, err error) {
+	uri, database, collection := params["uri"], params["database"], params["collection"]
+
+	if len(uri) == 0 || len(database) == 0 || len(collection) == 0 {
+		return nil, errors.New("mongo source requires an uri, a database and a collection")
+	}
+
+	keyField := "_id"
+	if v, ok := params["key-field"]; ok {
+		keyField = v
+	}
+
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		return
+	}
+
+	return &mongoSource{
+		coll:     client.Database(database).Collection(collection),
+		keyField: keyField,
+	}, nil
+}
+
+type mongoSource struct {
+	coll     *mongo.Collection
+	keyField string
+	topic    string
+}
+
+func (s *mongoSource) run(next time.Time) (err error) {
+	ctx, cancel := context.WithDeadline(context.Background(), next)
+	defer cancel()
+
+	var stream *mongo.ChangeStream
+	if *mongoChangeStream {
+		// open the stream before the snapshot so we don't miss changes made during it
+		stream, err = s.coll.Watch(ctx, mongo.Pipeline{},
+			options.ChangeStream().SetFullDocument(options.UpdateLookup))
+		if err != nil {
+			return
+		}
+
+		defer stream.Close(context.Background())
+	}
+
+	stats, err := srv.SyncFromSource(s.topic, true, s.Fill)
+	if err != nil {
+		return
+	}
+
+	log.Printf("source mongodb: sync to %q stats:\n%s", s.topic, stats.LogString())
+
+	if stream == nil {
+		return
+	}
+
+	return srv.ProduceFromSource(s.topic, func(produce func(KeyValue) error, cancelled <-chan bool) error {
+		return s.applyChanges(ctx, stream, produce, cancelled)
+	})
+}
+
+// Fill sends the documents of the collection, implementing source.Source.
+func (s *mongoSource) Fill(out chan<- KeyValue) (err error) {
+	ctx := context.Background()
+
+	cursor, err := s.coll.Find(ctx, bson.D{})
+	if err != nil {
+		return
+	}
+
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		kv, err := s.keyValue(cursor.Current)
+		if err != nil {
+			return err
+		}
+
+		if kv.Key == nil {
+			continue
+		}
+
+		out <- kv
+	}
+
+	return cursor.Err()
+}
+
+// keyValue serializes a document, using the key field as the key. The key is nil if the field is missing.
+func (s *mongoSource) keyValue(doc bson.Raw) (kv KeyValue, err error) {
+	kv.Key = mongoKey(doc, s.keyField)
+	if kv.Key == nil {
+		return
+	}
+
+	kv.Value, err = bson.MarshalExtJSON(doc, false, false)
+	return
+}
+
+func mongoKey(doc bson.Raw, field string) []byte {
+	v, err := doc.LookupErr(field)
+	if err != nil {
+		return nil
+	}
+
+	if s, ok := v.StringValueOK(); ok {
+		return []byte(s)
+	}
+
+	if oid, ok := v.ObjectIDOK(); ok {
+		return []byte(oid.Hex())
+	}
+
+	return []byte(v.String())
+}
+
+type mongoChangeEvent struct {
+	OperationType string   `bson:"operationType"`
+	FullDocument  bson.Raw `bson:"fullDocument"`
+	DocumentKey   bson.Raw `bson:"documentKey"`
+}
+
+// applyChanges produces the events of the stream until ctx's deadline, or until cancelled is closed.
+func (s *mongoSource) applyChanges(ctx context.Context, stream *mongo.ChangeStream, produce func(KeyValue) error, cancelled <-chan bool) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-cancelled:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for stream.Next(ctx) {
+		ev := mongoChangeEvent{}
+		if err = stream.Decode(&ev); err != nil {
+			return
+		}
+
+		var kv KeyValue
+
+		switch ev.OperationType {
+		case "insert", "update", "replace":
+			if ev.FullDocument == nil {
+				continue // deleted since
+			}
+
+			if kv, err = s.keyValue(ev.FullDocument); err != nil {
+				return
+			}
+
+		case "delete":
+			// only the _id is known on deletion, other key fields will be handled by the next snapshot
+			if s.keyField != "_id" {
+				continue
+			}
+
+			kv.Key = mongoKey(ev.DocumentKey, "_id")
+			kv.Value = []byte{}
+
+		default:
+			continue
+		}
+
+		if kv.Key == nil {
+			continue
+		}
+
+		if err = produce(kv); err != nil {
+			return
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil // time for the next snapshot
+	}
+
+	select {
+	case <-cancelled:
+		return errors.New("change stream stopped: the topic's lock was force-released or expired")
+	default:
+	}
+
+	return stream.Err()
+}
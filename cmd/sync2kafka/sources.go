@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/source"
+)
+
+var sourceSpecs stringsFlag
+
+func init() {
+	flag.Var(&sourceSpecs, "source", "Registered source to run, as name?topic=...&interval=...&delete=...&param=... (repeatable; "+
+		"topic defaults to -topic, interval to 1h, delete to false, other parameters are the source's)")
+}
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runScheduledSource calls run every interval, logging failures with the source name.
+func runScheduledSource(name string, interval time.Duration, run func(next time.Time) error) {
+	for {
+		next := time.Now().Add(interval)
+
+		log.Printf("source %s: starting", name)
+		if err := run(next); err != nil {
+			log.Printf("source %s: failed: %v", name, err)
+		}
+
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// setupRegisteredSources starts the sources of the -source flags.
+func setupRegisteredSources() {
+	for _, spec := range sourceSpecs {
+		name, query := spec, ""
+		if idx := strings.IndexByte(spec, '?'); idx != -1 {
+			name, query = spec[:idx], spec[idx+1:]
+		}
+
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			log.Fatalf("invalid source %q: %v", spec, err)
+		}
+
+		params := make(map[string]string, len(values))
+		for k := range values {
+			params[k] = values.Get(k)
+		}
+
+		topic := *targetTopic
+		if v, ok := params["topic"]; ok {
+			topic = v
+			delete(params, "topic")
+		}
+
+		interval := time.Hour
+		if v, ok := params["interval"]; ok {
+			if interval, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("invalid source %q interval: %v", name, err)
+			}
+			delete(params, "interval")
+		}
+
+		doDelete := false
+		if v, ok := params["delete"]; ok {
+			if doDelete, err = strconv.ParseBool(v); err != nil {
+				log.Fatalf("invalid source %q delete: %v", name, err)
+			}
+			delete(params, "delete")
+		}
+
+		if len(topic) == 0 {
+			log.Fatalf("source %q requires a topic", name)
+		}
+
+		src, err := source.New(name, params)
+		if err != nil {
+			log.Fatalf("failed to create source %q (available: %s): %v", name, strings.Join(source.Names(), ", "), err)
+		}
+
+		go runScheduledSource(name+" to "+topic, interval, func(_ time.Time) (err error) {
+			stats, err := srv.SyncFromSource(topic, doDelete, src.Fill)
+			if err != nil {
+				return
+			}
+
+			log.Printf("source %s: sync to %q stats:\n%s", name, topic, stats.LogString())
+			return
+		})
+	}
+}
@@ -19,17 +19,17 @@ type storeAPI struct{}
 
 func (a *storeAPI) Register(ws *restful.WebService) {
 	ws.Route(ws.GET("/store/stats").To(a.Stats))
-	ws.Route(ws.POST("/store/cleanup").To(a.Cleanup))
+	ws.Route(ws.POST("/store/cleanup").To(a.Cleanup).Filter(adminFilter))
 
 	bucketParam := ws.PathParameter("bucket-name", "Name of the bucket")
 
 	ws.Route(ws.GET("/store/buckets").To(a.ListBuckets))
-	ws.Route(ws.GET("/store/buckets/{bucket-name}").To(a.GetBucket).Param(bucketParam))
-	ws.Route(ws.DELETE("/store/buckets/{bucket-name}").To(a.DeleteBucket).Param(bucketParam))
+	ws.Route(ws.GET("/store/buckets/{bucket-name}").To(a.GetBucket).Param(bucketParam).Filter(adminFilter))
+	ws.Route(ws.DELETE("/store/buckets/{bucket-name}").To(a.DeleteBucket).Param(bucketParam).Filter(adminFilter))
 
-	ws.Route(ws.GET("/store/buckets/{bucket-name}/dump").To(a.DumpBucket).Param(bucketParam).
+	ws.Route(ws.GET("/store/buckets/{bucket-name}/dump").To(a.DumpBucket).Param(bucketParam).Filter(adminFilter).
 		Produces("application/x-jsonlines"))
-	ws.Route(ws.POST("/store/buckets/{bucket-name}/load").To(a.LoadBucket).Param(bucketParam).
+	ws.Route(ws.POST("/store/buckets/{bucket-name}/load").To(a.LoadBucket).Param(bucketParam).Filter(adminFilter).
 		Consumes("application/x-jsonlines"))
 }
 
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+// topCommand shows the connections of a running server, refreshed like top(1), from its HTTP API.
+func topCommand(args []string) {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	apiURL := flags.String("url", "http://localhost:8080", "URL of the server's HTTP API")
+	token := flags.String("token", "", "Token of the HTTP API (admin or read-only)")
+	interval := flags.Duration("interval", 2*time.Second, "Refresh interval")
+	topic := flags.String("topic", "", "Only show the connections to this topic")
+	limit := flags.Int("limit", 50, "Maximum number of connections shown")
+	once := flags.Bool("once", false, "Print the connections once, without refreshing the screen")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: sync2kafka top [-url url] [-token token] [-interval duration] [-topic topic] [-limit n] [-once]")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(*limit))
+	if len(*topic) != 0 {
+		query.Set("topic", *topic)
+	}
+
+	t := &topView{
+		url:   strings.TrimSuffix(*apiURL, "/") + "/connections/list?" + query.Encode(),
+		token: *token,
+	}
+
+	if *once {
+		buf := &bytes.Buffer{}
+		err := t.refresh(buf)
+		os.Stdout.Write(buf.Bytes())
+
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		// render before clearing the screen, to avoid flickering on slow APIs
+		buf := &bytes.Buffer{}
+		t.refresh(buf)
+
+		os.Stdout.WriteString("\033[H\033[2J")
+		os.Stdout.Write(buf.Bytes())
+
+		<-ticker.C
+	}
+}
+
+type topView struct {
+	url   string
+	token string
+
+	// previous statuses and time they were fetched, to compute the throughputs
+	previous map[string]server.ConnStatus
+	lastTime time.Time
+}
+
+// refresh fetches the connections and renders them to out.
+func (t *topView) refresh(out io.Writer) (err error) {
+	now := time.Now()
+
+	fmt.Fprintf(out, "sync2kafka top - %s - %s\n\n", t.url, now.Format("15:04:05"))
+
+	page, err := t.fetch()
+	if err != nil {
+		fmt.Fprintln(out, "error:", err)
+		return
+	}
+
+	active := make([]server.ConnStatus, 0)
+	recent := make([]server.ConnStatus, 0)
+
+	for _, cs := range page.Items {
+		if cs.EndTime.IsZero() {
+			active = append(active, cs)
+		} else {
+			recent = append(recent, cs)
+		}
+	}
+
+	fmt.Fprintf(out, "%d active, %d recent (%d matching)\n\n", len(active), len(recent), page.Total)
+
+	fmt.Fprintln(out, "ACTIVE")
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REMOTE\tTOPIC\tCLIENT\tSTATUS\tPHASE\tREAD\tREAD %\tRECORDS/S\tBYTES/S\tPRODUCED\tELAPSED")
+
+	for _, cs := range active {
+		records, bytes := t.throughput(cs, now)
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%.0f\t%s\t%d\t%s\n",
+			cs.Remote, cs.TargetTopic, cs.ClientName, cs.Status, cs.Progress.Phase,
+			cs.ItemsRead, readPercent(cs), records, formatBytes(bytes), cs.Progress.RecordsProduced,
+			now.Sub(cs.StartTime).Truncate(time.Second))
+	}
+
+	tw.Flush()
+
+	fmt.Fprintln(out, "\nRECENT")
+
+	tw = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REMOTE\tTOPIC\tCLIENT\tSTATUS\tREAD\tPRODUCED\tDELETES\tDURATION\tENDED")
+
+	for _, cs := range recent {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s ago\n",
+			cs.Remote, cs.TargetTopic, cs.ClientName, cs.Status, cs.ItemsRead,
+			cs.Progress.RecordsProduced, cs.Progress.DeletesEmitted,
+			cs.EndTime.Sub(cs.StartTime).Truncate(time.Millisecond), now.Sub(cs.EndTime).Truncate(time.Second))
+	}
+
+	tw.Flush()
+
+	t.previous = make(map[string]server.ConnStatus, len(active))
+	for _, cs := range active {
+		t.previous[cs.Remote] = cs
+	}
+	t.lastTime = now
+
+	return
+}
+
+func (t *topView) fetch() (page server.ConnectionsPage, err error) {
+	req, err := http.NewRequest(http.MethodGet, t.url, nil)
+	if err != nil {
+		return
+	}
+
+	if len(t.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return
+}
+
+// throughput returns the records and bytes read per second by the connection since the previous
+// refresh, or since its start if it's new.
+func (t *topView) throughput(cs server.ConnStatus, now time.Time) (records, bytes float64) {
+	items, read, since := cs.ItemsRead, cs.BytesRead, cs.StartTime
+
+	if prev, ok := t.previous[cs.Remote]; ok && prev.StartTime.Equal(cs.StartTime) {
+		items -= prev.ItemsRead
+		read -= prev.BytesRead
+		since = t.lastTime
+	}
+
+	elapsed := now.Sub(since).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	return float64(items) / elapsed, float64(read) / elapsed
+}
+
+// readPercent returns the part of the announced records read, if the client announced them.
+func readPercent(cs server.ConnStatus) string {
+	if cs.ExpectedRecords == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", cs.ReadPercent)
+}
+
+// formatBytes formats a number of bytes with a binary unit.
+func formatBytes(n float64) string {
+	const units = "KMGTPE"
+
+	if n < 1024 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", n, units[i])
+}
@@ -1,40 +0,0 @@
-package main
-
-import (
-	"log"
-	"runtime"
-	"sync"
-)
-
-var (
-	lockedTopics      = map[string]bool{}
-	lockedTopicsMutex = sync.Mutex{}
-)
-
-func lockTopic(topic string) bool {
-	lockedTopicsMutex.Lock()
-	defer lockedTopicsMutex.Unlock()
-
-	if lockedTopics[topic] {
-		return false
-	}
-
-	lockedTopics[topic] = true
-	return true
-}
-
-func unlockTopic(topic string) {
-	lockedTopicsMutex.Lock()
-	defer lockedTopicsMutex.Unlock()
-
-	delete(lockedTopics, topic)
-
-	if len(lockedTopics) == 0 {
-		// no more topics sync'ing, let's GC
-		go func() {
-			log.Print("manual GC...")
-			runtime.GC()
-			log.Print("manual GC finished.")
-		}()
-	}
-}
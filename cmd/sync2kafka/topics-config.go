@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+var (
+	topicsConfigFile = flag.String("topics-config", "", "JSON file with Kafka clusters, per-topic and per-virtual host configurations (reloaded on SIGHUP, except the clusters)")
+
+	clusters map[string]backend.Backend
+)
+
+// topicsConfig is the content of the topics configuration file.
+type topicsConfig struct {
+	// Clusters are the Kafka clusters topics can target, by name.
+	Clusters map[string]struct {
+		Brokers []string `json:"brokers"`
+		// Backend overrides the -kafka-backend flag (ie "redis" to hydrate a cache, "nats" or "pulsar").
+		Backend string `json:"backend"`
+	} `json:"clusters"`
+
+	// Topics are the configurations specific to topics, by name.
+	Topics map[string]server.TopicConfig `json:"topics"`
+
+	// VirtualHosts are the configurations of the clients connecting with TLS to a hostname, by hostname.
+	VirtualHosts map[string]server.VirtualHost `json:"virtualHosts"`
+
+	// TokenPriorities are the priorities of the syncs by token, overriding the topics' ones.
+	TokenPriorities map[string]int `json:"tokenPriorities"`
+}
+
+func readTopicsConfig() (config topicsConfig, err error) {
+	data, err := ioutil.ReadFile(*topicsConfigFile)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &config)
+	return
+}
+
+// readTopicsConfigIfAny reads the topics configuration, empty if there's none.
+func readTopicsConfigIfAny() (config topicsConfig, err error) {
+	if len(*topicsConfigFile) == 0 {
+		return
+	}
+	return readTopicsConfig()
+}
+
+// setupClusters connects to the clusters of the topics configuration, with the same settings as the main cluster.
+func setupClusters() {
+	if len(*topicsConfigFile) == 0 {
+		return
+	}
+
+	config, err := readTopicsConfig()
+	if err != nil {
+		log.Fatal("failed to read the topics configuration: ", err)
+	}
+
+	clusters = make(map[string]backend.Backend, len(config.Clusters))
+
+	for name, cluster := range config.Clusters {
+		backendName := cluster.Backend
+		if len(backendName) == 0 {
+			backendName = *kafkaBackend
+		}
+
+		clusters[name], err = backend.New(backendName, cluster.Brokers, kafkaConfig())
+		if err != nil {
+			log.Fatalf("failed to connect to Kafka cluster %q: %v", name, err)
+		}
+
+		log.Printf("connected to Kafka cluster %q (backend: %s, brokers: %s)", name, backendName, strings.Join(cluster.Brokers, ","))
+	}
+}
+
+// loadTopics reads and validates the topics configuration.
+func loadTopics() (config topicsConfig, err error) {
+	if len(*topicsConfigFile) == 0 {
+		return
+	}
+
+	if config, err = readTopicsConfig(); err != nil {
+		return
+	}
+
+	for name, topic := range config.Topics {
+		if err = topic.Validate(clusters); err != nil {
+			return topicsConfig{}, fmt.Errorf("topic %q: %v", name, err)
+		}
+	}
+
+	for hostname, vhost := range config.VirtualHosts {
+		if err = vhost.Validate(); err != nil {
+			return topicsConfig{}, fmt.Errorf("virtual host %q: %v", hostname, err)
+		}
+	}
+
+	return
+}
+
+// reloadTopics updates the server's topics' configurations, keeping the current ones on error.
+func reloadTopics() {
+	if len(*topicsConfigFile) == 0 {
+		return
+	}
+
+	config, err := loadTopics()
+	if err != nil {
+		log.Print("failed to reload the topics configuration: ", err)
+		return
+	}
+
+	srv.SetTopics(config.Topics)
+	srv.SetVirtualHosts(config.VirtualHosts)
+	srv.SetTokenPriorities(config.TokenPriorities)
+	log.Printf("topics configuration reloaded (%d topics, %d virtual hosts)", len(config.Topics), len(config.VirtualHosts))
+}
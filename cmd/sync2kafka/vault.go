@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	vaultAddr      = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "Vault address (secrets are read from Vault if set)")
+	vaultTokenFile = flag.String("vault-token-file", "", "File containing the Vault token (VAULT_TOKEN is used if not set)")
+	vaultSecret    = flag.String("vault-secret", "secret/data/sync2kafka", "Vault path of the secret, with the token, tls-cert, tls-key, kafka-sasl-user and kafka-sasl-password fields (all optional)")
+	vaultRefresh   = flag.Duration("vault-refresh", 5*time.Minute, "Period of the Vault token renewal and secret reload")
+
+	vault *vaultClient
+
+	// vaultCert is the TLS certificate read from Vault, if any
+	vaultCert      *tls.Certificate
+	vaultCertMutex sync.Mutex
+)
+
+// vaultClient reads secrets with the Vault HTTP API.
+type vaultClient struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func setupVault() {
+	if len(*vaultAddr) == 0 {
+		return
+	}
+
+	vaultToken := os.Getenv("VAULT_TOKEN")
+	if len(*vaultTokenFile) != 0 {
+		tokenBytes, err := ioutil.ReadFile(*vaultTokenFile)
+		if err != nil {
+			log.Fatal("failed to read the Vault token: ", err)
+		}
+		vaultToken = strings.TrimSpace(string(tokenBytes))
+	}
+
+	vault = &vaultClient{
+		addr:   strings.TrimSuffix(*vaultAddr, "/"),
+		token:  vaultToken,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	secret, err := vault.readSecret(*vaultSecret)
+	if err != nil {
+		log.Fatal("failed to read the secret from Vault: ", err)
+	}
+
+	if v, ok := secret["token"]; ok {
+		*token = v
+	}
+
+	if v, ok := secret["kafka-sasl-user"]; ok {
+		*kafkaSASLUser = v
+	}
+
+	if v, ok := secret["kafka-sasl-password"]; ok {
+		*kafkaSASLPassword = v
+	}
+
+	if err := loadVaultCert(secret); err != nil {
+		log.Fatal("failed to load the TLS key pair from Vault: ", err)
+	}
+
+	log.Print("secrets loaded from Vault")
+}
+
+// refreshVault periodically renews the Vault token and reloads the secret, updating the server's
+// token and TLS certificate, and reconnecting to Kafka when its credentials changed.
+func refreshVault() {
+	if vault == nil {
+		return
+	}
+
+	for range time.Tick(*vaultRefresh) {
+		if err := vault.renewToken(); err != nil {
+			log.Print("failed to renew the Vault token: ", err)
+		}
+
+		secret, err := vault.readSecret(*vaultSecret)
+		if err != nil {
+			log.Print("failed to reload the secret from Vault: ", err)
+			continue
+		}
+
+		if v, ok := secret["token"]; ok {
+			srv.SetToken(v)
+		}
+
+		if err := loadVaultCert(secret); err != nil {
+			log.Print("failed to reload the TLS key pair from Vault: ", err)
+		}
+
+		refreshKafkaCredentials(secret)
+	}
+}
+
+// refreshKafkaCredentials reconnects to Kafka if the secret's credentials changed. The previous ones
+// are kept if the reconnection fails, to retry on the next refresh.
+func refreshKafkaCredentials(secret map[string]string) {
+	user, password := *kafkaSASLUser, *kafkaSASLPassword
+
+	if v, ok := secret["kafka-sasl-user"]; ok {
+		user = v
+	}
+
+	if v, ok := secret["kafka-sasl-password"]; ok {
+		password = v
+	}
+
+	if user == *kafkaSASLUser && password == *kafkaSASLPassword {
+		return
+	}
+
+	previousUser, previousPassword := *kafkaSASLUser, *kafkaSASLPassword
+	*kafkaSASLUser, *kafkaSASLPassword = user, password
+
+	if err := reconnectKafka(); err != nil {
+		log.Print("failed to reconnect to Kafka with the credentials from Vault: ", err)
+		*kafkaSASLUser, *kafkaSASLPassword = previousUser, previousPassword
+	}
+}
+
+func loadVaultCert(secret map[string]string) error {
+	certPEM, hasCert := secret["tls-cert"]
+	keyPEM, hasKey := secret["tls-key"]
+
+	if !hasCert || !hasKey {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return err
+	}
+
+	vaultCertMutex.Lock()
+	vaultCert = &cert
+	vaultCertMutex.Unlock()
+
+	return nil
+}
+
+// getVaultCertificate is a tls.Config.GetCertificate returning the certificate from Vault.
+func getVaultCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	vaultCertMutex.Lock()
+	defer vaultCertMutex.Unlock()
+
+	return vaultCert, nil
+}
+
+// readSecret reads a secret's fields. KV version 2 secrets are supported.
+func (v *vaultClient) readSecret(path string) (fields map[string]string, err error) {
+	res := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	if err = v.call("GET", "/v1/"+strings.TrimPrefix(path, "/"), &res); err != nil {
+		return
+	}
+
+	data := res.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested // KV v2
+	}
+
+	fields = make(map[string]string, len(data))
+	for k, value := range data {
+		if s, ok := value.(string); ok {
+			fields[k] = s
+		}
+	}
+
+	return
+}
+
+// renewToken extends the lease of the token.
+func (v *vaultClient) renewToken() error {
+	return v.call("POST", "/v1/auth/token/renew-self", nil)
+}
+
+func (v *vaultClient) call(method, path string, result interface{}) (err error) {
+	req, err := http.NewRequest(method, v.addr+path, nil)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("X-Vault-Token", v.token)
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("vault answered %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	if result == nil {
+		return
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(result); err != nil {
+		return errors.New("invalid vault response: " + err.Error())
+	}
+
+	return
+}
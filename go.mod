@@ -2,27 +2,30 @@ module github.com/mcluseau/sync2kafka
 
 require (
 	github.com/Shopify/sarama v1.25.0
+	github.com/apache/pulsar-client-go v0.12.0
 	github.com/boltdb/bolt v1.3.1
 	github.com/emicklei/go-restful v2.11.0+incompatible
 	github.com/emicklei/go-restful-openapi v1.2.0
 	github.com/frankban/quicktest v1.5.0 // indirect
+	github.com/go-ldap/ldap/v3 v3.2.4
 	github.com/go-openapi/jsonreference v0.19.3 // indirect
 	github.com/go-openapi/spec v0.19.4 // indirect
+	github.com/gomodule/redigo v1.8.9
 	github.com/hashicorp/go-uuid v1.0.2 // indirect
-	github.com/json-iterator/go v1.1.7 // indirect
+	github.com/hashicorp/yamux v0.1.1
 	github.com/mailru/easyjson v0.7.0 // indirect
 	github.com/mcluseau/go-diff v1.0.8
 	github.com/mcluseau/go-swagger-ui v0.0.0-20191019002626-fd9128c24a34
 	github.com/mcluseau/kafka-sync v1.0.10-0.20200113221917-ff58513e3726
-	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/nats-io/nats.go v1.31.0
 	github.com/oklog/ulid v1.3.1
 	github.com/pierrec/lz4 v2.4.0+incompatible // indirect
-	github.com/spaolacci/murmur3 v1.1.0 // indirect
-	golang.org/x/crypto v0.0.0-20200109152110-61a87790db17 // indirect
-	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553 // indirect
-	golang.org/x/sys v0.0.0-20191025021431-6c3a3bfe00ae // indirect
-	gopkg.in/yaml.v2 v2.2.4 // indirect
+	github.com/prometheus/client_golang v1.11.1
+	github.com/segmentio/kafka-go v0.4.47
+	github.com/ugorji/go/codec v1.2.7
+	go.mongodb.org/mongo-driver v1.17.10
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.25.0
 )
 
 go 1.13
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Alert kinds.
+const (
+	AlertSyncFailed = "sync-failed"
+	AlertStaleTopic = "stale-topic"
+)
+
+// Alert is sent to the notifiers when a sync fails or a topic is stale.
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Topic   string    `json:"topic"`
+	SyncID  string    `json:"syncId,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier sends alerts somewhere.
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// NewSlackNotifier returns a notifier posting to a Slack incoming webhook.
+func NewSlackNotifier(url string) Notifier {
+	return webhookNotifier{url: url, payload: func(alert Alert) interface{} {
+		return map[string]string{"text": alertText(alert)}
+	}}
+}
+
+// NewTeamsNotifier returns a notifier posting to a Microsoft Teams incoming webhook.
+func NewTeamsNotifier(url string) Notifier {
+	return webhookNotifier{url: url, payload: func(alert Alert) interface{} {
+		return map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  "sync2kafka: " + alert.Kind,
+			"title":    "sync2kafka: " + alert.Kind,
+			"text":     alertText(alert),
+		}
+	}}
+}
+
+// NewWebhookNotifier returns a notifier posting the alerts as JSON.
+func NewWebhookNotifier(url string) Notifier {
+	return webhookNotifier{url: url, payload: func(alert Alert) interface{} { return alert }}
+}
+
+func alertText(alert Alert) string {
+	return fmt.Sprintf("[%s] topic %q: %s", alert.Kind, alert.Topic, alert.Message)
+}
+
+type webhookNotifier struct {
+	url     string
+	payload func(Alert) interface{}
+}
+
+func (n webhookNotifier) Notify(alert Alert) (err error) {
+	body, err := json.Marshal(n.payload(alert))
+	if err != nil {
+		return
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	res, err := httpClient.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		err = fmt.Errorf("webhook answered %s", res.Status)
+	}
+
+	return
+}
+
+// alert sends the alert to all the notifiers, in the background.
+func (s *Server) alert(alert Alert) {
+	alert.Time = time.Now()
+
+	log.Printf("alert: %s", alertText(alert))
+
+	for _, notifier := range s.opts.Notifiers {
+		go func(notifier Notifier) {
+			if err := notifier.Notify(alert); err != nil {
+				log.Print("failed to send alert: ", err)
+			}
+		}(notifier)
+	}
+}
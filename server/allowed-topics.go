@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrNoAllowedTopicsFile is returned when managing allowed topics without allowed topics file.
+	ErrNoAllowedTopicsFile = errors.New("no allowed topics file")
+
+	// ErrInvalidTopicName is returned when allowing a topic that can't be written in the allowed topics file.
+	ErrInvalidTopicName = errors.New("invalid topic name")
+)
+
+// IsTopicAllowed returns true if the topic can be synchronized.
+func (s *Server) IsTopicAllowed(topic string) bool {
+	if s.opts.AllowAllTopics {
+		return true
+	}
+
+	if _, ok := s.topicConfig(topic); ok {
+		return true
+	}
+
+	if len(s.opts.AllowedTopicsFile) == 0 {
+		return topic == s.opts.DefaultTopic
+	}
+
+	topics, err := s.AllowedTopics()
+	if err != nil {
+		log.Print("failed to read allowed topics, not allowing: ", err)
+		return false
+	}
+
+	for _, allowed := range topics {
+		if allowed == topic {
+			return true
+		}
+	}
+
+	// nothing more to allow
+	return false
+}
+
+// AllowedTopics returns the topics of the allowed topics file.
+func (s *Server) AllowedTopics() (topics []string, err error) {
+	if len(s.opts.AllowedTopicsFile) == 0 {
+		err = ErrNoAllowedTopicsFile
+		return
+	}
+
+	s.allowedTopicsMutex.Lock()
+	defer s.allowedTopicsMutex.Unlock()
+
+	lines, err := s.readAllowedTopicsFile()
+	if err != nil {
+		return
+	}
+
+	topics = make([]string, 0, len(lines))
+	for _, line := range lines {
+		if isAllowedTopicLine(line) {
+			topics = append(topics, line)
+		}
+	}
+
+	return
+}
+
+// AllowTopic adds the topic to the allowed topics file.
+func (s *Server) AllowTopic(topic string) (err error) {
+	if !isAllowedTopicLine(topic) || strings.ContainsAny(topic, "\r\n") {
+		return ErrInvalidTopicName
+	}
+
+	return s.updateAllowedTopics(func(lines []string) []string {
+		for _, line := range lines {
+			if line == topic {
+				return lines
+			}
+		}
+
+		return append(lines, topic)
+	})
+}
+
+// DisallowTopic removes the topic from the allowed topics file.
+func (s *Server) DisallowTopic(topic string) (err error) {
+	return s.updateAllowedTopics(func(lines []string) []string {
+		kept := lines[:0]
+		for _, line := range lines {
+			if line != topic {
+				kept = append(kept, line)
+			}
+		}
+
+		return kept
+	})
+}
+
+// isAllowedTopicLine returns true if the line of the allowed topics file is a topic.
+func isAllowedTopicLine(line string) bool {
+	return len(line) != 0 && line[0] != '#'
+}
+
+// readAllowedTopicsFile returns the lines of the allowed topics file; a missing file has no lines.
+func (s *Server) readAllowedTopicsFile() (lines []string, err error) {
+	file, err := os.Open(s.opts.AllowedTopicsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// updateAllowedTopics rewrites the allowed topics file with the lines returned by update, keeping comments.
+func (s *Server) updateAllowedTopics(update func(lines []string) []string) (err error) {
+	if len(s.opts.AllowedTopicsFile) == 0 {
+		return ErrNoAllowedTopicsFile
+	}
+
+	s.allowedTopicsMutex.Lock()
+	defer s.allowedTopicsMutex.Unlock()
+
+	lines, err := s.readAllowedTopicsFile()
+	if err != nil {
+		return
+	}
+
+	lines = update(lines)
+
+	// write a new file then rename it, so readers never see a partial file
+	path := s.opts.AllowedTopicsFile
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(tmp.Name())
+
+	content := strings.Join(lines, "\n")
+	if len(lines) != 0 {
+		content += "\n"
+	}
+
+	if _, err = tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return
+	}
+
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	mode := os.FileMode(0644)
+	if info, statErr := os.Stat(path); statErr == nil {
+		mode = info.Mode()
+	}
+
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+// AuthRequest is sent to the auth webhook to authorize a sync.
+type AuthRequest struct {
+	Token    string `json:"token"`
+	Topic    string `json:"topic"`
+	Remote   string `json:"remote"`
+	DoDelete bool   `json:"doDelete"`
+
+	ClientName    string `json:"clientName,omitempty"`
+	ClientVersion string `json:"clientVersion,omitempty"`
+}
+
+// AuthResponse is the auth webhook's decision.
+type AuthResponse struct {
+	Allow bool `json:"allow"`
+
+	// Reason of a denial, given to the client
+	Reason string `json:"reason,omitempty"`
+
+	// Code of a denial's error, one of the client.Err* (client.ErrUnauthorized if empty)
+	Code string `json:"code,omitempty"`
+
+	// Constraints on an allowed sync
+	Constraints AuthConstraints `json:"constraints"`
+}
+
+// AuthConstraints restrict a sync allowed by the auth webhook.
+type AuthConstraints struct {
+	// NoDelete refuses syncs with deletions.
+	NoDelete bool `json:"noDelete,omitempty"`
+
+	// MaxKeySize lowers the server's maximum key size (no change if 0).
+	MaxKeySize int `json:"maxKeySize,omitempty"`
+
+	// MaxValueSize lowers the server's maximum value size (no change if 0).
+	MaxValueSize int `json:"maxValueSize,omitempty"`
+}
+
+// builtinAuth returns the authorization of the syncs through the virtual host: the auth webhook if set,
+// or the checks of the token and allowed topics.
+func (s *Server) builtinAuth(vhost *VirtualHost) AuthFunc {
+	return func(req AuthRequest) (res AuthResponse, err error) {
+		if len(s.opts.AuthWebhook) != 0 {
+			if res, err = s.authorize(req); err == nil && !res.Allow {
+				res.Reason = "not allowed: " + res.Reason
+			}
+			return
+		}
+
+		switch {
+		case !s.isVirtualHostTokenValid(vhost, req.Topic, req.Token):
+			res.Reason = "authentication failed: wrong token"
+
+		case !s.isVirtualHostTopicAllowed(vhost, req.Topic):
+			res.Code = client.ErrTopicNotAllowed
+			res.Reason = fmt.Sprintf("topic %q is not allowed", req.Topic)
+
+		default:
+			res.Allow = true
+		}
+
+		return
+	}
+}
+
+// authorize asks the auth webhook if the sync is allowed.
+func (s *Server) authorize(req AuthRequest) (res AuthResponse, err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	httpClient := &http.Client{Timeout: s.opts.AuthWebhookTimeout}
+
+	httpRes, err := httpClient.Post(s.opts.AuthWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	defer httpRes.Body.Close()
+
+	if httpRes.StatusCode != http.StatusOK {
+		err = fmt.Errorf("auth webhook answered %s", httpRes.Status)
+		return
+	}
+
+	err = json.NewDecoder(httpRes.Body).Decode(&res)
+	return
+}
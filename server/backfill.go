@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+// BackfillRequest copies the state of a topic into another, ie: to rename or repartition it.
+type BackfillRequest struct {
+	// Source is the topic whose state (the last value of each key not deleted) is copied.
+	Source string `json:"source"`
+
+	// Transforms applied to the copied records, ie: to prefix the keys. The transforms of the target
+	// topic are not applied, the source's records already went through those of the source topic.
+	Transforms []Transform `json:"transforms,omitempty"`
+
+	// DoDelete deletes the keys of the target topic not copied from the source.
+	DoDelete bool `json:"doDelete,omitempty"`
+
+	// Reason of the backfill, for the audit log.
+	Reason string `json:"reason,omitempty"`
+}
+
+// BackfillResult is the outcome of a backfill.
+type BackfillResult struct {
+	// Copied is the number of records read from the source and synced to the target.
+	Copied   int                `json:"copied"`
+	Counts   *client.SyncCounts `json:"counts,omitempty"`
+	Warnings []string           `json:"warnings,omitempty"`
+}
+
+// Backfill syncs the target topic with the state of the source topic, like a client sending it would.
+// The target's envelope, canary, changes and verification apply. Each backfill is logged for audit with
+// the requester.
+func (s *Server) Backfill(target string, req BackfillRequest, requester string) (result BackfillResult, err error) {
+	if len(req.Source) == 0 {
+		return result, errors.New("no source topic")
+	}
+
+	if req.Source == target {
+		return result, errors.New("the source and target topics must be different")
+	}
+
+	if err = validateTransforms(req.Transforms); err != nil {
+		return
+	}
+
+	targetConfig, _ := s.topicConfig(target)
+
+	spec := &syncSpec{
+		TargetTopic: target,
+		DoDelete:    req.DoDelete,
+		ClientName:  "backfill",
+		State:       true,
+	}
+
+	holder := fmt.Sprintf("backfill from %q by %s", req.Source, requester)
+
+	stats, err := s.syncFromSource(spec, holder, func(out chan<- KeyValue) error {
+		return s.TopicState(req.Source, func(key, value []byte) (err error) {
+			kv := KeyValue{Key: key, Value: value}
+
+			for _, t := range req.Transforms {
+				if kv, err = t.apply(kv, targetConfig.JSON); err != nil {
+					return fmt.Errorf("key %q: %v", key, err)
+				}
+			}
+
+			out <- kv
+			result.Copied++
+			return
+		})
+	})
+
+	result.Warnings = spec.Warnings
+
+	if stats != nil {
+		result.Counts = syncCounts(stats)
+	}
+
+	if err != nil {
+		log.Printf("AUDIT: backfill of topic %q from %q by %s failed after %d records: %v (reason: %q)",
+			target, req.Source, requester, result.Copied, err, req.Reason)
+		return
+	}
+
+	log.Printf("AUDIT: backfill of topic %q from %q by %s: %d records copied (reason: %q)",
+		target, req.Source, requester, result.Copied, req.Reason)
+
+	return
+}
+
+// TopicState calls fn with the state of the topic, the last value of each key not deleted, partition by
+// partition. The values are unwrapped from their envelopes: they're as the clients sent them, to be synced
+// again (ie: dumped and restored).
+func (s *Server) TopicState(topic string, fn func(key, value []byte) error) (err error) {
+	kafka := s.kafka(topic)
+
+	partitions, err := kafka.Partitions(topic)
+	if err != nil {
+		return
+	}
+
+	var unwrap func([]byte) []byte
+	if config, _ := s.topicConfig(topic); config.Envelope != nil {
+		unwrap = unwrapEnvelope
+	}
+
+	for _, partition := range partitions {
+		err = s.topicState(kafka, topic, partition, func(key, value []byte) error {
+			if unwrap != nil {
+				value = unwrap(value)
+			}
+			return fn(key, value)
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// stateBatchSize is the number of messages written to the state file of a topic per transaction.
+const stateBatchSize = 10000
+
+// topicState calls fn with the last value of each key of the partition not deleted. The state is kept in
+// a temporary file, as it may not fit in memory.
+func (s *Server) topicState(kafka backend.Backend, topic string, partition int32, fn func(key, value []byte) error) (err error) {
+	low, high, err := kafka.Offsets(topic, partition)
+	if err != nil || high <= low {
+		return
+	}
+
+	file, err := ioutil.TempFile("", "sync2kafka-state-")
+	if err != nil {
+		return
+	}
+
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return
+	}
+
+	defer db.Close()
+
+	db.NoSync = true // temporary
+
+	bucket := []byte("state")
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	b, err := tx.CreateBucket(bucket)
+	if err != nil {
+		return
+	}
+
+	count := 0
+	err = s.readTopic(kafka, topic, partition, low, high, func(msg *backend.Message) (err error) {
+		if len(msg.Value) == 0 {
+			err = b.Delete(msg.Key)
+		} else {
+			err = b.Put(msg.Key, msg.Value)
+		}
+		if err != nil {
+			return
+		}
+
+		if count++; count%stateBatchSize != 0 {
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			tx = nil
+			return
+		}
+
+		if tx, err = db.Begin(true); err != nil {
+			return
+		}
+		b = tx.Bucket(bucket)
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	tx = nil
+	if err != nil {
+		return
+	}
+
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(key, value []byte) error {
+			// only valid during the transaction
+			return fn(append([]byte{}, key...), append([]byte{}, value...))
+		})
+	})
+}
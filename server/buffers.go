@@ -0,0 +1,47 @@
+package server
+
+// The buffers of the records' keys and values are reused to reduce the GC pressure of big syncs.
+// Buffers are released when the record is not needed anymore (unchanged or skipped).
+
+const (
+	minBufferSize = 256
+	maxBufferSize = 64 << 10
+)
+
+var freeBuffers = make(chan []byte, 4*kvBufferSize)
+
+// getBuffer returns a buffer of size bytes, reusing a free one if possible.
+func getBuffer(size int) []byte {
+	select {
+	case buf := <-freeBuffers:
+		if cap(buf) >= size {
+			return buf[:size]
+		}
+		// too small, leave it to the GC
+
+	default:
+	}
+
+	if size < minBufferSize {
+		return make([]byte, size, minBufferSize)
+	}
+
+	return make([]byte, size)
+}
+
+// releaseBuffers releases the buffers of a record.
+func releaseBuffers(kv KeyValue) {
+	releaseBuffer(kv.Key)
+	releaseBuffer(kv.Value)
+}
+
+func releaseBuffer(buf []byte) {
+	if cap(buf) < minBufferSize || cap(buf) > maxBufferSize {
+		return
+	}
+
+	select {
+	case freeBuffers <- buf[:0]:
+	default: // enough free buffers
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// CanaryConfig makes the syncs of a topic produce their changes to a canary topic first. The changes
+// are validated there, then replayed to the topic; the topic is not changed if they are rejected.
+type CanaryConfig struct {
+	// Topic receiving the changes (the topic's name with a ".canary" suffix if empty).
+	Topic string `json:"topic,omitempty"`
+
+	// MaxChangePercent is the maximum percentage of the topic's records created, modified or deleted
+	// by a sync (no limit if 0).
+	MaxChangePercent float64 `json:"maxChangePercent,omitempty"`
+
+	// MaxCountDeltaPercent is the maximum change of the topic's record count by a sync, in percent
+	// (no limit if 0).
+	MaxCountDeltaPercent float64 `json:"maxCountDeltaPercent,omitempty"`
+
+	// Schema checks the changed values before they are replayed (no check if nil).
+	Schema *ValueSchema `json:"schema,omitempty"`
+}
+
+// CanaryError is returned when the changes of a sync are rejected by its canary validation.
+type CanaryError struct {
+	Reason string
+}
+
+func (e *CanaryError) Error() string {
+	return "canary validation failed: " + e.Reason
+}
+
+func (c *CanaryConfig) topic(target string) string {
+	if len(c.Topic) != 0 {
+		return c.Topic
+	}
+	return target + ".canary"
+}
+
+// checkStats validates the changes counts of a sync. Without a previous record, any change is allowed.
+func (c *CanaryConfig) checkStats(stats *SyncStats) error {
+	previous := float64(stats.Unchanged + stats.Modified + stats.Deleted)
+	if previous == 0 {
+		return nil
+	}
+
+	changes := float64(stats.Created + stats.Modified + stats.Deleted)
+	if pct := 100 * changes / previous; c.MaxChangePercent != 0 && pct > c.MaxChangePercent {
+		return &CanaryError{fmt.Sprintf("%.1f%% of the records changed, more than %g%%", pct, c.MaxChangePercent)}
+	}
+
+	delta := float64(stats.Created) - float64(stats.Deleted)
+	if pct := 100 * math.Abs(delta) / previous; c.MaxCountDeltaPercent != 0 && pct > c.MaxCountDeltaPercent {
+		return &CanaryError{fmt.Sprintf("record count changed by %+.0f (%.1f%%), more than %g%%", delta, pct, c.MaxCountDeltaPercent)}
+	}
+
+	return nil
+}
+
+// partitionHighWaters returns the high water marks of the topic's partitions, where the records produced
+// next start (ie: the changes of the next sync to a canary topic).
+func partitionHighWaters(kafka backend.Backend, topic string) (offsets map[int32]int64, err error) {
+	partitions, err := kafka.Partitions(topic)
+	if err != nil {
+		return
+	}
+
+	offsets = make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		if _, offsets[partition], err = kafka.Offsets(topic, partition); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// replayCanary validates the changes produced to the canary topic's partitions from the start offsets
+// (from their beginning if not given, ie: partitions added since), then produces them to the target
+// topic. The changes of a key are in one partition, so they are replayed in order.
+func (s *Server) replayCanary(kafka backend.Backend, config *CanaryConfig, target string, start map[int32]int64) (err error) {
+	canaryTopic := config.topic(target)
+
+	partitions, err := kafka.Partitions(canaryTopic)
+	if err != nil {
+		return
+	}
+
+	type partitionRange struct {
+		partition  int32
+		start, end int64
+	}
+
+	ranges := make([]partitionRange, 0, len(partitions))
+	for _, partition := range partitions {
+		low, end, err := kafka.Offsets(canaryTopic, partition)
+		if err != nil {
+			return err
+		}
+
+		from, ok := start[partition]
+		if !ok {
+			from = low
+		}
+
+		if end > from {
+			ranges = append(ranges, partitionRange{partition, from, end})
+		}
+	}
+
+	if len(ranges) == 0 {
+		return
+	}
+
+	if config.Schema != nil {
+		for _, r := range ranges {
+			err = s.readTopic(kafka, canaryTopic, r.partition, r.start, r.end, func(msg *backend.Message) error {
+				if len(msg.Value) == 0 {
+					return nil // deletion
+				}
+
+				if err := config.Schema.check(msg.Value); err != nil {
+					return &CanaryError{fmt.Sprintf("value of key %q: %v", msg.Key, err)}
+				}
+				return nil
+			})
+
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	producer, err := kafka.NewProducer()
+	if err != nil {
+		return
+	}
+
+	for _, r := range ranges {
+		err = s.readTopic(kafka, canaryTopic, r.partition, r.start, r.end, func(msg *backend.Message) error {
+			producer.Send(&backend.Message{
+				Topic:     target,
+				Key:       msg.Key,
+				Value:     msg.Value,
+				Timestamp: msg.Timestamp,
+				Headers:   msg.Headers,
+			})
+			return nil
+		})
+
+		if err != nil {
+			break
+		}
+	}
+
+	if _, errors := producer.Close(); err == nil && errors != 0 {
+		err = fmt.Errorf("%d changes failed to be replayed from the canary topic", errors)
+	}
+
+	return
+}
+
+// readTopic calls fn with the messages of the topic's partition from start to end (excluded).
+func (s *Server) readTopic(kafka backend.Backend, topic string, partition int32, start, end int64, fn func(*backend.Message) error) (err error) {
+	consumer, err := kafka.Consume(topic, partition, start)
+	if err != nil {
+		return
+	}
+
+	defer consumer.Close()
+
+	for {
+		select {
+		case msg, ok := <-consumer.Messages():
+			if !ok {
+				return fmt.Errorf("topic %q ended before offset %d", topic, end)
+			}
+
+			if msg.Offset >= end {
+				return
+			}
+
+			if err = fn(msg); err != nil {
+				return
+			}
+
+			if msg.Offset+1 >= end {
+				return
+			}
+
+		case cErr := <-consumer.Errors():
+			log.Printf("error reading topic %s: %v", topic, cErr)
+
+		case <-time.After(s.opts.ReadTimeout):
+			return syncer.ErrReadTimeout
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	diff "github.com/mcluseau/go-diff"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// ChangesConfig publishes the changes made by the syncs of a topic to a changes topic, so consumers are
+// notified of them without diffing the topic's states.
+type ChangesConfig struct {
+	// Topic receiving the changes ("<topic>-changes" if empty).
+	Topic string `json:"topic,omitempty"`
+
+	// OldValues adds the previous values of the modified and deleted keys, read from the topic once the
+	// sync succeeded: the changes are then published at the end of the sync instead of during it.
+	OldValues bool `json:"oldValues,omitempty"`
+}
+
+func (c *ChangesConfig) topic(topic string) string {
+	if len(c.Topic) != 0 {
+		return c.Topic
+	}
+	return topic + "-changes"
+}
+
+// Change types.
+const (
+	ChangeCreated  = "created"
+	ChangeModified = "modified"
+	ChangeDeleted  = "deleted"
+)
+
+// ChangeEvent is a change made by a sync, published to the changes topic with the record's key. The
+// values are JSON, or JSON strings if they're not. The keys that are not UTF-8 are base64 encoded, with
+// KeyEncoding set to "base64".
+type ChangeEvent struct {
+	SyncID      string          `json:"syncId"`
+	Topic       string          `json:"topic"`
+	Type        string          `json:"type"`
+	Key         string          `json:"key"`
+	KeyEncoding string          `json:"keyEncoding,omitempty"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	OldValue    json.RawMessage `json:"oldValue,omitempty"`
+	Time        time.Time       `json:"time"`
+}
+
+func (e *ChangeEvent) setKey(key []byte) {
+	if utf8.Valid(key) {
+		e.Key = string(key)
+		return
+	}
+
+	e.Key = base64.StdEncoding.EncodeToString(key)
+	e.KeyEncoding = "base64"
+}
+
+// key returns the record's key.
+func (e *ChangeEvent) key() []byte {
+	if e.KeyEncoding == "base64" {
+		key, _ := base64.StdEncoding.DecodeString(e.Key)
+		return key
+	}
+	return []byte(e.Key)
+}
+
+// changePublisher publishes the changes of a sync. The changes are buffered on disk until the end of the
+// sync when they need the old values, or when a canary may reject them.
+type changePublisher struct {
+	s       *Server
+	config  *ChangesConfig
+	kafka   backend.Backend
+	topic   string
+	syncID  string
+	unwrap  func([]byte) []byte
+	starts  []int64
+	pending *pendingChanges
+
+	producer backend.Producer
+	buffered bool
+	finished bool
+}
+
+// newChangePublisher prepares the publication of the changes of a sync of the topic, with the given
+// number of partitions.
+func (s *Server) newChangePublisher(config TopicConfig, topic, syncID string, partitions int) (p *changePublisher, err error) {
+	p = &changePublisher{
+		s:        s,
+		config:   config.Changes,
+		kafka:    s.kafka(topic),
+		topic:    topic,
+		syncID:   syncID,
+		buffered: config.Changes.OldValues || config.Canary != nil,
+	}
+
+	if config.Envelope != nil {
+		p.unwrap = unwrapEnvelope
+	}
+
+	if config.Changes.OldValues {
+		if p.starts, err = highWaterMarks(p.kafka, topic, partitions); err != nil {
+			return
+		}
+	}
+
+	if p.buffered {
+		p.pending, err = newPendingChanges()
+	} else {
+		p.producer, err = p.kafka.NewProducer()
+	}
+
+	return
+}
+
+// add is the syncer's OnChange.
+func (p *changePublisher) add(t diff.ChangeType, kv syncer.KeyValue) {
+	event := ChangeEvent{
+		SyncID: p.syncID,
+		Topic:  p.topic,
+		Time:   kv.Timestamp.UTC(),
+	}
+	event.setKey(kv.Key)
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	switch t {
+	case diff.Created:
+		event.Type = ChangeCreated
+	case diff.Modified:
+		event.Type = ChangeModified
+	case diff.Deleted:
+		event.Type = ChangeDeleted
+	}
+
+	if t != diff.Deleted {
+		event.Value = jsonValue(kv.Value)
+	}
+
+	if p.buffered {
+		p.pending.add(event)
+	} else {
+		p.send(event)
+	}
+}
+
+func (p *changePublisher) send(event ChangeEvent) {
+	value, _ := json.Marshal(event) // can't fail with valid values
+
+	p.producer.Send(&backend.Message{
+		Topic: p.config.topic(p.topic),
+		Key:   event.key(),
+		Value: value,
+	})
+}
+
+// finish publishes the buffered changes if the sync succeeded, and waits for their delivery. Returns the
+// warnings of the sync. Only the first call does something.
+func (p *changePublisher) finish(succeeded bool) (warnings []string) {
+	if p.finished {
+		return
+	}
+
+	p.finished = true
+
+	if p.buffered {
+		defer p.pending.close()
+
+		if !succeeded || p.pending.count == 0 {
+			return
+		}
+
+		if err := p.pending.flush(); err != nil {
+			log.Printf("sync %s: failed to buffer the changes: %v", p.syncID, err)
+			return append(warnings, "the changes were not published: "+err.Error())
+		}
+
+		withOldValues := false
+		if p.config.OldValues {
+			if err := p.readOldValues(); err != nil {
+				log.Printf("sync %s: failed to read the old values of the changes: %v", p.syncID, err)
+				warnings = append(warnings, "the changes were published without their old values: "+err.Error())
+			} else {
+				withOldValues = true
+			}
+		}
+
+		var err error
+		if p.producer, err = p.kafka.NewProducer(); err != nil {
+			log.Printf("sync %s: failed to publish the changes: %v", p.syncID, err)
+			return append(warnings, "the changes were not published: "+err.Error())
+		}
+
+		err = p.pending.forEach(withOldValues, func(event ChangeEvent, oldValue []byte) error {
+			if oldValue != nil {
+				if p.unwrap != nil {
+					oldValue = p.unwrap(oldValue)
+				}
+				event.OldValue = jsonValue(oldValue)
+			}
+
+			p.send(event)
+			return nil
+		})
+
+		if err != nil {
+			log.Printf("sync %s: failed to read the buffered changes: %v", p.syncID, err)
+			warnings = append(warnings, "the changes were partially published: "+err.Error())
+		}
+	}
+
+	if _, errors := p.producer.Close(); errors != 0 {
+		log.Printf("sync %s: %d changes failed to be published", p.syncID, errors)
+		warnings = append(warnings, fmt.Sprintf("%d changes failed to be published", errors))
+	}
+
+	return
+}
+
+// readOldValues records the old values of the pending changes, reading the topic up to its offsets before
+// the sync.
+func (p *changePublisher) readOldValues() (err error) {
+	for partition, end := range p.starts {
+		var low int64
+		if low, _, err = p.kafka.Offsets(p.topic, int32(partition)); err != nil {
+			return
+		}
+
+		if end <= low {
+			continue
+		}
+
+		err = p.s.readTopic(p.kafka, p.topic, int32(partition), low, end, func(msg *backend.Message) error {
+			return p.pending.setOldValue(msg.Key, msg.Value)
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	return p.pending.flush()
+}
+
+// jsonValue returns the value if it's JSON, or the value as a JSON string.
+func jsonValue(value []byte) json.RawMessage {
+	if json.Valid(value) {
+		return value
+	}
+
+	v, _ := json.Marshal(string(value))
+	return v
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricUncompacted = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "sync2kafka",
+	Name:      "uncompacted_records_estimate",
+	Help:      "Records of the topic superseded by newer ones but not compacted yet, after the last sync with deletions",
+}, []string{"topic"})
+
+// compactionConfig returns the configuration entries to set on the topic after a sync.
+func (s *Server) compactionConfig(topic string) map[string]string {
+	config, _ := s.topicConfig(topic)
+	if len(config.CompactionConfig) == 0 {
+		return s.opts.CompactionConfig
+	}
+
+	entries := make(map[string]string, len(s.opts.CompactionConfig)+len(config.CompactionConfig))
+	for name, value := range s.opts.CompactionConfig {
+		entries[name] = value
+	}
+	for name, value := range config.CompactionConfig {
+		entries[name] = value
+	}
+
+	return entries
+}
+
+// checkCompaction verifies the compaction of the topic after a successful sync, setting its
+// compaction configuration if needed, and estimates its uncompacted records.
+func (s *Server) checkCompaction(topic string, doDelete bool, stats *SyncStats) (warnings []string) {
+	entries := s.compactionConfig(topic)
+
+	if !s.opts.CompactionCheck && len(entries) == 0 {
+		return
+	}
+
+	kafka := s.kafka(topic)
+
+	current, err := kafka.TopicConfig(topic)
+	if err != nil {
+		log.Printf("topic %q: failed to read the configuration: %v", topic, err)
+		return []string{"failed to check the topic's compaction"}
+	}
+
+	if policy := current["cleanup.policy"]; !strings.Contains(policy, "compact") {
+		warnings = append(warnings, fmt.Sprintf("topic %q is not compacted (cleanup.policy=%s)", topic, policy))
+	}
+
+	changes := map[string]string{}
+	for name, value := range entries {
+		if current[name] != value {
+			changes[name] = value
+		}
+	}
+
+	if len(changes) != 0 {
+		if err := kafka.SetTopicConfig(topic, changes); err != nil {
+			log.Printf("topic %q: failed to set the configuration %v: %v", topic, changes, err)
+			warnings = append(warnings, "failed to set the topic's compaction configuration")
+		} else {
+			log.Printf("topic %q: configuration set: %v", topic, changes)
+		}
+	}
+
+	// the active records are only known when all of them were sent
+	if !doDelete || stats == nil {
+		return
+	}
+
+	partitions, err := kafka.Partitions(topic)
+	if err != nil {
+		log.Printf("topic %q: failed to read the partitions: %v", topic, err)
+		return
+	}
+
+	records := int64(0)
+	for _, partition := range partitions {
+		oldest, highWater, err := kafka.Offsets(topic, partition)
+		if err != nil {
+			log.Printf("topic %q: failed to read the offsets of partition %d: %v", topic, partition, err)
+			return
+		}
+
+		records += highWater - oldest
+	}
+
+	uncompacted := records - int64(stats.Count)
+	if uncompacted < 0 {
+		uncompacted = 0
+	}
+
+	metricUncompacted.WithLabelValues(topic).Set(float64(uncompacted))
+	log.Printf("topic %q: about %d records waiting for compaction (%d active)", topic, uncompacted, stats.Count)
+
+	if uncompacted > int64(stats.Count) {
+		warnings = append(warnings, fmt.Sprintf("about %d superseded records are not compacted yet, for %d active records", uncompacted, stats.Count))
+	}
+
+	return
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	kafkasync "github.com/mcluseau/kafka-sync"
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+type ConnStatus struct {
+	Remote        string
+	ClientName    string
+	ClientVersion string
+	Status        string
+	TargetTopic   string
+	ItemsRead     int64
+	ItemsSkipped  int64
+	// ExpectedRecords is the record count announced by the client, and ReadPercent the part of it read
+	ExpectedRecords int64
+	ReadPercent     float64
+	// ItemsDuplicated is the number of keys sent more than once (only counted with a duplicate keys policy)
+	ItemsDuplicated int64
+	BytesRead       int64
+	SyncStats       *kafkasync.Stats
+	// Progress of the sync, by phase
+	Progress syncer.Progress
+	// Timings of the sync, once finished
+	Timings   *client.SyncTimings
+	Pipeline  PipelineStats
+	StartTime time.Time
+	EndTime   time.Time
+
+	samples *recordSamples
+	slot    *syncSlot
+	lock    *TopicLock
+}
+
+func (s *Server) connStatusCleaner(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.connStatusesMutex.Lock()
+
+		now := time.Now()
+		expired := make([]*ConnStatus, 0)
+
+		for _, v := range s.connStatuses {
+			if v.EndTime.IsZero() {
+				continue
+			}
+
+			if now.Sub(v.EndTime).Minutes() > 9 {
+				expired = append(expired, v)
+			}
+		}
+
+		for _, exp := range expired {
+			delete(s.connStatuses, exp.Remote)
+		}
+
+		s.connStatusesMutex.Unlock()
+	}
+}
+
+func (s *Server) newConnStatus(conn net.Conn) (cs *ConnStatus) {
+	cs = &ConnStatus{
+		Remote:    conn.RemoteAddr().String(),
+		Status:    "initializing",
+		StartTime: time.Now(),
+	}
+
+	if s.opts.RecordSamples != 0 {
+		cs.samples = &recordSamples{max: s.opts.RecordSamples, maxBytes: s.opts.RecordSampleBytes}
+	}
+
+	s.connStatusesMutex.Lock()
+	defer s.connStatusesMutex.Unlock()
+
+	s.connStatuses[cs.Remote] = cs
+
+	return
+}
+
+// Connections returns a copy of the current and recent connection statuses, by remote address.
+func (s *Server) Connections() map[string]ConnStatus {
+	return s.FilterConnections(ConnectionsFilter{})
+}
+
+// ConnectionsFilter selects connection statuses. Empty fields match all the statuses.
+type ConnectionsFilter struct {
+	Topic  string
+	Status string
+	Client string
+
+	// Active only matches the connections not finished.
+	Active bool
+}
+
+func (f ConnectionsFilter) match(cs *ConnStatus) bool {
+	return (len(f.Topic) == 0 || cs.TargetTopic == f.Topic) &&
+		(len(f.Status) == 0 || cs.Status == f.Status) &&
+		(len(f.Client) == 0 || cs.ClientName == f.Client) &&
+		(!f.Active || cs.EndTime.IsZero())
+}
+
+// ConnectionsPage is a page of connection statuses, the most recent first.
+type ConnectionsPage struct {
+	// Total is the number of statuses matching the filter.
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Items  []ConnStatus `json:"items"`
+}
+
+// FilterConnections returns a copy of the current and recent connection statuses matching the filter,
+// by remote address.
+func (s *Server) FilterConnections(filter ConnectionsFilter) map[string]ConnStatus {
+	s.connStatusesMutex.Lock()
+	defer s.connStatusesMutex.Unlock()
+
+	statuses := make(map[string]ConnStatus, len(s.connStatuses))
+	for remote, cs := range s.connStatuses {
+		if filter.match(cs) {
+			statuses[remote] = *cs
+		}
+	}
+
+	return statuses
+}
+
+// ListConnections returns up to limit connection statuses matching the filter, from offset, the most
+// recent first (all of them if limit is 0).
+func (s *Server) ListConnections(filter ConnectionsFilter, offset, limit int) (page ConnectionsPage) {
+	statuses := s.FilterConnections(filter)
+
+	items := make([]ConnStatus, 0, len(statuses))
+	for _, cs := range statuses {
+		items = append(items, cs)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].StartTime.Equal(items[j].StartTime) {
+			return items[i].StartTime.After(items[j].StartTime)
+		}
+		return items[i].Remote < items[j].Remote
+	})
+
+	page.Total = len(items)
+	page.Offset = offset
+
+	if offset > len(items) {
+		offset = len(items)
+	}
+	items = items[offset:]
+
+	if limit != 0 && limit < len(items) {
+		items = items[:limit]
+	}
+
+	page.Items = items
+	return
+}
+
+// statusIncomplete is the status of a connection lost before the end of its transfer, kept once finished.
+const statusIncomplete = "aborted (incomplete input)"
+
+// setConnStatus sets the status of the connection, that the read and sync loops may both change, and
+// returns the previous one.
+func (s *Server) setConnStatus(cs *ConnStatus, status string) (previous string) {
+	s.connStatusesMutex.Lock()
+	defer s.connStatusesMutex.Unlock()
+
+	previous = cs.Status
+	cs.Status = status
+	return
+}
+
+// restoreConnStatus sets the status of the connection back to previous, unless it changed since it was
+// set to current (ie: the transfer aborted meanwhile).
+func (s *Server) restoreConnStatus(cs *ConnStatus, current, previous string) {
+	s.connStatusesMutex.Lock()
+	defer s.connStatusesMutex.Unlock()
+
+	if cs.Status == current {
+		cs.Status = previous
+	}
+}
+
+func (cs *ConnStatus) Finished() {
+	if cs.Status != statusIncomplete {
+		cs.Status = "finished"
+	}
+	cs.EndTime = time.Now()
+}
@@ -0,0 +1,533 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+func (s *Server) handleConn(conn net.Conn) {
+	logPrefix := fmt.Sprintf("from %v: ", conn.RemoteAddr().String())
+
+	log.Print(logPrefix, "new connection")
+	status := s.newConnStatus(conn)
+
+	atomic.AddInt32(&s.activeConns, 1)
+	defer atomic.AddInt32(&s.activeConns, -1)
+
+	hostname, err := serverName(conn)
+	if err != nil {
+		log.Print(logPrefix, "TLS handshake failed: ", err)
+		conn.Close()
+		status.Finished()
+		return
+	}
+
+	vhost := s.virtualHost(hostname)
+	if vhost != nil {
+		log.Printf("%svirtual host %s", logPrefix, hostname)
+	}
+
+	conn = countingConn{Conn: conn, status: status}
+
+	defer func() {
+		log.Print(logPrefix, "closing connection")
+		conn.Close()
+		status.Finished()
+
+		if err := recover(); err != nil {
+			buf := make([]byte, 64*1024)
+			runtime.Stack(buf, false)
+			log.Print(logPrefix, "panic: ", err, "\n", string(buf))
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	// reject tells the client why the connection is closed
+	reject := func(code, message string) {
+		log.Printf("%srejecting: %s", logPrefix, message)
+		enc.Encode(SyncResult{OK: false, Error: &client.Error{Code: code, Message: message}})
+	}
+
+	init := &SyncInitInfo{}
+	if err := dec.Decode(init); err != nil {
+		reject(client.ErrBadRequest, "failed to read init object: "+err.Error())
+		return
+	}
+
+	if init.Info {
+		enc.Encode(s.Info())
+		return
+	}
+
+	if s.isDraining() {
+		reject(client.ErrShuttingDown, "the server is shutting down")
+		return
+	}
+
+	if len(init.ClientName) != 0 {
+		log.Printf("%sclient is %s %s", logPrefix, init.ClientName, init.ClientVersion)
+		logPrefix += fmt.Sprintf("%s: ", init.ClientName)
+
+		status.ClientName = init.ClientName
+		status.ClientVersion = init.ClientVersion
+	}
+
+	if init.Multiplex {
+		status.Status = "multiplexing"
+		enc.Encode(SyncResult{OK: true})
+
+		s.handleMultiplexed(conn, dec.Buffered(), hostname, logPrefix)
+		return
+	}
+
+	negotiated := false
+	if len(init.Format) == 0 && len(init.Formats) != 0 {
+		init.Format = negotiateFormat(init.Formats)
+		if len(init.Format) == 0 {
+			reject(client.ErrUnknownFormat, fmt.Sprintf("no supported format in %q", init.Formats))
+			return
+		}
+		negotiated = true
+	}
+
+	if len(init.Format) != 0 && !isFormatSupported(init.Format) {
+		reject(client.ErrUnknownFormat, fmt.Sprintf("unknown format %q", init.Format))
+		return
+	}
+
+	topic := vhost.defaultTopic(s.opts.DefaultTopic)
+	if len(init.Topic) != 0 {
+		topic = init.Topic
+	}
+
+	if len(topic) == 0 {
+		reject(client.ErrNoTopic, "no topic specified and no default topic")
+		return
+	}
+
+	if len(init.SessionID) != 0 && !sessionIDPattern.MatchString(init.SessionID) {
+		reject(client.ErrBadRequest, fmt.Sprintf("invalid session ID %q", init.SessionID))
+		return
+	}
+
+	if init.ExpectedRecords < 0 {
+		reject(client.ErrBadRequest, "negative expected records")
+		return
+	}
+
+	config, _ := s.topicConfig(topic)
+
+	if config.DeletePolicy == DeleteForce {
+		init.DoDelete = true
+	}
+
+	auth, err := s.authMiddlewares(s.builtinAuth(vhost))(AuthRequest{
+		Token:    init.Token,
+		Topic:    topic,
+		Remote:   status.Remote,
+		DoDelete: init.DoDelete,
+
+		ClientName:    init.ClientName,
+		ClientVersion: init.ClientVersion,
+	})
+	if err != nil {
+		log.Printf("%sauthorization failed: %v", logPrefix, err)
+		reject(client.ErrUnauthorized, "authorization failed")
+		return
+	}
+
+	if !auth.Allow {
+		code := auth.Code
+		if len(code) == 0 {
+			code = client.ErrUnauthorized
+		}
+		reject(code, auth.Reason)
+		return
+	}
+
+	if config.DeletePolicy == DeleteDeny && init.DoDelete {
+		reject(client.ErrUnauthorized, fmt.Sprintf("deletions are not allowed on topic %q", topic))
+		return
+	}
+
+	if auth.Constraints.NoDelete && init.DoDelete {
+		reject(client.ErrUnauthorized, "deletions are not allowed")
+		return
+	}
+
+	rules := s.recordRules(config)
+	rules.recordLimits = rules.restrict(recordLimits{
+		MaxKeySize:   auth.Constraints.MaxKeySize,
+		MaxValueSize: auth.Constraints.MaxValueSize,
+	})
+	rules.SkipInvalid = s.skipsInvalidRecords(init.DoDelete)
+
+	lock := s.LockTopic(topic, status.Remote)
+	if lock == nil {
+		reject(client.ErrTopicLocked, fmt.Sprintf("topic %q already locked", topic))
+		return
+	}
+	defer s.UnlockTopic(lock)
+
+	status.lock = lock
+
+	// the sync may be cancelled as soon as it holds the lock, even while it waits for a slot
+	cancel := make(chan bool, 1)
+	cancelOnce := sync.Once{}
+	cancelSync := func() { cancelOnce.Do(func() { close(cancel) }) }
+
+	lock.SetCancel(func() {
+		cancelSync()
+		conn.Close()
+	})
+
+	if len(init.IdempotencyKey) != 0 {
+		if result, ok := s.completedResult(topic, init.Token, init.IdempotencyKey); ok {
+			log.Printf("%ssync with idempotency key %q already completed", logPrefix, init.IdempotencyKey)
+			result.Completed = true
+			enc.Encode(result)
+			return
+		}
+	}
+
+	var warnings []string
+	if init.DoDelete && len(s.opts.LagCheckGroups) != 0 {
+		var err error
+		warnings, err = s.checkConsumerLag(topic)
+		if err != nil {
+			log.Printf("%sconsumer lag check failed: %v", logPrefix, err)
+			warnings = append(warnings, "consumer lag check failed")
+		}
+
+		if len(warnings) != 0 && s.opts.LagCheckRefuse {
+			reject(client.ErrConsumerLag, "refusing sync with deletions: "+strings.Join(warnings, "; "))
+			return
+		}
+	}
+
+	sessionID := ""
+	if s.sessionsEnabled() {
+		sessionID = init.SessionID
+	}
+
+	resumePath, resumeRecords := "", 0
+	var produceFrom map[int32]int64
+	if len(sessionID) != 0 {
+		if init.ResumeSession {
+			var err error
+			if resumePath, resumeRecords, produceFrom, err = s.resumeSession(sessionID, topic, init.Token); err != nil {
+				reject(client.ErrBadRequest, "failed to resume the session: "+err.Error())
+				return
+			}
+		} else if err := s.discardSession(sessionID, init.Token); err != nil {
+			reject(client.ErrBadRequest, err.Error())
+			return
+		}
+	}
+
+	log.Printf("%saccepting topic %q", logPrefix, init.Topic)
+
+	if negotiated || init.ResumeSession || len(init.IdempotencyKey) != 0 {
+		enc.Encode(SyncResult{OK: true, Format: init.Format, ResumeFrom: int64(resumeRecords)})
+	}
+	status.TargetTopic = topic
+	status.ExpectedRecords = init.ExpectedRecords
+	logPrefix += fmt.Sprintf("to topic %q: ", init.Topic)
+
+	slot, ok := s.acquireSyncSlot(s.syncPriority(topic, init.Token), status, cancel)
+	if !ok {
+		log.Print(logPrefix, "cancelled while waiting for a sync slot")
+		reject(client.ErrShuttingDown, "cancelled while waiting for a sync slot")
+		return
+	}
+	defer s.releaseSyncSlot(slot)
+
+	j, err := s.newJournal(journalHeader{
+		Topic:       topic,
+		DoDelete:    init.DoDelete,
+		Remote:      status.Remote,
+		StartTime:   status.StartTime,
+		SessionID:   sessionID,
+		TokenHash:   tokenHash(init.Token),
+		ProduceFrom: produceFrom,
+	})
+	if err != nil {
+		reject(client.ErrSyncFailed, "failed to create the journal: "+err.Error())
+		return
+	}
+
+	interrupted := false
+	defer func() {
+		if interrupted && j != nil && len(sessionID) != 0 {
+			if err := j.Keep(); err == nil {
+				log.Printf("%skeeping session %s for %v", logPrefix, sessionID, s.opts.SessionTTL)
+				s.keepSession(sessionID)
+				return
+			}
+		}
+
+		j.Remove()
+	}()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	// the topic stays locked until the sync ended, even when the client got its result before
+	defer wg.Wait()
+
+	var syncErr error
+
+	kvSource := make(chan KeyValue, kvBufferSize)
+	status.Pipeline.BufferCapacity = kvBufferSize
+
+	defer cancelSync()
+
+	spec := &syncSpec{
+		Source:      kvSource,
+		TargetTopic: topic,
+		DoDelete:    init.DoDelete,
+		Cancel:      cancel,
+		OnSend:      func(d time.Duration) { status.produceSent(d); s.yieldSyncSlot(status, cancel) },
+		Release:     releaseBuffers,
+		Progress:    &status.Progress,
+		Force:       init.Force,
+		Lock:        lock,
+
+		ClientName:    init.ClientName,
+		ClientVersion: init.ClientVersion,
+	}
+
+	go func() {
+		defer wg.Done()
+		status.SyncStats, syncErr = s.sync(spec)
+	}()
+
+	s.setConnStatus(status, "reading data")
+
+	// values follow the init object, maybe already buffered by its decoder
+	decode := newFrameDecoder(init.Format, bufio.NewReader(io.MultiReader(dec.Buffered(), conn)))
+
+	duplicates := newDuplicateKeys(rules.DuplicateKeysPolicy)
+
+	readStart := time.Now()
+
+	if len(resumePath) != 0 {
+		log.Printf("%sresuming session %s after %d records", logPrefix, sessionID, resumeRecords)
+
+		if err = replaySession(resumePath, kvSource, status, j, duplicates); err != nil {
+			log.Printf("%sfailed to replay session %s: %v", logPrefix, sessionID, err)
+
+			// the new journal only has a part of the session's one, that the client can resume again
+			j.Remove()
+			j = nil
+			s.restoreSession(sessionID, resumePath)
+
+			enc.Encode(SyncResult{OK: false, Error: &client.Error{Code: client.ErrSyncFailed, Message: "failed to replay the session"}})
+			return
+		}
+	}
+
+	err = s.readKVs(conn, decode, kvSource, status, j, rules, duplicates, cancel)
+	conn.SetReadDeadline(time.Time{})
+
+	readDuration := time.Since(readStart)
+
+	if err == nil && init.DoDelete {
+		if msg := config.checkRecordCount(status.ItemsRead); len(msg) == 0 {
+			// expected count
+		} else if init.Force {
+			log.Printf("%sforced sync: %s", logPrefix, msg)
+			warnings = append(warnings, "forced: "+msg)
+		} else {
+			err = &client.Error{Code: client.ErrDatasetSize, Message: msg + "; refusing to delete (force the sync to override)"}
+		}
+	}
+
+	if err == nil && init.ExpectedRecords != 0 {
+		if msg := s.checkShortfall(init.ExpectedRecords, status.ItemsRead+status.ItemsSkipped); len(msg) == 0 {
+			// expected count
+		} else if init.Force {
+			log.Printf("%sforced sync: %s", logPrefix, msg)
+			warnings = append(warnings, "forced: "+msg)
+		} else {
+			err = &client.Error{Code: client.ErrTruncated, Message: msg + "; the transfer looks truncated (force the sync to override)"}
+		}
+	}
+
+	if err == nil {
+		if jErr := j.Complete(); jErr != nil {
+			err = &client.Error{Code: client.ErrSyncFailed, Message: "failed to journal the end of transfer: " + jErr.Error()}
+		}
+	}
+
+	if err == errAborted {
+		log.Print(logPrefix, "transfer aborted by the client")
+		s.setConnStatus(status, "aborting")
+		cancelSync()
+		wg.Wait()
+
+		enc.Encode(SyncResult{OK: false, Error: &client.Error{Code: client.ErrAborted, Message: "transfer aborted"}})
+		return
+	}
+
+	if clientErr, ok := err.(*client.Error); ok {
+		log.Printf("%srejecting transfer: %v", logPrefix, clientErr.Message)
+		s.setConnStatus(status, "aborting")
+		cancelSync()
+		wg.Wait()
+
+		enc.Encode(SyncResult{OK: false, Warnings: warnings, Error: clientErr})
+		return
+	}
+
+	if err != nil {
+		log.Printf("%sfailed to read values from %v: %v", logPrefix, conn.RemoteAddr(), err)
+		interrupted = true
+
+		// the source is not closed, so the partial input is never considered complete: the sync stops
+		// without deleting anything, and is waited for so no other sync starts meanwhile.
+		s.setConnStatus(status, statusIncomplete)
+		atomic.StoreInt32(&spec.incomplete, 1)
+		cancelSync()
+
+		if !s.waitFinalized(&wg, cancelSync) {
+			log.Print(logPrefix, "incomplete sync not stopped yet, the topic stays locked until it is")
+		}
+		return
+	}
+
+	if status.ItemsSkipped != 0 {
+		warnings = append(warnings, fmt.Sprintf("%d invalid records skipped", status.ItemsSkipped))
+	}
+
+	if warning := duplicates.warning(); len(warning) != 0 {
+		warnings = append(warnings, warning)
+	}
+
+	log.Printf("%sfinished reading values (%d bytes)", logPrefix, status.BytesRead)
+	close(kvSource)
+
+	s.setConnStatus(status, "finializing")
+
+	if !s.waitFinalized(&wg, cancelSync) {
+		msg := fmt.Sprintf("sync not finished %v after the end of the transfer, cancelled", s.opts.FinalizeTimeout)
+		log.Print(logPrefix, msg, ", the topic stays locked until it stopped")
+		s.setConnStatus(status, "finalization timed out")
+
+		s.alert(Alert{Kind: AlertSyncFailed, Topic: topic, Message: msg})
+
+		enc.Encode(SyncResult{OK: false, Warnings: warnings, Error: &client.Error{Code: client.ErrSyncFailed, Message: msg}})
+		return
+	}
+
+	warnings = append(warnings, spec.Warnings...)
+
+	if status.SyncStats != nil {
+		log.Print(logPrefix, "sync stats:\n", status.SyncStats.LogString())
+	}
+
+	timings := syncTimings(readDuration, &status.Progress)
+	status.Timings = timings
+
+	log.Printf("%stimings: read %dms, index %dms, diff %dms, produce %dms, delete %dms",
+		logPrefix, timings.Read, timings.Index, timings.Diff, timings.Produce, timings.Delete)
+
+	if syncErr != nil {
+		code := client.ErrSyncFailed
+		switch syncErr.(type) {
+		case *syncer.TooManyDeletionsError:
+			code = client.ErrTooManyDeletes
+		case *CanaryError:
+			code = client.ErrCanaryRejected
+		}
+
+		enc.Encode(SyncResult{
+			OK:       false,
+			Warnings: warnings,
+			Error:    &client.Error{Code: code, Message: syncErr.Error()},
+			Timings:  timings,
+		})
+
+		log.Print(logPrefix, "sync failed: ", syncErr)
+		return
+	}
+
+	result := SyncResult{
+		OK:           true,
+		Warnings:     warnings,
+		Counts:       syncCounts(status.SyncStats),
+		Timings:      timings,
+		Verification: spec.Verification,
+		Repartition:  spec.Repartition,
+	}
+
+	if len(init.IdempotencyKey) != 0 {
+		s.storeCompletedResult(topic, init.Token, init.IdempotencyKey, result)
+	}
+
+	enc.Encode(result)
+}
+
+// finalizeGrace is the time given to a sync to stop once cancelled after FinalizeTimeout.
+const finalizeGrace = 10 * time.Second
+
+// waitFinalized waits for the sync to end, up to FinalizeTimeout. After, the sync is cancelled and
+// waited for finalizeGrace, but it may not stop (ie: flushing to a stuck broker); it returns false then,
+// and the sync must still be waited for before unlocking its topic.
+func (s *Server) waitFinalized(wg *sync.WaitGroup, cancel func()) bool {
+	if s.opts.FinalizeTimeout == 0 {
+		wg.Wait()
+		return true
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(s.opts.FinalizeTimeout):
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(finalizeGrace):
+	}
+
+	return false
+}
+
+// remoteConn overrides the remote address of a connection.
+type remoteConn struct {
+	net.Conn
+	remote     net.Addr
+	serverName string
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+type remoteAddr struct {
+	network, addr string
+}
+
+func (a remoteAddr) Network() string { return a.network }
+func (a remoteAddr) String() string  { return a.addr }
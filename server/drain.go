@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Drain makes the server refuse new connections, and waits for the active ones to end or the context
+// to be done. The listeners are closed by cancelling the context given to Serve.
+func (s *Server) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.drainOnce.Do(func() { close(s.drained) })
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt32(&s.activeConns) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
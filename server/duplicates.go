@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+// duplicateKeys detects the keys sent more than once in a transfer. Only hashes of the keys and
+// values are kept.
+type duplicateKeys struct {
+	policy string
+	seen   map[[16]byte]uint64
+
+	// Count is the number of duplicate records, and Different those with a value different from the previous one.
+	Count     int64
+	Different int64
+}
+
+func newDuplicateKeys(policy string) *duplicateKeys {
+	if policy == DuplicateKeysIgnore {
+		return nil
+	}
+
+	return &duplicateKeys{policy: policy, seen: map[[16]byte]uint64{}}
+}
+
+// check records the key, returning a client error if it is a duplicate and the policy rejects them.
+func (d *duplicateKeys) check(kv KeyValue) error {
+	if d == nil {
+		return nil
+	}
+
+	var keyHash [16]byte
+	h := fnv.New128a()
+	h.Write(kv.Key)
+	h.Sum(keyHash[:0])
+
+	vh := fnv.New64a()
+	vh.Write(kv.Value)
+	valueHash := vh.Sum64()
+
+	previous, duplicate := d.seen[keyHash]
+	d.seen[keyHash] = valueHash
+
+	if !duplicate {
+		return nil
+	}
+
+	d.Count++
+
+	different := previous != valueHash
+	if different {
+		d.Different++
+	}
+
+	if d.policy != DuplicateKeysReject {
+		return nil
+	}
+
+	msg := fmt.Sprintf("key %q sent twice", kv.Key)
+	if different {
+		msg += " with different values"
+	}
+
+	return &client.Error{Code: client.ErrDuplicateKey, Message: msg}
+}
+
+// warning returns the report of the duplicates, or "" if none.
+func (d *duplicateKeys) warning() string {
+	if d == nil || d.Count == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d duplicate keys (%d with a different value), the last value was kept", d.Count, d.Different)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"sort"
+)
+
+// EffectiveConfig is the configuration enforced by the server, without its secrets.
+type EffectiveConfig struct {
+	DefaultTopic string `json:"defaultTopic,omitempty"`
+
+	// AllowAllTopics allows any topic; AllowedTopics are empty then.
+	AllowAllTopics bool `json:"allowAllTopics"`
+
+	// AllowedTopics are the configured topics and the topics of the allowed topics file, or the default
+	// topic without file, sorted.
+	AllowedTopics     []string `json:"allowedTopics"`
+	AllowedTopicsFile string   `json:"allowedTopicsFile,omitempty"`
+
+	// Auth is how the clients are authenticated: "token", "webhook" or "none".
+	Auth string `json:"auth"`
+	TLS  bool   `json:"tls"`
+
+	MaxKeySize          int     `json:"maxKeySize"`
+	MaxValueSize        int     `json:"maxValueSize"`
+	MaxDeletePercent    float64 `json:"maxDeletePercent"`
+	MaxShortfallPercent float64 `json:"maxShortfallPercent"`
+	VerifyPercent       float64 `json:"verifyPercent"`
+
+	IdleTimeout       string `json:"idleTimeout"`
+	PausedIdleTimeout string `json:"pausedIdleTimeout"`
+	ReadTimeout       string `json:"readTimeout"`
+	FinalizeTimeout   string `json:"finalizeTimeout"`
+	TopicLockTTL      string `json:"topicLockTTL"`
+
+	RecordErrorPolicy   string `json:"recordErrorPolicy"`
+	DuplicateKeysPolicy string `json:"duplicateKeysPolicy"`
+	ProduceErrorPolicy  string `json:"produceErrorPolicy"`
+	ProduceRetries      int    `json:"produceRetries"`
+	ProduceWorkers      int    `json:"produceWorkers"`
+	SortedProduce       bool   `json:"sortedProduce"`
+	MaxConcurrentSyncs  int    `json:"maxConcurrentSyncs"`
+	RecordSamples       int    `json:"recordSamples"`
+
+	Store          bool     `json:"store"`
+	WarmTopics     []string `json:"warmTopics,omitempty"`
+	JournalDir     string   `json:"journalDir,omitempty"`
+	SessionTTL     string   `json:"sessionTTL"`
+	IdempotencyTTL string   `json:"idempotencyTTL"`
+
+	// Clusters are the names of the other Kafka clusters.
+	Clusters []string `json:"clusters,omitempty"`
+
+	// Topics are the configurations specific to topics; their tokens and secrets are redacted.
+	Topics map[string]TopicConfig `json:"topics,omitempty"`
+
+	// VirtualHosts are the configurations of the TLS hostnames; their tokens are redacted.
+	VirtualHosts map[string]VirtualHost `json:"virtualHosts,omitempty"`
+}
+
+const redacted = "<redacted>"
+
+// EffectiveConfig returns the configuration enforced by the server.
+func (s *Server) EffectiveConfig() (config EffectiveConfig, err error) {
+	opts := s.Options()
+
+	config = EffectiveConfig{
+		DefaultTopic:      opts.DefaultTopic,
+		AllowAllTopics:    opts.AllowAllTopics,
+		AllowedTopics:     []string{},
+		AllowedTopicsFile: opts.AllowedTopicsFile,
+
+		Auth: "none",
+		TLS:  opts.TLSConfig != nil,
+
+		MaxKeySize:          opts.MaxKeySize,
+		MaxValueSize:        opts.MaxValueSize,
+		MaxDeletePercent:    opts.MaxDeletePercent,
+		MaxShortfallPercent: opts.MaxShortfallPercent,
+		VerifyPercent:       opts.VerifyPercent,
+
+		IdleTimeout:       opts.IdleTimeout.String(),
+		PausedIdleTimeout: opts.PausedIdleTimeout.String(),
+		ReadTimeout:       opts.ReadTimeout.String(),
+		FinalizeTimeout:   opts.FinalizeTimeout.String(),
+		TopicLockTTL:      opts.TopicLockTTL.String(),
+
+		RecordErrorPolicy:   opts.RecordErrorPolicy,
+		DuplicateKeysPolicy: opts.DuplicateKeysPolicy,
+		ProduceErrorPolicy:  opts.ProduceErrorPolicy,
+		ProduceRetries:      opts.ProduceRetries,
+		ProduceWorkers:      opts.ProduceWorkers,
+		SortedProduce:       opts.SortedProduce,
+		MaxConcurrentSyncs:  opts.MaxConcurrentSyncs,
+		RecordSamples:       opts.RecordSamples,
+
+		Store:          opts.Store != nil,
+		WarmTopics:     opts.WarmTopics,
+		JournalDir:     opts.JournalDir,
+		SessionTTL:     opts.SessionTTL.String(),
+		IdempotencyTTL: opts.IdempotencyTTL.String(),
+
+		Topics: make(map[string]TopicConfig, len(opts.Topics)),
+	}
+
+	switch {
+	case len(opts.AuthWebhook) != 0:
+		config.Auth = "webhook"
+	case len(opts.Token) != 0:
+		config.Auth = "token"
+	}
+
+	for name := range opts.Clusters {
+		config.Clusters = append(config.Clusters, name)
+	}
+	sort.Strings(config.Clusters)
+
+	for name, topicConfig := range opts.Topics {
+		topicConfig.Tokens = redactTokens(topicConfig.Tokens)
+
+		if len(topicConfig.Transforms) != 0 {
+			transforms := make([]Transform, len(topicConfig.Transforms))
+			for i, t := range topicConfig.Transforms {
+				if len(t.Secret) != 0 {
+					t.Secret = redacted
+				}
+				transforms[i] = t
+			}
+			topicConfig.Transforms = transforms
+		}
+
+		config.Topics[name] = topicConfig
+	}
+
+	if len(opts.VirtualHosts) != 0 {
+		config.VirtualHosts = make(map[string]VirtualHost, len(opts.VirtualHosts))
+	}
+
+	for name, vhost := range opts.VirtualHosts {
+		vhost.Tokens = redactTokens(vhost.Tokens)
+		config.VirtualHosts[name] = vhost
+	}
+
+	if opts.AllowAllTopics {
+		return
+	}
+
+	allowed := map[string]bool{}
+
+	for name := range opts.Topics {
+		allowed[name] = true
+	}
+
+	if len(opts.AllowedTopicsFile) == 0 {
+		if len(opts.DefaultTopic) != 0 {
+			allowed[opts.DefaultTopic] = true
+		}
+
+	} else {
+		var topics []string
+		if topics, err = s.AllowedTopics(); err != nil {
+			return
+		}
+
+		for _, topic := range topics {
+			allowed[topic] = true
+		}
+	}
+
+	for topic := range allowed {
+		config.AllowedTopics = append(config.AllowedTopics, topic)
+	}
+	sort.Strings(config.AllowedTopics)
+
+	return
+}
+
+// redactTokens returns as many redacted tokens as tokens.
+func redactTokens(tokens []string) (redactedTokens []string) {
+	if len(tokens) == 0 {
+		return tokens
+	}
+
+	redactedTokens = make([]string, len(tokens))
+	for i := range redactedTokens {
+		redactedTokens[i] = redacted
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// EnvelopeConfig makes the values of a topic JSON envelopes with metadata:
+// {"source":"...","syncId":"...","timestamp":"...","value":...}. The diff compares the values only, so
+// unchanged records are not produced again for their metadata.
+type EnvelopeConfig struct {
+	// Source is the name of the system the values come from (the client's name if empty).
+	Source string `json:"source,omitempty"`
+
+	// Fields of the clients' values, that must then be JSON objects, assembled as the envelope's value
+	// (the whole value if empty). The missing fields are omitted.
+	Fields []string `json:"fields,omitempty"`
+}
+
+type envelope struct {
+	Source    string          `json:"source,omitempty"`
+	SyncID    string          `json:"syncId"`
+	Timestamp time.Time       `json:"timestamp"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// value returns the value of the envelope from a client's value, encoded as it is once produced, or nil
+// if it's the value as it is (raw JSON).
+func (e *EnvelopeConfig) value(value []byte, j *JSONConfig) (v []byte, err error) {
+	if len(e.Fields) == 0 && j.raw() {
+		if !json.Valid(value) {
+			return nil, errors.New("value is not JSON")
+		}
+		return nil, nil
+	}
+
+	if len(e.Fields) == 0 {
+		buf := &bytes.Buffer{}
+		if err = json.Compact(buf, value); err != nil {
+			return nil, errors.New("value is not JSON")
+		}
+
+		if j == nil || !j.NoHTMLEscape {
+			// as marshaled in the envelope
+			escaped := &bytes.Buffer{}
+			json.HTMLEscape(escaped, buf.Bytes())
+			return escaped.Bytes(), nil
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	obj := map[string]json.RawMessage{}
+	if err = json.Unmarshal(value, &obj); err != nil {
+		return nil, errors.New("value is not a JSON object")
+	}
+
+	fields := make(map[string]json.RawMessage, len(e.Fields))
+	for _, field := range e.Fields {
+		if v, ok := obj[field]; ok {
+			fields[field] = v
+		}
+	}
+
+	return j.marshal(fields)
+}
+
+// wrapper returns the syncer's Wrap function of a sync. The values are the envelopes' values, as value
+// returns them, so they're compared as unwrapEnvelope returns them (the values of the server's sources
+// that are not JSON are JSON strings then).
+func (e *EnvelopeConfig) wrapper(clientName, syncID string, j *JSONConfig) func(syncer.KeyValue) []byte {
+	source := e.Source
+	if len(source) == 0 {
+		source = clientName
+	}
+
+	return func(kv syncer.KeyValue) []byte {
+		env := envelope{
+			Source:    source,
+			SyncID:    syncID,
+			Timestamp: kv.Timestamp.UTC(),
+			Value:     kv.Value,
+		}
+
+		if env.Timestamp.IsZero() {
+			env.Timestamp = time.Now().UTC()
+		}
+
+		if !json.Valid(kv.Value) {
+			env.Value, _ = j.marshal(string(kv.Value))
+		} else if j.raw() {
+			// the value is the envelope's last field: marshal the others, and append it as it is
+			env.Value = nil
+			value, _ := j.marshal(env)
+
+			value = append(value[:len(value)-len("null}")], kv.Value...)
+			return append(value, '}')
+		}
+
+		value, _ := j.marshal(env) // can't fail with a valid value
+		return value
+	}
+}
+
+// unwrapEnvelope returns the value of a produced envelope, or the value itself if it's not one (ie:
+// produced before the topic had envelopes).
+func unwrapEnvelope(value []byte) []byte {
+	env := envelope{}
+	if err := json.Unmarshal(value, &env); err != nil || env.Value == nil {
+		return value
+	}
+	return env.Value
+}
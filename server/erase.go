@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+// EraseRequest selects the keys of a topic to erase, ie: for a right to erasure request.
+type EraseRequest struct {
+	// Keys to erase, as the clients send them: the key transforms of the topic are applied.
+	Keys []string `json:"keys,omitempty"`
+
+	// Pattern is a regular expression matching the keys to erase, as they are in the topic.
+	Pattern string `json:"pattern,omitempty"`
+
+	// Reason of the erasure, for the audit log (ie: the reference of the request).
+	Reason string `json:"reason,omitempty"`
+
+	// DryRun counts the keys to erase, without erasing them.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// EraseResult is the outcome of an erasure.
+type EraseResult struct {
+	// Erased is the number of keys of the topic tombstoned (to tombstone on a dry run).
+	Erased int `json:"erased"`
+	// NotFound is the number of requested Keys not in the topic.
+	NotFound int  `json:"notFound"`
+	DryRun   bool `json:"dryRun,omitempty"`
+}
+
+// Erase produces tombstones for the selected keys still in the topic. The topic is locked meanwhile, so
+// no sync runs. Each erasure is logged for audit with the requester; the keys are not.
+func (s *Server) Erase(topic string, req EraseRequest, requester string) (result EraseResult, err error) {
+	if len(req.Keys) == 0 && len(req.Pattern) == 0 {
+		return result, errors.New("no keys or pattern to erase")
+	}
+
+	var pattern *regexp.Regexp
+	if len(req.Pattern) != 0 {
+		if pattern, err = regexp.Compile(req.Pattern); err != nil {
+			return result, fmt.Errorf("invalid pattern: %v", err)
+		}
+	}
+
+	keys := map[string]bool{}
+	if len(req.Keys) != 0 {
+		config, _ := s.topicConfig(topic)
+
+		for _, key := range req.Keys {
+			kv := KeyValue{Key: []byte(key)}
+
+			for _, t := range config.Transforms {
+				if t.Type == TransformDropFields {
+					continue
+				}
+
+				if kv, err = t.apply(kv, nil); err != nil {
+					return result, fmt.Errorf("key %q: %v", key, err)
+				}
+			}
+
+			keys[string(kv.Key)] = true
+		}
+	}
+
+	lock := s.LockTopic(topic, "erase by "+requester)
+	if lock == nil {
+		return result, fmt.Errorf("topic %q is being synced", topic)
+	}
+	defer s.UnlockTopic(lock)
+
+	kafka := s.kafka(topic)
+
+	partitions, err := s.indexNames(topic)
+	if err != nil {
+		return
+	}
+
+	found := map[string]bool{}
+	var tombstones []*backend.Message
+
+	for p := range partitions {
+		partition := int32(p)
+
+		if isClosed(lock.cancelled) {
+			return result, errLockCancelled
+		}
+
+		var live map[string]bool
+		if live, err = s.liveKeys(kafka, topic, partition); err != nil {
+			return
+		}
+
+		lock.Touch()
+
+		for key := range live {
+			if keys[key] {
+				found[key] = true
+			} else if pattern == nil || !pattern.MatchString(key) {
+				continue
+			}
+
+			tombstones = append(tombstones, &backend.Message{
+				Topic:     topic,
+				Partition: partition,
+				Key:       []byte(key),
+				Value:     []byte{},
+			})
+		}
+	}
+
+	result = EraseResult{
+		Erased:   len(tombstones),
+		NotFound: len(keys) - len(found),
+		DryRun:   req.DryRun,
+	}
+
+	if req.DryRun {
+		log.Printf("AUDIT: erase dry run on topic %q by %s: %d keys to erase, %d not found (reason: %q)",
+			topic, requester, result.Erased, result.NotFound, req.Reason)
+		return
+	}
+
+	for i, msg := range tombstones {
+		if isClosed(lock.cancelled) {
+			err = errLockCancelled
+		} else {
+			err = kafka.Produce(msg)
+			lock.Touch()
+		}
+
+		if err != nil {
+			result.Erased = i
+			metricTombstones.WithLabelValues(topic, "erase").Add(float64(i))
+			log.Printf("AUDIT: erase on topic %q by %s failed after %d of %d keys: %v (reason: %q)",
+				topic, requester, i, len(tombstones), err, req.Reason)
+			return
+		}
+	}
+
+	metricTombstones.WithLabelValues(topic, "erase").Add(float64(result.Erased))
+
+	log.Printf("AUDIT: erase on topic %q by %s: %d keys erased, %d not found (reason: %q)",
+		topic, requester, result.Erased, result.NotFound, req.Reason)
+
+	if s.hasStore() {
+		go s.IndexTopic(topic)
+	}
+
+	return
+}
+
+// liveKeys returns the keys of the partition not deleted.
+func (s *Server) liveKeys(kafka backend.Backend, topic string, partition int32) (keys map[string]bool, err error) {
+	keys = map[string]bool{}
+
+	low, high, err := kafka.Offsets(topic, partition)
+	if err != nil || high <= low {
+		return
+	}
+
+	err = s.readTopic(kafka, topic, partition, low, high, func(msg *backend.Message) error {
+		if len(msg.Value) == 0 {
+			delete(keys, string(msg.Key))
+		} else {
+			keys[string(msg.Key)] = true
+		}
+		return nil
+	})
+
+	return
+}
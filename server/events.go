@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/oklog/ulid"
+)
+
+// Sync outcomes.
+const (
+	SyncSucceeded = "succeeded"
+	SyncFailed    = "failed"
+	SyncCancelled = "cancelled"
+	// SyncIncomplete is a sync cancelled because its client disconnected before the end of its transfer.
+	SyncIncomplete = "incomplete"
+)
+
+// SyncEvent is published to the events topic at the end of each sync.
+type SyncEvent struct {
+	SyncID        string     `json:"syncId"`
+	Topic         string     `json:"topic"`
+	ClientName    string     `json:"clientName,omitempty"`
+	ClientVersion string     `json:"clientVersion,omitempty"`
+	DoDelete      bool       `json:"doDelete"`
+	Outcome       string     `json:"outcome"`
+	Error         string     `json:"error,omitempty"`
+	Stats         *SyncStats `json:"stats,omitempty"`
+	StartTime     time.Time  `json:"startTime"`
+	EndTime       time.Time  `json:"endTime"`
+	DurationMs    int64      `json:"durationMs"`
+}
+
+func newSyncID(t time.Time) string {
+	return ulid.MustNew(ulid.Timestamp(t), rand.Reader).String()
+}
+
+// publishSyncEvent publishes the event to the events topic, if set. The key is the synced topic.
+func (s *Server) publishSyncEvent(event SyncEvent) {
+	if len(s.opts.EventsTopic) == 0 {
+		return
+	}
+
+	value, err := json.Marshal(event)
+	if err != nil {
+		log.Print("failed to encode the sync event: ", err)
+		return
+	}
+
+	err = s.opts.Kafka.Produce(&backend.Message{
+		Topic: s.opts.EventsTopic,
+		Key:   []byte(event.Topic),
+		Value: value,
+	})
+
+	if err != nil {
+		log.Printf("failed to publish the event of sync %s: %v", event.SyncID, err)
+	}
+}
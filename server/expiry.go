@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// ExpiryConfig deletes the expired keys of a topic, ie: a cache. A record expires at the time of its
+// syncer.ExpiryHeader (set from the clients' ExpiresAt), or else TTL after it was produced.
+type ExpiryConfig struct {
+	// TTL of the records without expiry header, as a duration (ie: "24h"; they don't expire if empty).
+	TTL string `json:"ttl,omitempty"`
+}
+
+func (c *ExpiryConfig) validate() error {
+	if c == nil || len(c.TTL) == 0 {
+		return nil
+	}
+
+	if _, err := time.ParseDuration(c.TTL); err != nil {
+		return fmt.Errorf("expiry: invalid TTL: %v", err)
+	}
+	return nil
+}
+
+func (c *ExpiryConfig) ttl() (ttl time.Duration) {
+	if c != nil {
+		ttl, _ = time.ParseDuration(c.TTL) // validated
+	}
+	return
+}
+
+// ExpireTopics deletes the expired keys of the topics with an expiry configuration.
+func (s *Server) ExpireTopics() {
+	s.optsMutex.Lock()
+	topics := make([]string, 0)
+	for topic, config := range s.opts.Topics {
+		if config.Expiry != nil {
+			topics = append(topics, topic)
+		}
+	}
+	s.optsMutex.Unlock()
+
+	for _, topic := range topics {
+		count, err := s.ExpireKeys(topic)
+		if err != nil {
+			log.Printf("expiry: topic %q: %v", topic, err)
+		}
+
+		if count != 0 {
+			log.Printf("expiry: deleted %d keys from topic %q", count, topic)
+		}
+	}
+}
+
+// ExpireKeys produces tombstones for the expired keys of the topic, returning how many were. The topic is
+// locked meanwhile, so no sync runs.
+func (s *Server) ExpireKeys(topic string) (count int, err error) {
+	config, _ := s.topicConfig(topic)
+	ttl := config.Expiry.ttl()
+
+	lock := s.LockTopic(topic, "expiry")
+	if lock == nil {
+		return 0, fmt.Errorf("topic %q: %w", topic, ErrTopicLocked)
+	}
+	defer s.UnlockTopic(lock)
+
+	kafka := s.kafka(topic)
+
+	partitions, err := kafka.Partitions(topic)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	defer func() {
+		metricTombstones.WithLabelValues(topic, "expiry").Add(float64(count))
+
+		if count != 0 && s.hasStore() {
+			go s.IndexTopic(topic)
+		}
+	}()
+
+	for _, partition := range partitions {
+		low, high, err := kafka.Offsets(topic, partition)
+		if err != nil {
+			return count, err
+		}
+
+		if high <= low {
+			continue
+		}
+
+		expiries := map[string]time.Time{}
+
+		err = s.readTopic(kafka, topic, partition, low, high, func(msg *backend.Message) error {
+			lock.Touch()
+
+			key := string(msg.Key)
+
+			expiry, ok := recordExpiry(msg)
+			if !ok && ttl != 0 {
+				expiry, ok = msg.Timestamp.Add(ttl), true
+			}
+
+			if len(msg.Value) == 0 || !ok {
+				delete(expiries, key)
+				return nil
+			}
+
+			expiries[key] = expiry
+			return nil
+		})
+
+		if err != nil {
+			return count, err
+		}
+
+		for key, expiry := range expiries {
+			if expiry.After(now) {
+				continue
+			}
+
+			if isClosed(lock.cancelled) {
+				return count, errLockCancelled
+			}
+
+			err = kafka.Produce(&backend.Message{
+				Topic:     topic,
+				Partition: partition,
+				Key:       []byte(key),
+				Value:     []byte{},
+			})
+			if err != nil {
+				return count, err
+			}
+
+			lock.Touch()
+			count++
+		}
+	}
+
+	return
+}
+
+// recordExpiry returns the time of the record's expiry header (RFC3339 or Unix seconds), if any.
+func recordExpiry(msg *backend.Message) (expiry time.Time, ok bool) {
+	for _, hdr := range msg.Headers {
+		if string(hdr.Key) != syncer.ExpiryHeader {
+			continue
+		}
+
+		value := string(hdr.Value)
+
+		if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(secs, 0), true
+		}
+
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, true
+		}
+
+		log.Printf("expiry: invalid %s header value: %q", syncer.ExpiryHeader, value)
+	}
+
+	return
+}
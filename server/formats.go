@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/ugorji/go/codec"
+)
+
+// supportedFormats are the formats the server accepts, the most efficient first.
+var supportedFormats = []string{"msgpack", "cbor", "gob", "binary", "json"}
+
+var (
+	msgpackHandle = &codec.MsgpackHandle{}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func isFormatSupported(format string) bool {
+	for _, f := range supportedFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateFormat returns the client's preferred format supported by the server, or "" if none is.
+func negotiateFormat(clientFormats []string) string {
+	for _, f := range clientFormats {
+		if isFormatSupported(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// newFrameDecoder returns the decoder of the format's frames. An empty format is detected from the data,
+// only for the msgpack and cbor formats.
+func newFrameDecoder(format string, r *bufio.Reader) frameDecoder {
+	switch format {
+	case "json":
+		return jsonFrames(json.NewDecoder(r))
+
+	case "binary":
+		return binaryJSONFrames(json.NewDecoder(r))
+
+	case "msgpack":
+		// the init object is followed by a newline
+		return afterSpaces(r, binaryFrames(codec.NewDecoder(r, msgpackHandle)))
+
+	case "cbor":
+		// the init object is followed by a newline
+		return afterSpaces(r, binaryFrames(codec.NewDecoder(r, cborHandle)))
+
+	case "gob":
+		// the init object is followed by a newline; gob messages start with their length
+		return afterNewline(r, binaryFrames(gob.NewDecoder(r)))
+
+	case "":
+		return detectFrames(r)
+
+	default:
+		panic("unknown format " + format)
+	}
+}
+
+// detectFrames sniffs the format on the first frame.
+func detectFrames(r *bufio.Reader) frameDecoder {
+	var decode frameDecoder
+
+	return func() (f frame, err error) {
+		if decode == nil {
+			var b byte
+			if b, err = peekNonSpace(r); err != nil {
+				return
+			}
+
+			switch {
+			case b == '{':
+				// json and binary values can't be told apart reliably (base64 strings are valid strings)
+				err = &client.Error{
+					Code:    client.ErrUnknownFormat,
+					Message: "JSON values require the format to be declared (json or binary)",
+				}
+				return
+
+			case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf: // msgpack maps
+				decode = newFrameDecoder("msgpack", r)
+
+			case b >= 0xa0 && b <= 0xbb, b == 0xbf: // cbor maps
+				decode = newFrameDecoder("cbor", r)
+
+			default:
+				err = &client.Error{
+					Code:    client.ErrUnknownFormat,
+					Message: fmt.Sprintf("failed to detect the format (first byte: 0x%02x)", b),
+				}
+				return
+			}
+		}
+
+		return decode()
+	}
+}
+
+// afterSpaces skips the spaces before the first frame.
+func afterSpaces(r *bufio.Reader, decode frameDecoder) frameDecoder {
+	skipped := false
+
+	return func() (f frame, err error) {
+		if !skipped {
+			if _, err = peekNonSpace(r); err != nil {
+				return
+			}
+			skipped = true
+		}
+
+		return decode()
+	}
+}
+
+// afterNewline skips the newline before the first frame.
+func afterNewline(r *bufio.Reader, decode frameDecoder) frameDecoder {
+	skipped := false
+
+	return func() (f frame, err error) {
+		if !skipped {
+			var buf []byte
+			if buf, err = r.Peek(1); err != nil {
+				return
+			}
+			if buf[0] == '\n' {
+				r.Discard(1)
+			}
+			skipped = true
+		}
+
+		return decode()
+	}
+}
+
+func peekNonSpace(r *bufio.Reader) (b byte, err error) {
+	for {
+		var buf []byte
+		if buf, err = r.Peek(1); err != nil {
+			return
+		}
+
+		if b = buf[0]; !bytes.ContainsRune([]byte(" \t\r\n"), rune(b)) {
+			return
+		}
+
+		r.Discard(1)
+	}
+}
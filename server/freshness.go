@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sync2kafka",
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Time of the last successful sync of the topic",
+	}, []string{"topic"})
+
+	metricExpectedInterval = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sync2kafka",
+		Name:      "expected_sync_interval_seconds",
+		Help:      "Maximum expected duration between successful syncs of the topic",
+	}, []string{"topic"})
+
+	metricStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sync2kafka",
+		Name:      "topic_stale",
+		Help:      "1 if the topic had no successful sync in its expected interval",
+	}, []string{"topic"})
+)
+
+// TopicFreshness tells how recent the data of a topic is.
+type TopicFreshness struct {
+	Topic string
+	// LastSuccess is the time of the last successful sync since the server started (zero if none).
+	LastSuccess time.Time
+	// Age is the time since the last successful sync, or since the server started if none.
+	Age time.Duration
+	// ExpectedInterval is the maximum expected duration between successful syncs (0 if not checked).
+	ExpectedInterval time.Duration
+	// Stale is true if the age is over the expected interval.
+	Stale bool
+}
+
+// expectedInterval returns the expected sync interval of the topic (0 if not checked).
+func (s *Server) expectedInterval(topic string) time.Duration {
+	if interval, ok := s.opts.FreshnessIntervals[topic]; ok {
+		return interval
+	}
+	return s.opts.FreshnessWindow
+}
+
+// syncSucceeded records a successful sync of the topic.
+func (s *Server) syncSucceeded(topic string) {
+	s.lastSyncsMutex.Lock()
+	defer s.lastSyncsMutex.Unlock()
+
+	now := time.Now()
+
+	s.lastSyncs[topic] = now
+	delete(s.staleTopics, topic)
+
+	metricLastSuccess.WithLabelValues(topic).Set(float64(now.Unix()))
+	metricStale.WithLabelValues(topic).Set(0)
+}
+
+// Freshness returns the freshness of the topics synced since the server started, and of the topics
+// with an expected interval.
+func (s *Server) Freshness() (freshness []TopicFreshness) {
+	s.lastSyncsMutex.Lock()
+	defer s.lastSyncsMutex.Unlock()
+
+	return s.freshness(time.Now())
+}
+
+func (s *Server) freshness(now time.Time) (freshness []TopicFreshness) {
+	topics := make([]string, 0, len(s.lastSyncs)+len(s.opts.FreshnessIntervals))
+	for topic := range s.lastSyncs {
+		topics = append(topics, topic)
+	}
+	for topic := range s.opts.FreshnessIntervals {
+		if _, ok := s.lastSyncs[topic]; !ok {
+			topics = append(topics, topic)
+		}
+	}
+
+	sort.Strings(topics)
+
+	freshness = make([]TopicFreshness, 0, len(topics))
+	for _, topic := range topics {
+		f := TopicFreshness{
+			Topic:            topic,
+			LastSuccess:      s.lastSyncs[topic],
+			ExpectedInterval: s.expectedInterval(topic),
+		}
+
+		if f.LastSuccess.IsZero() {
+			f.Age = now.Sub(s.startTime)
+		} else {
+			f.Age = now.Sub(f.LastSuccess)
+		}
+
+		f.Stale = f.ExpectedInterval != 0 && f.Age > f.ExpectedInterval
+
+		freshness = append(freshness, f)
+	}
+
+	return
+}
+
+// staleTopicsChecker alerts once for each topic without successful sync in its expected interval,
+// since its last successful sync.
+func (s *Server) staleTopicsChecker(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.checkStaleTopics()
+	}
+}
+
+func (s *Server) checkStaleTopics() {
+	stale := make([]TopicFreshness, 0)
+
+	s.lastSyncsMutex.Lock()
+	for _, f := range s.freshness(time.Now()) {
+		if f.ExpectedInterval != 0 {
+			metricExpectedInterval.WithLabelValues(f.Topic).Set(f.ExpectedInterval.Seconds())
+		}
+
+		if !f.Stale || s.staleTopics[f.Topic] {
+			continue
+		}
+
+		s.staleTopics[f.Topic] = true
+		metricStale.WithLabelValues(f.Topic).Set(1)
+
+		stale = append(stale, f)
+	}
+	s.lastSyncsMutex.Unlock()
+
+	for _, f := range stale {
+		msg := fmt.Sprintf("no successful sync since the server started %v ago (expected every %v)",
+			f.Age.Round(time.Second), f.ExpectedInterval)
+		if !f.LastSuccess.IsZero() {
+			msg = fmt.Sprintf("no successful sync since %s (%v ago, expected every %v)",
+				f.LastSuccess.Format(time.RFC3339), f.Age.Round(time.Second), f.ExpectedInterval)
+		}
+
+		s.alert(Alert{Kind: AlertStaleTopic, Topic: f.Topic, Message: msg})
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"time"
+)
+
+type idempotentResult struct {
+	result SyncResult
+	expiry time.Time
+}
+
+// idempotencyID returns the ID of a sync's result. The keys are scoped by token, so a client can't get
+// the results of another.
+func idempotencyID(topic, token, key string) string {
+	return topic + "\x00" + tokenHash(token) + "\x00" + key
+}
+
+// completedResult returns the result of the topic's sync with the token and idempotency key, if it
+// completed recently.
+func (s *Server) completedResult(topic, token, key string) (result SyncResult, ok bool) {
+	s.idempotentResultsMutex.Lock()
+	defer s.idempotentResultsMutex.Unlock()
+
+	r, ok := s.idempotentResults[idempotencyID(topic, token, key)]
+	if !ok || time.Now().After(r.expiry) {
+		return result, false
+	}
+
+	return r.result, true
+}
+
+// storeCompletedResult keeps the result of the topic's sync with the token and idempotency key for
+// IdempotencyTTL.
+func (s *Server) storeCompletedResult(topic, token, key string, result SyncResult) {
+	s.idempotentResultsMutex.Lock()
+	defer s.idempotentResultsMutex.Unlock()
+
+	now := time.Now()
+
+	for id, r := range s.idempotentResults {
+		if now.After(r.expiry) {
+			delete(s.idempotentResults, id)
+		}
+	}
+
+	s.idempotentResults[idempotencyID(topic, token, key)] = idempotentResult{
+		result: result,
+		expiry: now.Add(s.opts.IdempotencyTTL),
+	}
+}
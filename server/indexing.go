@@ -0,0 +1,123 @@
+package server
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/mcluseau/go-diff/boltindex"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// IndexTopic updates the stored index of the topic. Does nothing without a store.
+func (s *Server) IndexTopic(topic string) (err error) {
+	if !s.hasStore() {
+		return
+	}
+
+	s.lockTopicForIndexing(topic)
+	defer s.unlockTopicForIndexing(topic)
+
+	names, err := s.indexNames(topic)
+	if err != nil {
+		log.Printf("indexing topic %s: error: %v", topic, err)
+		return
+	}
+
+	log.Printf("indexing topic %s...", topic)
+
+	for partition, name := range names {
+		if pErr := s.indexPartition(topic, int32(partition), name); pErr != nil && err == nil {
+			err = pErr
+		}
+	}
+
+	if err := s.opts.Store.Sync(); err != nil {
+		log.Print("bolt DB sync failed: ", err)
+	}
+
+	return
+}
+
+// indexPartition updates the stored index of a partition of the topic.
+func (s *Server) indexPartition(topic string, partition int32, name string) (err error) {
+	index, err := boltindex.New(s.opts.Store, []byte(name), false)
+	if err != nil {
+		return
+	}
+
+	sy := s.newSyncer(topic)
+	sy.Partition = partition
+
+	msgCount, err := sy.IndexTopic(s.kafka(topic), index)
+
+	if err == syncer.ErrIndexInvalid {
+		log.Printf("indexing topic %s: the stored index %s doesn't match the topic's offsets, rebuilding it", topic, name)
+
+		if err = s.resetIndex(name); err != nil {
+			return
+		}
+
+		msgCount, err = sy.IndexTopic(s.kafka(topic), index)
+	}
+
+	log.Printf("indexing topic %s: %d messages read in partition %d", topic, msgCount, partition)
+
+	if err != nil {
+		log.Printf("indexing topic %s: partition %d: error: %v", topic, partition, err)
+	}
+
+	return
+}
+
+// indexNames returns the names of the stored indexes of the topic, by partition. Only the first partition
+// is indexed, unless the topic has partition affinity.
+func (s *Server) indexNames(topic string) (names []string, err error) {
+	if config, _ := s.topicConfig(topic); !config.PartitionAffinity {
+		return []string{topic}, nil
+	}
+
+	partitions, err := s.kafka(topic).Partitions(topic)
+	if err != nil {
+		return
+	}
+
+	for _, partition := range partitions {
+		names = append(names, topic+"#"+strconv.Itoa(int(partition)))
+	}
+
+	return
+}
+
+// resetIndex removes the stored index with the given name, to rebuild it from scratch.
+func (s *Server) resetIndex(name string) error {
+	return s.opts.Store.Update(func(tx *bolt.Tx) error {
+		// buckets of boltindex: the index and its metadata (resume key)
+		for _, bucket := range [][]byte{[]byte(name), []byte("meta:" + name)} {
+			if err := tx.DeleteBucket(bucket); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		_, err := tx.CreateBucket([]byte(name))
+		return err
+	})
+}
+
+func (s *Server) lockTopicForIndexing(topic string) {
+	s.indexingTopicsCond.L.Lock()
+	for len(s.indexingTopics) >= s.opts.ParallelIndexers || s.indexingTopics[topic] {
+		s.indexingTopicsCond.Wait()
+	}
+
+	s.indexingTopics[topic] = true
+	s.indexingTopicsCond.L.Unlock()
+}
+
+func (s *Server) unlockTopicForIndexing(topic string) {
+	s.indexingTopicsCond.L.Lock()
+	defer s.indexingTopicsCond.L.Unlock()
+
+	delete(s.indexingTopics, topic)
+	s.indexingTopicsCond.Broadcast()
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"runtime"
+
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+// Info returns the build and the enabled features of the server.
+func (s *Server) Info() client.ServerInfo {
+	opts := s.Options()
+
+	features := []string{client.FeatureMultiplex, client.FeatureIdempotency}
+
+	if s.sessionsEnabled() {
+		features = append(features, client.FeatureSessions)
+	}
+	if opts.VerifyPercent != 0 {
+		features = append(features, client.FeatureVerification)
+	}
+	if opts.TLSConfig != nil {
+		features = append(features, client.FeatureTLS)
+	}
+	if len(opts.VirtualHosts) != 0 {
+		features = append(features, client.FeatureVirtualHosts)
+	}
+	if len(opts.AuthWebhook) != 0 {
+		features = append(features, client.FeatureAuthWebhook)
+	}
+	if opts.MaxConcurrentSyncs != 0 {
+		features = append(features, client.FeaturePriorities)
+	}
+	if opts.Store != nil {
+		features = append(features, client.FeatureStore)
+	}
+	if opts.RecordSamples != 0 {
+		features = append(features, client.FeatureRecordSamples)
+	}
+
+	return client.ServerInfo{
+		Version:          client.Version,
+		Commit:           client.Commit,
+		GoVersion:        runtime.Version(),
+		ProtocolVersions: []int{client.ProtocolVersion},
+		Formats:          supportedFormats,
+		Features:         features,
+	}
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+const journalExt = ".journal"
+
+// journal records the values accepted from a client on disk, until the end of their sync.
+// A journal left by a crash is replayed when the server restarts.
+type journal struct {
+	path string
+	file *os.File
+	buf  *bufio.Writer
+	enc  *json.Encoder
+}
+
+// journalHeader is the first entry of a journal, followed by the values and an end of transfer.
+type journalHeader struct {
+	Topic     string
+	DoDelete  bool
+	Remote    string
+	StartTime time.Time
+
+	// SessionID is set if the client can resume the transfer
+	SessionID string `json:",omitempty"`
+
+	// TokenHash identifies the token of the session's client, the only one able to resume it
+	TokenHash string `json:",omitempty"`
+
+	// ProduceFrom are the high water marks of the topic's partitions when the journal was created (or the
+	// journal of the resumed session). The topic being locked, the records after them were produced by
+	// the sync.
+	ProduceFrom map[int32]int64 `json:",omitempty"`
+}
+
+// journalEntry is a value of a journal, or a count of the client's records skipped (invalid).
+type journalEntry struct {
+	BinaryKV
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// JournalRecovery is the report of the replay of a journal.
+type JournalRecovery struct {
+	File     string
+	Topic    string
+	Remote   string
+	Records  int
+	Complete bool
+	DoDelete bool
+
+	// ProduceFrom are the offsets of the topic's partitions where the interrupted sync started producing,
+	// and Produced the count of the journal's keys found after them: handed to Kafka before the
+	// interruption. ProduceFrom is nil for the journals that didn't record it, Produced being then unknown.
+	ProduceFrom map[int32]int64 `json:",omitempty"`
+	Produced    int
+
+	Stats *SyncStats
+	Error string
+	Time  time.Time
+}
+
+// newJournal creates the journal of a sync, or returns nil if journaling is not enabled.
+func (s *Server) newJournal(header journalHeader) (j *journal, err error) {
+	if len(s.opts.JournalDir) == 0 {
+		return
+	}
+
+	if header.ProduceFrom == nil {
+		if header.ProduceFrom, err = partitionHighWaters(s.kafka(header.Topic), header.Topic); err != nil {
+			return nil, fmt.Errorf("failed to read the offsets of topic %q: %v", header.Topic, err)
+		}
+	}
+
+	path := filepath.Join(s.opts.JournalDir, fmt.Sprintf("%s-%d%s", header.Topic, time.Now().UnixNano(), journalExt))
+	if len(header.SessionID) != 0 {
+		path = s.sessionJournalPath(header.SessionID)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+
+	j = &journal{path: path, file: file}
+	j.buf = bufio.NewWriter(file)
+	j.enc = json.NewEncoder(j.buf)
+
+	if err = j.enc.Encode(header); err != nil {
+		j.Remove()
+		return nil, err
+	}
+
+	return
+}
+
+// Append journals a value.
+func (j *journal) Append(kv KeyValue) error {
+	if j == nil {
+		return nil
+	}
+
+	obj := BinaryKV{Key: kv.Key, Value: kv.Value}
+	if !kv.Timestamp.IsZero() {
+		obj.Timestamp = &kv.Timestamp
+	}
+	if !kv.ExpiresAt.IsZero() {
+		obj.ExpiresAt = &kv.ExpiresAt
+	}
+
+	return j.enc.Encode(obj)
+}
+
+// Skip journals that records of the client were skipped, so a resumed session starts after them.
+func (j *journal) Skip(records int) error {
+	if j == nil || records == 0 {
+		return nil
+	}
+
+	return j.enc.Encode(struct {
+		Skipped int `json:"skipped"`
+	}{records})
+}
+
+// Complete marks the end of the transfer and flushes the journal to disk.
+func (j *journal) Complete() (err error) {
+	if j == nil {
+		return
+	}
+
+	if err = j.enc.Encode(BinaryKV{EndOfTransfer: true}); err != nil {
+		return
+	}
+
+	if err = j.buf.Flush(); err != nil {
+		return
+	}
+
+	return j.file.Sync()
+}
+
+// Keep flushes and closes the journal of an interrupted transfer, so it can be resumed.
+func (j *journal) Keep() (err error) {
+	if err = j.buf.Flush(); err != nil {
+		return
+	}
+
+	if err = j.file.Sync(); err != nil {
+		return
+	}
+
+	return j.file.Close()
+}
+
+// Remove deletes the journal, as its sync ended.
+func (j *journal) Remove() {
+	if j == nil {
+		return
+	}
+
+	j.file.Close()
+
+	if err := os.Remove(j.path); err != nil {
+		log.Print("failed to remove journal: ", err)
+	}
+}
+
+// readJournal reads a journal, calling fn for each value. A journal without end of transfer is not
+// complete: the server stopped during the transfer. The records are the client's, skipped ones included.
+func readJournal(path string, fn func(KeyValue)) (header journalHeader, records int, complete bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+
+	if err = dec.Decode(&header); err != nil {
+		return
+	}
+
+	for {
+		obj := journalEntry{}
+		if decErr := dec.Decode(&obj); decErr != nil {
+			if decErr != io.EOF {
+				// the last entry was not fully written
+				log.Printf("journal %s: ignoring truncated entry: %v", path, decErr)
+			}
+			return
+		}
+
+		if obj.EndOfTransfer {
+			complete = true
+			return
+		}
+
+		if obj.Skipped != 0 {
+			records += obj.Skipped
+			continue
+		}
+
+		kv := KeyValue{Key: obj.Key, Value: obj.Value}
+		if obj.Timestamp != nil {
+			kv.Timestamp = *obj.Timestamp
+		}
+		if obj.ExpiresAt != nil {
+			kv.ExpiresAt = *obj.ExpiresAt
+		}
+
+		records++
+
+		if fn != nil {
+			fn(kv)
+		}
+	}
+}
+
+// recoverJournals replays the journals of the syncs interrupted by a server stop.
+func (s *Server) recoverJournals() {
+	s.restoreResumedSessions()
+
+	paths, err := filepath.Glob(filepath.Join(s.opts.JournalDir, "*"+journalExt))
+	if err != nil {
+		log.Print("failed to list journals: ", err)
+		return
+	}
+
+	for _, path := range paths {
+		if s.sessionsEnabled() {
+			header, _, complete, err := readJournal(path, nil)
+			if err == nil && len(header.SessionID) != 0 && !complete {
+				log.Printf("journal %s: waiting %v for the client to resume session %s", path, s.opts.SessionTTL, header.SessionID)
+				s.keepSession(header.SessionID)
+				continue
+			}
+		}
+
+		s.addRecovery(s.recoverJournal(path))
+	}
+}
+
+func (s *Server) addRecovery(recovery JournalRecovery) {
+	s.recoveriesMutex.Lock()
+	defer s.recoveriesMutex.Unlock()
+
+	s.recoveries = append(s.recoveries, recovery)
+}
+
+// recoverJournal replays a journal. Deletions are only done if the transfer was complete.
+func (s *Server) recoverJournal(path string) (recovery JournalRecovery) {
+	recovery = JournalRecovery{File: path, Time: time.Now()}
+
+	header, records, complete, err := readJournal(path, nil)
+	if err != nil {
+		recovery.Error = err.Error()
+		log.Printf("journal %s: failed to read: %v", path, err)
+		return
+	}
+
+	recovery.Topic = header.Topic
+	recovery.Remote = header.Remote
+	recovery.Records = records
+	recovery.Complete = complete
+	recovery.DoDelete = header.DoDelete && complete
+
+	if recovery.ProduceFrom = header.ProduceFrom; recovery.ProduceFrom != nil {
+		if recovery.Produced, err = s.producedKeys(path, header); err != nil {
+			recovery.Error = err.Error()
+			log.Printf("journal %s: failed to find the records already produced: %v", path, err)
+			return
+		}
+	}
+
+	log.Printf("journal %s: recovering the sync of %d values from %s to topic %q (complete: %v, already produced: %d)",
+		path, records, header.Remote, header.Topic, complete, recovery.Produced)
+
+	recovery.Stats, err = s.SyncFromState(header.Topic, recovery.DoDelete, func(out chan<- KeyValue) (err error) {
+		_, _, _, err = readJournal(path, func(kv KeyValue) { out <- kv })
+		return
+	})
+
+	if err != nil {
+		recovery.Error = err.Error()
+		log.Printf("journal %s: recovery failed, keeping it: %v", path, err)
+		return
+	}
+
+	log.Printf("journal %s: recovered", path)
+
+	if err := os.Remove(path); err != nil {
+		log.Print("failed to remove journal: ", err)
+	}
+
+	return
+}
+
+// producedKeys counts the keys of the journal found in the topic after the offsets where its sync
+// started producing.
+func (s *Server) producedKeys(path string, header journalHeader) (produced int, err error) {
+	keys := map[string]bool{} // true once found
+	if _, _, _, err = readJournal(path, func(kv KeyValue) { keys[string(kv.Key)] = false }); err != nil {
+		return
+	}
+
+	kafka := s.kafka(header.Topic)
+
+	for partition, start := range header.ProduceFrom {
+		low, end, err := kafka.Offsets(header.Topic, partition)
+		if err != nil {
+			return 0, err
+		}
+
+		if start < low {
+			start = low
+		}
+
+		if start >= end {
+			continue
+		}
+
+		err = s.readTopic(kafka, header.Topic, partition, start, end, func(msg *backend.Message) error {
+			if found, ok := keys[string(msg.Key)]; ok && !found {
+				keys[string(msg.Key)] = true
+				produced++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return
+}
+
+// Recoveries returns the reports of the journals replayed since the server started.
+func (s *Server) Recoveries() []JournalRecovery {
+	s.recoveriesMutex.Lock()
+	defer s.recoveriesMutex.Unlock()
+
+	return append([]JournalRecovery{}, s.recoveries...)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// JSONConfig controls how the JSON values of a topic are encoded by the server. By default, the values
+// in envelopes are compacted, and the values re-encoded (drop-fields transform, envelope fields) have
+// the characters <, > and & of their strings escaped, like encoding/json does. The numbers are always
+// kept as they are written.
+type JSONConfig struct {
+	// Raw keeps the values in the envelopes as the clients sent them, instead of compacting them. The
+	// re-encoded values are still compact.
+	Raw bool `json:"raw,omitempty"`
+
+	// NoHTMLEscape keeps the characters <, > and & as they are in the re-encoded values and envelopes.
+	NoHTMLEscape bool `json:"noHTMLEscape,omitempty"`
+
+	// LargeIntegersAsStrings quotes the integers of the values beyond ±2^53, so consumers decoding the
+	// numbers as floating point (ie: JavaScript) don't round them.
+	LargeIntegersAsStrings bool `json:"largeIntegersAsStrings,omitempty"`
+}
+
+func (c *JSONConfig) raw() bool {
+	return c != nil && c.Raw
+}
+
+// marshal is json.Marshal, escaping HTML unless NoHTMLEscape is set.
+func (c *JSONConfig) marshal(v interface{}) ([]byte, error) {
+	if c == nil || !c.NoHTMLEscape {
+		return json.Marshal(v)
+	}
+
+	buf := &bytes.Buffer{}
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+// encodeValue returns the value to sync once encoded as configured, or nil if it's unchanged. Values
+// that are not JSON are unchanged.
+func (c *JSONConfig) encodeValue(value []byte) []byte {
+	if c == nil || !c.LargeIntegersAsStrings || !json.Valid(value) {
+		return nil
+	}
+
+	return quoteLargeIntegers(value)
+}
+
+// maxSafeInteger is 2^53-1, beyond which float64 can't represent all the integers.
+const maxSafeInteger = "9007199254740991"
+
+// quoteLargeIntegers returns the valid JSON value with its integers beyond ±2^53 quoted, or nil if it
+// has none.
+func quoteLargeIntegers(value []byte) (quoted []byte) {
+	start := 0 // of the value not copied to quoted yet
+
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"':
+			// skip the string
+			for i++; value[i] != '"'; i++ {
+				if value[i] == '\\' {
+					i++
+				}
+			}
+
+		case c == '-' || c >= '0' && c <= '9':
+			end := i + 1
+			for end < len(value) && bytes.IndexByte([]byte("0123456789.eE+-"), value[end]) != -1 {
+				end++
+			}
+
+			if isLargeInteger(value[i:end]) {
+				quoted = append(quoted, value[start:i]...)
+				quoted = append(quoted, '"')
+				quoted = append(quoted, value[i:end]...)
+				quoted = append(quoted, '"')
+				start = end
+			}
+
+			i = end - 1
+		}
+	}
+
+	if quoted == nil {
+		return nil
+	}
+
+	return append(quoted, value[start:]...)
+}
+
+// isLargeInteger returns true if the JSON number is an integer beyond ±2^53.
+func isLargeInteger(number []byte) bool {
+	digits := bytes.TrimPrefix(number, []byte{'-'})
+
+	if bytes.ContainsAny(digits, ".eE") {
+		return false
+	}
+
+	return len(digits) > len(maxSafeInteger) ||
+		len(digits) == len(maxSafeInteger) && string(digits) > maxSafeInteger
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+)
+
+// checkConsumerLag returns a warning for each checked consumer group lagging behind the topic. The groups
+// without committed offsets on the topic don't consume it, and are skipped.
+func (s *Server) checkConsumerLag(topic string) (warnings []string, err error) {
+	kafka := s.kafka(topic)
+
+	partitions, err := kafka.Partitions(topic)
+	if err != nil {
+		return
+	}
+
+	highWaters := make(map[int32]int64, len(partitions))
+	lowWaters := make(map[int32]int64, len(partitions))
+
+	for _, partition := range partitions {
+		if lowWaters[partition], highWaters[partition], err = kafka.Offsets(topic, partition); err != nil {
+			return
+		}
+	}
+
+	for _, group := range s.opts.LagCheckGroups {
+		offsets, err := kafka.CommittedOffsets(group, topic, partitions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get offsets of group %q: %v", group, err)
+		}
+
+		lag := int64(0)
+		consumes := false
+
+		for _, partition := range partitions {
+			committed := lowWaters[partition]
+
+			if offset, ok := offsets[partition]; ok && offset >= 0 {
+				committed = offset
+				consumes = true
+			}
+
+			lag += highWaters[partition] - committed
+		}
+
+		if !consumes {
+			continue
+		}
+
+		if lag > s.opts.MaxConsumerLag {
+			warnings = append(warnings, fmt.Sprintf("consumer group %q lags %d messages behind topic %q", group, lag, topic))
+		}
+	}
+
+	return
+}
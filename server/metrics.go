@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricReadWait = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "read_wait_seconds_total",
+		Help:      "Time spent waiting for and decoding client records (client or decode bound)",
+	}, []string{"topic"})
+
+	metricBufferFullWait = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "buffer_full_wait_seconds_total",
+		Help:      "Time the reader waited on a full source buffer (sync bound)",
+	}, []string{"topic"})
+
+	metricBufferUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sync2kafka",
+		Name:      "source_buffer_usage",
+		Help:      "Records waiting in the source buffer",
+	}, []string{"topic"})
+
+	metricBytesRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "read_bytes_total",
+		Help:      "Bytes read from the clients (topic is empty until the client's topic is accepted)",
+	}, []string{"topic"})
+
+	metricSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "syncs_total",
+		Help:      "Syncs by topic, client name and outcome",
+	}, []string{"topic", "client", "outcome"})
+
+	metricRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "records_total",
+		Help:      "Records of the syncs by topic and change (created, modified, deleted or unchanged; unchanged records are not produced)",
+	}, []string{"topic", "change"})
+
+	metricProduceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "produce_errors_total",
+		Help:      "Messages that failed to be produced, by topic and action (retried or skipped)",
+	}, []string{"topic", "action"})
+
+	metricVerifyDiscrepancies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "verify_discrepancies_total",
+		Help:      "Produced records not read back as produced, by topic and kind (missing or mismatched)",
+	}, []string{"topic", "kind"})
+
+	metricTombstones = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sync2kafka",
+		Name:      "tombstones_total",
+		Help:      "Tombstones produced, by topic and origin (sync, erase or expiry)",
+	}, []string{"topic", "origin"})
+
+	metricLastSyncTombstones = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sync2kafka",
+		Name:      "last_sync_tombstones",
+		Help:      "Tombstones produced by the last successful sync of the topic",
+	}, []string{"topic"})
+
+	metricLastSyncDeletedRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sync2kafka",
+		Name:      "last_sync_deleted_ratio",
+		Help:      "Ratio of the topic's keys deleted by its last successful sync (0 to 1)",
+	}, []string{"topic"})
+
+	metricProduceSend = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sync2kafka",
+		Name:      "produce_send_seconds",
+		Help:      "Latency of handing a record to the producer (broker bound when high)",
+		Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 12),
+	}, []string{"topic"})
+)
+
+// PipelineStats tells where a sync spends its time.
+type PipelineStats struct {
+	// BufferUsage is the number of records waiting in the source buffer, at the last read.
+	BufferUsage int
+	// BufferCapacity is the size of the source buffer.
+	BufferCapacity int
+	// ReadWait is the time spent waiting for and decoding client records (client or decode bound).
+	ReadWait time.Duration
+	// BufferFullWait is the time the reader waited on a full source buffer (sync bound).
+	BufferFullWait time.Duration
+	// ProduceSendTime is the total time spent handing records to the producer (broker bound when high).
+	ProduceSendTime time.Duration
+	// ProduceSends is the number of records handed to the producer.
+	ProduceSends int64
+}
+
+func (cs *ConnStatus) readWait(d time.Duration) {
+	cs.Pipeline.ReadWait += d
+	metricReadWait.WithLabelValues(cs.TargetTopic).Add(d.Seconds())
+}
+
+// push sends a record to the sync, accounting for the time spent waiting on a full buffer.
+func (cs *ConnStatus) push(out chan KeyValue, kv KeyValue) {
+	cs.ItemsRead++
+
+	if cs.ExpectedRecords != 0 {
+		cs.ReadPercent = 100 * float64(cs.ItemsRead) / float64(cs.ExpectedRecords)
+	}
+
+	select {
+	case out <- kv:
+	default:
+		start := time.Now()
+		out <- kv
+
+		d := time.Since(start)
+		cs.Pipeline.BufferFullWait += d
+		metricBufferFullWait.WithLabelValues(cs.TargetTopic).Add(d.Seconds())
+	}
+
+	cs.Pipeline.BufferUsage = len(out)
+	metricBufferUsage.WithLabelValues(cs.TargetTopic).Set(float64(len(out)))
+}
+
+// countingConn accounts the bytes read from the client.
+type countingConn struct {
+	net.Conn
+	status *ConnStatus
+}
+
+func (c countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.status.bytesRead(n)
+	return
+}
+
+func (cs *ConnStatus) bytesRead(n int) {
+	if n == 0 {
+		return
+	}
+
+	cs.BytesRead += int64(n)
+	metricBytesRead.WithLabelValues(cs.TargetTopic).Add(float64(n))
+}
+
+func (cs *ConnStatus) produceSent(d time.Duration) {
+	cs.Pipeline.ProduceSendTime += d
+	cs.Pipeline.ProduceSends++
+	metricProduceSend.WithLabelValues(cs.TargetTopic).Observe(d.Seconds())
+}
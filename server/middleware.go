@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+// ConnHandler serves an accepted connection.
+type ConnHandler func(conn net.Conn)
+
+// AuthFunc decides if a sync is allowed.
+type AuthFunc func(req AuthRequest) (AuthResponse, error)
+
+// RecordFunc processes a record received for a topic, after the topic's rules, and returns the record
+// to sync. An error rejects the record like an invalid one.
+type RecordFunc func(topic string, kv KeyValue) (KeyValue, error)
+
+// ProduceFunc hands a message to Kafka.
+type ProduceFunc func(msg *backend.Message)
+
+// Middleware wraps the steps of the syncs, like HTTP middlewares, so embedders can add logging,
+// metering or policies. Each function receives the next step and returns the step to use instead;
+// nil functions leave their step unchanged.
+type Middleware struct {
+	// Conn wraps the handling of the accepted connections (and multiplexed streams). Wrapping the
+	// connection hides its TLS server name from the virtual hosts.
+	Conn func(next ConnHandler) ConnHandler
+
+	// Auth wraps the authorization of the syncs: the token and allowed topics checks, or the auth webhook.
+	Auth func(next AuthFunc) AuthFunc
+
+	// Record wraps the processing of the received records.
+	Record func(next RecordFunc) RecordFunc
+
+	// Produce wraps the messages sent to Kafka by the syncs and erasures. Not calling next drops the message.
+	Produce func(next ProduceFunc) ProduceFunc
+}
+
+// The middlewares are applied in reverse order, so the first of Options.Middlewares is the outermost.
+
+func (s *Server) connMiddlewares(h ConnHandler) ConnHandler {
+	for i := len(s.opts.Middlewares) - 1; i >= 0; i-- {
+		if m := s.opts.Middlewares[i].Conn; m != nil {
+			h = m(h)
+		}
+	}
+	return h
+}
+
+func (s *Server) authMiddlewares(f AuthFunc) AuthFunc {
+	for i := len(s.opts.Middlewares) - 1; i >= 0; i-- {
+		if m := s.opts.Middlewares[i].Auth; m != nil {
+			f = m(f)
+		}
+	}
+	return f
+}
+
+func (s *Server) recordMiddlewares(f RecordFunc) RecordFunc {
+	for i := len(s.opts.Middlewares) - 1; i >= 0; i-- {
+		if m := s.opts.Middlewares[i].Record; m != nil {
+			f = m(f)
+		}
+	}
+	return f
+}
+
+func (s *Server) produceMiddlewares(f ProduceFunc) ProduceFunc {
+	for i := len(s.opts.Middlewares) - 1; i >= 0; i-- {
+		if m := s.opts.Middlewares[i].Produce; m != nil {
+			f = m(f)
+		}
+	}
+	return f
+}
+
+func (s *Server) hasProduceMiddlewares() bool {
+	for _, m := range s.opts.Middlewares {
+		if m.Produce != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// middlewareBackend passes the produced messages through the Produce middlewares.
+type middlewareBackend struct {
+	backend.Backend
+	s *Server
+}
+
+func (b middlewareBackend) NewProducer() (producer backend.Producer, err error) {
+	next, err := b.Backend.NewProducer()
+	if err != nil {
+		return
+	}
+
+	p := &middlewareProducer{Producer: next, send: b.s.produceMiddlewares(next.Send)}
+
+	if notifier, ok := next.(backend.ErrorNotifier); ok {
+		return notifyingMiddlewareProducer{p, notifier}, nil
+	}
+
+	return p, nil
+}
+
+var _ backend.PartitionProducer = middlewareBackend{}
+
+func (b middlewareBackend) Produce(msgs ...*backend.Message) error {
+	kept := b.filter(msgs)
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return b.Backend.Produce(kept...)
+}
+
+// ProduceToPartitions passes the messages through the Produce middlewares, like Produce.
+func (b middlewareBackend) ProduceToPartitions(msgs ...*backend.Message) error {
+	producer, ok := b.Backend.(backend.PartitionProducer)
+	if !ok {
+		return backend.ErrPartitionsUnsupported
+	}
+
+	kept := b.filter(msgs)
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return producer.ProduceToPartitions(kept...)
+}
+
+// filter returns the messages passed through the Produce middlewares, as they modified them.
+func (b middlewareBackend) filter(msgs []*backend.Message) []*backend.Message {
+	kept := make([]*backend.Message, 0, len(msgs))
+
+	produce := b.s.produceMiddlewares(func(msg *backend.Message) {
+		kept = append(kept, msg)
+	})
+
+	for _, msg := range msgs {
+		produce(msg)
+	}
+
+	return kept
+}
+
+type middlewareProducer struct {
+	backend.Producer
+	send ProduceFunc
+}
+
+func (p *middlewareProducer) Send(msg *backend.Message) {
+	p.send(msg)
+}
+
+// notifyingMiddlewareProducer keeps the error notifications of the wrapped producer.
+type notifyingMiddlewareProducer struct {
+	*middlewareProducer
+	notifier backend.ErrorNotifier
+}
+
+func (p notifyingMiddlewareProducer) NotifyErrors(onError func(msg *backend.Message, err error)) {
+	p.notifier.NotifyErrors(onError)
+}
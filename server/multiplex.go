@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// handleMultiplexed serves the streams of a multiplexed connection, each stream being handled like a
+// connection of its own, with its own init object. It returns when the connection is closed.
+func (s *Server) handleMultiplexed(conn net.Conn, buffered io.Reader, hostname, logPrefix string) {
+	// skip the end of line of the init object
+	data, _ := ioutil.ReadAll(buffered)
+	buffered = bytes.NewReader(bytes.TrimLeft(data, " \t\r\n"))
+
+	config := yamux.DefaultConfig()
+	config.KeepAliveInterval = s.opts.KeepAlivePeriod
+	config.LogOutput = log.Writer()
+
+	session, err := yamux.Server(bufferedConn{Conn: conn, r: io.MultiReader(buffered, conn)}, config)
+	if err != nil {
+		log.Print(logPrefix, "failed to start multiplexing: ", err)
+		return
+	}
+
+	defer session.Close()
+
+	log.Print(logPrefix, "multiplexing")
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if err != io.EOF && err != yamux.ErrSessionShutdown {
+				log.Print(logPrefix, "failed to accept stream: ", err)
+			}
+			return
+		}
+
+		// each stream has its own address as the statuses are indexed by it
+		go s.connHandler(remoteConn{
+			Conn:       stream,
+			remote:     remoteAddr{"stream", fmt.Sprintf("%s#%d", conn.RemoteAddr(), stream.StreamID())},
+			serverName: hostname,
+		})
+	}
+}
+
+// bufferedConn reads the data already buffered before the connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	pendingEventsBucket = []byte("events")
+	pendingOldBucket    = []byte("old")
+)
+
+// Markers of the keys in the old values bucket.
+const (
+	oldValueNone  = 0
+	oldValueFound = 1
+)
+
+// pendingChanges keeps the changes of a sync in a temporary file until its end, as they may not fit in
+// memory, with the old values of the modified and deleted keys.
+type pendingChanges struct {
+	path  string
+	db    *bolt.DB
+	tx    *bolt.Tx // current batch
+	batch int
+	count int
+	err   error
+}
+
+func newPendingChanges() (c *pendingChanges, err error) {
+	file, err := ioutil.TempFile("", "sync2kafka-changes-")
+	if err != nil {
+		return
+	}
+
+	file.Close()
+
+	c = &pendingChanges{path: file.Name()}
+
+	if c.db, err = bolt.Open(c.path, 0600, nil); err != nil {
+		os.Remove(c.path)
+		return nil, err
+	}
+
+	c.db.NoSync = true // temporary
+
+	err = c.db.Update(func(tx *bolt.Tx) (err error) {
+		if _, err = tx.CreateBucket(pendingEventsBucket); err != nil {
+			return
+		}
+		_, err = tx.CreateBucket(pendingOldBucket)
+		return
+	})
+
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	return
+}
+
+// write runs fn in the current batch, committed every stateBatchSize writes. The first error is kept.
+func (c *pendingChanges) write(fn func(tx *bolt.Tx) error) {
+	if c.err != nil {
+		return
+	}
+
+	if c.tx == nil {
+		if c.tx, c.err = c.db.Begin(true); c.err != nil {
+			return
+		}
+	}
+
+	if c.err = fn(c.tx); c.err != nil {
+		c.tx.Rollback()
+		c.tx = nil
+		return
+	}
+
+	if c.batch++; c.batch >= stateBatchSize {
+		c.err = c.flush()
+	}
+}
+
+// flush commits the current batch.
+func (c *pendingChanges) flush() (err error) {
+	if c.tx != nil {
+		err = c.tx.Commit()
+		c.tx = nil
+		c.batch = 0
+	}
+
+	if c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// add keeps the event. The keys modified or deleted are marked to record their old values.
+func (c *pendingChanges) add(event ChangeEvent) {
+	c.write(func(tx *bolt.Tx) (err error) {
+		value, _ := json.Marshal(event) // can't fail with valid values
+
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, uint64(c.count))
+
+		if err = tx.Bucket(pendingEventsBucket).Put(seq, value); err != nil {
+			return
+		}
+
+		if event.Type != ChangeCreated {
+			err = tx.Bucket(pendingOldBucket).Put(event.key(), []byte{oldValueNone})
+		}
+		return
+	})
+
+	if c.err == nil {
+		c.count++
+	}
+}
+
+// setOldValue records the value of the key, if it's a marked key. The last value set is the old value.
+func (c *pendingChanges) setOldValue(key, value []byte) error {
+	c.write(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingOldBucket)
+		if b.Get(key) == nil {
+			return nil
+		}
+
+		if len(value) == 0 {
+			return b.Put(key, []byte{oldValueNone}) // deleted
+		}
+
+		return b.Put(key, append([]byte{oldValueFound}, value...))
+	})
+
+	return c.err
+}
+
+// forEach calls fn with the events in order, and their old values if withOldValues (nil if none).
+func (c *pendingChanges) forEach(withOldValues bool, fn func(event ChangeEvent, oldValue []byte) error) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		old := tx.Bucket(pendingOldBucket)
+
+		return tx.Bucket(pendingEventsBucket).ForEach(func(_, value []byte) (err error) {
+			event := ChangeEvent{}
+			if err = json.Unmarshal(value, &event); err != nil {
+				return
+			}
+
+			var oldValue []byte
+			if withOldValues && event.Type != ChangeCreated {
+				if v := old.Get(event.key()); len(v) > 1 && v[0] == oldValueFound {
+					// only valid during the transaction
+					oldValue = append([]byte{}, v[1:]...)
+				}
+			}
+
+			return fn(event, oldValue)
+		})
+	})
+}
+
+// close removes the temporary file.
+func (c *pendingChanges) close() {
+	if c.tx != nil {
+		c.tx.Rollback()
+		c.tx = nil
+	}
+
+	c.db.Close()
+	os.Remove(c.path)
+}
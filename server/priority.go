@@ -0,0 +1,163 @@
+package server
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+// syncSlot is the place of a sync in the schedule, when the concurrency of the syncs is limited. The
+// syncs are ranked by priority then arrival; those beyond MaxConcurrentSyncs are preempted.
+type syncSlot struct {
+	priority  int
+	seq       int64
+	preempted int32
+}
+
+// SetTokenPriorities replaces the priorities of the syncs by token.
+func (s *Server) SetTokenPriorities(priorities map[string]int) {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	s.opts.TokenPriorities = priorities
+}
+
+// syncPriority returns the priority of a sync of the topic with the token.
+func (s *Server) syncPriority(topic, token string) int {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	if priority, ok := s.opts.TokenPriorities[token]; ok && len(token) != 0 {
+		return priority
+	}
+
+	return s.opts.Topics[topic].Priority
+}
+
+// acquireSyncSlot waits until the sync can run, given its priority. Returns nil if the concurrency of
+// the syncs is not limited. The wait ends with ok false when the sync is cancelled or the server drains,
+// and the slot is released then. The topic's lock is kept alive while waiting.
+func (s *Server) acquireSyncSlot(priority int, status *ConnStatus, cancel <-chan bool) (slot *syncSlot, ok bool) {
+	if s.opts.MaxConcurrentSyncs == 0 {
+		ok = true
+		return
+	}
+
+	s.syncSlotsMutex.Lock()
+
+	s.syncSlotsSeq++
+	slot = &syncSlot{priority: priority, seq: s.syncSlotsSeq}
+
+	s.syncSlots = append(s.syncSlots, slot)
+	s.rankSyncSlots()
+
+	s.syncSlotsMutex.Unlock()
+
+	status.slot = slot
+
+	if atomic.LoadInt32(&slot.preempted) != 0 {
+		s.setConnStatus(status, "waiting for a sync slot")
+	}
+
+	stopKeepAlive := s.keepLockAlive(status.lock)
+	ok = s.waitSyncSlot(slot, cancel)
+	stopKeepAlive()
+
+	if !ok {
+		s.releaseSyncSlot(slot)
+		status.slot = nil
+		slot = nil
+	}
+
+	return
+}
+
+// waitSyncSlot waits until the slot is not preempted. Returns false if the sync is cancelled or the
+// server drains before.
+func (s *Server) waitSyncSlot(slot *syncSlot, cancel <-chan bool) bool {
+	for {
+		s.syncSlotsMutex.Lock()
+		changed := s.syncSlotsChanged
+		s.syncSlotsMutex.Unlock()
+
+		if atomic.LoadInt32(&slot.preempted) == 0 {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-cancel:
+			return false
+		case <-s.drained:
+			return false
+		}
+	}
+}
+
+// releaseSyncSlot gives the slot of a finished sync to the next one.
+func (s *Server) releaseSyncSlot(slot *syncSlot) {
+	if slot == nil {
+		return
+	}
+
+	s.syncSlotsMutex.Lock()
+	defer s.syncSlotsMutex.Unlock()
+
+	for i, other := range s.syncSlots {
+		if other == slot {
+			s.syncSlots = append(s.syncSlots[:i], s.syncSlots[i+1:]...)
+			break
+		}
+	}
+
+	s.rankSyncSlots()
+}
+
+// rankSyncSlots preempts the syncs beyond MaxConcurrentSyncs, and wakes up the others. Must be called
+// with syncSlotsMutex locked.
+func (s *Server) rankSyncSlots() {
+	slots := s.syncSlots
+
+	sort.SliceStable(slots, func(i, j int) bool {
+		if slots[i].priority != slots[j].priority {
+			return slots[i].priority > slots[j].priority
+		}
+		return slots[i].seq < slots[j].seq
+	})
+
+	for i, slot := range slots {
+		preempted := int32(0)
+		if i >= s.opts.MaxConcurrentSyncs {
+			preempted = 1
+		}
+		atomic.StoreInt32(&slot.preempted, preempted)
+	}
+
+	close(s.syncSlotsChanged)
+	s.syncSlotsChanged = make(chan bool)
+}
+
+// yieldSyncSlot pauses the sync while syncs of higher priority use its slot. The sync resumes when it's
+// cancelled, so it can stop, or when the server drains, so it can finish. The topic's lock is kept alive
+// while paused.
+func (s *Server) yieldSyncSlot(status *ConnStatus, cancel <-chan bool) {
+	slot := status.slot
+	if slot == nil || atomic.LoadInt32(&slot.preempted) == 0 {
+		return
+	}
+
+	log.Printf("from %s: preempted by syncs of higher priority", status.Remote)
+
+	previous := s.setConnStatus(status, "preempted")
+
+	stopKeepAlive := s.keepLockAlive(status.lock)
+	defer stopKeepAlive()
+
+	if s.waitSyncSlot(slot, cancel) {
+		log.Printf("from %s: resumed", status.Remote)
+	} else {
+		log.Printf("from %s: resumed to stop", status.Remote)
+	}
+
+	s.restoreConnStatus(status, "preempted", previous)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+// ProduceFromSource produces the records a source gives to the produce function of fill, outside of any
+// sync (ie: the events of a change stream between its snapshots). The topic is locked while fill runs,
+// and cancelled is closed if the lock is force-released or expires.
+//
+// The records go through the topic's rules like those of SyncFromSource. A record with an empty value is
+// a tombstone: only its key is transformed, and it's skipped if the topic denies deletions. The invalid
+// records fail fill's produce calls, unless the record error policy skips them.
+func (s *Server) ProduceFromSource(topic string, fill func(produce func(kv KeyValue) error, cancelled <-chan bool) error) (err error) {
+	lock := s.LockTopic(topic, "source")
+	if lock == nil {
+		return fmt.Errorf("topic %q: %w", topic, ErrTopicLocked)
+	}
+	defer s.UnlockTopic(lock)
+
+	config, _ := s.topicConfig(topic)
+	rules := s.recordRules(config)
+	rules.SkipInvalid = s.skipsInvalidRecords(false)
+	kafka := s.kafka(topic)
+
+	var wrap func(KeyValue) []byte
+	if config.Envelope != nil {
+		wrap = config.Envelope.wrapper("source", newSyncID(time.Now()), config.JSON)
+	}
+
+	produce := func(kv KeyValue) (err error) {
+		if isClosed(lock.cancelled) {
+			return errLockCancelled
+		}
+
+		lock.Touch()
+
+		if len(kv.Value) == 0 {
+			if config.DeletePolicy == DeleteDeny {
+				log.Printf("to topic %q: skipping tombstone of source record: %v", topic, ErrDeletionsDenied)
+				return
+			}
+
+			if kv, err = rules.applyToKey(kv); err != nil {
+				return
+			}
+
+			return kafka.Produce(&backend.Message{Topic: topic, Key: kv.Key, Value: []byte{}})
+		}
+
+		if rules.Envelope != nil && !json.Valid(kv.Value) {
+			// the values of the sources may not be JSON, they're JSON strings in the envelopes
+			kv.Value, _ = rules.JSON.marshal(string(kv.Value))
+		}
+
+		kv, err = rules.apply(kv)
+		if err == nil && s.processRecord != nil {
+			kv, err = s.processRecord(topic, kv)
+		}
+
+		if err != nil {
+			if rules.SkipInvalid {
+				log.Printf("to topic %q: skipping source record: %v", topic, err)
+				err = nil
+			}
+			return
+		}
+
+		if wrap != nil {
+			kv.Value = wrap(kv)
+		}
+
+		return kafka.Produce(&backend.Message{Topic: topic, Key: kv.Key, Value: kv.Value, Timestamp: kv.Timestamp, Headers: kv.Headers()})
+	}
+
+	return fill(produce, lock.Cancelled())
+}
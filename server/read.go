@@ -0,0 +1,324 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+var errAborted = errors.New("transfer aborted")
+
+// frame is a message decoded from the client during a transfer.
+type frame struct {
+	KeyValue
+
+	EndOfTransfer bool
+	Abort         bool
+	Pause         bool
+	Resume        bool
+}
+
+type frameDecoder func() (frame, error)
+
+func jsonFrames(dec *json.Decoder) frameDecoder {
+	return func() (f frame, err error) {
+		obj := JsonKV{}
+		if err = dec.Decode(&obj); err != nil {
+			return
+		}
+
+		return jsonFrame(obj)
+	}
+}
+
+func jsonFrame(obj JsonKV) (f frame, err error) {
+	f = frame{
+		EndOfTransfer: obj.EndOfTransfer,
+		Abort:         obj.Abort,
+		Pause:         obj.Pause,
+		Resume:        obj.Resume,
+	}
+
+	if obj.Timestamp != nil {
+		f.Timestamp = *obj.Timestamp
+	}
+	if obj.ExpiresAt != nil {
+		f.ExpiresAt = *obj.ExpiresAt
+	}
+
+	if obj.Key != nil && obj.Value != nil {
+		f.Key, f.Value = *obj.Key, *obj.Value
+	} else if !f.isControl() {
+		err = errors.New("value without key or value")
+	}
+
+	return
+}
+
+// binaryDecoder is implemented by the decoders of binary values (json with base64 values, msgpack).
+type binaryDecoder interface {
+	Decode(v interface{}) error
+}
+
+func binaryFrames(dec binaryDecoder) frameDecoder {
+	return func() (f frame, err error) {
+		obj := BinaryKV{}
+		if err = dec.Decode(&obj); err != nil {
+			return
+		}
+
+		f = binaryFrame(obj)
+		return
+	}
+}
+
+// rawBinaryKV is a BinaryKV keeping the base64 encoded key and value.
+type rawBinaryKV struct {
+	Key           json.RawMessage `json:"k"`
+	Value         json.RawMessage `json:"v"`
+	EndOfTransfer bool            `json:"EOT"`
+	Abort         bool            `json:"abort"`
+	Pause         bool            `json:"pause"`
+	Resume        bool            `json:"resume"`
+	Timestamp     *time.Time      `json:"ts"`
+	ExpiresAt     *time.Time      `json:"exp"`
+}
+
+// binaryJSONFrames decodes the binary format like binaryFrames, but without allocations: the base64
+// keys and values are decoded in reused buffers.
+func binaryJSONFrames(dec *json.Decoder) frameDecoder {
+	obj := rawBinaryKV{}
+
+	return func() (f frame, err error) {
+		obj = rawBinaryKV{Key: obj.Key[:0], Value: obj.Value[:0]}
+		if err = dec.Decode(&obj); err != nil {
+			return
+		}
+
+		f = frame{
+			EndOfTransfer: obj.EndOfTransfer,
+			Abort:         obj.Abort,
+			Pause:         obj.Pause,
+			Resume:        obj.Resume,
+		}
+
+		if obj.Timestamp != nil {
+			f.Timestamp = *obj.Timestamp
+		}
+		if obj.ExpiresAt != nil {
+			f.ExpiresAt = *obj.ExpiresAt
+		}
+
+		if f.Key, err = decodeBase64(obj.Key); err != nil {
+			return
+		}
+
+		if f.Value, err = decodeBase64(obj.Value); err != nil {
+			releaseBuffer(f.Key)
+			f.Key = nil
+		}
+
+		return
+	}
+}
+
+// decodeBase64 decodes a JSON base64 string in a buffer, like encoding/json does for a []byte.
+func decodeBase64(raw json.RawMessage) (buf []byte, err error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return
+	}
+
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return nil, errors.New("binary keys and values must be base64 strings")
+	}
+
+	src := raw[1 : len(raw)-1]
+
+	if bytes.IndexByte(src, '\\') != -1 {
+		// escaped string, leave it to the standard decoder
+		var decoded []byte
+		err = json.Unmarshal(raw, &decoded)
+		return decoded, err
+	}
+
+	buf = getBuffer(base64.StdEncoding.DecodedLen(len(src)))
+
+	n, err := base64.StdEncoding.Decode(buf, src)
+	if err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func binaryFrame(obj BinaryKV) (f frame) {
+	f = frame{
+		KeyValue:      KeyValue{Key: obj.Key, Value: obj.Value},
+		EndOfTransfer: obj.EndOfTransfer,
+		Abort:         obj.Abort,
+		Pause:         obj.Pause,
+		Resume:        obj.Resume,
+	}
+
+	if obj.Timestamp != nil {
+		f.Timestamp = *obj.Timestamp
+	}
+	if obj.ExpiresAt != nil {
+		f.ExpiresAt = *obj.ExpiresAt
+	}
+	return
+}
+
+// recordLimits are the maximum sizes of a record's key and value (no limit if 0).
+type recordLimits struct {
+	MaxKeySize   int
+	MaxValueSize int
+}
+
+func (s *Server) recordLimits() recordLimits {
+	return recordLimits{MaxKeySize: s.opts.MaxKeySize, MaxValueSize: s.opts.MaxValueSize}
+}
+
+// restrict returns the limits lowered to other's, if set.
+func (l recordLimits) restrict(other recordLimits) recordLimits {
+	lower := func(max, otherMax int) int {
+		if otherMax != 0 && (max == 0 || otherMax < max) {
+			return otherMax
+		}
+		return max
+	}
+
+	return recordLimits{
+		MaxKeySize:   lower(l.MaxKeySize, other.MaxKeySize),
+		MaxValueSize: lower(l.MaxValueSize, other.MaxValueSize),
+	}
+}
+
+// check returns a client error if the record is invalid.
+func (l recordLimits) check(kv KeyValue) error {
+	if max := l.MaxKeySize; max != 0 && len(kv.Key) > max {
+		return &client.Error{
+			Code:    client.ErrRecordTooLarge,
+			Message: fmt.Sprintf("key of %d bytes exceeds the limit of %d bytes", len(kv.Key), max),
+		}
+	}
+
+	if max := l.MaxValueSize; max != 0 && len(kv.Value) > max {
+		return &client.Error{
+			Code:    client.ErrRecordTooLarge,
+			Message: fmt.Sprintf("value of %d bytes for key %q exceeds the limit of %d bytes", len(kv.Value), kv.Key, max),
+		}
+	}
+
+	return nil
+}
+
+func (f frame) isControl() bool {
+	return f.EndOfTransfer || f.Abort || f.Pause || f.Resume
+}
+
+// readKVs reads the client's frames until the end of transfer, sending the values to out.
+func (s *Server) readKVs(conn net.Conn, decode frameDecoder, out chan KeyValue, status *ConnStatus, j *journal, rules recordRules, duplicates *duplicateKeys, cancel <-chan bool) error {
+	paused := false
+	limiter := rateLimiter{rate: rules.MaxRecordsPerSecond}
+
+	// the lock is kept alive while paused, the client still holds it
+	stopKeepAlive := func() {}
+	defer func() { stopKeepAlive() }()
+
+	for {
+		timeout := s.opts.IdleTimeout
+		if paused {
+			timeout = s.opts.PausedIdleTimeout
+		}
+
+		if timeout == 0 {
+			conn.SetReadDeadline(time.Time{})
+		} else {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		start := time.Now()
+
+		f, err := decode()
+		if err != nil {
+			return err
+		}
+
+		if !paused {
+			status.readWait(time.Since(start))
+		}
+
+		switch {
+		case f.EndOfTransfer:
+			return nil
+
+		case f.Abort:
+			return errAborted
+
+		case f.Pause:
+			if !paused {
+				stopKeepAlive = s.keepLockAlive(status.lock)
+			}
+			paused = true
+			s.setConnStatus(status, "paused")
+			continue
+
+		case f.Resume:
+			stopKeepAlive()
+			paused = false
+			s.setConnStatus(status, "reading data")
+			continue
+		}
+
+		if paused {
+			stopKeepAlive()
+			paused = false
+			s.setConnStatus(status, "reading data")
+		}
+
+		status.samples.add(f.KeyValue)
+
+		kv, err := rules.apply(f.KeyValue)
+		if err == nil && s.processRecord != nil {
+			kv, err = s.processRecord(status.TargetTopic, kv)
+		}
+		if err != nil {
+			if !rules.SkipInvalid {
+				return err
+			}
+
+			status.ItemsSkipped++
+			releaseBuffers(kv)
+
+			if err := j.Skip(1); err != nil {
+				return &client.Error{Code: client.ErrSyncFailed, Message: "failed to journal the skipped value: " + err.Error()}
+			}
+			continue
+		}
+
+		err = duplicates.check(kv)
+		if duplicates != nil {
+			status.ItemsDuplicated = duplicates.Count
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := j.Append(kv); err != nil {
+			return &client.Error{Code: client.ErrSyncFailed, Message: "failed to journal the value: " + err.Error()}
+		}
+
+		limiter.wait()
+		s.yieldSyncSlot(status, cancel)
+
+		status.push(out, kv)
+	}
+}
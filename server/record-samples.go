@@ -0,0 +1,88 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// RecordSample is a record recently received from a client, truncated.
+type RecordSample struct {
+	Key   string    `json:"key"`
+	Value string    `json:"value"`
+	Time  time.Time `json:"time"`
+
+	// KeySize and ValueSize are the sizes of the record's key and value before truncation.
+	KeySize   int  `json:"keySize"`
+	ValueSize int  `json:"valueSize"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// recordSamples keeps the last records of a connection.
+type recordSamples struct {
+	max      int
+	maxBytes int
+
+	mutex sync.Mutex
+	items []RecordSample
+	next  int
+}
+
+func (rs *recordSamples) add(kv KeyValue) {
+	if rs == nil {
+		return
+	}
+
+	sample := RecordSample{
+		Key:       rs.truncate(kv.Key),
+		Value:     rs.truncate(kv.Value),
+		Time:      time.Now(),
+		KeySize:   len(kv.Key),
+		ValueSize: len(kv.Value),
+	}
+	sample.Truncated = len(sample.Key) != sample.KeySize || len(sample.Value) != sample.ValueSize
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if len(rs.items) < rs.max {
+		rs.items = append(rs.items, sample)
+		return
+	}
+
+	rs.items[rs.next] = sample
+	rs.next = (rs.next + 1) % rs.max
+}
+
+func (rs *recordSamples) truncate(b []byte) string {
+	if len(b) > rs.maxBytes {
+		b = b[:rs.maxBytes]
+	}
+	return string(b)
+}
+
+// list returns the samples, the oldest first.
+func (rs *recordSamples) list() (samples []RecordSample) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	samples = make([]RecordSample, 0, len(rs.items))
+	samples = append(samples, rs.items[rs.next:]...)
+	samples = append(samples, rs.items[:rs.next]...)
+	return
+}
+
+// RecordSamples returns the last records received by the connections matching the filter, the oldest
+// first, by remote address. The records are as the clients sent them, before the topics' transforms.
+func (s *Server) RecordSamples(filter ConnectionsFilter) map[string][]RecordSample {
+	s.connStatusesMutex.Lock()
+	defer s.connStatusesMutex.Unlock()
+
+	samples := make(map[string][]RecordSample, len(s.connStatuses))
+	for remote, cs := range s.connStatuses {
+		if cs.samples != nil && filter.match(cs) {
+			samples[remote] = cs.samples.list()
+		}
+	}
+
+	return samples
+}
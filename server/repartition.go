@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// partitionsBucket keeps the number of partitions of the topics at their last successful sync.
+var partitionsBucket = []byte("sync2kafka:partitions") // not a valid topic name
+
+// checkPartitions returns the repartition of the topic since its last successful sync, if any, and the
+// topic's current number of partitions.
+func (s *Server) checkPartitions(topic string) (repartition *client.SyncRepartition, partitions int, err error) {
+	ids, err := s.kafka(topic).Partitions(topic)
+	if err != nil {
+		return
+	}
+
+	partitions = len(ids)
+
+	previous, err := s.lastPartitions(topic)
+	if err != nil || previous == 0 || previous == partitions {
+		return
+	}
+
+	config, _ := s.topicConfig(topic)
+
+	repartition = &client.SyncRepartition{
+		PreviousPartitions: previous,
+		Partitions:         partitions,
+		PartitionAffinity:  config.PartitionAffinity,
+	}
+
+	return
+}
+
+// repartitionWarning describes the repartition for the sync's result.
+func repartitionWarning(r *client.SyncRepartition, doDelete bool) string {
+	msg := fmt.Sprintf("the topic's partitions changed from %d to %d since its last sync", r.PreviousPartitions, r.Partitions)
+
+	switch {
+	case !r.PartitionAffinity:
+		return msg + ", all the records were produced again to the partition their key hashes to now (unchanged ones included)"
+	case doDelete:
+		return msg + fmt.Sprintf(", the keys moved to another partition were produced to it, and their %d records deleted from the previous one", r.MovedDeleted)
+	default:
+		return msg + ", the keys moved to another partition were produced to it, but their records remain in the previous one until a sync with delete"
+	}
+}
+
+// deleteMovedKeys deletes the records left in the partitions their key doesn't hash to anymore. The
+// tombstones are produced to those partitions explicitly: the syncs' deletions go to the partition of
+// the key's hash, where they would delete the record moved there.
+func (s *Server) deleteMovedKeys(topic string, partitions int) (deleted int, err error) {
+	kafka := s.kafka(topic)
+
+	producer, ok := kafka.(backend.PartitionProducer)
+	if !ok {
+		return 0, fmt.Errorf("the partitions of topic %q changed, but its backend can't delete the records of the moved keys from their previous partition", topic)
+	}
+
+	removedValue := s.newSyncer(topic).RemovedValue
+
+	for p := 0; p < partitions; p++ {
+		partition := int32(p)
+
+		low, high, err := kafka.Offsets(topic, partition)
+		if err != nil {
+			return deleted, err
+		}
+
+		if high <= low {
+			continue
+		}
+
+		// only the keys are kept, and only those of the moved records
+		moved := map[string]bool{}
+
+		err = s.readTopic(kafka, topic, partition, low, high, func(msg *backend.Message) error {
+			switch {
+			case len(msg.Value) == 0:
+				delete(moved, string(msg.Key))
+			case syncer.KeyPartition(msg.Key, partitions) != partition:
+				moved[string(msg.Key)] = true
+			}
+			return nil
+		})
+
+		if err != nil {
+			return deleted, err
+		}
+
+		if len(moved) == 0 {
+			continue
+		}
+
+		msgs := make([]*backend.Message, 0, len(moved))
+		for key := range moved {
+			msgs = append(msgs, &backend.Message{Topic: topic, Partition: partition, Key: []byte(key), Value: removedValue})
+		}
+
+		if err = producer.ProduceToPartitions(msgs...); err != nil {
+			if errors.Is(err, backend.ErrPartitionsUnsupported) {
+				err = fmt.Errorf("the partitions of topic %q changed, but its backend can't delete the records of the moved keys from their previous partition", topic)
+			}
+			return deleted, err
+		}
+
+		deleted += len(msgs)
+	}
+
+	return
+}
+
+// lastPartitions returns the number of partitions of the topic at its last successful sync (0 if unknown).
+func (s *Server) lastPartitions(topic string) (partitions int, err error) {
+	s.partitionCountsMutex.Lock()
+	partitions, ok := s.partitionCounts[topic]
+	s.partitionCountsMutex.Unlock()
+
+	if ok || !s.hasStore() {
+		return
+	}
+
+	err = s.opts.Store.View(func(tx *bolt.Tx) (err error) {
+		bucket := tx.Bucket(partitionsBucket)
+		if bucket == nil {
+			return
+		}
+
+		if v := bucket.Get([]byte(topic)); v != nil {
+			partitions, err = strconv.Atoi(string(v))
+		}
+		return
+	})
+
+	return
+}
+
+// setLastPartitions records the number of partitions of the topic at a successful sync.
+func (s *Server) setLastPartitions(topic string, partitions int) {
+	s.partitionCountsMutex.Lock()
+	s.partitionCounts[topic] = partitions
+	s.partitionCountsMutex.Unlock()
+
+	if !s.hasStore() {
+		return
+	}
+
+	err := s.opts.Store.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(partitionsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(topic), []byte(strconv.Itoa(partitions)))
+	})
+
+	if err != nil {
+		log.Printf("failed to store the partitions of topic %q: %v", topic, err)
+	}
+}
@@ -0,0 +1,464 @@
+// Package server implements the sync2kafka endpoint, to be embedded in any binary.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	kafkasync "github.com/mcluseau/kafka-sync"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+const kvBufferSize = 1000
+
+type KeyValue = syncer.KeyValue
+type SyncStats = kafkasync.Stats
+type SyncInitInfo = client.SyncInitInfo
+type SyncResult = client.SyncResult
+type JsonKV = client.JsonKV
+type BinaryKV = client.BinaryKV
+
+// Options of a Server.
+type Options struct {
+	// Kafka is the Kafka client (required).
+	Kafka backend.Backend
+
+	// Clusters are other Kafka clusters, by name, that topics can target in their configuration.
+	Clusters map[string]backend.Backend
+
+	// Topics are the configurations specific to topics, by name.
+	Topics map[string]TopicConfig
+
+	// Store is the bolt store used to keep topic indexes between syncs (optional).
+	Store *bolt.DB
+
+	// Token required from clients (optional).
+	Token string
+
+	// AuthWebhook is the URL of an HTTP endpoint authorizing the syncs, instead of Token and the allowed topics.
+	// It receives an AuthRequest and answers an AuthResponse.
+	AuthWebhook string
+
+	// AuthWebhookTimeout is the maximum duration of an auth webhook call.
+	AuthWebhookTimeout time.Duration
+
+	// DefaultTopic is the topic used when the client doesn't specify one.
+	DefaultTopic string
+
+	// AllowAllTopics allows any topic to be synchronized.
+	AllowAllTopics bool
+
+	// AllowedTopicsFile is a file containing allowed topics (1 per line; # is comment).
+	// If empty and not AllowAllTopics, only the DefaultTopic is allowed.
+	AllowedTopicsFile string
+
+	// TLSConfig enables TLS on accepted connections if set.
+	TLSConfig *tls.Config
+
+	// VirtualHosts are the configurations of the clients connecting to a hostname (TLS SNI), by hostname.
+	// The clients of other hostnames, or without TLS, use the server's configuration.
+	VirtualHosts map[string]VirtualHost
+
+	// KeepAlivePeriod is the TCP keepalive period of accepted connections.
+	KeepAlivePeriod time.Duration
+
+	// ReadTimeout is the maximum time to wait for a message when reading a topic.
+	ReadTimeout time.Duration
+
+	// SortedProduce produces the changes of a sync sorted by key, once the client sent them all.
+	SortedProduce bool
+
+	// ProduceWorkers is the number of parallel producers of a sync (1 if 0).
+	ProduceWorkers int
+
+	// ProduceErrorPolicy is what to do with the messages that failed to be produced:
+	// syncer.ProduceErrorsFail (the default), ProduceErrorsRetry, ProduceErrorsAbort or ProduceErrorsSkip.
+	ProduceErrorPolicy string
+
+	// ProduceRetries is the maximum number of retries of failed messages with ProduceErrorsRetry.
+	ProduceRetries int
+
+	// ProduceRetryBackoff is the delay before the first retry, doubled for each next one (1s if 0).
+	ProduceRetryBackoff time.Duration
+
+	// IdleTimeout is the maximum silence of a client during a transfer (no limit if 0).
+	IdleTimeout time.Duration
+
+	// PausedIdleTimeout is the maximum silence of a client that paused its transfer (no limit if 0).
+	PausedIdleTimeout time.Duration
+
+	// TopicLockTTL is the time without progress after which the holder of a topic lock is cancelled
+	// when the topic is locked again (no limit if 0). The topic is released once the holder stopped.
+	TopicLockTTL time.Duration
+
+	// FinalizeTimeout is the maximum time a sync can take to finish once its records are read (no limit
+	// if 0). Above, the sync is cancelled and reported as failed, releasing its topic.
+	FinalizeTimeout time.Duration
+
+	// MaxKeySize is the maximum size of a record's key (no limit if 0).
+	MaxKeySize int
+
+	// MaxValueSize is the maximum size of a record's value (no limit if 0).
+	MaxValueSize int
+
+	// RecordErrorPolicy is what to do with an invalid record: RecordErrorFail (the default) or RecordErrorSkip.
+	RecordErrorPolicy string
+
+	// MaxShortfallPercent is the maximum percentage of the records announced by a client that its transfer
+	// can miss, unless forced. Above, the transfer is rejected as truncated.
+	MaxShortfallPercent float64
+
+	// MaxDeletePercent is the maximum percentage of a topic's keys a sync can delete, unless forced
+	// (no limit if 0).
+	MaxDeletePercent float64
+
+	// CompactionCheck verifies after each sync that the topic is compacted, and estimates its records
+	// waiting for compaction.
+	CompactionCheck bool
+
+	// CompactionConfig are the topic configuration entries set after each sync, if different
+	// (ie: min.cleanable.dirty.ratio).
+	CompactionConfig map[string]string
+
+	// DuplicateKeysPolicy is what to do with keys sent twice in a transfer: DuplicateKeysIgnore (the default),
+	// DuplicateKeysWarn or DuplicateKeysReject.
+	DuplicateKeysPolicy string
+
+	// EventsTopic is the topic where a SyncEvent is published at the end of each sync (no events if empty).
+	EventsTopic string
+
+	// Notifiers receive the alerts on sync failures and stale topics.
+	Notifiers []Notifier
+
+	// FreshnessWindow is the maximum duration without successful sync of a topic before an alert
+	// (no alerts if 0). Only topics synced since the server started are checked.
+	FreshnessWindow time.Duration
+
+	// FreshnessIntervals are the expected sync intervals of topics, overriding FreshnessWindow.
+	// These topics are checked even if they were not synced since the server started.
+	FreshnessIntervals map[string]time.Duration
+
+	// JournalDir is where the values accepted from clients are journaled until the end of their sync,
+	// to replay them if the server stopped (no journal if empty).
+	JournalDir string
+
+	// SessionTTL is how long the journal of a transfer interrupted by a disconnection or a server stop
+	// is kept for its client to resume it, when the client gave a session ID. The journal is replayed
+	// without deletions after that. Sessions are disabled if 0 or without JournalDir.
+	SessionTTL time.Duration
+
+	// IdempotencyTTL is how long the results of the syncs with an idempotency key are kept, to answer
+	// the retries of these syncs (1 hour if 0).
+	IdempotencyTTL time.Duration
+
+	// VerifyPercent is the percentage of the keys produced by a sync read back from the topic after it,
+	// to check their values (no verification if 0). The keys are sampled by hash, so the same keys are
+	// checked at each sync.
+	VerifyPercent float64
+
+	// ParallelIndexers is the maximum of parallel indexing operations.
+	ParallelIndexers int
+
+	// WarmTopics are the topics whose stored index is kept up to date between syncs, so their syncs
+	// start diffing without reading the topic first (requires Store).
+	WarmTopics []string
+
+	// WarmInterval is the period of the warm topics' index updates.
+	WarmInterval time.Duration
+
+	// LagCheckGroups are the consumer groups to check the lag of before a sync with deletions, on the
+	// topics they have committed offsets on.
+	LagCheckGroups []string
+
+	// MaxConsumerLag is the maximum lag of checked consumer groups before a sync with deletions.
+	MaxConsumerLag int64
+
+	// LagCheckRefuse refuses syncs with deletions when a checked consumer group lags (only warn in the result otherwise).
+	LagCheckRefuse bool
+
+	// MaxConcurrentSyncs is the maximum of syncs reading or producing records at the same time (no limit
+	// if 0). The syncs of highest priority run first, pausing the running syncs of lower priority.
+	MaxConcurrentSyncs int
+
+	// TokenPriorities are the priorities of the syncs by token, overriding the topics' priorities.
+	TokenPriorities map[string]int
+
+	// Middlewares wrap the steps of the syncs, the first being the outermost (optional).
+	Middlewares []Middleware
+
+	// RecordSamples is the number of recent records kept per connection, as the client sent them, to
+	// preview them through RecordSamples (no samples if 0).
+	RecordSamples int
+
+	// RecordSampleBytes is the size the sampled keys and values are truncated to (64 if 0).
+	RecordSampleBytes int
+}
+
+// Record error policies.
+const (
+	// RecordErrorFail fails the transfer on the first invalid record.
+	RecordErrorFail = "fail"
+	// RecordErrorSkip ignores invalid records, reporting them in the result's warnings. Syncs with
+	// deletions still fail, as they would delete the keys of the skipped records.
+	RecordErrorSkip = "skip"
+)
+
+// skipsInvalidRecords returns true if the invalid records of a sync are skipped.
+func (s *Server) skipsInvalidRecords(doDelete bool) bool {
+	return s.opts.RecordErrorPolicy == RecordErrorSkip && !doDelete
+}
+
+// Duplicate keys policies.
+const (
+	// DuplicateKeysIgnore keeps the last value of a key sent twice.
+	DuplicateKeysIgnore = ""
+	// DuplicateKeysWarn keeps the last value, reporting the duplicates in the result's warnings.
+	DuplicateKeysWarn = "warn"
+	// DuplicateKeysReject fails the transfer on the first duplicate key.
+	DuplicateKeysReject = "reject"
+)
+
+// Server is a sync2kafka endpoint.
+type Server struct {
+	opts      Options
+	optsMutex sync.Mutex
+
+	// connHandler and processRecord are the steps wrapped by the middlewares (processRecord is nil without)
+	connHandler   ConnHandler
+	processRecord RecordFunc
+
+	lockedTopics      map[string]*TopicLock
+	lockedTopicsMutex sync.Mutex
+
+	connStatuses      map[string]*ConnStatus
+	connStatusesMutex sync.Mutex
+
+	indexingTopics     map[string]bool
+	indexingTopicsCond *sync.Cond
+
+	allowedTopicsMutex sync.Mutex
+
+	recoveries      []JournalRecovery
+	recoveriesMutex sync.Mutex
+
+	sessions      map[string]*time.Timer
+	sessionsMutex sync.Mutex
+
+	idempotentResults      map[string]idempotentResult
+	idempotentResultsMutex sync.Mutex
+
+	partitionCounts      map[string]int
+	partitionCountsMutex sync.Mutex
+
+	syncSlots        []*syncSlot
+	syncSlotsMutex   sync.Mutex
+	syncSlotsChanged chan bool
+	syncSlotsSeq     int64
+
+	activeConns int32
+	draining    int32
+	drainOnce   sync.Once
+	drained     chan bool
+
+	startTime      time.Time
+	lastSyncs      map[string]time.Time
+	staleTopics    map[string]bool
+	lastSyncsMutex sync.Mutex
+}
+
+// New creates a server. Its background tasks are started by Serve.
+func New(opts Options) *Server {
+	if opts.KeepAlivePeriod == 0 {
+		opts.KeepAlivePeriod = 30 * time.Second
+	}
+
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = 10 * time.Second
+	}
+
+	if opts.AuthWebhookTimeout == 0 {
+		opts.AuthWebhookTimeout = 5 * time.Second
+	}
+
+	if opts.ProduceRetryBackoff == 0 {
+		opts.ProduceRetryBackoff = time.Second
+	}
+
+	if opts.IdempotencyTTL == 0 {
+		opts.IdempotencyTTL = time.Hour
+	}
+
+	if opts.ParallelIndexers == 0 {
+		opts.ParallelIndexers = 4
+	}
+
+	if opts.WarmInterval == 0 {
+		opts.WarmInterval = 10 * time.Second
+	}
+
+	if opts.RecordSampleBytes == 0 {
+		opts.RecordSampleBytes = 64
+	}
+
+	s := &Server{
+		opts:               opts,
+		lockedTopics:       map[string]*TopicLock{},
+		connStatuses:       map[string]*ConnStatus{},
+		indexingTopics:     map[string]bool{},
+		indexingTopicsCond: sync.NewCond(&sync.Mutex{}),
+		startTime:          time.Now(),
+		lastSyncs:          map[string]time.Time{},
+		staleTopics:        map[string]bool{},
+		sessions:           map[string]*time.Timer{},
+		idempotentResults:  map[string]idempotentResult{},
+		partitionCounts:    map[string]int{},
+		syncSlotsChanged:   make(chan bool),
+		drained:            make(chan bool),
+	}
+
+	s.connHandler = s.connMiddlewares(s.handleConn)
+	if len(opts.Middlewares) != 0 {
+		s.processRecord = s.recordMiddlewares(func(_ string, kv KeyValue) (KeyValue, error) { return kv, nil })
+	}
+
+	return s
+}
+
+// Options returns the server's options.
+func (s *Server) Options() Options {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	return s.opts
+}
+
+// SetToken changes the token required from clients.
+func (s *Server) SetToken(token string) {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	s.opts.Token = token
+}
+
+func (s *Server) token() string {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	return s.opts.Token
+}
+
+func (s *Server) hasStore() bool {
+	return s.opts.Store != nil
+}
+
+func (s *Server) newSyncer(topic string) syncer.Syncer {
+	sy := syncer.New(topic)
+	sy.ReadTimeout = s.opts.ReadTimeout
+	sy.Sorted = s.opts.SortedProduce
+	sy.ProduceWorkers = s.opts.ProduceWorkers
+	sy.ProduceErrorPolicy = s.opts.ProduceErrorPolicy
+	sy.ProduceRetries = s.opts.ProduceRetries
+	sy.ProduceRetryBackoff = s.opts.ProduceRetryBackoff
+
+	if config, _ := s.topicConfig(topic); config.Envelope != nil {
+		sy.Unwrap = unwrapEnvelope
+	}
+
+	return sy
+}
+
+// Listener accepts connections for the server, with its own options.
+type Listener struct {
+	net.Listener
+
+	// NoTLS accepts plain connections, even if the server has a TLSConfig.
+	NoTLS bool
+
+	// KeepAlivePeriod overrides the server's KeepAlivePeriod if not 0.
+	KeepAlivePeriod time.Duration
+}
+
+// Serve accepts connections on the listener until the context is cancelled.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	return s.ServeListeners(ctx, Listener{Listener: listener})
+}
+
+// ServeListeners accepts connections on the listeners until the context is cancelled, or one of them fails.
+func (s *Server) ServeListeners(ctx context.Context, listeners ...Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go s.connStatusCleaner(ctx)
+
+	if len(s.opts.DefaultTopic) != 0 {
+		go s.IndexTopic(s.opts.DefaultTopic)
+	}
+
+	if len(s.opts.WarmTopics) != 0 {
+		go s.warmIndexes(ctx)
+	}
+
+	if len(s.opts.JournalDir) != 0 {
+		go s.recoverJournals()
+	}
+
+	if s.opts.FreshnessWindow != 0 || len(s.opts.FreshnessIntervals) != 0 {
+		go s.staleTopicsChecker(ctx)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener Listener) {
+			errs <- s.accept(ctx, listener)
+		}(listener)
+	}
+
+	return <-errs
+}
+
+// accept handles the connections of the listener until the context is cancelled.
+func (s *Server) accept(ctx context.Context, listener Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	keepAlivePeriod := s.opts.KeepAlivePeriod
+	if listener.KeepAlivePeriod != 0 {
+		keepAlivePeriod = listener.KeepAlivePeriod
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetKeepAlivePeriod(keepAlivePeriod)
+			c.SetKeepAlive(true)
+
+		default: // should not happen
+			log.Print("connection is not TCP?!")
+		}
+
+		if s.opts.TLSConfig != nil && !listener.NoTLS {
+			conn = tls.Server(conn, s.opts.TLSConfig)
+		}
+
+		go s.connHandler(conn)
+	}
+}
@@ -0,0 +1,143 @@
+package servertest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+var errChaosReset = errors.New("servertest: connection reset by chaos")
+
+// Chaos injects failures in the connections of a server, to check the retry and resume logic of clients
+// against slow servers, connection resets and delayed results. Add its Middleware to the server's
+// options:
+//
+//	chaos := &servertest.Chaos{ResetProbability: 0.01, Seed: 1}
+//	s := servertest.NewServer(server.Options{Middlewares: []server.Middleware{chaos.Middleware()}})
+//
+// The probabilities apply to each read or write of the server on a connection.
+type Chaos struct {
+	// SlowReadProbability is the probability of a read being delayed by up to SlowReadDelay.
+	SlowReadProbability float64
+	SlowReadDelay       time.Duration
+
+	// ResetProbability is the probability of a read resetting the connection instead.
+	ResetProbability float64
+
+	// DelayedResultProbability is the probability of a write (an answer of the server, like the result
+	// of a sync) being delayed by up to ResultDelay.
+	DelayedResultProbability float64
+	ResultDelay              time.Duration
+
+	// Seed of the random failures, to reproduce them (the same failures need the same reads and writes).
+	Seed int64
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+
+	slowReads      int64
+	resets         int64
+	delayedResults int64
+}
+
+// ChaosStats counts the failures injected.
+type ChaosStats struct {
+	SlowReads      int64
+	Resets         int64
+	DelayedResults int64
+}
+
+// Middleware returns the middleware injecting the failures in the server's connections.
+func (c *Chaos) Middleware() server.Middleware {
+	return server.Middleware{
+		Conn: func(next server.ConnHandler) server.ConnHandler {
+			return func(conn net.Conn) {
+				next(&chaosConn{Conn: conn, chaos: c})
+			}
+		},
+	}
+}
+
+// Stats returns the failures injected so far.
+func (c *Chaos) Stats() ChaosStats {
+	return ChaosStats{
+		SlowReads:      atomic.LoadInt64(&c.slowReads),
+		Resets:         atomic.LoadInt64(&c.resets),
+		DelayedResults: atomic.LoadInt64(&c.delayedResults),
+	}
+}
+
+// roll returns true with the given probability.
+func (c *Chaos) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.source().Float64() < probability
+}
+
+// delay returns a random delay up to max.
+func (c *Chaos) delay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return time.Duration(c.source().Int63n(int64(max)))
+}
+
+// source returns the random source, with the mutex locked.
+func (c *Chaos) source() *rand.Rand {
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(c.Seed))
+	}
+	return c.rand
+}
+
+type chaosConn struct {
+	net.Conn
+	chaos *Chaos
+}
+
+func (c *chaosConn) Read(b []byte) (n int, err error) {
+	if c.chaos.roll(c.chaos.ResetProbability) {
+		atomic.AddInt64(&c.chaos.resets, 1)
+		c.reset()
+		return 0, errChaosReset
+	}
+
+	if c.chaos.roll(c.chaos.SlowReadProbability) {
+		atomic.AddInt64(&c.chaos.slowReads, 1)
+		time.Sleep(c.chaos.delay(c.chaos.SlowReadDelay))
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *chaosConn) Write(b []byte) (n int, err error) {
+	if c.chaos.roll(c.chaos.DelayedResultProbability) {
+		atomic.AddInt64(&c.chaos.delayedResults, 1)
+		time.Sleep(c.chaos.delay(c.chaos.ResultDelay))
+	}
+
+	return c.Conn.Write(b)
+}
+
+// reset closes the connection, with a TCP reset if possible.
+func (c *chaosConn) reset() {
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+
+	c.Conn.Close()
+}
@@ -0,0 +1,72 @@
+// Package servertest provides a sync2kafka server for integration tests, backed by an in-memory Kafka.
+package servertest
+
+import (
+	"context"
+	"net"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/server"
+)
+
+// Server is a sync2kafka server listening on a local port.
+type Server struct {
+	*server.Server
+
+	// Kafka is the in-memory backend of the server.
+	Kafka *backend.Memory
+
+	// Addr is the address to connect to (host:port).
+	Addr string
+
+	cancel func()
+	done   chan error
+}
+
+// NewServer starts a server with the given options. If opts.Kafka is nil, an in-memory backend is used
+// and topics are all allowed. It panics if it can't listen on a local port.
+func NewServer(opts server.Options) *Server {
+	mem, _ := opts.Kafka.(*backend.Memory)
+
+	if opts.Kafka == nil {
+		mem = backend.NewMemory()
+		opts.Kafka = mem
+		opts.AllowAllTopics = true
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("servertest: failed to listen: " + err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		Server: server.New(opts),
+		Kafka:  mem,
+		Addr:   listener.Addr().String(),
+		cancel: cancel,
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		s.done <- s.Serve(ctx, listener)
+	}()
+
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// State returns the compacted state of the topic's first partition, as strings.
+func (s *Server) State(topic string) map[string]string {
+	state := map[string]string{}
+	for k, v := range s.Kafka.State(topic, 0) {
+		state[k] = string(v)
+	}
+	return state
+}
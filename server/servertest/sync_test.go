@@ -0,0 +1,80 @@
+package servertest_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/server"
+	"github.com/mcluseau/sync2kafka/server/servertest"
+)
+
+// syncRecords transfers the records to the topic with a client, returning the counts of the server's result.
+func syncRecords(t *testing.T, s *servertest.Server, topic string, doDelete bool, records map[string]string) *client.SyncCounts {
+	t.Helper()
+
+	c := client.NewBinary(&client.SyncInitInfo{Topic: topic, DoDelete: doDelete}, s.Addr, false, false, "")
+	defer c.Close()
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal("connect failed: ", err)
+	}
+
+	if err := c.StartTransfer(); err != nil {
+		t.Fatal("start of transfer failed: ", err)
+	}
+
+	for k, v := range records {
+		if err := c.SendValue(client.BinaryKV{Key: []byte(k), Value: []byte(v)}); err != nil {
+			t.Fatal("send failed: ", err)
+		}
+	}
+
+	if err := c.EndTransfer(); err != nil {
+		t.Fatal("sync failed: ", err)
+	}
+
+	return c.Counts()
+}
+
+func TestSync(t *testing.T) {
+	s := servertest.NewServer(server.Options{})
+	defer s.Close()
+
+	records := map[string]string{"a": "1", "b": "2", "c": "3"}
+
+	counts := syncRecords(t, s, "test", false, records)
+	if expected := (client.SyncCounts{Created: 3}); counts == nil || *counts != expected {
+		t.Errorf("first sync: expected counts %+v, got %+v", expected, counts)
+	}
+
+	if state := s.State("test"); !reflect.DeepEqual(state, records) {
+		t.Errorf("first sync: expected state %v, got %v", records, state)
+	}
+
+	// b modified, c deleted
+	records = map[string]string{"a": "1", "b": "two"}
+
+	counts = syncRecords(t, s, "test", true, records)
+	if counts == nil || counts.Modified != 1 || counts.Deleted != 1 || counts.Unchanged != 1 || counts.Created != 0 {
+		t.Errorf("second sync: expected 1 modified, 1 deleted and 1 unchanged, got %+v", counts)
+	}
+
+	if state := s.State("test"); !reflect.DeepEqual(state, records) {
+		t.Errorf("second sync: expected state %v, got %v", records, state)
+	}
+}
+
+func TestSyncWithoutDelete(t *testing.T) {
+	s := servertest.NewServer(server.Options{})
+	defer s.Close()
+
+	syncRecords(t, s, "test", false, map[string]string{"a": "1", "b": "2"})
+	syncRecords(t, s, "test", false, map[string]string{"c": "3"})
+
+	expected := map[string]string{"a": "1", "b": "2", "c": "3"}
+	if state := s.State("test"); !reflect.DeepEqual(state, expected) {
+		t.Errorf("expected state %v, got %v", expected, state)
+	}
+}
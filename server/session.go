@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// sessionIDPattern restricts the session IDs, as they are part of the journals' file names.
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// tokenHash identifies a token without keeping it.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ownedBy returns true if the journal's session was created with the token. The journals from before the
+// tokens were recorded are anyone's.
+func (h journalHeader) ownedBy(token string) bool {
+	return len(h.TokenHash) == 0 || h.TokenHash == tokenHash(token)
+}
+
+func (s *Server) sessionsEnabled() bool {
+	return len(s.opts.JournalDir) != 0 && s.opts.SessionTTL != 0
+}
+
+func (s *Server) sessionJournalPath(id string) string {
+	return filepath.Join(s.opts.JournalDir, "session-"+id+journalExt)
+}
+
+// keepSession keeps the journal of an interrupted session for the client to resume it, until SessionTTL
+// where it is replayed like the journals of a server stop.
+func (s *Server) keepSession(id string) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+
+	if timer := s.sessions[id]; timer != nil {
+		timer.Stop()
+	}
+
+	s.sessions[id] = time.AfterFunc(s.opts.SessionTTL, func() {
+		if !s.claimSession(id) {
+			return // resumed
+		}
+
+		log.Printf("session %s: not resumed in %v", id, s.opts.SessionTTL)
+		s.addRecovery(s.recoverJournal(s.sessionJournalPath(id)))
+	})
+}
+
+// claimSession removes the session from the ones waiting to be resumed. It returns false if the session
+// is not waiting.
+func (s *Server) claimSession(id string) bool {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+
+	timer, ok := s.sessions[id]
+	if !ok {
+		return false
+	}
+
+	timer.Stop()
+	delete(s.sessions, id)
+
+	return true
+}
+
+// resumeSession claims the journal of an interrupted session, and returns its path, the count of the
+// client's records it has, and the offsets its sync started producing at. The path is empty if the
+// session is not waiting to be resumed.
+func (s *Server) resumeSession(id, topic, token string) (path string, records int, produceFrom map[int32]int64, err error) {
+	if !s.claimSession(id) {
+		return
+	}
+
+	sessionPath := s.sessionJournalPath(id)
+
+	header, records, _, err := readJournal(sessionPath, nil)
+	if err != nil {
+		s.keepSession(id)
+		return
+	}
+
+	if !header.ownedBy(token) {
+		s.keepSession(id)
+		return "", 0, nil, fmt.Errorf("session %s belongs to another token", id)
+	}
+
+	if header.Topic != topic {
+		s.keepSession(id)
+		return "", 0, nil, fmt.Errorf("session %s is on topic %q", id, header.Topic)
+	}
+
+	// the session's new journal takes the path, this one is removed once replayed in the new one
+	path = sessionPath + resumedExt
+	if err = os.Rename(sessionPath, path); err != nil {
+		s.keepSession(id)
+		return "", 0, nil, err
+	}
+
+	produceFrom = header.ProduceFrom
+	return
+}
+
+// discardSession removes the journal of an interrupted session, restarted from scratch by its client.
+func (s *Server) discardSession(id, token string) (err error) {
+	if !s.claimSession(id) {
+		return
+	}
+
+	sessionPath := s.sessionJournalPath(id)
+
+	if header, _, _, err := readJournal(sessionPath, nil); err == nil && !header.ownedBy(token) {
+		s.keepSession(id)
+		return fmt.Errorf("session %s belongs to another token", id)
+	}
+
+	if err := os.Remove(sessionPath); err != nil {
+		log.Print("failed to remove journal: ", err)
+	}
+	return
+}
+
+// restoreSession puts back the journal of a session whose resume failed, for the client to resume it
+// again.
+func (s *Server) restoreSession(id, resumedPath string) {
+	if err := os.Rename(resumedPath, s.sessionJournalPath(id)); err != nil {
+		log.Printf("session %s: failed to restore the journal: %v", id, err)
+		return
+	}
+
+	s.keepSession(id)
+}
+
+// restoreResumedSessions puts back the journals of the sessions whose resume was interrupted by a server
+// stop. The journals of the resumes only have a copy of their beginning, as the replay comes first.
+func (s *Server) restoreResumedSessions() {
+	paths, err := filepath.Glob(filepath.Join(s.opts.JournalDir, "*"+journalExt+resumedExt))
+	if err != nil {
+		log.Print("failed to list resumed journals: ", err)
+		return
+	}
+
+	for _, path := range paths {
+		if err := os.Rename(path, strings.TrimSuffix(path, resumedExt)); err != nil {
+			log.Printf("journal %s: failed to restore: %v", path, err)
+		}
+	}
+}
+
+// resumedExt is the extension of a session's journal being replayed in the journal of its resume.
+const resumedExt = ".resumed"
+
+// replaySession sends the records of a resumed session's journal to out, journaling them again in j, then
+// removes it.
+func replaySession(path string, out chan KeyValue, status *ConnStatus, j *journal, duplicates *duplicateKeys) (err error) {
+	var appendErr error
+	replayed := 0
+
+	_, records, _, err := readJournal(path, func(kv KeyValue) {
+		if appendErr != nil {
+			return
+		}
+
+		replayed++
+
+		duplicates.check(kv) // already checked, only tracks the keys
+
+		if appendErr = j.Append(kv); appendErr != nil {
+			return
+		}
+
+		status.push(out, kv)
+	})
+
+	if err == nil {
+		err = appendErr
+	}
+
+	if err == nil {
+		err = j.Skip(records - replayed)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Print("failed to remove journal: ", err)
+	}
+
+	return
+}
@@ -0,0 +1,599 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	diff "github.com/mcluseau/go-diff"
+	"github.com/mcluseau/go-diff/boltindex"
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+type syncSpec struct {
+	Source      chan KeyValue
+	TargetTopic string
+	DoDelete    bool
+	Cancel      chan bool
+
+	// OnSend is called with the time taken to hand each record to the producer (optional).
+	OnSend func(time.Duration)
+
+	// Release is called with the records not needed anymore (optional).
+	Release func(KeyValue)
+
+	// Progress is updated as the sync advances (optional).
+	Progress *syncer.Progress
+
+	// Force bypasses the maximum percentage of deleted keys.
+	Force bool
+
+	// Lock of the topic, touched as the sync progresses (optional).
+	Lock *TopicLock
+
+	// State is set when the source's records are a state of the topic (ie: a dump, a backfilled topic or
+	// a journal), that already went through the topic's rules: they're not applied again.
+	State bool
+
+	// Warnings are set by the sync.
+	Warnings []string
+
+	// Verification is set by the sync if its produced records were verified.
+	Verification *client.SyncVerification
+
+	// Repartition is set by the sync if the topic's partitions changed since its last sync.
+	Repartition *client.SyncRepartition
+
+	// ClientName and ClientVersion identify the client requesting the sync (optional).
+	ClientName    string
+	ClientVersion string
+
+	// incomplete is set (atomically) before cancelling the sync when its source ended before the end
+	// of its transfer.
+	incomplete int32
+}
+
+func (s *Server) sync(spec *syncSpec) (stats *SyncStats, err error) {
+	startTime := time.Now()
+	syncID := newSyncID(startTime)
+
+	if len(spec.ClientName) == 0 {
+		log.Printf("sync %s: starting on topic %q", syncID, spec.TargetTopic)
+	} else {
+		log.Printf("sync %s: starting on topic %q for client %s %s", syncID, spec.TargetTopic, spec.ClientName, spec.ClientVersion)
+	}
+
+	defer func() {
+		event := SyncEvent{
+			SyncID:        syncID,
+			Topic:         spec.TargetTopic,
+			ClientName:    spec.ClientName,
+			ClientVersion: spec.ClientVersion,
+			DoDelete:      spec.DoDelete,
+			Outcome:       SyncSucceeded,
+			Stats:         stats,
+			StartTime:     startTime,
+			EndTime:       time.Now(),
+		}
+
+		event.DurationMs = int64(event.EndTime.Sub(startTime) / time.Millisecond)
+
+		select {
+		case <-spec.Cancel:
+			event.Outcome = SyncCancelled
+		default:
+		}
+
+		if err != nil {
+			event.Outcome = SyncFailed
+			event.Error = err.Error()
+		}
+
+		if atomic.LoadInt32(&spec.incomplete) != 0 {
+			event.Outcome = SyncIncomplete
+		}
+
+		switch event.Outcome {
+		case SyncSucceeded:
+			s.syncSucceeded(spec.TargetTopic)
+
+		case SyncFailed:
+			s.alert(Alert{Kind: AlertSyncFailed, Topic: spec.TargetTopic, SyncID: syncID, Message: event.Error})
+		}
+
+		metricSyncs.WithLabelValues(spec.TargetTopic, spec.ClientName, event.Outcome).Inc()
+
+		if stats != nil {
+			counts := syncCounts(stats)
+			metricRecords.WithLabelValues(spec.TargetTopic, "created").Add(float64(counts.Created))
+			metricRecords.WithLabelValues(spec.TargetTopic, "modified").Add(float64(counts.Modified))
+			metricRecords.WithLabelValues(spec.TargetTopic, "deleted").Add(float64(counts.Deleted))
+			metricRecords.WithLabelValues(spec.TargetTopic, "unchanged").Add(float64(counts.Unchanged))
+		}
+
+		s.recordTombstones(syncID, spec, stats, event.Outcome)
+
+		s.publishSyncEvent(event)
+	}()
+
+	indexNames, err := s.indexNames(spec.TargetTopic)
+	if err != nil {
+		return
+	}
+
+	repartition, partitions, err := s.checkPartitions(spec.TargetTopic)
+	if err != nil {
+		return
+	}
+
+	if repartition != nil {
+		log.Printf("sync %s: the partitions of topic %q changed from %d to %d since its last sync (partition affinity: %v)",
+			syncID, spec.TargetTopic, repartition.PreviousPartitions, repartition.Partitions, repartition.PartitionAffinity)
+
+		if repartition.PartitionAffinity && spec.DoDelete {
+			// the indexes of the partitions still have the moved keys, whose deletion would go to their new partition
+			if repartition.MovedDeleted, err = s.deleteMovedKeys(spec.TargetTopic, partitions); err != nil {
+				return
+			}
+
+			log.Printf("sync %s: %d records of the keys moved to another partition deleted from topic %q",
+				syncID, repartition.MovedDeleted, spec.TargetTopic)
+
+			if s.hasStore() {
+				for _, name := range indexNames {
+					if err = s.resetIndex(name); err != nil {
+						return
+					}
+				}
+			}
+		}
+
+		spec.Repartition = repartition
+		spec.Warnings = append(spec.Warnings, repartitionWarning(repartition, spec.DoDelete))
+	}
+
+	indexes, err := s.newIndexes(indexNames, spec.DoDelete)
+	if err != nil {
+		return
+	}
+
+	log.Print("index created")
+	defer func() {
+		log.Print("index cleanup")
+		cleanupIndexes(indexes)
+		log.Print("index cleaned-up")
+	}()
+
+	if spec.Progress == nil {
+		spec.Progress = &syncer.Progress{}
+	}
+
+	sy := s.newSyncer(spec.TargetTopic)
+	sy.OnSend = spec.OnSend
+	sy.Release = spec.Release
+	sy.Progress = spec.Progress
+
+	if spec.Lock != nil {
+		sy.OnProgress = spec.Lock.Touch
+	}
+
+	if repartition != nil && !repartition.PartitionAffinity {
+		// the index of the first partition misses the keys hashing to it now, and has the moved ones
+		sy.ProduceUnchanged = true
+		repartition.Reproduced = true
+	}
+
+	if spec.DoDelete && !spec.Force {
+		sy.MaxDeletePercent = s.maxDeletePercent(spec.TargetTopic)
+	}
+
+	config, _ := s.topicConfig(spec.TargetTopic)
+	canary := config.Canary
+
+	if config.Envelope != nil {
+		sy.Wrap = config.Envelope.wrapper(spec.ClientName, syncID, config.JSON)
+	}
+
+	syncIndexes := func() (*SyncStats, error) {
+		if config.PartitionAffinity {
+			return sy.SyncPartitions(s.kafka(spec.TargetTopic), spec.Source, indexes, spec.Cancel)
+		}
+		return sy.SyncWithIndex(s.kafka(spec.TargetTopic), spec.Source, indexes[0], spec.Cancel)
+	}
+
+	var canaryStart map[int32]int64
+	if canary != nil {
+		sy.ProduceTopic = canary.topic(spec.TargetTopic)
+
+		if canaryStart, err = partitionHighWaters(s.kafka(spec.TargetTopic), sy.ProduceTopic); err != nil {
+			return
+		}
+	}
+
+	var changes *changePublisher
+	if config.Changes != nil {
+		if changes, err = s.newChangePublisher(config, spec.TargetTopic, syncID, len(indexes)); err != nil {
+			return
+		}
+		defer changes.finish(false)
+
+		sy.OnChange = changes.add
+	}
+
+	var (
+		sample       *producedSample
+		verifyStarts []int64
+	)
+
+	if pct := s.verifyPercent(spec.TargetTopic); pct != 0 {
+		sample = newProducedSample(pct)
+		sy.OnProduce = sample.add
+
+		if verifyStarts, err = highWaterMarks(s.kafka(spec.TargetTopic), spec.TargetTopic, len(indexes)); err != nil {
+			return
+		}
+	}
+
+	stats, err = syncIndexes()
+
+	if err == syncer.ErrIndexInvalid && s.hasStore() {
+		// the source was not read yet, retry with new indexes
+		log.Printf("sync %s: the stored index doesn't match the topic's offsets, rebuilding it", syncID)
+
+		cleanupIndexes(indexes)
+		indexes = nil // nothing to clean up until the new indexes are created
+
+		for _, name := range indexNames {
+			if err = s.resetIndex(name); err != nil {
+				return
+			}
+		}
+
+		if indexes, err = s.newIndexes(indexNames, spec.DoDelete); err != nil {
+			return
+		}
+
+		stats, err = syncIndexes()
+	}
+
+	if n := spec.Progress.ProduceRetries; n != 0 {
+		spec.Warnings = append(spec.Warnings, fmt.Sprintf("%d messages retried after produce errors", n))
+		metricProduceErrors.WithLabelValues(spec.TargetTopic, "retried").Add(float64(n))
+	}
+
+	if n := spec.Progress.ProduceSkipped; n != 0 {
+		spec.Warnings = append(spec.Warnings, fmt.Sprintf("%d messages skipped after produce errors", n))
+		metricProduceErrors.WithLabelValues(spec.TargetTopic, "skipped").Add(float64(n))
+	}
+
+	if err == nil && canary != nil {
+		select {
+		case <-spec.Cancel:
+		default:
+			if err = canary.checkStats(stats); err == nil {
+				err = s.replayCanary(s.kafka(spec.TargetTopic), canary, spec.TargetTopic, canaryStart)
+			}
+
+			if err != nil {
+				log.Printf("sync %s: canary: %v", syncID, err)
+			}
+		}
+	}
+
+	if changes != nil {
+		succeeded := err == nil
+		select {
+		case <-spec.Cancel:
+			succeeded = false
+		default:
+		}
+
+		spec.Warnings = append(spec.Warnings, changes.finish(succeeded)...)
+	}
+
+	if err == nil && sample != nil {
+		select {
+		case <-spec.Cancel:
+		default:
+			s.verifySync(syncID, spec, verifyStarts, sample)
+		}
+	}
+
+	if err == nil {
+		select {
+		case <-spec.Cancel:
+		default:
+			spec.Warnings = append(spec.Warnings, s.checkCompaction(spec.TargetTopic, spec.DoDelete, stats)...)
+
+			// the moved keys remaining in their previous partition are deleted by the next sync with delete
+			if repartition == nil || !repartition.PartitionAffinity || spec.DoDelete {
+				s.setLastPartitions(spec.TargetTopic, partitions)
+			}
+		}
+	}
+
+	if s.hasStore() {
+		if err == nil {
+			err = s.opts.Store.Sync()
+		}
+
+		go s.IndexTopic(spec.TargetTopic)
+	}
+
+	return
+}
+
+// recordTombstones reports the tombstones produced to the topic by the sync: all those produced, unless
+// they were held in the canary topic, and the last successful sync's.
+func (s *Server) recordTombstones(syncID string, spec *syncSpec, stats *SyncStats, outcome string) {
+	if spec.Progress == nil {
+		return
+	}
+
+	tombstones := spec.Progress.DeletesEmitted
+
+	if config, _ := s.topicConfig(spec.TargetTopic); config.Canary != nil && outcome != SyncSucceeded {
+		tombstones = 0
+	}
+
+	if tombstones != 0 {
+		metricTombstones.WithLabelValues(spec.TargetTopic, "sync").Add(float64(tombstones))
+	}
+
+	if outcome != SyncSucceeded || stats == nil {
+		if tombstones != 0 {
+			log.Printf("sync %s: %d tombstones produced to topic %q before the sync %s", syncID, tombstones, spec.TargetTopic, outcome)
+		}
+		return
+	}
+
+	ratio := deletedRatio(stats)
+
+	metricLastSyncTombstones.WithLabelValues(spec.TargetTopic).Set(float64(tombstones))
+	metricLastSyncDeletedRatio.WithLabelValues(spec.TargetTopic).Set(ratio)
+
+	if tombstones != 0 {
+		log.Printf("sync %s: %d tombstones produced to topic %q (%.1f%% of its keys)", syncID, tombstones, spec.TargetTopic, 100*ratio)
+	}
+}
+
+// verifySync reads back the sampled records produced by the sync, reporting the discrepancies in its
+// warnings. The sync is not failed: its records are already in the topic.
+func (s *Server) verifySync(syncID string, spec *syncSpec, starts []int64, sample *producedSample) {
+	v, err := s.verifyProduced(s.kafka(spec.TargetTopic), spec.TargetTopic, starts, sample)
+	if err != nil {
+		log.Printf("sync %s: verification failed: %v", syncID, err)
+		spec.Warnings = append(spec.Warnings, "verification of the produced records failed: "+err.Error())
+		return
+	}
+
+	spec.Verification = v
+
+	metricVerifyDiscrepancies.WithLabelValues(spec.TargetTopic, "missing").Add(float64(v.Missing))
+	metricVerifyDiscrepancies.WithLabelValues(spec.TargetTopic, "mismatched").Add(float64(v.Mismatched))
+
+	if warning := verificationWarning(v); len(warning) != 0 {
+		log.Printf("sync %s: %s", syncID, warning)
+		spec.Warnings = append(spec.Warnings, warning)
+	} else {
+		log.Printf("sync %s: %d produced records verified", syncID, v.Checked)
+	}
+}
+
+// newIndexes creates the indexes of a sync, stored with the given names if the server has a store.
+func (s *Server) newIndexes(names []string, doDelete bool) (indexes []diff.Index, err error) {
+	for _, name := range names {
+		if !s.hasStore() {
+			// in memory index; simple but slower on big datasets, as it requires reindexing the topic each time
+			var index diff.Index = diff.NewIndex(false)
+			if !doDelete {
+				index = noDeleteIndex{index.(*diff.MemoryIndex)}
+			}
+
+			indexes = append(indexes, index)
+			continue
+		}
+
+		// use the local store
+		var index *boltindex.Index
+		if index, err = boltindex.New(s.opts.Store, []byte(name), doDelete); err != nil {
+			cleanupIndexes(indexes)
+			return nil, err
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	return
+}
+
+// noDeleteIndex is an index streaming no unseen keys, as the memory index always records them.
+type noDeleteIndex struct {
+	*diff.MemoryIndex
+}
+
+func (noDeleteIndex) KeysNotSeen() <-chan []byte {
+	keys := make(chan []byte)
+	close(keys)
+	return keys
+}
+
+func cleanupIndexes(indexes []diff.Index) {
+	for _, index := range indexes {
+		if err := index.Cleanup(); err != nil {
+			log.Print("WARN: index cleanup failed: ", err)
+		}
+	}
+}
+
+// syncCounts returns the records of the sync by change.
+func syncCounts(stats *SyncStats) *client.SyncCounts {
+	if stats == nil {
+		return nil
+	}
+
+	return &client.SyncCounts{
+		Created:        stats.Created,
+		Modified:       stats.Modified,
+		Deleted:        stats.Deleted,
+		Unchanged:      stats.Unchanged,
+		DeletedPercent: 100 * deletedRatio(stats),
+	}
+}
+
+// deletedRatio returns the ratio of the topic's keys deleted by the sync.
+func deletedRatio(stats *SyncStats) float64 {
+	existing := stats.Deleted + stats.Modified + stats.Unchanged
+	if existing == 0 {
+		return 0
+	}
+	return float64(stats.Deleted) / float64(existing)
+}
+
+// syncTimings returns the timings of a sync, given the time taken to read its records.
+func syncTimings(read time.Duration, progress *syncer.Progress) *client.SyncTimings {
+	return &client.SyncTimings{
+		Read:    read.Milliseconds(),
+		Index:   progress.IndexDuration.Milliseconds(),
+		Diff:    progress.DiffDuration.Milliseconds(),
+		Produce: (progress.SendDuration + progress.FlushDuration).Milliseconds(),
+		Delete:  progress.DeleteDuration.Milliseconds(),
+	}
+}
+
+// SyncFromSource runs a full sync of the topic with the values produced by fill.
+//
+// If fill fails, the sync is cancelled so no deletion can be done from a partial dataset.
+func (s *Server) SyncFromSource(topic string, doDelete bool, fill func(out chan<- KeyValue) error) (stats *SyncStats, err error) {
+	return s.syncFromSource(&syncSpec{TargetTopic: topic, DoDelete: doDelete}, "source", fill)
+}
+
+// SyncFromState is SyncFromSource with records of a state of the topic (ie: a dump being restored), that
+// already went through the topic's rules. The rules are not applied again, as the transforms of the keys
+// (prefix, hmac...) would be applied twice.
+func (s *Server) SyncFromState(topic string, doDelete bool, fill func(out chan<- KeyValue) error) (stats *SyncStats, err error) {
+	return s.syncFromSource(&syncSpec{TargetTopic: topic, DoDelete: doDelete, State: true}, "restore", fill)
+}
+
+// ErrDeletionsDenied is returned when a sync from a source with deletions targets a topic denying them.
+var ErrDeletionsDenied = errors.New("deletions are not allowed")
+
+// syncFromSource runs the sync of the spec, with the values produced by fill as its source. The topic's
+// delete policy applies like to the clients' syncs, except forced deletions (a source is not a dataset).
+func (s *Server) syncFromSource(spec *syncSpec, holder string, fill func(out chan<- KeyValue) error) (stats *SyncStats, err error) {
+	topic := spec.TargetTopic
+
+	if config, _ := s.topicConfig(topic); config.DeletePolicy == DeleteDeny && spec.DoDelete {
+		return nil, fmt.Errorf("topic %q: %w", topic, ErrDeletionsDenied)
+	}
+
+	lock := s.LockTopic(topic, holder)
+	if lock == nil {
+		return nil, fmt.Errorf("topic %q: %w", topic, ErrTopicLocked)
+	}
+	defer s.UnlockTopic(lock)
+
+	kvSource := make(chan KeyValue, kvBufferSize)
+	cancel := make(chan bool)
+	cancelOnce := sync.Once{}
+	cancelSync := func() { cancelOnce.Do(func() { close(cancel) }) }
+	fillDone := make(chan bool)
+
+	lock.SetCancel(cancelSync)
+
+	var fillErr error
+	go func() {
+		defer close(fillDone)
+
+		if spec.State {
+			fillErr = fill(kvSource)
+		} else {
+			fillErr = s.fillWithRules(spec, kvSource, fill)
+		}
+
+		if fillErr != nil {
+			cancelSync()
+			return
+		}
+
+		close(kvSource)
+	}()
+
+	spec.Source = kvSource
+	spec.Cancel = cancel
+	spec.Lock = lock
+
+	stats, err = s.sync(spec)
+
+	// unblock the source if the sync stopped early
+drain:
+	for {
+		select {
+		case <-kvSource:
+		case <-fillDone:
+			break drain
+		}
+	}
+
+	if fillErr != nil {
+		err = fillErr
+		s.alert(Alert{Kind: AlertSyncFailed, Topic: topic, Message: "source failed: " + err.Error()})
+	}
+
+	return
+}
+
+// fillWithRules fills out with the records of fill, transformed and checked by the rules of the topic
+// like the records of the clients.
+func (s *Server) fillWithRules(spec *syncSpec, out chan<- KeyValue, fill func(out chan<- KeyValue) error) (err error) {
+	topic := spec.TargetTopic
+
+	config, _ := s.topicConfig(topic)
+	rules := s.recordRules(config)
+	rules.SkipInvalid = s.skipsInvalidRecords(spec.DoDelete)
+
+	in := make(chan KeyValue, kvBufferSize)
+	fillErr := make(chan error, 1)
+
+	go func() {
+		defer close(in)
+		fillErr <- fill(in)
+	}()
+
+	for kv := range in {
+		if err != nil {
+			continue // let fill end
+		}
+
+		if rules.Envelope != nil && !json.Valid(kv.Value) {
+			// the values of the sources may not be JSON, they're JSON strings in the envelopes
+			kv.Value, _ = rules.JSON.marshal(string(kv.Value))
+		}
+
+		kv, err = rules.apply(kv)
+		if err == nil && s.processRecord != nil {
+			kv, err = s.processRecord(topic, kv)
+		}
+
+		if err != nil {
+			if rules.SkipInvalid {
+				log.Printf("to topic %q: skipping source record: %v", topic, err)
+				err = nil
+			}
+			continue
+		}
+
+		out <- kv
+	}
+
+	if fErr := <-fillErr; fErr != nil {
+		err = fErr
+	}
+
+	return
+}
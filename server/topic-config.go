@@ -0,0 +1,522 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/client"
+)
+
+// Delete policies of a topic.
+const (
+	// DeleteAllow lets the client decide if its sync deletes.
+	DeleteAllow = ""
+	// DeleteDeny refuses syncs with deletions.
+	DeleteDeny = "deny"
+	// DeleteForce makes all the syncs delete.
+	DeleteForce = "force"
+)
+
+// Transform types.
+const (
+	// TransformKeyPrefix prepends Value to the keys.
+	TransformKeyPrefix = "key-prefix"
+	// TransformKeyLowercase lowercases the keys. Invalid UTF-8 sequences are replaced, TransformKeyUTF8
+	// before it rejects them instead.
+	TransformKeyLowercase = "key-lowercase"
+	// TransformKeyTrimSpace removes the leading and trailing white spaces of the keys.
+	TransformKeyTrimSpace = "key-trim-space"
+	// TransformKeyUTF8 rejects the keys that are not valid UTF-8.
+	TransformKeyUTF8 = "key-utf8"
+	// TransformDropFields removes Fields from the values, that must be JSON objects.
+	TransformDropFields = "drop-fields"
+	// TransformKeyHMAC replaces the keys by their HMAC-SHA256 with Secret, hex encoded, so the identifiers
+	// they carry are not in the topic. The same key gives the same token in every sync.
+	TransformKeyHMAC = "key-hmac"
+)
+
+// TopicConfig is the configuration specific to a topic. A configured topic is allowed.
+type TopicConfig struct {
+	// Tokens allowed to sync the topic, instead of the server's token (ignored with the auth webhook).
+	Tokens []string `json:"tokens,omitempty"`
+
+	// DeletePolicy is DeleteAllow, DeleteDeny or DeleteForce.
+	DeletePolicy string `json:"deletePolicy,omitempty"`
+
+	// MaxRecordsPerSecond limits the rate of records read from the clients (no limit if 0).
+	MaxRecordsPerSecond int `json:"maxRecordsPerSecond,omitempty"`
+
+	// Priority of the topic's syncs when their concurrency is limited (see Options.MaxConcurrentSyncs).
+	Priority int `json:"priority,omitempty"`
+
+	// MaxKeySize lowers the server's maximum key size (no change if 0).
+	MaxKeySize int `json:"maxKeySize,omitempty"`
+
+	// MaxValueSize lowers the server's maximum value size (no change if 0).
+	MaxValueSize int `json:"maxValueSize,omitempty"`
+
+	// MinRecords and MaxRecords are the expected record count of a sync with deletions (no limit if 0).
+	// A sync out of these bounds is cancelled before any deletion, unless the client forces it.
+	MinRecords int64 `json:"minRecords,omitempty"`
+	MaxRecords int64 `json:"maxRecords,omitempty"`
+
+	// MaxDeletePercent overrides the server's maximum percentage of the keys a sync can delete, if set.
+	MaxDeletePercent float64 `json:"maxDeletePercent,omitempty"`
+
+	// VerifyPercent overrides the server's percentage of produced keys verified, if set.
+	VerifyPercent float64 `json:"verifyPercent,omitempty"`
+
+	// DuplicateKeysPolicy overrides the server's policy if set.
+	DuplicateKeysPolicy string `json:"duplicateKeysPolicy,omitempty"`
+
+	// Schema validates the values (no validation if nil).
+	Schema *ValueSchema `json:"schema,omitempty"`
+
+	// CompactionConfig overrides entries of the server's CompactionConfig.
+	CompactionConfig map[string]string `json:"compactionConfig,omitempty"`
+
+	// Cluster is the name of the Kafka cluster of the topic, in the server's Clusters (the server's
+	// Kafka if empty).
+	Cluster string `json:"cluster,omitempty"`
+
+	// Transforms are applied to the records, in order, before their validation and diff. They can
+	// canonicalize the keys, so different spellings of a key from the sources are the same record.
+	Transforms []Transform `json:"transforms,omitempty"`
+
+	// PartitionAffinity syncs the partitions of the topic in parallel, each with its own index, diff and
+	// producer, to use more CPUs on topics with many partitions. The records are produced to the partition
+	// of their key, so the topic must only be produced with the hash partitioner (sarama's and kafka-go's
+	// default).
+	PartitionAffinity bool `json:"partitionAffinity,omitempty"`
+
+	// Envelope wraps the values in JSON envelopes with metadata when producing them (no envelope if nil).
+	Envelope *EnvelopeConfig `json:"envelope,omitempty"`
+
+	// Canary validates the changes of the syncs in a canary topic before applying them (no canary if nil).
+	// The topic must only be written by its syncs.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+
+	// Changes publishes the changes made by the syncs to a changes topic (no changes topic if nil).
+	Changes *ChangesConfig `json:"changes,omitempty"`
+
+	// JSON controls how the JSON values are encoded (see JSONConfig for the defaults).
+	JSON *JSONConfig `json:"json,omitempty"`
+
+	// Expiry deletes the expired keys of the topic periodically (no expiry if nil).
+	Expiry *ExpiryConfig `json:"expiry,omitempty"`
+}
+
+// ValueSchema is the expected structure of JSON values.
+type ValueSchema struct {
+	// Type of the values: object, array, string, number or boolean (any JSON if empty).
+	Type string `json:"type,omitempty"`
+
+	// Required fields of object values.
+	Required []string `json:"required,omitempty"`
+}
+
+// Transform changes the records of a topic.
+type Transform struct {
+	Type   string   `json:"type"`
+	Value  string   `json:"value,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// Validate checks the configuration of the topic.
+func (c TopicConfig) Validate(clusters map[string]backend.Backend) error {
+	switch c.DeletePolicy {
+	case DeleteAllow, DeleteDeny, DeleteForce:
+	default:
+		return fmt.Errorf("invalid delete policy %q", c.DeletePolicy)
+	}
+
+	if c.MaxDeletePercent < 0 || c.MaxDeletePercent > 100 {
+		return fmt.Errorf("maxDeletePercent must be between 0 and 100")
+	}
+
+	if c.VerifyPercent < 0 || c.VerifyPercent > 100 {
+		return fmt.Errorf("verifyPercent must be between 0 and 100")
+	}
+
+	if c.MaxRecords != 0 && c.MinRecords > c.MaxRecords {
+		return fmt.Errorf("minRecords is greater than maxRecords")
+	}
+
+	switch c.DuplicateKeysPolicy {
+	case DuplicateKeysIgnore, DuplicateKeysWarn, DuplicateKeysReject:
+	default:
+		return fmt.Errorf("invalid duplicate keys policy %q", c.DuplicateKeysPolicy)
+	}
+
+	if len(c.Cluster) != 0 && clusters[c.Cluster] == nil {
+		return fmt.Errorf("unknown cluster %q", c.Cluster)
+	}
+
+	if err := c.Schema.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Expiry.validate(); err != nil {
+		return err
+	}
+
+	if c.Canary != nil {
+		if c.PartitionAffinity {
+			return fmt.Errorf("canary is not supported with partition affinity")
+		}
+
+		if c.Canary.MaxChangePercent < 0 || c.Canary.MaxCountDeltaPercent < 0 {
+			return fmt.Errorf("canary limits must be positive")
+		}
+
+		if err := c.Canary.Schema.validate(); err != nil {
+			return fmt.Errorf("canary: %v", err)
+		}
+	}
+
+	return validateTransforms(c.Transforms)
+}
+
+func validateTransforms(transforms []Transform) error {
+	for _, t := range transforms {
+		switch t.Type {
+		case TransformKeyPrefix, TransformKeyLowercase, TransformKeyTrimSpace, TransformKeyUTF8, TransformDropFields:
+		case TransformKeyHMAC:
+			if len(t.Secret) == 0 {
+				return fmt.Errorf("transform %q requires a secret", t.Type)
+			}
+		default:
+			return fmt.Errorf("invalid transform type %q", t.Type)
+		}
+	}
+
+	return nil
+}
+
+// SetTopics replaces the topics' configurations.
+func (s *Server) SetTopics(topics map[string]TopicConfig) {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	s.opts.Topics = topics
+}
+
+// topicConfig returns the configuration of the topic, if any.
+func (s *Server) topicConfig(topic string) (config TopicConfig, ok bool) {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	config, ok = s.opts.Topics[topic]
+	return
+}
+
+// maxDeletePercent returns the maximum percentage of the topic's keys a sync can delete (no limit if 0).
+func (s *Server) maxDeletePercent(topic string) float64 {
+	if config, _ := s.topicConfig(topic); config.MaxDeletePercent != 0 {
+		return config.MaxDeletePercent
+	}
+	return s.opts.MaxDeletePercent
+}
+
+// verifyPercent returns the percentage of the produced keys verified after the topic's syncs (none if 0).
+func (s *Server) verifyPercent(topic string) float64 {
+	if config, _ := s.topicConfig(topic); config.VerifyPercent != 0 {
+		return config.VerifyPercent
+	}
+	return s.opts.VerifyPercent
+}
+
+// kafka returns the Kafka client of the topic's cluster, producing through the middlewares.
+func (s *Server) kafka(topic string) (kafka backend.Backend) {
+	config, _ := s.topicConfig(topic)
+
+	kafka = s.opts.Kafka
+	if cluster := s.opts.Clusters[config.Cluster]; cluster != nil {
+		kafka = cluster
+	}
+
+	if s.hasProduceMiddlewares() {
+		kafka = middlewareBackend{Backend: kafka, s: s}
+	}
+
+	return
+}
+
+// isTokenValid returns true if the token allows to sync the topic.
+func (s *Server) isTokenValid(topic, token string) bool {
+	config, _ := s.topicConfig(topic)
+	if len(config.Tokens) == 0 {
+		return token == s.token()
+	}
+
+	for _, allowed := range config.Tokens {
+		if token == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRecordCount returns why the record count of a sync with deletions is unexpected, or "".
+func (c TopicConfig) checkRecordCount(count int64) string {
+	switch {
+	case c.MinRecords != 0 && count < c.MinRecords:
+		return fmt.Sprintf("%d records received, less than the minimum of %d", count, c.MinRecords)
+	case c.MaxRecords != 0 && count > c.MaxRecords:
+		return fmt.Sprintf("%d records received, more than the maximum of %d", count, c.MaxRecords)
+	}
+	return ""
+}
+
+// checkShortfall returns why the records received are too few compared to the announced ones, or "".
+func (s *Server) checkShortfall(expected, count int64) string {
+	if count >= expected {
+		return ""
+	}
+
+	if pct := 100 * float64(expected-count) / float64(expected); pct > s.opts.MaxShortfallPercent {
+		return fmt.Sprintf("%d records received, %.1f%% less than the %d announced", count, pct, expected)
+	}
+	return ""
+}
+
+// recordRules are applied to each record read from a client.
+type recordRules struct {
+	recordLimits
+
+	Schema              *ValueSchema
+	Transforms          []Transform
+	Envelope            *EnvelopeConfig
+	JSON                *JSONConfig
+	MaxRecordsPerSecond int
+	DuplicateKeysPolicy string
+
+	// SkipInvalid skips the invalid records instead of failing the transfer.
+	SkipInvalid bool
+}
+
+func (s *Server) recordRules(config TopicConfig) (rules recordRules) {
+	rules = recordRules{
+		recordLimits: s.recordLimits().restrict(recordLimits{
+			MaxKeySize:   config.MaxKeySize,
+			MaxValueSize: config.MaxValueSize,
+		}),
+		Schema:              config.Schema,
+		Transforms:          config.Transforms,
+		Envelope:            config.Envelope,
+		JSON:                config.JSON,
+		MaxRecordsPerSecond: config.MaxRecordsPerSecond,
+		DuplicateKeysPolicy: s.opts.DuplicateKeysPolicy,
+	}
+
+	if len(config.DuplicateKeysPolicy) != 0 {
+		rules.DuplicateKeysPolicy = config.DuplicateKeysPolicy
+	}
+
+	return
+}
+
+// apply transforms and checks the record, returning a client error if it is invalid.
+func (r recordRules) apply(kv KeyValue) (KeyValue, error) {
+	for _, t := range r.Transforms {
+		var err error
+		if kv, err = t.apply(kv, r.JSON); err != nil {
+			return kv, &client.Error{Code: client.ErrInvalidRecord, Message: fmt.Sprintf("key %q: %v", kv.Key, err)}
+		}
+	}
+
+	if err := r.check(kv); err != nil {
+		return kv, err
+	}
+
+	if err := r.Schema.check(kv.Value); err != nil {
+		return kv, &client.Error{Code: client.ErrInvalidRecord, Message: fmt.Sprintf("value of key %q: %v", kv.Key, err)}
+	}
+
+	if r.Envelope != nil {
+		value, err := r.Envelope.value(kv.Value, r.JSON)
+		if err != nil {
+			return kv, &client.Error{Code: client.ErrInvalidRecord, Message: fmt.Sprintf("value of key %q: %v", kv.Key, err)}
+		}
+
+		if value != nil {
+			releaseBuffer(kv.Value)
+			kv.Value = value
+		}
+	}
+
+	if value := r.JSON.encodeValue(kv.Value); value != nil {
+		releaseBuffer(kv.Value)
+		kv.Value = value
+	}
+
+	return kv, nil
+}
+
+// applyToKey transforms and checks the key of a tombstone: the transforms of the values don't apply.
+func (r recordRules) applyToKey(kv KeyValue) (KeyValue, error) {
+	for _, t := range r.Transforms {
+		if t.Type == TransformDropFields {
+			continue
+		}
+
+		var err error
+		if kv, err = t.apply(kv, r.JSON); err != nil {
+			return kv, &client.Error{Code: client.ErrInvalidRecord, Message: fmt.Sprintf("key %q: %v", kv.Key, err)}
+		}
+	}
+
+	return kv, r.check(kv)
+}
+
+// apply transforms the record; the values re-encoded are encoded as configured by j (optional).
+func (t Transform) apply(kv KeyValue, j *JSONConfig) (KeyValue, error) {
+	switch t.Type {
+	case TransformKeyPrefix:
+		key := make([]byte, 0, len(t.Value)+len(kv.Key))
+		key = append(append(key, t.Value...), kv.Key...)
+
+		releaseBuffer(kv.Key)
+		kv.Key = key
+
+	case TransformKeyLowercase:
+		key := bytes.ToLower(kv.Key)
+
+		releaseBuffer(kv.Key)
+		kv.Key = key
+
+	case TransformKeyTrimSpace:
+		kv.Key = bytes.TrimSpace(kv.Key) // a sub-slice, the buffer is still released with the record
+
+	case TransformKeyUTF8:
+		if !utf8.Valid(kv.Key) {
+			return kv, errors.New("not valid UTF-8")
+		}
+
+	case TransformDropFields:
+		obj := map[string]json.RawMessage{}
+		if err := json.Unmarshal(kv.Value, &obj); err != nil {
+			return kv, fmt.Errorf("value is not a JSON object: %v", err)
+		}
+
+		for _, field := range t.Fields {
+			delete(obj, field)
+		}
+
+		value, err := j.marshal(obj)
+		if err != nil {
+			return kv, err
+		}
+
+		releaseBuffer(kv.Value)
+		kv.Value = value
+
+	case TransformKeyHMAC:
+		mac := hmac.New(sha256.New, []byte(t.Secret))
+		mac.Write(kv.Key)
+
+		key := make([]byte, hex.EncodedLen(mac.Size()))
+		hex.Encode(key, mac.Sum(nil))
+
+		releaseBuffer(kv.Key)
+		kv.Key = key
+	}
+
+	return kv, nil
+}
+
+// validate checks the schema itself.
+func (schema *ValueSchema) validate() error {
+	if schema == nil {
+		return nil
+	}
+
+	switch schema.Type {
+	case "", "object", "array", "string", "number", "boolean":
+		return nil
+	default:
+		return fmt.Errorf("invalid schema type %q", schema.Type)
+	}
+}
+
+// check returns an error if the value doesn't match the schema.
+func (schema *ValueSchema) check(value []byte) error {
+	if schema == nil {
+		return nil
+	}
+
+	var obj interface{}
+	if err := json.Unmarshal(value, &obj); err != nil {
+		return fmt.Errorf("not JSON: %v", err)
+	}
+
+	typeName := ""
+	switch obj.(type) {
+	case map[string]interface{}:
+		typeName = "object"
+	case []interface{}:
+		typeName = "array"
+	case string:
+		typeName = "string"
+	case float64:
+		typeName = "number"
+	case bool:
+		typeName = "boolean"
+	case nil:
+		typeName = "null"
+	}
+
+	if len(schema.Type) != 0 && typeName != schema.Type {
+		return fmt.Errorf("expected %s, got %s", schema.Type, typeName)
+	}
+
+	if len(schema.Required) != 0 {
+		fields, isObject := obj.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("expected object with fields %q, got %s", schema.Required, typeName)
+		}
+
+		for _, field := range schema.Required {
+			if _, ok := fields[field]; !ok {
+				return fmt.Errorf("missing field %q", field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rateLimiter paces the records to a maximum rate (no limit if 0).
+type rateLimiter struct {
+	rate    int
+	start   time.Time
+	records int
+}
+
+// wait sleeps until the next record is allowed.
+func (l *rateLimiter) wait() {
+	if l.rate == 0 {
+		return
+	}
+
+	if l.records == 0 {
+		l.start = time.Now()
+	}
+
+	l.records++
+
+	next := l.start.Add(time.Duration(l.records) * time.Second / time.Duration(l.rate))
+	if d := time.Until(next); d > 10*time.Millisecond {
+		time.Sleep(d)
+	}
+}
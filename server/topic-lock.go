@@ -0,0 +1,253 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TopicLock reserves a topic for a sync, or another operation writing it. The topic stays locked until
+// its holder unlocks it, even when force-released or expired: the holder is only cancelled.
+type TopicLock struct {
+	topic  string
+	holder string
+	since  time.Time
+
+	// active is the time of the holder's last progress, in Unix nanoseconds (atomic).
+	active int64
+
+	mutex     sync.Mutex
+	cancel    func()
+	cancelled chan bool
+	released  chan bool
+}
+
+// SetCancel sets the function cancelling the holder's operation when the lock is force-released or
+// expires. It's called right away if the lock already was.
+func (l *TopicLock) SetCancel(cancel func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.cancel = cancel
+
+	select {
+	case <-l.cancelled:
+		go cancel()
+	default:
+	}
+}
+
+// Cancelled is closed when the lock is force-released or expires, for the holders checking it instead
+// of setting a cancel function.
+func (l *TopicLock) Cancelled() <-chan bool {
+	return l.cancelled
+}
+
+// Touch tells the holder progressed, delaying the lock's expiry.
+func (l *TopicLock) Touch() {
+	atomic.StoreInt64(&l.active, time.Now().UnixNano())
+}
+
+// keepLockAlive touches the lock until stop is called, for the holders waiting without progress (ie: a
+// transfer paused by its client, or a sync waiting for a slot): they're still alive.
+func (s *Server) keepLockAlive(lock *TopicLock) (stop func()) {
+	if lock == nil || s.opts.TopicLockTTL == 0 {
+		return func() {}
+	}
+
+	lock.Touch()
+
+	done := make(chan bool)
+	stopOnce := sync.Once{}
+
+	go func() {
+		ticker := time.NewTicker(s.opts.TopicLockTTL / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				lock.Touch()
+			case <-done:
+				lock.Touch()
+				return
+			}
+		}
+	}()
+
+	return func() { stopOnce.Do(func() { close(done) }) }
+}
+
+func (l *TopicLock) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&l.active))
+}
+
+// cancelHolder cancels the holder's operation; returns false if it already was.
+func (l *TopicLock) cancelHolder() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	select {
+	case <-l.cancelled:
+		return false
+	default:
+	}
+
+	close(l.cancelled)
+
+	if l.cancel != nil {
+		go l.cancel()
+	}
+
+	return true
+}
+
+// TopicLockStatus describes a held topic lock.
+type TopicLockStatus struct {
+	Topic  string    `json:"topic"`
+	Holder string    `json:"holder"`
+	Since  time.Time `json:"since"`
+
+	// LastActive is the time of the holder's last progress.
+	LastActive time.Time `json:"lastActive"`
+
+	// Expired is set when the holder didn't progress for the TopicLockTTL: the next lock of the topic
+	// cancels it.
+	Expired bool `json:"expired,omitempty"`
+
+	// Cancelled is set when the holder was cancelled, but didn't stop yet.
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// ErrTopicLocked is returned when the topic of a sync from a source is already locked.
+var ErrTopicLocked = errors.New("topic already locked")
+
+// ErrTopicNotLocked is returned when releasing a topic not locked.
+var ErrTopicNotLocked = errors.New("topic not locked")
+
+// ErrLockHolderRunning is returned when the holder of a force-released lock didn't stop in time; the
+// topic is released once it does.
+var ErrLockHolderRunning = errors.New("lock holder cancelled, but not stopped yet")
+
+// errLockCancelled is returned by the operations stopped because their lock was force-released or expired.
+var errLockCancelled = errors.New("cancelled: the topic's lock was force-released or expired")
+
+// LockTopic reserves the topic for a sync; returns nil if it's already locked. The holder describes who
+// locks it (ie: the client's address). The holder of a lock without progress for the TopicLockTTL is
+// cancelled, and the topic can be locked again once it stopped.
+func (s *Server) LockTopic(topic, holder string) *TopicLock {
+	s.lockedTopicsMutex.Lock()
+	defer s.lockedTopicsMutex.Unlock()
+
+	if current := s.lockedTopics[topic]; current != nil {
+		if s.isLockExpired(current) && current.cancelHolder() {
+			log.Printf("lock of topic %q by %s expired without progress for %v, cancelling its holder",
+				topic, current.holder, time.Since(current.lastActive()).Truncate(time.Second))
+		}
+		return nil
+	}
+
+	lock := &TopicLock{
+		topic:     topic,
+		holder:    holder,
+		since:     time.Now(),
+		cancelled: make(chan bool),
+		released:  make(chan bool),
+	}
+	lock.Touch()
+
+	s.lockedTopics[topic] = lock
+	return lock
+}
+
+// UnlockTopic releases a lock returned by LockTopic.
+func (s *Server) UnlockTopic(lock *TopicLock) {
+	s.lockedTopicsMutex.Lock()
+	defer s.lockedTopicsMutex.Unlock()
+
+	if s.lockedTopics[lock.topic] != lock {
+		return
+	}
+
+	delete(s.lockedTopics, lock.topic)
+	close(lock.released)
+
+	if len(s.lockedTopics) == 0 {
+		// no more topics sync'ing, let's GC
+		go func() {
+			log.Print("manual GC...")
+			runtime.GC()
+			log.Print("manual GC finished.")
+		}()
+	}
+}
+
+// ReleaseTopic force-releases the lock of the topic: its holder's operation is cancelled, and waited for
+// up to timeout. It returns ErrTopicNotLocked if the topic is not locked, and ErrLockHolderRunning if
+// the holder didn't stop in time.
+func (s *Server) ReleaseTopic(topic string, timeout time.Duration) error {
+	s.lockedTopicsMutex.Lock()
+	lock := s.lockedTopics[topic]
+	s.lockedTopicsMutex.Unlock()
+
+	if lock == nil {
+		return ErrTopicNotLocked
+	}
+
+	if lock.cancelHolder() {
+		log.Printf("lock of topic %q by %s force-released, cancelling its holder", topic, lock.holder)
+	}
+
+	select {
+	case <-lock.released:
+		return nil
+	case <-time.After(timeout):
+		return ErrLockHolderRunning
+	}
+}
+
+// TopicLocks returns the held topic locks, sorted by topic.
+func (s *Server) TopicLocks() (locks []TopicLockStatus) {
+	s.lockedTopicsMutex.Lock()
+	defer s.lockedTopicsMutex.Unlock()
+
+	locks = make([]TopicLockStatus, 0, len(s.lockedTopics))
+	for topic, lock := range s.lockedTopics {
+		locks = append(locks, TopicLockStatus{
+			Topic:      topic,
+			Holder:     lock.holder,
+			Since:      lock.since,
+			LastActive: lock.lastActive(),
+			Expired:    s.isLockExpired(lock),
+			Cancelled:  isClosed(lock.cancelled),
+		})
+	}
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Topic < locks[j].Topic })
+	return
+}
+
+func (s *Server) isLockExpired(lock *TopicLock) bool {
+	return s.opts.TopicLockTTL != 0 && time.Since(lock.lastActive()) > s.opts.TopicLockTTL
+}
+
+func isClosed(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// isTopicLocked returns true if a sync is running on the topic.
+func (s *Server) isTopicLocked(topic string) bool {
+	s.lockedTopicsMutex.Lock()
+	defer s.lockedTopicsMutex.Unlock()
+
+	return s.lockedTopics[topic] != nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/mcluseau/sync2kafka/backend"
+	"github.com/mcluseau/sync2kafka/client"
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// maxVerifyKeys is the maximum number of discrepancies' keys reported.
+const maxVerifyKeys = 10
+
+// producedSample keeps the hashes of the values of a sample of the keys produced by a sync, to read them
+// back from the topic after it.
+type producedSample struct {
+	percent float64
+	values  map[string]uint64
+}
+
+func newProducedSample(percent float64) *producedSample {
+	return &producedSample{percent: percent, values: map[string]uint64{}}
+}
+
+// add records the produced message if its key is in the sample.
+func (p *producedSample) add(kv syncer.KeyValue) {
+	if p.percent < 100 {
+		h := fnv.New32a()
+		h.Write(kv.Key)
+
+		if float64(h.Sum32()%10000) >= p.percent*100 {
+			return
+		}
+	}
+
+	p.values[string(kv.Key)] = valueHash(kv.Value)
+}
+
+func valueHash(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	return h.Sum64()
+}
+
+// highWaterMarks returns the high water marks of the first partitions of the topic.
+func highWaterMarks(kafka backend.Backend, topic string, partitions int) (offsets []int64, err error) {
+	offsets = make([]int64, partitions)
+
+	for p := range offsets {
+		if _, offsets[p], err = kafka.Offsets(topic, int32(p)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// verifyProduced reads the partitions of the topic from the starts offsets, checking the last value of
+// each sampled key is the produced one.
+func (s *Server) verifyProduced(kafka backend.Backend, topic string, starts []int64, sample *producedSample) (v *client.SyncVerification, err error) {
+	v = &client.SyncVerification{Checked: int64(len(sample.values))}
+	if v.Checked == 0 {
+		return
+	}
+
+	read := make(map[string]uint64, len(sample.values))
+
+	for p, start := range starts {
+		low, end, err := kafka.Offsets(topic, int32(p))
+		if err != nil {
+			return nil, err
+		}
+
+		if start < low {
+			start = low
+		}
+
+		if end <= start {
+			continue
+		}
+
+		err = s.readTopic(kafka, topic, int32(p), start, end, func(msg *backend.Message) error {
+			if _, ok := sample.values[string(msg.Key)]; ok {
+				read[string(msg.Key)] = valueHash(msg.Value)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, hash := range sample.values {
+		readHash, ok := read[key]
+
+		switch {
+		case !ok:
+			v.Missing++
+		case readHash != hash:
+			v.Mismatched++
+		default:
+			continue
+		}
+
+		v.Keys = append(v.Keys, key)
+	}
+
+	sort.Strings(v.Keys)
+	if len(v.Keys) > maxVerifyKeys {
+		v.Keys = v.Keys[:maxVerifyKeys]
+	}
+
+	return
+}
+
+// verificationWarning returns the report of the discrepancies, or "" if none.
+func verificationWarning(v *client.SyncVerification) string {
+	if v == nil || v.Missing+v.Mismatched == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d of the %d verified records were not read back from the topic (%d missing, %d mismatched), ie: %q",
+		v.Missing+v.Mismatched, v.Checked, v.Missing, v.Mismatched, v.Keys)
+}
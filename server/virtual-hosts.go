@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// VirtualHost is the configuration of the clients connecting to a hostname (TLS SNI), so one server
+// can serve several populations of clients. Its settings replace the server's ones when set.
+type VirtualHost struct {
+	// Tokens accepted from the clients, instead of the server's token (topics with tokens still require theirs).
+	Tokens []string `json:"tokens,omitempty"`
+
+	// DefaultTopic is the topic used when the client doesn't specify one.
+	DefaultTopic string `json:"defaultTopic,omitempty"`
+
+	// AllowedTopics are the only topics the clients can sync, with the default topic, instead of the
+	// server's allowed topics. Required with Tokens: a virtual host with tokens only allows its topics.
+	AllowedTopics []string `json:"allowedTopics,omitempty"`
+}
+
+// Validate checks the virtual host's configuration.
+func (v VirtualHost) Validate() error {
+	if len(v.Tokens) != 0 && len(v.AllowedTopics) == 0 && len(v.DefaultTopic) == 0 {
+		return errors.New("tokens require allowedTopics or a defaultTopic")
+	}
+	return nil
+}
+
+// SetVirtualHosts replaces the virtual hosts' configurations.
+func (s *Server) SetVirtualHosts(vhosts map[string]VirtualHost) {
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	s.opts.VirtualHosts = vhosts
+}
+
+// virtualHost returns the configuration of the hostname, if any.
+func (s *Server) virtualHost(hostname string) (vhost *VirtualHost) {
+	if len(hostname) == 0 {
+		return
+	}
+
+	s.optsMutex.Lock()
+	defer s.optsMutex.Unlock()
+
+	if config, ok := s.opts.VirtualHosts[hostname]; ok {
+		vhost = &config
+	}
+	return
+}
+
+func (v *VirtualHost) defaultTopic(serverDefault string) string {
+	if v == nil || len(v.DefaultTopic) == 0 {
+		return serverDefault
+	}
+	return v.DefaultTopic
+}
+
+// isVirtualHostTokenValid returns true if the token allows to sync the topic through the virtual host.
+func (s *Server) isVirtualHostTokenValid(v *VirtualHost, topic, token string) bool {
+	if config, _ := s.topicConfig(topic); v == nil || len(v.Tokens) == 0 || len(config.Tokens) != 0 {
+		return s.isTokenValid(topic, token)
+	}
+
+	for _, allowed := range v.Tokens {
+		if token == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isVirtualHostTopicAllowed returns true if the topic can be synchronized through the virtual host.
+func (s *Server) isVirtualHostTopicAllowed(v *VirtualHost, topic string) bool {
+	if v != nil && len(v.DefaultTopic) != 0 && topic == v.DefaultTopic {
+		return true
+	}
+
+	if v == nil || len(v.AllowedTopics) == 0 && len(v.Tokens) == 0 {
+		return s.IsTopicAllowed(topic)
+	}
+
+	for _, allowed := range v.AllowedTopics {
+		if allowed == topic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serverName returns the hostname requested by the client (TLS SNI), completing the TLS handshake.
+func serverName(conn net.Conn) (name string, err error) {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err = c.Handshake(); err != nil {
+			return
+		}
+		name = c.ConnectionState().ServerName
+
+	case remoteConn:
+		name = c.serverName
+	}
+	return
+}
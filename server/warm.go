@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// warmIndexes keeps the stored indexes of the warm topics up to date, so their syncs only read the
+// records produced since the last round.
+func (s *Server) warmIndexes(ctx context.Context) {
+	if !s.hasStore() {
+		log.Print("warm topics: no store, their indexes can't be kept")
+		return
+	}
+
+	ticker := time.NewTicker(s.opts.WarmInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, topic := range s.opts.WarmTopics {
+			if ctx.Err() != nil {
+				return
+			}
+
+			s.warmIndex(topic)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmIndex updates the stored index of the topic, unless a sync is using it.
+func (s *Server) warmIndex(topic string) {
+	if s.isTopicLocked(topic) {
+		return // the sync updates the index
+	}
+
+	if err := s.IndexTopic(topic); err != nil {
+		log.Printf("warm topics: failed to index topic %s: %v", topic, err)
+	}
+}
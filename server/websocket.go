@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler returns an HTTP handler accepting syncs over WebSocket, for browsers and clients
+// limited to HTTP. The messages are the same as over TCP, in binary frames; the frames don't need to
+// match the messages' boundaries. Any origin is accepted since syncs are authenticated by their token.
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+
+			// report the client instead of the WebSocket origin
+			conn := remoteConn{Conn: ws, remote: remoteAddr{"websocket", ws.Request().RemoteAddr}}
+			if tls := ws.Request().TLS; tls != nil {
+				conn.serverName = tls.ServerName
+			}
+
+			s.connHandler(conn)
+		},
+	}
+}
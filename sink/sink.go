@@ -0,0 +1,32 @@
+// Package sink defines the interface of the connectors the syncs write to, and their registry.
+//
+// The sinks are the Kafka backends: a sync reads the current state of the target topic from its sink
+// before writing the changes to it. A sink registers itself by name in its package's init function, is
+// compiled in sync2kafka or loaded from a Go plugin (see the -plugin flag), and selected with the
+// -kafka-backend flag.
+package sink
+
+import (
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+// Sink stores the topics written by the syncs.
+type Sink = backend.Backend
+
+// Factory creates a sink connected to the given brokers.
+type Factory = backend.Factory
+
+// Register makes a sink available by name. It panics if the name is already registered.
+func Register(name string, factory Factory) {
+	backend.Register(name, factory)
+}
+
+// New creates a sink by name.
+func New(name string, brokers []string, config backend.Config) (Sink, error) {
+	return backend.New(name, brokers, config)
+}
+
+// Names returns the registered sinks' names, sorted.
+func Names() []string {
+	return backend.Names()
+}
@@ -0,0 +1,72 @@
+// Package source defines the interface of the connectors reading datasets to sync, and their registry.
+//
+// A connector registers itself by name in its package's init function. It is either compiled in
+// sync2kafka by adding a blank import of its package to a file of cmd/sync2kafka, or built as a Go
+// plugin (go build -buildmode=plugin) loaded with the -plugin flag, without changing this repository.
+// It is enabled with the -source flag. The mongo and ldap sources are built-in.
+package source
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mcluseau/sync2kafka/syncer"
+)
+
+// KeyValue is a record of the dataset.
+type KeyValue = syncer.KeyValue
+
+// Source reads the full dataset of a topic.
+type Source interface {
+	// Fill sends all the records of the dataset to out, without closing it. On error, the sync is
+	// cancelled so no deletion is done from a partial dataset.
+	Fill(out chan<- KeyValue) error
+}
+
+// Factory creates a source from its parameters.
+type Factory func(params map[string]string) (Source, error)
+
+var (
+	factories      = map[string]Factory{}
+	factoriesMutex sync.Mutex
+)
+
+// Register makes a source available by name. It panics if the name is already registered.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("source %q registered twice", name))
+	}
+
+	factories[name] = factory
+}
+
+// New creates a source by name.
+func New(name string, params map[string]string) (Source, error) {
+	factoriesMutex.Lock()
+	factory, ok := factories[name]
+	factoriesMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown source %q", name)
+	}
+
+	return factory(params)
+}
+
+// Names returns the registered sources' names, sorted.
+func Names() (names []string) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	names = make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,330 @@
+package syncer
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	diff "github.com/mcluseau/go-diff"
+	kafkasync "github.com/mcluseau/kafka-sync"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+// KeyPartition returns the partition of a key among partitions, as chosen by the hash partitioners of
+// sarama and kafka-go (FNV-1a).
+func KeyPartition(key []byte, partitions int) int32 {
+	h := fnv.New32a()
+	h.Write(key)
+
+	partition := int32(h.Sum32()) % int32(partitions)
+	if partition < 0 {
+		partition = -partition
+	}
+
+	return partition
+}
+
+// SyncPartitions synchronizes a data source with all the partitions of the topic in parallel: partition
+// p is indexed in indexes[p], and has its own diff and producer. The records are dispatched to the
+// partition of their key (KeyPartition), so the topic must only be produced with the hash partitioner.
+// MaxDeletePercent applies to each partition, and no partition deletes anything if one has too many
+// deletions. OnSend, OnProduce and OnChange are not called concurrently.
+//
+// The partitions are all indexed before the source is read, so it's still unread on ErrIndexInvalid.
+func (s Syncer) SyncPartitions(kafka backend.Backend, kvSource <-chan KeyValue, indexes []diff.Index, cancel <-chan bool) (stats *Stats, err error) {
+	stats = kafkasync.NewStats()
+
+	if s.Progress == nil {
+		s.Progress = &Progress{}
+	}
+
+	defer s.Progress.setPhase(PhaseDone)
+
+	s.serializeCallbacks()
+
+	count := len(indexes)
+	partitions := make([]Syncer, count)
+	partStats := make([]*Stats, count)
+	errs := make([]error, count)
+
+	deletions := newDeletionBarrier(count)
+
+	for p := range partitions {
+		ps := s
+		ps.Partition = int32(p)
+		ps.deletions = deletions
+		ps.Progress = &Progress{}
+
+		partitions[p] = ps
+		partStats[p] = kafkasync.NewStats()
+	}
+
+	s.Progress.setPhase(PhaseIndexing)
+
+	parallel(count, func(p int) {
+		partStats[p].MessagesInTopic, errs[p] = partitions[p].IndexTopic(kafka, indexes[p])
+	})
+
+	for p := range partitions {
+		stats.MessagesInTopic += partStats[p].MessagesInTopic
+		s.Progress.TopicMessages += partitions[p].Progress.TopicMessages
+		s.Progress.topicRead(s.Progress.TopicMessagesRead + partitions[p].Progress.TopicMessagesRead)
+	}
+
+	if err = firstError(errs); err != nil {
+		return
+	}
+
+	stats.ReadTopicDuration = stats.Elapsed()
+	startSyncTime := time.Now()
+
+	s.Progress.setPhase(PhaseDiffing)
+
+	// stop all the partitions on cancel, or when one fails
+	stop := make(chan bool)
+	stopOnce := sync.Once{}
+	stopAll := func() { stopOnce.Do(func() { close(stop) }) }
+
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		select {
+		case <-cancel:
+			stopAll()
+		case <-done:
+		}
+	}()
+
+	sources := make([]chan KeyValue, count)
+	for p := range sources {
+		sources[p] = make(chan KeyValue, 10)
+	}
+
+	go s.dispatch(kvSource, sources, stop)
+
+	parallel(count, func(p int) {
+		if errs[p] = partitions[p].syncWithPrepopulatedIndex(kafka, sources[p], indexes[p], partStats[p], stop); errs[p] != nil {
+			stopAll()
+		}
+
+		// if it failed before diffing
+		deletions.diffed(int32(p))
+		deletions.counted(int32(p), true)
+	})
+
+	for p, ps := range partitions {
+		addStats(stats, partStats[p])
+		s.Progress.addPartition(ps.Progress)
+	}
+
+	stats.SyncDuration = time.Since(startSyncTime)
+	stats.TotalDuration = stats.Elapsed()
+
+	err = firstError(errs)
+	return
+}
+
+// deletionBarrier makes parallel partitions stream their deletions one at a time, once they're all
+// diffed. The keys streamed by a bolt index are only valid in its read transaction, but it buffers some
+// after; they're invalid if the store is remapped by a write, so nothing must be written meanwhile.
+//
+// With a MaxDeletePercent, the partitions count their deletions first, and only delete if they're all
+// allowed.
+type deletionBarrier struct {
+	diffing sync.WaitGroup
+	mutex   sync.Mutex
+	done    []sync.Once
+
+	counting    sync.WaitGroup
+	countedDone []sync.Once
+	refused     int32 // atomic
+}
+
+func newDeletionBarrier(partitions int) *deletionBarrier {
+	b := &deletionBarrier{
+		done:        make([]sync.Once, partitions),
+		countedDone: make([]sync.Once, partitions),
+	}
+	b.diffing.Add(partitions)
+	b.counting.Add(partitions)
+	return b
+}
+
+// counted tells the partition's deletions were counted, and if they're allowed. Only the first call
+// of a partition counts; the partitions not deleting anything, stopped or not, call it with true.
+func (b *deletionBarrier) counted(partition int32, allowed bool) {
+	if b == nil {
+		return
+	}
+
+	b.countedDone[partition].Do(func() {
+		if !allowed {
+			atomic.StoreInt32(&b.refused, 1)
+		}
+		b.counting.Done()
+	})
+}
+
+// allAllowed waits for all the partitions to count their deletions, and returns true if they're all allowed.
+func (b *deletionBarrier) allAllowed() bool {
+	if b == nil {
+		return true
+	}
+
+	b.counting.Wait()
+	return atomic.LoadInt32(&b.refused) == 0
+}
+
+// diffed tells the partition's diff ended, stopped or not. It can be called many times.
+func (b *deletionBarrier) diffed(partition int32) {
+	if b == nil {
+		return
+	}
+
+	b.done[partition].Do(b.diffing.Done)
+}
+
+// lock waits for all the partitions to be diffed, and for the other partitions' deletions. The
+// partitions must check if they were stopped meanwhile.
+func (b *deletionBarrier) lock() {
+	if b == nil {
+		return
+	}
+
+	b.diffing.Wait()
+	b.mutex.Lock()
+}
+
+func (b *deletionBarrier) unlock() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Unlock()
+}
+
+// serializeCallbacks makes the calls of OnSend, OnProduce and OnChange exclusive, for the parallel partitions.
+func (s *Syncer) serializeCallbacks() {
+	mutex := &sync.Mutex{}
+
+	if onSend := s.OnSend; onSend != nil {
+		s.OnSend = func(d time.Duration) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			onSend(d)
+		}
+	}
+
+	if onProduce := s.OnProduce; onProduce != nil {
+		s.OnProduce = func(kv KeyValue) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			onProduce(kv)
+		}
+	}
+
+	if onChange := s.OnChange; onChange != nil {
+		s.OnChange = func(t diff.ChangeType, kv KeyValue) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			onChange(t, kv)
+		}
+	}
+}
+
+// dispatch sends the records of the source to the partition of their key. The partitions' sources are
+// closed at the end of the source, but not when stopped, so a partial source is never diffed to the end.
+func (s Syncer) dispatch(kvSource <-chan KeyValue, sources []chan KeyValue, stop <-chan bool) {
+	for {
+		var (
+			kv KeyValue
+			ok bool
+		)
+
+		select {
+		case <-stop:
+			return
+
+		case kv, ok = <-kvSource:
+		}
+
+		if !ok {
+			break
+		}
+
+		s.Progress.RecordsDiffed++
+
+		select {
+		case <-stop:
+			return
+
+		case sources[KeyPartition(kv.Key, len(sources))] <- kv:
+		}
+	}
+
+	for _, source := range sources {
+		close(source)
+	}
+}
+
+// addPartition adds the progress of a partition's sync, once finished. The partitions run in parallel,
+// so the longest of their phases is kept.
+func (p *Progress) addPartition(part *Progress) {
+	p.RecordsProduced += part.RecordsProduced
+	p.DeletesEmitted += part.DeletesEmitted
+	p.SendDuration += part.SendDuration
+	p.ProduceRetries += part.ProduceRetries
+	p.ProduceSkipped += part.ProduceSkipped
+
+	p.DiffDuration = maxDuration(p.DiffDuration, part.DiffDuration)
+	p.DeleteDuration = maxDuration(p.DeleteDuration, part.DeleteDuration)
+	p.FlushDuration = maxDuration(p.FlushDuration, part.FlushDuration)
+
+	// the phases were measured by the partitions
+	p.phaseStart = time.Time{}
+}
+
+func addStats(stats, part *Stats) {
+	stats.Created += part.Created
+	stats.Modified += part.Modified
+	stats.Deleted += part.Deleted
+	stats.Unchanged += part.Unchanged
+	stats.SendCount += part.SendCount
+	stats.SuccessCount += part.SuccessCount
+	stats.ErrorCount += part.ErrorCount
+	stats.Count += part.Count
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// parallel calls fn for 0 to count-1 in parallel, and waits for them.
+func parallel(count int, fn func(int)) {
+	wg := sync.WaitGroup{}
+	wg.Add(count)
+
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package syncer
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+// Produce error policies.
+const (
+	// ProduceErrorsFail fails the sync once all the messages were sent, if some failed.
+	ProduceErrorsFail = ""
+	// ProduceErrorsRetry sends the failed messages again once all the messages were sent, up to
+	// ProduceRetries times, and fails the sync if some still failed.
+	ProduceErrorsRetry = "retry"
+	// ProduceErrorsAbort stops the sync on the first failed message.
+	ProduceErrorsAbort = "abort"
+	// ProduceErrorsSkip ignores the failed messages.
+	ProduceErrorsSkip = "skip"
+)
+
+// produceErrors collects the failed messages of a producer, if it tells which they are.
+type produceErrors struct {
+	policy string
+
+	failed   []*backend.Message
+	firstErr error
+	mutex    sync.Mutex
+
+	aborted   chan bool
+	abortOnce sync.Once
+}
+
+func (s Syncer) watchProduceErrors(producer backend.Producer) *produceErrors {
+	pe := &produceErrors{policy: s.ProduceErrorPolicy, aborted: make(chan bool)}
+
+	if n, ok := producer.(backend.ErrorNotifier); ok {
+		n.NotifyErrors(pe.onError)
+	}
+
+	return pe
+}
+
+func (pe *produceErrors) onError(msg *backend.Message, err error) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	if pe.firstErr == nil {
+		pe.firstErr = err
+	}
+
+	switch pe.policy {
+	case ProduceErrorsRetry:
+		pe.failed = append(pe.failed, msg)
+
+	case ProduceErrorsAbort:
+		pe.abortOnce.Do(func() { close(pe.aborted) })
+	}
+}
+
+// isAborted returns true if a message failed with ProduceErrorsAbort.
+func (pe *produceErrors) isAborted() bool {
+	select {
+	case <-pe.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryFailed sends the failed messages again with new producers, waiting ProduceRetryBackoff before
+// the first attempt and doubling it for each next one, until they are delivered or ProduceRetries is
+// reached. The messages of a sync have distinct keys, so their order doesn't matter.
+func (s Syncer) retryFailed(kafka backend.Backend, pe *produceErrors, stats *Stats) {
+	failed := pe.failed
+	backoff := s.ProduceRetryBackoff
+
+	for attempt := 1; attempt <= s.ProduceRetries && len(failed) != 0; attempt++ {
+		log.Printf("syncer: retrying %d messages to topic %s in %v (attempt %d/%d)", len(failed), s.produceTopic(), backoff, attempt, s.ProduceRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		producer, err := kafka.NewProducer()
+		if err != nil {
+			log.Printf("syncer: failed to create a producer to retry: %v", err)
+			continue
+		}
+
+		retry := s.watchProduceErrors(producer)
+
+		for _, msg := range failed {
+			producer.Send(msg)
+		}
+
+		atomic.AddInt64(&s.Progress.ProduceRetries, int64(len(failed)))
+
+		successes, errors := producer.Close()
+		stats.SuccessCount += successes
+		stats.ErrorCount = errors
+
+		failed = retry.failed
+	}
+}
@@ -0,0 +1,80 @@
+package syncer
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+// producerPool sends messages through parallel producers. A key is always sent by the same producer,
+// so the messages of a key keep their order.
+type producerPool struct {
+	producers []backend.Producer
+	inputs    []chan *backend.Message
+	wg        sync.WaitGroup
+}
+
+var _ backend.Producer = &producerPool{}
+
+func newProducerPool(kafka backend.Backend, size int) (pool *producerPool, err error) {
+	pool = &producerPool{
+		producers: make([]backend.Producer, 0, size),
+		inputs:    make([]chan *backend.Message, 0, size),
+	}
+
+	for i := 0; i < size; i++ {
+		var producer backend.Producer
+		if producer, err = kafka.NewProducer(); err != nil {
+			pool.Close()
+			return nil, err
+		}
+
+		input := make(chan *backend.Message, 100)
+
+		pool.producers = append(pool.producers, producer)
+		pool.inputs = append(pool.inputs, input)
+
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for msg := range input {
+				producer.Send(msg)
+			}
+		}()
+	}
+
+	return
+}
+
+// NotifyErrors sets the error function of the producers implementing backend.ErrorNotifier.
+func (p *producerPool) NotifyErrors(onError func(*backend.Message, error)) {
+	for _, producer := range p.producers {
+		if n, ok := producer.(backend.ErrorNotifier); ok {
+			n.NotifyErrors(onError)
+		}
+	}
+}
+
+func (p *producerPool) Send(msg *backend.Message) {
+	h := fnv.New32a()
+	h.Write(msg.Key)
+
+	p.inputs[int(h.Sum32()%uint32(len(p.inputs)))] <- msg
+}
+
+func (p *producerPool) Close() (successes, errors int64) {
+	for _, input := range p.inputs {
+		close(input)
+	}
+
+	p.wg.Wait()
+
+	for _, producer := range p.producers {
+		s, e := producer.Close()
+		successes += s
+		errors += e
+	}
+
+	return
+}
@@ -0,0 +1,706 @@
+// Package syncer synchronizes a key-indexed data source with a topic, through any Kafka backend.
+//
+// It follows the github.com/mcluseau/kafka-sync API, with a backend.Backend instead of a sarama client.
+package syncer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	diff "github.com/mcluseau/go-diff"
+	kafkasync "github.com/mcluseau/kafka-sync"
+
+	"github.com/mcluseau/sync2kafka/backend"
+)
+
+const indexBatchSize = 500
+
+type Stats = kafkasync.Stats
+
+// KeyValue is a record to synchronize.
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+
+	// Timestamp of the record (optional; the producer's time if zero)
+	Timestamp time.Time
+
+	// ExpiresAt is the time the record expires, produced in the ExpiryHeader (optional; no header if zero)
+	ExpiresAt time.Time
+}
+
+// ExpiryHeader is the header of the records giving the time they expire at, in RFC3339.
+const ExpiryHeader = "expires-at"
+
+// Headers returns the headers of the record to produce.
+func (kv KeyValue) Headers() (headers []backend.Header) {
+	if !kv.ExpiresAt.IsZero() {
+		headers = append(headers, backend.Header{
+			Key:   []byte(ExpiryHeader),
+			Value: []byte(kv.ExpiresAt.UTC().Format(time.RFC3339)),
+		})
+	}
+	return
+}
+
+// ErrReadTimeout is returned when the topic is not read up to its high water mark in time.
+var ErrReadTimeout = errors.New("timed out while waiting for kafka message")
+
+// ErrIndexInvalid is returned when the index's resume key is out of the topic's offsets: the topic was
+// recreated, or records were removed before being indexed. The index must be rebuilt from scratch.
+var ErrIndexInvalid = errors.New("index resume key is out of the topic's offsets")
+
+type Syncer struct {
+	// The topic to synchronize.
+	Topic string
+
+	// The topic's partition to synchronize.
+	Partition int32
+
+	// ProduceTopic receives the changes instead of Topic, if set (ie: to validate them before applying them).
+	ProduceTopic string
+
+	// The value to use when a key is removed.
+	RemovedValue []byte
+
+	// The maximum time to wait for a message when reading the topic.
+	ReadTimeout time.Duration
+
+	// OnSend is called with the time taken to hand each message to the producer (optional).
+	OnSend func(time.Duration)
+
+	// OnProduce is called with each message handed to the producer, deletions included (optional).
+	OnProduce func(KeyValue)
+
+	// OnChange is called with each change handed to the producer, diff.Created, diff.Modified or
+	// diff.Deleted, and its record before Wrap (optional).
+	OnChange func(diff.ChangeType, KeyValue)
+
+	// Wrap returns the value to produce for a created or modified record, if set (ie: an envelope with
+	// metadata). Unwrap must then return the record's value from a produced one, so the index compares
+	// the values only.
+	Wrap   func(KeyValue) []byte
+	Unwrap func(value []byte) []byte
+
+	// Sorted buffers the changes to produce them sorted by key, after the whole source is read.
+	Sorted bool
+
+	// ProduceUnchanged produces the unchanged records too, still counted as unchanged (ie: to move them
+	// to the partition their key hashes to after the topic's partitions changed).
+	ProduceUnchanged bool
+
+	// Release is called with the records the syncer doesn't need anymore, so their buffers can be
+	// reused (optional). Records sent to Kafka are not released, as producers keep them until delivered.
+	Release func(KeyValue)
+
+	// ProduceWorkers is the number of parallel producers. The messages of a key are always sent by
+	// the same producer, keeping their order. Ignored when Sorted is set.
+	ProduceWorkers int
+
+	// MaxDeletePercent is the maximum percentage of the topic's keys a sync can delete (no limit if 0).
+	// Above, the sync fails with a TooManyDeletionsError before sending any deletion.
+	MaxDeletePercent float64
+
+	// Progress is updated as the sync advances, for monitoring (optional).
+	Progress *Progress
+
+	// OnProgress is called as the sync advances: for each batch of indexed messages, each diffed record
+	// and each message handed to the producer (optional). SyncPartitions calls it concurrently.
+	OnProgress func()
+
+	// ProduceErrorPolicy is what to do with the messages that failed to be produced (ProduceErrorsFail
+	// by default). The failed messages are only known to the producers implementing
+	// backend.ErrorNotifier; with other producers, the retry and abort policies fail the sync.
+	ProduceErrorPolicy string
+
+	// ProduceRetries is the maximum number of retries of the failed messages with ProduceErrorsRetry.
+	ProduceRetries int
+
+	// ProduceRetryBackoff is the delay before the first retry, doubled for each next one.
+	ProduceRetryBackoff time.Duration
+
+	// deletions synchronizes the deletions of parallel partitions (optional).
+	deletions *deletionBarrier
+}
+
+// Phases of a sync.
+const (
+	// PhaseIndexing reads the topic up to its high water mark to update the index.
+	PhaseIndexing = "indexing"
+	// PhaseDiffing compares the source's records to the index, producing the changes.
+	PhaseDiffing = "diffing"
+	// PhaseDeleting produces the deletions of the keys not in the source.
+	PhaseDeleting = "deleting"
+	// PhaseFlushing waits for the producer to deliver the messages.
+	PhaseFlushing = "flushing"
+	// PhaseDone is set when the sync ended.
+	PhaseDone = "done"
+)
+
+// Progress of a sync.
+type Progress struct {
+	Phase string
+
+	// TopicMessages is the number of messages to read from the topic to update the index, of which
+	// TopicMessagesRead were read (TopicReadPercent).
+	TopicMessages     int64
+	TopicMessagesRead int64
+	TopicReadPercent  float64
+
+	// RecordsDiffed is the number of source records compared to the index.
+	RecordsDiffed int64
+
+	// RecordsProduced is the number of messages handed to the producer, including the DeletesEmitted.
+	RecordsProduced int64
+	DeletesEmitted  int64
+
+	// Durations of the phases, and total time taken to hand the messages to the producer.
+	IndexDuration  time.Duration
+	DiffDuration   time.Duration
+	DeleteDuration time.Duration
+	FlushDuration  time.Duration
+	SendDuration   time.Duration
+
+	// ProduceRetries is the number of messages sent again after failing, ProduceSkipped the number of
+	// failed messages ignored.
+	ProduceRetries int64
+	ProduceSkipped int64
+
+	phaseStart time.Time
+}
+
+// setPhase ends the current phase, adding its duration, and starts the next one.
+func (p *Progress) setPhase(phase string) {
+	now := time.Now()
+
+	if !p.phaseStart.IsZero() {
+		d := now.Sub(p.phaseStart)
+
+		switch p.Phase {
+		case PhaseIndexing:
+			p.IndexDuration += d
+		case PhaseDiffing:
+			p.DiffDuration += d
+		case PhaseDeleting:
+			p.DeleteDuration += d
+		case PhaseFlushing:
+			p.FlushDuration += d
+		}
+	}
+
+	p.Phase = phase
+	p.phaseStart = now
+}
+
+func (p *Progress) topicRead(count int64) {
+	p.TopicMessagesRead = count
+	if p.TopicMessages != 0 {
+		p.TopicReadPercent = 100 * float64(count) / float64(p.TopicMessages)
+	}
+}
+
+// TooManyDeletionsError is returned when a sync would delete more than MaxDeletePercent of the topic's keys.
+type TooManyDeletionsError struct {
+	Deletions        int64
+	ExistingKeys     int64
+	MaxDeletePercent float64
+}
+
+func (e *TooManyDeletionsError) Error() string {
+	return fmt.Sprintf("refusing to delete %d of the %d keys of the topic (%.1f%%), more than %g%%",
+		e.Deletions, e.ExistingKeys, 100*float64(e.Deletions)/float64(e.ExistingKeys), e.MaxDeletePercent)
+}
+
+func New(topic string) Syncer {
+	return Syncer{
+		Topic:        topic,
+		Partition:    0,
+		RemovedValue: []byte{},
+		ReadTimeout:  10 * time.Second,
+	}
+}
+
+// SyncWithIndex synchronize a data source with a topic, using the given index.
+//
+// The kvSource channel provides values in the reference store. It MUST NOT produce duplicate keys.
+func (s Syncer) SyncWithIndex(kafka backend.Backend, kvSource <-chan KeyValue, topicIndex diff.Index, cancel <-chan bool) (stats *Stats, err error) {
+	stats = kafkasync.NewStats()
+
+	if s.Progress == nil {
+		s.Progress = &Progress{}
+	}
+
+	defer s.Progress.setPhase(PhaseDone)
+
+	msgCount, err := s.IndexTopic(kafka, topicIndex)
+	if err != nil {
+		return
+	}
+
+	stats.MessagesInTopic = msgCount
+	stats.ReadTopicDuration = stats.Elapsed()
+
+	err = s.syncWithPrepopulatedIndex(kafka, kvSource, topicIndex, stats, cancel)
+	return
+}
+
+func (s Syncer) syncWithPrepopulatedIndex(kafka backend.Backend, kvSource <-chan KeyValue, topicIndex diff.Index, stats *Stats, cancel <-chan bool) (err error) {
+	producer, err := s.newProducer(kafka)
+	if err != nil {
+		return
+	}
+
+	startSyncTime := time.Now()
+	s.Progress.setPhase(PhaseDiffing)
+
+	produceErrors := s.watchProduceErrors(producer)
+
+	// stop on cancel, or on the first produce error with ProduceErrorsAbort
+	stop := make(chan bool)
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		select {
+		case <-cancel:
+		case <-produceErrors.aborted:
+		case <-done:
+		}
+		close(stop)
+	}()
+
+	changes := make(chan change, 10)
+	diffErr := make(chan error, 1)
+	go func() {
+		defer close(changes)
+		diffErr <- s.diffStreamIndex(kvSource, topicIndex, changes, stop)
+	}()
+
+	if s.Sorted {
+		changes = sortChanges(changes)
+	}
+
+	s.applyChanges(changes, func(kv KeyValue) {
+		sendStart := time.Now()
+
+		producer.Send(&backend.Message{
+			Topic:     s.produceTopic(),
+			Partition: s.Partition,
+			Key:       kv.Key,
+			Value:     kv.Value,
+			Timestamp: kv.Timestamp,
+			Headers:   kv.Headers(),
+		})
+		stats.SendCount++
+
+		sendDuration := time.Since(sendStart)
+		s.Progress.RecordsProduced++
+		s.progressed()
+		s.Progress.SendDuration += sendDuration
+
+		if s.OnSend != nil {
+			s.OnSend(sendDuration)
+		}
+
+		if s.OnProduce != nil {
+			s.OnProduce(kv)
+		}
+	}, stats, stop)
+
+	// unblock the diff if we were cancelled
+	go func() {
+		for range changes {
+		}
+	}()
+
+	// the diff returns once stopped
+	err = <-diffErr
+
+	s.Progress.setPhase(PhaseFlushing)
+	stats.SuccessCount, stats.ErrorCount = producer.Close()
+
+	if stats.ErrorCount != 0 {
+		switch s.ProduceErrorPolicy {
+		case ProduceErrorsRetry:
+			s.retryFailed(kafka, produceErrors, stats)
+
+		case ProduceErrorsSkip:
+			log.Printf("syncer: skipping %d messages that failed to be produced to topic %s", stats.ErrorCount, s.produceTopic())
+			s.Progress.ProduceSkipped = stats.ErrorCount
+		}
+	}
+
+	stats.SyncDuration = time.Since(startSyncTime)
+	stats.TotalDuration = stats.Elapsed()
+
+	if produceErrors.isAborted() {
+		return fmt.Errorf("sync aborted on produce error: %v", produceErrors.firstErr)
+	}
+
+	if err == nil && stats.ErrorCount != 0 && s.ProduceErrorPolicy != ProduceErrorsSkip {
+		err = fmt.Errorf("%d messages failed to be produced", stats.ErrorCount)
+	}
+
+	return
+}
+
+func (s Syncer) produceTopic() string {
+	if len(s.ProduceTopic) != 0 {
+		return s.ProduceTopic
+	}
+	return s.Topic
+}
+
+func (s Syncer) newProducer(kafka backend.Backend) (backend.Producer, error) {
+	if s.Sorted || s.ProduceWorkers <= 1 {
+		return kafka.NewProducer()
+	}
+
+	return newProducerPool(kafka, s.ProduceWorkers)
+}
+
+// change is a diff.Change keeping the record's metadata.
+type change struct {
+	Type diff.ChangeType
+	KeyValue
+}
+
+// diffStreamIndex is diff.DiffStreamIndex keeping the record's metadata. Unchanged records are released.
+func (s Syncer) diffStreamIndex(referenceValues <-chan KeyValue, currentIndex diff.Index, changes chan<- change, cancel <-chan bool) error {
+	existingSeen := int64(0)
+
+	defer s.deletions.diffed(s.Partition)
+	defer s.deletions.counted(s.Partition, true)
+
+	for {
+		var (
+			kv KeyValue
+			ok bool
+		)
+
+		select {
+		case <-cancel:
+			return nil
+
+		case kv, ok = <-referenceValues:
+		}
+
+		if !ok {
+			break
+		}
+
+		s.Progress.RecordsDiffed++
+		s.progressed()
+
+		cmp, err := currentIndex.Compare(diff.KeyValue{Key: kv.Key, Value: kv.Value})
+		if err != nil {
+			return err
+		}
+
+		switch cmp {
+		case diff.MissingKey:
+			changes <- change{Type: diff.Created, KeyValue: kv}
+
+		case diff.ModifiedKey:
+			existingSeen++
+			changes <- change{Type: diff.Modified, KeyValue: kv}
+
+		case diff.UnchangedKey:
+			existingSeen++
+
+			if s.ProduceUnchanged {
+				changes <- change{Type: diff.Unchanged, KeyValue: kv}
+				continue
+			}
+
+			changes <- change{Type: diff.Unchanged}
+
+			if s.Release != nil {
+				s.Release(kv)
+			}
+		}
+	}
+
+	s.deletions.diffed(s.Partition)
+	s.deletions.lock()
+	defer s.deletions.unlock()
+
+	select {
+	case <-cancel:
+		return nil // another partition failed
+	default:
+	}
+
+	keysNotSeen := currentIndex.KeysNotSeen()
+	if keysNotSeen == nil {
+		// not supported by the index
+		return nil
+	}
+
+	s.Progress.setPhase(PhaseDeleting)
+
+	// the keys may be only valid until the next one is read (ie: in a bolt transaction), and they're
+	// kept by the producer until delivered.
+	if s.MaxDeletePercent == 0 {
+		for key := range keysNotSeen {
+			changes <- change{Type: diff.Deleted, KeyValue: KeyValue{Key: copyBytes(key)}}
+		}
+
+		return nil
+	}
+
+	// buffer the deletions until we know their count; no more than the allowed deletions are kept,
+	// but the keys are all read to release the index.
+	deletions := make([][]byte, 0)
+	deletionsCount := int64(0)
+
+	for key := range keysNotSeen {
+		deletionsCount++
+
+		if s.isDeletionAllowed(deletionsCount, existingSeen) {
+			deletions = append(deletions, copyBytes(key))
+		}
+	}
+
+	allowed := s.isDeletionAllowed(deletionsCount, existingSeen)
+
+	// no partition deletes anything if one has too many deletions
+	s.deletions.unlock()
+	s.deletions.counted(s.Partition, allowed)
+	allAllowed := s.deletions.allAllowed()
+	s.deletions.lock()
+
+	if !allowed {
+		return &TooManyDeletionsError{
+			Deletions:        deletionsCount,
+			ExistingKeys:     existingSeen + deletionsCount,
+			MaxDeletePercent: s.MaxDeletePercent,
+		}
+	}
+
+	if !allAllowed {
+		return nil // another partition failed
+	}
+
+	select {
+	case <-cancel:
+		return nil
+	default:
+	}
+
+	for _, key := range deletions {
+		changes <- change{Type: diff.Deleted, KeyValue: KeyValue{Key: key}}
+	}
+
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// isDeletionAllowed returns true if deleting deletions keys, keeping kept keys, is within MaxDeletePercent.
+func (s Syncer) isDeletionAllowed(deletions, kept int64) bool {
+	return s.MaxDeletePercent == 0 || float64(deletions) <= s.MaxDeletePercent/100*float64(deletions+kept)
+}
+
+// sortChanges buffers all the changes and streams them back sorted by key.
+func sortChanges(changes <-chan change) chan change {
+	sorted := make(chan change, 10)
+
+	go func() {
+		defer close(sorted)
+
+		buffer := make([]change, 0)
+		for c := range changes {
+			buffer = append(buffer, c)
+		}
+
+		sort.SliceStable(buffer, func(i, j int) bool { return bytes.Compare(buffer[i].Key, buffer[j].Key) < 0 })
+
+		for _, c := range buffer {
+			sorted <- c
+		}
+	}()
+
+	return sorted
+}
+
+// applyChanges sends the changes, updating the stats.
+func (s Syncer) applyChanges(changes <-chan change, send func(KeyValue), stats *Stats, cancel <-chan bool) {
+	for {
+		var (
+			change change
+			ok     bool
+		)
+
+		select {
+		case <-cancel:
+			return
+
+		case change, ok = <-changes:
+			if !ok {
+				return
+			}
+		}
+
+		switch change.Type {
+		case diff.Deleted:
+			send(KeyValue{Key: change.Key, Value: s.RemovedValue})
+			stats.Deleted++
+			s.Progress.DeletesEmitted++
+
+		case diff.Unchanged:
+			if change.Key != nil { // ProduceUnchanged
+				send(s.wrap(change.KeyValue))
+			}
+
+			stats.Unchanged++
+			stats.Count++
+			continue
+
+		case diff.Created:
+			send(s.wrap(change.KeyValue))
+			stats.Created++
+			stats.Count++
+
+		case diff.Modified:
+			send(s.wrap(change.KeyValue))
+			stats.Modified++
+			stats.Count++
+		}
+
+		if s.OnChange != nil {
+			s.OnChange(change.Type, change.KeyValue)
+		}
+	}
+}
+
+func (s Syncer) progressed() {
+	if s.OnProgress != nil {
+		s.OnProgress()
+	}
+}
+
+// wrap returns the record with the value to produce.
+func (s Syncer) wrap(kv KeyValue) KeyValue {
+	if s.Wrap != nil {
+		kv.Value = s.Wrap(kv)
+	}
+	return kv
+}
+
+// IndexTopic indexes the topic from the index's resume key up to the current high water mark.
+func (s Syncer) IndexTopic(kafka backend.Backend, index diff.Indexer) (msgCount uint64, err error) {
+	if s.Progress == nil {
+		s.Progress = &Progress{}
+	}
+
+	s.Progress.setPhase(PhaseIndexing)
+
+	lowWater, highWater, err := kafka.Offsets(s.Topic, s.Partition)
+	if err != nil {
+		return
+	}
+
+	resumeKey, err := index.ResumeKey()
+	if err != nil {
+		return
+	}
+
+	offset := lowWater
+	if resumeKey != nil {
+		if _, err = fmt.Fscanf(bytes.NewBuffer(resumeKey), "%x", &offset); err != nil {
+			return
+		}
+
+		offset++
+
+		if offset > highWater || offset < lowWater {
+			return 0, ErrIndexInvalid
+		}
+
+		if offset == highWater {
+			return // up-to-date
+		}
+	}
+
+	if highWater == 0 || lowWater == highWater {
+		return // topic is empty
+	}
+
+	s.Progress.TopicMessages = highWater - offset
+
+	consumer, err := kafka.Consume(s.Topic, s.Partition, offset)
+	if err != nil {
+		return
+	}
+
+	defer consumer.Close()
+
+	batch := make([]diff.KeyValue, 0, indexBatchSize)
+	lastOffset := int64(-1)
+
+	saveBatch := func() error {
+		kvs := make(chan diff.KeyValue, len(batch))
+		for _, kv := range batch {
+			kvs <- kv
+		}
+		close(kvs)
+
+		resumeKeyCh := make(chan []byte, 1)
+		resumeKeyCh <- []byte(fmt.Sprintf("%16x", lastOffset))
+
+		batch = batch[:0]
+		s.progressed()
+
+		return index.Index(kvs, resumeKeyCh)
+	}
+
+	timer := time.NewTimer(s.ReadTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case m := <-consumer.Messages():
+			value := m.Value
+			if bytes.Equal(value, s.RemovedValue) {
+				value = nil
+			} else if s.Unwrap != nil {
+				value = s.Unwrap(value)
+			}
+
+			batch = append(batch, diff.KeyValue{Key: m.Key, Value: value})
+			msgCount++
+			lastOffset = m.Offset
+			s.Progress.topicRead(m.Offset + 1 - offset)
+
+			if m.Offset+1 >= highWater {
+				err = saveBatch()
+				return
+			}
+
+			if len(batch) == indexBatchSize {
+				if err = saveBatch(); err != nil {
+					return
+				}
+			}
+
+		case cErr := <-consumer.Errors():
+			log.Printf("syncer: error reading topic %s: %v", s.Topic, cErr)
+			continue
+
+		case <-timer.C:
+			return msgCount, ErrReadTimeout
+		}
+
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(s.ReadTimeout)
+	}
+}